@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/acme"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// acmeManagers shares the acme managers between the listeners that have
+// the same ACMEConfig. A manager owns its cache_dir and binds its
+// http_challenge_addr, so different configs cannot share them.
+// The zero value is ready to use.
+type acmeManagers struct {
+	m  sync.Mutex
+	ms map[string]*sharedACMEManager // keyed by the cache dir
+}
+
+type sharedACMEManager struct {
+	cfg  ACMEConfig
+	m    *acme.Manager
+	refs int
+}
+
+// get returns the manager of cfg, and a func that releases it. The
+// manager is closed when all listeners that got it released it.
+func (s *acmeManagers) get(cfg *ACMEConfig, logger *zap.Logger) (*acme.Manager, func(), error) {
+	c := *cfg
+	if len(c.CacheDir) == 0 {
+		c.CacheDir = acme.DefaultCacheDir
+	}
+	c.CacheDir = filepath.Clean(c.CacheDir)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	sm := s.ms[c.CacheDir]
+	if sm != nil && !reflect.DeepEqual(sm.cfg, c) {
+		return nil, nil, fmt.Errorf("acme cache_dir %s is used by another acme config", c.CacheDir)
+	}
+	if sm == nil {
+		if len(c.HTTPChallengeAddr) > 0 {
+			for _, other := range s.ms {
+				if other.cfg.HTTPChallengeAddr == c.HTTPChallengeAddr {
+					return nil, nil, fmt.Errorf("acme http_challenge_addr %s is used by another acme config", c.HTTPChallengeAddr)
+				}
+			}
+		}
+		m, err := newACMEManager(&c, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		sm = &sharedACMEManager{cfg: c, m: m}
+		go m.Prefetch()
+		if s.ms == nil {
+			s.ms = make(map[string]*sharedACMEManager)
+		}
+		s.ms[c.CacheDir] = sm
+	}
+
+	sm.refs++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.m.Lock()
+			defer s.m.Unlock()
+			sm.refs--
+			if sm.refs == 0 {
+				sm.m.Close()
+				delete(s.ms, c.CacheDir)
+			}
+		})
+	}
+	return sm.m, release, nil
+}
+
+func newACMEManager(cfg *ACMEConfig, logger *zap.Logger) (*acme.Manager, error) {
+	var rootCAs *x509.CertPool
+	if len(cfg.CA) > 0 {
+		var err error
+		rootCAs, err = utils.LoadCertPool(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load acme ca, %w", err)
+		}
+	}
+	return acme.NewManager(acme.Opts{
+		Domains:           cfg.Domains,
+		Email:             cfg.Email,
+		DirectoryURL:      cfg.DirectoryURL,
+		RootCAs:           rootCAs,
+		CacheDir:          cfg.CacheDir,
+		HTTPChallengeAddr: cfg.HTTPChallengeAddr,
+		Logger:            logger,
+	})
+}
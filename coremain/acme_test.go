@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func Test_acmeManagers(t *testing.T) {
+	dir := t.TempDir()
+	cfg := func(domain, cacheDir, httpAddr string) *ACMEConfig {
+		return &ACMEConfig{
+			Domains:           []string{domain},
+			DirectoryURL:      "http://127.0.0.1:1/directory", // prefetches fail fast
+			CacheDir:          cacheDir,
+			HTTPChallengeAddr: httpAddr,
+		}
+	}
+	var s acmeManagers
+	lg := zap.NewNop()
+
+	m1, release1, err := s.get(cfg("dns.example", filepath.Join(dir, "a"), "127.0.0.1:0"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same config shares the manager and its http challenge server.
+	m2, release2, err := s.get(cfg("dns.example", filepath.Join(dir, "a")+"/", "127.0.0.1:0"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1 != m2 {
+		t.Fatal("listeners with the same acme config should share the manager")
+	}
+
+	tests := []struct {
+		name string
+		cfg  *ACMEConfig
+	}{
+		{"cache_dir of another config", cfg("other.example", filepath.Join(dir, "a"), "127.0.0.1:0")},
+		{"http_challenge_addr of another config", cfg("dns.example", filepath.Join(dir, "b"), "127.0.0.1:0")},
+	}
+	for _, tt := range tests {
+		if _, _, err := s.get(tt.cfg, lg); err == nil {
+			t.Errorf("%s: want an error", tt.name)
+		}
+	}
+	noDomain := cfg("", filepath.Join(dir, "c"), "")
+	noDomain.Domains = nil
+	if _, _, err := s.get(noDomain, lg); err == nil {
+		t.Error("want an error for empty domains")
+	}
+
+	// Another config has its own manager.
+	m3, release3, err := s.get(cfg("other.example", filepath.Join(dir, "b"), ""), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release3()
+	if m3 == m1 {
+		t.Fatal("different acme configs should not share the manager")
+	}
+
+	// The manager is closed after all listeners released it.
+	release1()
+	release1() // no-op
+	if len(s.ms) != 2 {
+		t.Fatal("the manager was closed before all listeners released it")
+	}
+	release2()
+	if len(s.ms) != 1 {
+		t.Fatal("the manager was not closed after all listeners released it")
+	}
+	m4, release4, err := s.get(cfg("dns.example", filepath.Join(dir, "a"), "127.0.0.1:0"), lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release4()
+	if m4 == m1 {
+		t.Fatal("got a closed manager")
+	}
+}
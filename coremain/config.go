@@ -32,6 +32,7 @@ type Config struct {
 	Plugins       []PluginConfig                     `yaml:"plugins"`
 	Servers       []ServerConfig                     `yaml:"servers"`
 	API           APIConfig                          `yaml:"api"`
+	Tracing       TracingConfig                      `yaml:"tracing"`
 
 	// Experimental
 	Security SecurityConfig `yaml:"security"`
@@ -80,17 +81,99 @@ type ServerListenerConfig struct {
 	Key                 string `yaml:"key"`                     // certificate key path, used by dot, doh, doq
 	KernelTX            bool   `yaml:"kernel_tx"`               // use kernel tls to send data
 	KernelRX            bool   `yaml:"kernel_rx"`               // use kernel tls to receive data
-	URLPath             string `yaml:"url_path"`                // used by doh, http. If it's empty, any path will be handled.
+	URLPath             string `yaml:"url_path"`                // used by doh, http. If it's empty, any path will be handled. A "{client_id}" segment sets the client id, see auth_tokens.
 	GetUserIPFromHeader string `yaml:"get_user_ip_from_header"` // used by doh, http, except "True-Client-IP" "X-Real-IP" "X-Forwarded-For".
 	ProxyProtocol       bool   `yaml:"proxy_protocol"`          // accepting the PROXYProtocol
 
+	// Certs are additional certificates. Used by dot, doh, doq, doh3.
+	// The certificate is selected by the tls server name (SNI) of the
+	// client, wildcard names are supported. Cert and Key (or the first
+	// one of Certs) is the default certificate.
+	Certs []CertConfig `yaml:"certs"`
+
+	// ECHKeys are the Encrypted Client Hello key files. Used by dot, doh.
+	// A file has a "PRIVATE KEY" and an "ECHCONFIG" PEM block.
+	ECHKeys []string `yaml:"ech_keys"`
+
+	// Allow and Deny are client ip lists of the listener. Elements can be
+	// ip, prefix or "provider:tag". If Allow is not empty, only the clients
+	// in it can access the listener. Deny has priority over Allow.
+	// Queries from denied udp clients are dropped (or refused if
+	// RefuseDenied is set), connections from other denied clients are closed.
+	// The lists are rebuilt by config reloads, the listeners are kept.
+	Allow        []string `yaml:"allow"`
+	Deny         []string `yaml:"deny"`
+	RefuseDenied bool     `yaml:"refuse_denied"`
+
+	// ClientCA enables mutual tls. Used by dot, doh, doq, doh3.
+	// It is a list of ca certificate files that verify client certificates.
+	// ClientAuth can be "require" (default) or "request". "request" also
+	// accepts clients without a certificate.
+	ClientCA   []string `yaml:"client_ca"`
+	ClientAuth string   `yaml:"client_auth"`
+
+	// ACME obtains the certificate via ACME instead of Cert and Key.
+	// Used by dot, doh, doq, doh3. Listeners that have the same acme
+	// config share the certificates and the http challenge server.
+	// Different configs must have different cache_dir and http_challenge_addr.
+	ACME *ACMEConfig `yaml:"acme"`
+
+	// RRL enables response rate limiting. Used by udp.
+	RRL *RRLConfig `yaml:"rrl"`
+
+	// AuthTokens maps client ids to bearer tokens. Used by doh, http.
+	// If it is not empty, requests must have a valid bearer token.
+	AuthTokens map[string]string `yaml:"auth_tokens"`
+	// UnauthenticatedClientID allows a "{client_id}" in url_path without
+	// auth_tokens. The client id is not authenticated then, any client can
+	// use any id. Used by doh, http.
+	UnauthenticatedClientID bool `yaml:"unauthenticated_client_id"`
+
 	IdleTimeout uint `yaml:"idle_timeout"` // (sec) used by tcp, dot, doh as connection idle timeout.
 }
 
+type CertConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// ACMEConfig configures the ACME certificate of a tls listener.
+// See acme.Opts.
+type ACMEConfig struct {
+	Domains           []string `yaml:"domains"`
+	Email             string   `yaml:"email"`
+	DirectoryURL      string   `yaml:"directory_url"`       // Default is the Let's Encrypt production directory.
+	CA                []string `yaml:"ca"`                  // ca certificate files of the ACME server, e.g. Pebble's.
+	CacheDir          string   `yaml:"cache_dir"`           // Default is "acme".
+	HTTPChallengeAddr string   `yaml:"http_challenge_addr"` // e.g. ":80". Empty disables HTTP-01 challenges.
+}
+
+// RRLConfig configures the response rate limiting of a udp listener.
+// See rrl.Opts.
+type RRLConfig struct {
+	ResponsesPerSecond int  `yaml:"responses_per_second"`
+	Slip               int  `yaml:"slip"` // Default is 2. Negative value disables slips.
+	IPv4Mask           int  `yaml:"ipv4_mask"`
+	IPv6Mask           int  `yaml:"ipv6_mask"`
+	LogOnly            bool `yaml:"log_only"`
+}
+
 type APIConfig struct {
 	HTTP string `yaml:"http"`
 }
 
+// TracingConfig configures the OpenTelemetry tracing of queries.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces endpoint, e.g. "http://127.0.0.1:4318/v1/traces".
+	// Empty Endpoint disables tracing.
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service_name"` // Default is "mosdns".
+	SampleRate  float64           `yaml:"sample_rate"`  // 0~1, the fraction of queries that will be traced.
+	// DebugClients are the client ips or prefixes whose queries are always traced.
+	DebugClients []string `yaml:"debug_clients"`
+}
+
 type SecurityConfig struct {
 	BadIPObserver BadIPObserverConfig `yaml:"bad_ip_observer"`
 }
@@ -43,3 +43,11 @@ type MatcherPlugin interface {
 	Plugin
 	executable_seq.Matcher
 }
+
+// DumperPlugin represents a Plugin that saves its states to files.
+// A reload calls Dump on the running plugins before it builds the new
+// plugins, so the new plugins can load the latest states.
+type DumperPlugin interface {
+	Plugin
+	Dump() error
+}
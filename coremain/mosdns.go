@@ -31,11 +31,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/mlog"
 	"github.com/pmkol/mosdns-x/pkg/data_provider"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/ip_observer"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
 	"github.com/pmkol/mosdns-x/pkg/safe_close"
 )
 
@@ -46,40 +49,141 @@ type Mosdns struct {
 	dataManager *data_provider.DataManager
 
 	// Plugins
+	plugins  []Plugin
 	execs    map[string]executable_seq.Executable
 	matchers map[string]executable_seq.Matcher
 
-	httpAPIMux    *http.ServeMux
-	httpAPIServer *http.Server
+	// aclLists are the listener acl lists that are loaded from dataManager.
+	aclLists []*netlist.MatcherGroup
+
+	ipObserver ip_observer.IPObserver
+
+	// httpAPIMux only serves the plugin apis of this Mosdns.
+	httpAPIMux *http.ServeMux
 
 	metricsReg *prometheus.Registry
 
 	sc *safe_close.SafeClose
+
+	// core is shared by all Mosdns that are created by reloads.
+	core *reloadCore
 }
 
 func RunMosdns(cfg *Config) error {
+	return runMosdns(cfg, nil)
+}
+
+// runMosdns runs mosdns with cfg. If loadCfg is not nil, the config
+// can be reloaded by SIGHUP or by the "/reload" api.
+func runMosdns(cfg *Config, loadCfg func() (*Config, error)) error {
 	lg, err := mlog.NewLogger(&cfg.Log)
 	if err != nil {
 		return fmt.Errorf("failed to init logger: %w", err)
 	}
 
-	m := &Mosdns{
+	core := &reloadCore{
+		loadCfg:       loadCfg,
+		apiMux:        http.NewServeMux(),
+		serverMetrics: newServerMetrics(),
+	}
+	m := newMosdns(lg, safe_close.NewSafeClose(), ip_observer.NewNopObserver(), core)
+	core.current.Store(m)
+	// Plugins flush their data (e.g. cache dumps, logs) when they are closed.
+	defer core.close()
+
+	gatherer := prometheus.Gatherers{
+		core.serverMetrics.reg,
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return core.current.Load().metricsReg.Gather()
+		}),
+	}
+	core.apiMux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	core.apiMux.HandleFunc("/debug/pprof/", pprof.Index)
+	core.apiMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	core.apiMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	core.apiMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	core.apiMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	core.apiMux.HandleFunc("/plugins/", func(w http.ResponseWriter, req *http.Request) {
+		core.current.Load().httpAPIMux.ServeHTTP(w, req)
+	})
+	core.apiMux.HandleFunc("/reload", core.serveReload)
+
+	// Init bad ip observer
+	if err := m.initBadIPObserver(&cfg.Security.BadIPObserver); err != nil {
+		return fmt.Errorf("failed to init bad ip observer, %w", err)
+	}
+
+	if err := m.initTracer(&cfg.Tracing); err != nil {
+		return fmt.Errorf("failed to init tracer, %w", err)
+	}
+
+	if err := m.loadPlugins(cfg); err != nil {
+		return err
+	}
+
+	if len(cfg.Servers) == 0 {
+		return errors.New("no server is configured")
+	}
+	for i, sc := range cfg.Servers {
+		if err := m.startServers(&sc); err != nil {
+			return fmt.Errorf("failed to start server #%d, %w", i, err)
+		}
+	}
+
+	// Start http api server
+	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
+		httpServer := &http.Server{
+			Addr:    httpAddr,
+			Handler: core.apiMux,
+		}
+		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+			defer done()
+			errChan := make(chan error, 1)
+			go func() {
+				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
+				errChan <- httpServer.ListenAndServe()
+			}()
+			select {
+			case err := <-errChan:
+				m.sc.SendCloseSignal(err)
+			case <-closeSignal:
+				httpServer.Close()
+			}
+		})
+	}
+
+	if loadCfg != nil {
+		m.sc.Attach(core.reloadOnSignal)
+	}
+
+	time.AfterFunc(time.Second*1, func() {
+		runtime.GC()
+		debug.FreeOSMemory()
+	})
+	<-m.sc.ReceiveCloseSignal()
+	m.sc.Done()
+	m.sc.CloseWait()
+	return m.sc.Err()
+}
+
+func newMosdns(lg *zap.Logger, sc *safe_close.SafeClose, o ip_observer.IPObserver, core *reloadCore) *Mosdns {
+	return &Mosdns{
 		logger:      lg,
 		dataManager: data_provider.NewDataManager(),
 		execs:       make(map[string]executable_seq.Executable),
 		matchers:    make(map[string]executable_seq.Matcher),
+		ipObserver:  o,
 		httpAPIMux:  http.NewServeMux(),
 		metricsReg:  newMetricsReg(),
-		sc:          safe_close.NewSafeClose(),
+		sc:          sc,
+		core:        core,
 	}
+}
 
-	m.httpAPIMux.Handle("/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
-	m.httpAPIMux.HandleFunc("/debug/pprof/", pprof.Index)
-	m.httpAPIMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	m.httpAPIMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	m.httpAPIMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	m.httpAPIMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-
+// loadPlugins inits data providers and plugins from cfg.
+// If an error occurs, caller should call closePlugins to
+// release the plugins that have been loaded.
+func (m *Mosdns) loadPlugins(cfg *Config) error {
 	// Init data manager
 	dupTag := make(map[string]struct{})
 	for _, dpc := range cfg.DataProviders {
@@ -91,7 +195,7 @@ func RunMosdns(cfg *Config) error {
 		}
 		dupTag[dpc.Tag] = struct{}{}
 
-		dp, err := data_provider.NewDataProvider(lg, dpc)
+		dp, err := data_provider.NewDataProvider(m.logger, dpc)
 		if err != nil {
 			return fmt.Errorf("failed to init data provider %s, %w", dpc.Tag, err)
 		}
@@ -130,49 +234,36 @@ func RunMosdns(cfg *Config) error {
 			m.httpAPIMux.Handle(fmt.Sprintf("/plugins/%s/", p.Tag()), h)
 		}
 	}
+	return nil
+}
 
-	if len(cfg.Servers) == 0 {
-		return errors.New("no server is configured")
-	}
-	for i, sc := range cfg.Servers {
-		if err := m.startServers(&sc); err != nil {
-			return fmt.Errorf("failed to start server #%d, %w", i, err)
+// closePlugins closes all plugins and data providers in m.
+func (m *Mosdns) closePlugins() {
+	for i := len(m.plugins) - 1; i >= 0; i-- {
+		p := m.plugins[i]
+		if err := p.Close(); err != nil {
+			m.logger.Warn("failed to close plugin", zap.String("tag", p.Tag()), zap.Error(err))
 		}
 	}
+	for _, l := range m.aclLists {
+		l.Close()
+	}
+	m.dataManager.Close()
+}
 
-	// Start http api server
-	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
-		httpServer := &http.Server{
-			Addr:    httpAddr,
-			Handler: m.httpAPIMux,
-		}
-		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
-			defer done()
-			errChan := make(chan error, 1)
-			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
-			}()
-			select {
-			case err := <-errChan:
-				m.sc.SendCloseSignal(err)
-			case <-closeSignal:
-				httpServer.Close()
+// dumpPlugins calls Dump on the plugins that are DumperPlugin.
+func (m *Mosdns) dumpPlugins() {
+	for _, p := range m.plugins {
+		if d, ok := p.(DumperPlugin); ok {
+			if err := d.Dump(); err != nil {
+				m.logger.Warn("failed to dump plugin", zap.String("tag", p.Tag()), zap.Error(err))
 			}
-		})
+		}
 	}
-
-	time.AfterFunc(time.Second*1, func() {
-		runtime.GC()
-		debug.FreeOSMemory()
-	})
-	<-m.sc.ReceiveCloseSignal()
-	m.sc.Done()
-	m.sc.CloseWait()
-	return m.sc.Err()
 }
 
 func (m *Mosdns) addPlugin(p Plugin) {
+	m.plugins = append(m.plugins, p)
 	t := p.Tag()
 	if p, ok := p.(ExecutablePlugin); ok {
 		m.execs[t] = p
@@ -190,6 +281,12 @@ func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
 	return m.sc
 }
 
+// GetIPObserver returns the ip_observer.IPObserver. Plugins can report
+// bad client behaviours to it. It always returns a non-nil value.
+func (m *Mosdns) GetIPObserver() ip_observer.IPObserver {
+	return m.ipObserver
+}
+
 func (m *Mosdns) GetExecutables() map[string]executable_seq.Executable {
 	return m.execs
 }
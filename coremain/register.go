@@ -199,7 +199,11 @@ func (p *BP) M() *Mosdns {
 }
 
 // GetMetricsReg return a prometheus.Registerer with a prefix of "plugin_${plugin_tag}_]"
+// If p has no Mosdns (e.g. in tests), a new registry is returned.
 func (p *BP) GetMetricsReg() prometheus.Registerer {
+	if p.m == nil {
+		return prometheus.NewRegistry()
+	}
 	return prometheus.WrapRegistererWithPrefix(fmt.Sprintf("plugin_%s_", p.tag), p.m.GetMetricsReg())
 }
 
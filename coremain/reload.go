@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/server"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+	"github.com/pmkol/mosdns-x/pkg/tracing"
+)
+
+// reloadCore holds the states that are shared by all Mosdns
+// that are created by reloads.
+type reloadCore struct {
+	loadCfg func() (*Config, error)
+	apiMux  *http.ServeMux
+
+	m        sync.Mutex // serializes reloads and protects handlers, acls and closed
+	current  atomic.Pointer[Mosdns]
+	handlers []serverEntry
+	acls     []listenerACL
+	closed   bool
+
+	serverMetrics *serverMetrics
+	tracer        *tracing.Tracer // nil if tracing is disabled
+	acmeManagers  acmeManagers
+}
+
+type serverEntry struct {
+	exec string
+	h    *D.EntryHandler
+}
+
+type listenerACL struct {
+	cfg *ServerListenerConfig
+	acl *server.ACL
+}
+
+func (c *reloadCore) addEntryHandler(exec string, h *D.EntryHandler) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.handlers = append(c.handlers, serverEntry{exec: exec, h: h})
+}
+
+func (c *reloadCore) addACL(cfg *ServerListenerConfig, acl *server.ACL) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.acls = append(c.acls, listenerACL{cfg: cfg, acl: acl})
+}
+
+// reload loads the config again, builds a new set of plugins and
+// swaps them into the running servers. Listeners are not restarted,
+// but their acl lists are loaded again from the new data providers.
+// The running plugins are dumped (see DumperPlugin) before the new ones are built.
+// The "log", "servers", "api", "tracing" and "security" sections are not reloaded.
+// If the new config cannot be built, the running plugins are untouched.
+func (c *reloadCore) reload() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.loadCfg == nil {
+		return errors.New("config reload is not available")
+	}
+	if c.closed {
+		return errors.New("mosdns is closed")
+	}
+	cfg, err := c.loadCfg()
+	if err != nil {
+		return fmt.Errorf("failed to load config, %w", err)
+	}
+
+	old := c.current.Load()
+	old.dumpPlugins() // so the new plugins can load the latest dumps
+	nm := newMosdns(old.logger, old.sc, old.ipObserver, c)
+	if err := nm.loadPlugins(cfg); err != nil {
+		nm.closePlugins()
+		return err
+	}
+
+	entries := make([]executable_seq.Executable, len(c.handlers))
+	for i, se := range c.handlers {
+		e := nm.execs[se.exec]
+		if e == nil {
+			nm.closePlugins()
+			return fmt.Errorf("cannot find entry %s", se.exec)
+		}
+		entries[i] = e
+	}
+
+	type aclLists struct{ allow, deny netlist.Matcher }
+	acls := make([]aclLists, len(c.acls))
+	for i, la := range c.acls {
+		allow, deny, err := nm.loadACLLists(la.cfg)
+		if err != nil {
+			nm.closePlugins()
+			return fmt.Errorf("failed to load acl of %s, %w", la.cfg.Addr, err)
+		}
+		acls[i] = aclLists{allow: allow, deny: deny}
+	}
+
+	c.current.Store(nm)
+	for i, la := range c.acls {
+		la.acl.Set(acls[i].allow, acls[i].deny)
+	}
+	wg := new(sync.WaitGroup)
+	for i, se := range c.handlers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			se.h.SetEntry(entries[i])
+		}()
+	}
+	wg.Wait() // wait in-flight queries
+	old.closePlugins()
+	return nil
+}
+
+// close closes the plugins of the current Mosdns. Reloads will fail
+// after close is called.
+func (c *reloadCore) close() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.current.Load().closePlugins()
+}
+
+func (c *reloadCore) reloadAndLog(trigger string) error {
+	lg := c.current.Load().logger
+	lg.Info("reloading config", zap.String("trigger", trigger))
+	if err := c.reload(); err != nil {
+		lg.Error("failed to reload config, the running config is kept", zap.Error(err))
+		return err
+	}
+	lg.Info("config reloaded")
+	return nil
+}
+
+func (c *reloadCore) reloadOnSignal(done func(), closeSignal <-chan struct{}) {
+	defer done()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+			c.reloadAndLog("signal")
+		case <-closeSignal:
+			return
+		}
+	}
+}
+
+func (c *reloadCore) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := c.reloadAndLog("api"); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("config reloaded"))
+}
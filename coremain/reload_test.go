@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/ip_observer"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/safe_close"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+const testReloadPluginType = "_test_reload_exec"
+
+type testReloadPlugin struct {
+	*BP
+	queries atomic.Int32
+	dumps   atomic.Int32
+	closed  atomic.Bool
+}
+
+func (p *testReloadPlugin) Dump() error {
+	p.dumps.Add(1)
+	return nil
+}
+
+func (p *testReloadPlugin) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecChainNode) error {
+	p.queries.Add(1)
+	return nil
+}
+
+func (p *testReloadPlugin) Close() error {
+	p.closed.Store(true)
+	return nil
+}
+
+func TestReloadCore_reload(t *testing.T) {
+	var running *testReloadPlugin
+	var dumpsAtInit int32 // dumps of the running plugin when a new plugin is built
+	RegNewPluginFunc(testReloadPluginType, func(bp *BP, _ any) (Plugin, error) {
+		if running != nil {
+			dumpsAtInit = running.dumps.Load()
+		}
+		return &testReloadPlugin{BP: bp}, nil
+	}, nil)
+	defer DelPluginType(testReloadPluginType)
+
+	var nextCfg *Config
+	var nextErr error
+	core := &reloadCore{
+		loadCfg:       func() (*Config, error) { return nextCfg, nextErr },
+		apiMux:        http.NewServeMux(),
+		serverMetrics: newServerMetrics(),
+	}
+	m := newMosdns(zap.NewNop(), safe_close.NewSafeClose(), ip_observer.NewNopObserver(), core)
+	core.current.Store(m)
+	cfgWithEntry := func(tag string) *Config {
+		return &Config{Plugins: []PluginConfig{{Tag: tag, Type: testReloadPluginType}}}
+	}
+	if err := m.loadPlugins(cfgWithEntry("main")); err != nil {
+		t.Fatal(err)
+	}
+	h, err := D.NewEntryHandler(D.EntryHandlerOpts{Entry: m.execs["main"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.addEntryHandler("main", h)
+	serve := func() {
+		q := dns.NewMsg("example.com.", dns.TypeA)
+		h.ServeDNS(context.Background(), q, query_context.NewRequestMeta(netip.Addr{}))
+	}
+	running = m.execs["main"].(*testReloadPlugin)
+
+	// Failed reloads keep the running plugins.
+	nextErr = errors.New("bad config")
+	if err := core.reload(); err == nil {
+		t.Fatal("reload should fail if the config cannot be loaded")
+	}
+	nextCfg, nextErr = cfgWithEntry("not_main"), nil
+	if err := core.reload(); err == nil {
+		t.Fatal("reload should fail if the entry is missing")
+	}
+	if core.current.Load() != m {
+		t.Fatal("current Mosdns is replaced by a failed reload")
+	}
+	if running.closed.Load() {
+		t.Fatal("running plugin is closed by a failed reload")
+	}
+	serve()
+	if running.queries.Load() != 1 {
+		t.Fatal("running entry is not used after a failed reload")
+	}
+
+	// Successful reloads swap the entry and close the old plugins.
+	nextCfg = cfgWithEntry("main")
+	if err := core.reload(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := core.current.Load().execs["main"].(*testReloadPlugin)
+	if !running.closed.Load() {
+		t.Fatal("old plugin is not closed")
+	}
+	if dumpsAtInit == 0 {
+		t.Fatal("old plugin is not dumped before the new plugins are built")
+	}
+	serve()
+	if running.queries.Load() != 1 || reloaded.queries.Load() != 1 {
+		t.Fatal("new entry is not used after a reload")
+	}
+
+	// close closes the plugins and disables reloads.
+	core.close()
+	if !reloaded.closed.Load() {
+		t.Fatal("plugin is not closed")
+	}
+	if err := core.reload(); err == nil {
+		t.Fatal("reload should fail after close")
+	}
+}
+
+func TestReloadCore_reloadACL(t *testing.T) {
+	RegNewPluginFunc(testReloadPluginType, func(bp *BP, _ any) (Plugin, error) {
+		return &testReloadPlugin{BP: bp}, nil
+	}, nil)
+	defer DelPluginType(testReloadPluginType)
+
+	f := filepath.Join(t.TempDir(), "ips.txt")
+	writeList := func(s string) {
+		if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeList("10.0.0.0/8")
+	cfgWithProvider := func(tag string) *Config {
+		return &Config{
+			DataProviders: []data_provider.DataProviderConfig{{Tag: tag, File: f}},
+			Plugins:       []PluginConfig{{Tag: "main", Type: testReloadPluginType}},
+		}
+	}
+
+	var nextCfg *Config
+	core := &reloadCore{
+		loadCfg:       func() (*Config, error) { return nextCfg, nil },
+		apiMux:        http.NewServeMux(),
+		serverMetrics: newServerMetrics(),
+	}
+	m := newMosdns(zap.NewNop(), safe_close.NewSafeClose(), ip_observer.NewNopObserver(), core)
+	core.current.Store(m)
+	if err := m.loadPlugins(cfgWithProvider("ips")); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := m.loadListenerACL(&ServerListenerConfig{Addr: "127.0.0.1:53", Allow: []string{"provider:ips"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(addr string, want bool) {
+		t.Helper()
+		if got := acl.Allowed(netip.MustParseAddr(addr)); got != want {
+			t.Fatalf("Allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	check("10.0.0.1", true)
+	check("192.168.0.1", false)
+
+	// Failed reloads keep the running lists.
+	writeList("192.168.0.0/16")
+	nextCfg = cfgWithProvider("other")
+	if err := core.reload(); err == nil {
+		t.Fatal("reload should fail if the acl provider is missing")
+	}
+	check("10.0.0.1", true)
+
+	// Successful reloads load the lists from the new providers.
+	nextCfg = cfgWithProvider("ips")
+	if err := core.reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("10.0.0.1", false)
+	check("192.168.0.1", true)
+	core.close()
+}
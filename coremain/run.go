@@ -108,16 +108,24 @@ func StartServer(sf *serverFlags) error {
 		mlog.L().Info("working directory changed", zap.String("path", sf.dir))
 	}
 
-	cfg, fileUsed, err := loadConfig(sf.c)
-	if err != nil {
-		return fmt.Errorf("fail to load config, %w", err)
+	loadCfg := func() (*Config, error) {
+		cfg, fileUsed, err := loadConfig(sf.c)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load config, %w", err)
+		}
+
+		if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
+			return nil, fmt.Errorf("failed to load sub config file, %w", err)
+		}
+		return cfg, nil
 	}
 
-	if err := mergeInclude(cfg, 0, []string{fileUsed}); err != nil {
-		return fmt.Errorf("failed to load sub config file, %w", err)
+	cfg, err := loadCfg()
+	if err != nil {
+		return err
 	}
 
-	if err := RunMosdns(cfg); err != nil {
+	if err := runMosdns(cfg, loadCfg); err != nil {
 		return fmt.Errorf("mosdns exited, %w", err)
 	}
 	return nil
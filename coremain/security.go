@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pmkol/mosdns-x/pkg/ip_observer"
+)
+
+// initBadIPObserver inits the bad ip observer if it is enabled
+// and registers its api to the http api mux.
+func (m *Mosdns) initBadIPObserver(cfg *BadIPObserverConfig) error {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+	cfg.Init()
+
+	o, err := ip_observer.NewBadIPObserver(ip_observer.BadIPObserverOpts{
+		Threshold:        cfg.Threshold,
+		Interval:         time.Duration(cfg.Interval) * time.Second,
+		TTL:              time.Duration(cfg.TTL) * time.Second,
+		OnUpdateCallBack: cfg.OnUpdateCallBack,
+		IPv4Mask:         cfg.IPv4Mask,
+		IPv6Mask:         cfg.IPv6Mask,
+		Logger:           m.logger.Named("bad_ip_observer"),
+	})
+	if err != nil {
+		return err
+	}
+	m.ipObserver = o
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		<-closeSignal
+		o.Close()
+	})
+
+	m.core.apiMux.HandleFunc("/security/bad_ip", func(w http.ResponseWriter, req *http.Request) {
+		for _, e := range o.BanList() {
+			fmt.Fprintf(w, "%s %s\n", e.Prefix, e.Expiration.Format(time.RFC3339))
+		}
+	})
+	return nil
+}
@@ -21,6 +21,7 @@ package coremain
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
@@ -32,9 +33,13 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/coremain/listen"
+	"github.com/pmkol/mosdns-x/pkg/acme"
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/rrl"
 	"github.com/pmkol/mosdns-x/pkg/server"
 	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 const defaultQueryTimeout = time.Second * 5
@@ -62,10 +67,13 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 		Entry:              entry,
 		QueryTimeout:       queryTimeout,
 		RecursionAvailable: true,
+		IPObserver:         m.ipObserver,
+		Tracer:             m.core.tracer,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to init entry handler, %w", err)
 	}
+	m.core.addEntryHandler(cfg.Exec, dnsHandler)
 
 	for _, lc := range cfg.Listeners {
 		if err := m.startServerListener(lc, dnsHandler); err != nil {
@@ -75,37 +83,122 @@ func (m *Mosdns) startServers(cfg *ServerConfig) error {
 	return nil
 }
 
-func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Handler) error {
+func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Handler) (err error) {
 	if len(cfg.Addr) == 0 {
 		return errors.New("no address to bind")
 	}
 
 	m.logger.Info("starting server", zap.String("proto", cfg.Protocol), zap.String("addr", cfg.Addr))
 
+	protocol := cfg.Protocol
+	if len(protocol) == 0 {
+		protocol = "udp"
+	}
+	dnsHandler = m.core.serverMetrics.wrapHandler(dnsHandler, cfg.Addr, protocol)
+
 	idleTimeout := time.Duration(0)
 	if cfg.IdleTimeout > 0 {
 		idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
 	}
 
 	httpHandler, err := H.NewHandler(H.HandlerOpts{
-		DNSHandler:  dnsHandler,
-		Path:        cfg.URLPath,
-		SrcIPHeader: cfg.GetUserIPFromHeader,
-		Logger:      m.logger,
+		DNSHandler:              dnsHandler,
+		Path:                    cfg.URLPath,
+		Tokens:                  cfg.AuthTokens,
+		UnauthenticatedClientID: cfg.UnauthenticatedClientID,
+		SrcIPHeader:             cfg.GetUserIPFromHeader,
+		IPObserver:              m.ipObserver,
+		Logger:                  m.logger,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to init http handler, %w", err)
 	}
 
+	acl, err := m.loadListenerACL(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load acl, %w", err)
+	}
+
+	var limiter *rrl.Limiter
+	if rc := cfg.RRL; rc != nil {
+		if protocol != "udp" {
+			return fmt.Errorf("rrl is not supported by %s listeners", protocol)
+		}
+		limiter, err = rrl.NewLimiter(rrl.Opts{
+			ResponsesPerSecond: rc.ResponsesPerSecond,
+			Slip:               rc.Slip,
+			IPv4Mask:           rc.IPv4Mask,
+			IPv6Mask:           rc.IPv6Mask,
+			LogOnly:            rc.LogOnly,
+			Logger:             m.logger,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to init rrl, %w", err)
+		}
+		if err := m.core.serverMetrics.listenerReg(cfg.Addr).Register(limiter); err != nil {
+			limiter.Close()
+			return fmt.Errorf("failed to register rrl metrics, %w", err)
+		}
+		defer func() {
+			if err != nil { // The listener is not started.
+				limiter.Close()
+			}
+		}()
+	}
+
+	var clientCAs *x509.CertPool
+	requireClientCert := false
+	if len(cfg.ClientCA) > 0 {
+		clientCAs, err = utils.LoadCertPool(cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to load client ca, %w", err)
+		}
+		switch cfg.ClientAuth {
+		case "", "require":
+			requireClientCert = true
+		case "request":
+		default:
+			return fmt.Errorf("invalid client_auth %s", cfg.ClientAuth)
+		}
+	}
+
+	certs := make([]server.KeyPair, 0, len(cfg.Certs))
+	for _, c := range cfg.Certs {
+		certs = append(certs, server.KeyPair{Cert: c.Cert, Key: c.Key})
+	}
+
+	var acmeManager *acme.Manager
+	releaseACME := func() {}
+	if ac := cfg.ACME; ac != nil {
+		acmeManager, releaseACME, err = m.core.acmeManagers.get(ac, m.logger)
+		if err != nil {
+			return fmt.Errorf("failed to init acme, %w", err)
+		}
+		defer func() {
+			if err != nil { // The listener is not started.
+				releaseACME()
+			}
+		}()
+	}
+
 	opts := server.ServerOpts{
-		DNSHandler:  dnsHandler,
-		HttpHandler: httpHandler,
-		Cert:        cfg.Cert,
-		Key:         cfg.Key,
-		KernelTX:    cfg.KernelTX,
-		KernelRX:    cfg.KernelRX,
-		IdleTimeout: idleTimeout,
-		Logger:      m.logger,
+		DNSHandler:        dnsHandler,
+		HttpHandler:       httpHandler,
+		Cert:              cfg.Cert,
+		Key:               cfg.Key,
+		Certs:             certs,
+		ECHKeys:           cfg.ECHKeys,
+		ACME:              acmeManager,
+		ClientCAs:         clientCAs,
+		RequireClientCert: requireClientCert,
+		KernelTX:          cfg.KernelTX,
+		KernelRX:          cfg.KernelRX,
+		IdleTimeout:       idleTimeout,
+		IPObserver:        m.ipObserver,
+		ACL:               acl,
+		RefuseDenied:      cfg.RefuseDenied,
+		RRL:               limiter,
+		Logger:            m.logger,
 	}
 	s := server.NewServer(opts)
 
@@ -197,6 +290,10 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 
 	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 		defer done()
+		if limiter != nil {
+			defer limiter.Close()
+		}
+		defer releaseACME()
 		errChan := make(chan error, 1)
 		go func() {
 			errChan <- run()
@@ -210,3 +307,40 @@ func (m *Mosdns) startServerListener(cfg *ServerListenerConfig, dnsHandler D.Han
 
 	return nil
 }
+
+// loadListenerACL loads the acl of cfg. It returns nil if cfg has no acl.
+// The acl is registered to m.core so its lists are rebuilt by reloads.
+func (m *Mosdns) loadListenerACL(cfg *ServerListenerConfig) (*server.ACL, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, nil
+	}
+	allow, deny, err := m.loadACLLists(cfg)
+	if err != nil {
+		return nil, err
+	}
+	acl := server.NewACL(allow, deny)
+	m.core.addACL(cfg, acl)
+	return acl, nil
+}
+
+// loadACLLists loads the allow and deny lists of cfg from the data
+// providers of m. The lists are closed by m.closePlugins.
+func (m *Mosdns) loadACLLists(cfg *ServerListenerConfig) (allow, deny netlist.Matcher, err error) {
+	if len(cfg.Allow) > 0 {
+		l, err := netlist.BatchLoadProvider(cfg.Allow, m.dataManager, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load allow list, %w", err)
+		}
+		m.aclLists = append(m.aclLists, l)
+		allow = l
+	}
+	if len(cfg.Deny) > 0 {
+		l, err := netlist.BatchLoadProvider(cfg.Deny, m.dataManager, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load deny list, %w", err)
+		}
+		m.aclLists = append(m.aclLists, l)
+		deny = l
+	}
+	return allow, deny, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"strconv"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+// serverMetrics are the metrics of server listeners. Listeners are not
+// restarted by reloads, so serverMetrics are shared by all Mosdns that
+// are created by reloads.
+type serverMetrics struct {
+	reg           *prometheus.Registry
+	requestTotal  *prometheus.CounterVec
+	responseTotal *prometheus.CounterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		reg: prometheus.NewRegistry(),
+		requestTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "server_request_total",
+			Help: "The total number of requests received by the listener",
+		}, []string{"listener", "protocol"}),
+		responseTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "server_response_total",
+			Help: "The total number of responses sent by the listener by rcode",
+		}, []string{"listener", "protocol", "rcode"}),
+	}
+	prometheus.WrapRegistererWithPrefix("mosdns_", m.reg).MustRegister(m.requestTotal, m.responseTotal)
+	return m
+}
+
+// listenerReg returns a prometheus.Registerer for the metrics of listener.
+func (m *serverMetrics) listenerReg(listener string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(
+		prometheus.Labels{"listener": listener},
+		prometheus.WrapRegistererWithPrefix("mosdns_", m.reg),
+	)
+}
+
+// wrapHandler returns a D.Handler that records the metrics of listener.
+func (m *serverMetrics) wrapHandler(h D.Handler, listener, protocol string) D.Handler {
+	return &metricsHandler{
+		Handler:       h,
+		requestTotal:  m.requestTotal.WithLabelValues(listener, protocol),
+		responseTotal: m.responseTotal.MustCurryWith(prometheus.Labels{"listener": listener, "protocol": protocol}),
+	}
+}
+
+type metricsHandler struct {
+	D.Handler
+	requestTotal  prometheus.Counter
+	responseTotal *prometheus.CounterVec // rcode
+}
+
+func (h *metricsHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_context.RequestMeta) (*dns.Msg, error) {
+	h.requestTotal.Inc()
+	r, err := h.Handler.ServeDNS(ctx, req, meta)
+	if r != nil {
+		h.responseTotal.WithLabelValues(strconv.Itoa(int(r.Rcode))).Inc()
+	}
+	return r, err
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/pmkol/mosdns-x/pkg/tracing"
+)
+
+// initTracer inits the tracer if tracing is enabled. The tracer is
+// shared by all Mosdns that are created by reloads.
+func (m *Mosdns) initTracer(cfg *TracingConfig) error {
+	if len(cfg.Endpoint) == 0 {
+		return nil
+	}
+
+	var debugClients []netip.Prefix
+	for _, s := range cfg.DebugClients {
+		var p netip.Prefix
+		var err error
+		if strings.ContainsRune(s, '/') {
+			p, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return fmt.Errorf("invalid debug client %s, %w", s, err)
+		}
+		debugClients = append(debugClients, p.Masked())
+	}
+
+	t, err := tracing.NewTracer(tracing.Opts{
+		Endpoint:     cfg.Endpoint,
+		Headers:      cfg.Headers,
+		ServiceName:  cfg.ServiceName,
+		SampleRate:   cfg.SampleRate,
+		AlwaysSample: debugClients,
+		Logger:       m.logger.Named("tracing"),
+	})
+	if err != nil {
+		return err
+	}
+	m.core.tracer = t
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		<-closeSignal
+		t.Close()
+	})
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package acme obtains and renews tls certificates via ACME (RFC 8555).
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ALPNProto is the alpn protocol of the TLS-ALPN-01 challenge. TLS
+// listeners should add it to their next protocols.
+const ALPNProto = acme.ALPNProto
+
+// DefaultCacheDir is the default Opts.CacheDir.
+const DefaultCacheDir = "acme"
+
+type Opts struct {
+	// Domains are the domains of the certificate. Required.
+	Domains []string
+
+	// Email is the contact email of the ACME account. Optional.
+	Email string
+
+	// DirectoryURL is the ACME directory url.
+	// Default is the Let's Encrypt production directory.
+	DirectoryURL string
+
+	// RootCAs verifies the certificate of the ACME server. Default is the
+	// system cert pool. It is useful to test with Pebble.
+	RootCAs *x509.CertPool
+
+	// CacheDir is the directory to store the account key and certificates.
+	// Default is "acme".
+	CacheDir string
+
+	// HTTPChallengeAddr is the address that serves the HTTP-01 challenges,
+	// e.g. ":80". If it is empty, only the TLS-ALPN-01 challenges that are
+	// received by the tls listeners are served.
+	HTTPChallengeAddr string
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Manager obtains, renews and caches the certificates. Certificates are
+// obtained on the first tls handshake of a domain, and renewed in the
+// background before they expire.
+type Manager struct {
+	opts Opts
+	m    *autocert.Manager
+
+	closeOnce  sync.Once
+	httpServer *http.Server
+}
+
+// NewManager creates a Manager. If opts.HTTPChallengeAddr is set, it
+// also starts the http challenge server.
+func NewManager(opts Opts) (*Manager, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("no domain is configured")
+	}
+	if len(opts.CacheDir) == 0 {
+		opts.CacheDir = DefaultCacheDir
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	client := &acme.Client{DirectoryURL: opts.DirectoryURL}
+	if opts.RootCAs != nil {
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: opts.RootCAs},
+			},
+		}
+	}
+	m := &Manager{
+		opts: opts,
+		m: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.CacheDir),
+			HostPolicy: autocert.HostWhitelist(opts.Domains...),
+			Client:     client,
+			Email:      opts.Email,
+		},
+	}
+
+	if len(opts.HTTPChallengeAddr) > 0 {
+		l, err := net.Listen("tcp", opts.HTTPChallengeAddr)
+		if err != nil {
+			return nil, err
+		}
+		m.httpServer = &http.Server{
+			Handler:           m.m.HTTPHandler(nil),
+			ReadHeaderTimeout: time.Second * 5,
+		}
+		go func() {
+			err := m.httpServer.Serve(l)
+			if !errors.Is(err, http.ErrServerClosed) {
+				opts.Logger.Error("acme http challenge server exited", zap.Error(err))
+			}
+		}()
+	}
+	return m, nil
+}
+
+// GetCertificate returns the certificate of hello.ServerName. If the client
+// does not send a server name, the certificate of the first domain will be
+// returned. It also answers the TLS-ALPN-01 challenges.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.ServerName) == 0 {
+		h := *hello
+		h.ServerName = m.opts.Domains[0]
+		hello = &h
+	}
+	c, err := m.m.GetCertificate(hello)
+	if err != nil {
+		m.opts.Logger.Warn("failed to get acme certificate", zap.String("server_name", hello.ServerName), zap.Error(err))
+	}
+	return c, err
+}
+
+// Prefetch obtains the certificates of all domains, so the first
+// handshakes don't have to wait for them.
+func (m *Manager) Prefetch() {
+	for _, d := range m.opts.Domains {
+		hello := &tls.ClientHelloInfo{
+			ServerName:   d,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		if _, err := m.GetCertificate(hello); err == nil {
+			m.opts.Logger.Info("acme certificate is ready", zap.String("domain", d))
+		}
+	}
+}
+
+// Close stops the http challenge server.
+// Close always returns a nil error.
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() {
+		if m.httpServer != nil {
+			m.httpServer.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acme
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+func TestNewManager(t *testing.T) {
+	if _, err := NewManager(Opts{}); err == nil {
+		t.Fatal("want an error for empty domains")
+	}
+
+	m, err := NewManager(Opts{Domains: []string{"dns.example"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); err == nil {
+		t.Fatal("want an error for a domain that is not configured")
+	}
+}
+
+// TestManager_Pebble obtains a certificate from a local Pebble server.
+// Run Pebble with PEBBLE_VA_ALWAYS_VALID=1, then set the env
+// MOSDNS_TEST_PEBBLE_DIR to its directory url (e.g. https://127.0.0.1:14000/dir)
+// and MOSDNS_TEST_PEBBLE_CA to its certificate (pebble.minica.pem).
+func TestManager_Pebble(t *testing.T) {
+	dir := os.Getenv("MOSDNS_TEST_PEBBLE_DIR")
+	if len(dir) == 0 {
+		t.Skip("MOSDNS_TEST_PEBBLE_DIR is not set")
+	}
+	rootCAs, err := utils.LoadCertPool([]string{os.Getenv("MOSDNS_TEST_PEBBLE_CA")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(Opts{
+		Domains:      []string{"dns.example"},
+		DirectoryURL: dir,
+		RootCAs:      rootCAs,
+		CacheDir:     t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	c, err := m.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Leaf == nil || c.Leaf.VerifyHostname("dns.example") != nil {
+		t.Fatal("unexpected certificate")
+	}
+}
@@ -23,11 +23,13 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"codeberg.org/miekg/dns"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/tracing"
 )
 
 type Upstream interface {
@@ -52,6 +54,10 @@ type parallelResult struct {
 
 var nopLogger = zap.NewNop()
 
+// ExchangeParallel sends the query of qCtx to upstreams in parallel. It
+// returns the first response that is from a trusted upstream or has a
+// NOERROR rcode, and the address of its upstream. If there is only one
+// upstream, its response is returned whatever its rcode is.
 func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstreams []Upstream, logger *zap.Logger) (*dns.Msg, error, string) {
 	if logger == nil {
 		logger = nopLogger
@@ -70,7 +76,28 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			r, err := u.Exchange(taskCtx, qCopy)
+			queryTime := time.Now()
+			ctx, span := tracing.StartSpan(taskCtx, tracing.SpanKindClient, "upstream exchange",
+				tracing.String("mosdns.upstream", u.Address()))
+			r, err := u.Exchange(ctx, qCopy)
+			if r != nil {
+				span.SetAttributes(tracing.Int("dns.rcode", int(r.Rcode)))
+			}
+			span.End(err)
+			if observers := qCtx.ExchangeObservers(); len(observers) > 0 {
+				e := &query_context.UpstreamExchange{
+					Upstream:     u.Address(),
+					UpstreamAddr: u.IPAddress(),
+					Query:        qCopy,
+					Response:     r,
+					QueryTime:    queryTime,
+					ResponseTime: time.Now(),
+					Err:          err,
+				}
+				for _, o := range observers {
+					o(e)
+				}
+			}
 
 			select {
 			case c <- &parallelResult{r: r, err: err, from: u}:
@@ -106,7 +133,9 @@ func ExchangeParallel(ctx context.Context, qCtx *query_context.Context, upstream
 				continue
 			}
 
-			if res.r != nil && (res.from.Trusted() || res.r.Rcode == dns.RcodeSuccess) {
+			// The response of a single upstream is always accepted,
+			// there is no other response to wait for.
+			if res.r != nil && (len(upstreams) == 1 || res.from.Trusted() || res.r.Rcode == dns.RcodeSuccess) {
 				cancel()
 				return res.r, nil, res.from.Address()
 			}
@@ -39,6 +39,14 @@ type Backend interface {
 	// If expirationTime is already passed, Store is a noop.
 	Store(key string, v []byte, storedTime, expirationTime time.Time)
 
+	// Range calls f sequentially for each entry in the Backend. If f
+	// returns false, Range stops the iteration. f can call other methods
+	// of the Backend.
+	Range(f func(key string, v []byte, storedTime, expirationTime time.Time) bool)
+
+	// Delete deletes the entry of key from the Backend.
+	Delete(key string)
+
 	Len() int
 
 	// Closer closes the cache backend. Get and Store should become noop calls.
@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mem_cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Dump file format. All integers are big endian.
+//
+//	magic     [8]byte "MOSDNSMC"
+//	version   uint16
+//	count     uint64
+//	entries   count * {keyLen uint32, key, vLen uint32, v, storedTime int64, expirationTime int64}
+//	checksum  uint32, crc32 (Castagnoli) of all previous bytes
+//
+// Times are unix nanoseconds.
+const (
+	dumpMagic   = "MOSDNSMC"
+	dumpVersion = 1
+
+	maxDumpFieldLen = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type dumpEntry struct {
+	key string
+	e   *elem
+}
+
+// Dump writes the unexpired entries of c to w. If filter is not nil,
+// only the entries whose keys pass the filter are written. Entries are
+// written from the least recently used ones, so Load can restore their order.
+// It returns the number of entries written.
+func (c *MemCache) Dump(w io.Writer, filter func(key string) bool) (int, error) {
+	if c.isClosed() {
+		return 0, errors.New("cache is closed")
+	}
+
+	now := time.Now()
+	var entries []dumpEntry
+	c.lru.Clean(func(key string, v *elem) bool {
+		if v.expirationTime.After(now) && (filter == nil || filter(key)) {
+			entries = append(entries, dumpEntry{key: key, e: v})
+		}
+		return false
+	})
+
+	h := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	bw.WriteString(dumpMagic)
+	binary.Write(bw, binary.BigEndian, uint16(dumpVersion))
+	binary.Write(bw, binary.BigEndian, uint64(len(entries)))
+	for _, de := range entries {
+		binary.Write(bw, binary.BigEndian, uint32(len(de.key)))
+		bw.WriteString(de.key)
+		binary.Write(bw, binary.BigEndian, uint32(len(de.e.v)))
+		bw.Write(de.e.v)
+		binary.Write(bw, binary.BigEndian, de.e.storedTime.UnixNano())
+		binary.Write(bw, binary.BigEndian, de.e.expirationTime.UnixNano())
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, h.Sum32()); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// Load reads a dump from r and stores its unexpired entries into c.
+// Nothing will be stored if the dump is invalid or corrupted.
+// It returns the number of entries stored.
+func (c *MemCache) Load(r io.Reader) (int, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < len(dumpMagic)+2+8+4 {
+		return 0, errors.New("dump is too short")
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return 0, errors.New("dump checksum mismatched")
+	}
+
+	br := bytes.NewReader(body)
+	magic := make([]byte, len(dumpMagic))
+	io.ReadFull(br, magic)
+	if string(magic) != dumpMagic {
+		return 0, errors.New("not a cache dump")
+	}
+	var version uint16
+	binary.Read(br, binary.BigEndian, &version)
+	if version != dumpVersion {
+		return 0, fmt.Errorf("unsupported dump version %d", version)
+	}
+	var count uint64
+	binary.Read(br, binary.BigEndian, &count)
+
+	var entries []dumpEntry
+	for i := uint64(0); i < count; i++ {
+		key, err := readDumpField(br)
+		if err != nil {
+			return 0, fmt.Errorf("invalid entry #%d, %w", i, err)
+		}
+		v, err := readDumpField(br)
+		if err != nil {
+			return 0, fmt.Errorf("invalid entry #%d, %w", i, err)
+		}
+		var storedTime, expirationTime int64
+		if err := binary.Read(br, binary.BigEndian, &storedTime); err != nil {
+			return 0, fmt.Errorf("invalid entry #%d, %w", i, err)
+		}
+		if err := binary.Read(br, binary.BigEndian, &expirationTime); err != nil {
+			return 0, fmt.Errorf("invalid entry #%d, %w", i, err)
+		}
+		entries = append(entries, dumpEntry{key: string(key), e: &elem{
+			v:              v,
+			storedTime:     time.Unix(0, storedTime),
+			expirationTime: time.Unix(0, expirationTime),
+		}})
+	}
+	if br.Len() != 0 {
+		return 0, errors.New("unexpected trailing data")
+	}
+
+	n := 0
+	now := time.Now()
+	for _, de := range entries {
+		if de.e.expirationTime.After(now) {
+			c.Store(de.key, de.e.v, de.e.storedTime, de.e.expirationTime)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func readDumpField(r io.Reader) ([]byte, error) {
+	var l uint32
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	if l > maxDumpFieldLen {
+		return nil, fmt.Errorf("field length %d is too large", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mem_cache
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_memCache_dump(t *testing.T) {
+	c := NewMemCache(1024, 0)
+	defer c.Close()
+	now := time.Now()
+	for i := 0; i < 128; i++ {
+		c.Store(strconv.Itoa(i), []byte{byte(i)}, now, now.Add(time.Minute))
+	}
+	c.Store("expired", []byte{1}, now, now.Add(time.Millisecond*10))
+	c.Store("filtered", []byte{1}, now, now.Add(time.Minute))
+	time.Sleep(time.Millisecond * 20)
+
+	buf := new(bytes.Buffer)
+	n, err := c.Dump(buf, func(key string) bool { return key != "filtered" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 128 {
+		t.Fatalf("want 128 dumped entries, got %d", n)
+	}
+	b := buf.Bytes()
+
+	c2 := NewMemCache(1024, 0)
+	defer c2.Close()
+	n, err = c2.Load(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 128 || c2.Len() != 128 {
+		t.Fatalf("want 128 loaded entries, got %d", n)
+	}
+	for i := 0; i < 128; i++ {
+		v, storedTime, expirationTime := c2.Get(strconv.Itoa(i))
+		if len(v) != 1 || v[0] != byte(i) {
+			t.Fatal("cache kv mismatched")
+		}
+		if !storedTime.Equal(now) || !expirationTime.Equal(now.Add(time.Minute)) {
+			t.Fatal("cache time mismatched")
+		}
+	}
+
+	// Corrupted dumps are rejected.
+	for _, corrupted := range [][]byte{
+		nil,
+		b[:len(b)-1],
+		append(append([]byte{}, b[:20]...), append([]byte{b[20] ^ 0xff}, b[21:]...)...),
+	} {
+		c3 := NewMemCache(1024, 0)
+		if _, err := c3.Load(bytes.NewReader(corrupted)); err == nil {
+			t.Fatal("corrupted dump is loaded")
+		}
+		if c3.Len() != 0 {
+			t.Fatal("entries of corrupted dump are stored")
+		}
+		c3.Close()
+	}
+}
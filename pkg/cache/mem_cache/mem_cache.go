@@ -111,6 +111,33 @@ func (c *MemCache) Store(key string, v []byte, storedTime, expirationTime time.T
 	return
 }
 
+// Range implements cache.Backend. Entries are visited from the least
+// recently used ones. Range does not change their order.
+func (c *MemCache) Range(f func(key string, v []byte, storedTime, expirationTime time.Time) bool) {
+	if c.isClosed() {
+		return
+	}
+
+	// Collect the entries first, so f can modify the cache.
+	var entries []dumpEntry
+	c.lru.Clean(func(key string, v *elem) bool {
+		entries = append(entries, dumpEntry{key: key, e: v})
+		return false
+	})
+	for _, de := range entries {
+		if !f(de.key, de.e.v, de.e.storedTime, de.e.expirationTime) {
+			return
+		}
+	}
+}
+
+func (c *MemCache) Delete(key string) {
+	if c.isClosed() {
+		return
+	}
+	c.lru.Del(key)
+}
+
 func (c *MemCache) startCleaner(interval time.Duration) {
 	if interval <= 0 {
 		interval = defaultCleanerInterval
@@ -80,3 +80,38 @@ func Test_memCache_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func Test_memCache_rangeDelete(t *testing.T) {
+	c := NewMemCache(1024, -1)
+	defer c.Close()
+	for i := 0; i < 64; i++ {
+		c.Store(strconv.Itoa(i), []byte{byte(i)}, time.Now(), time.Now().Add(time.Minute))
+	}
+
+	n := 0
+	c.Range(func(key string, v []byte, _, _ time.Time) bool {
+		if key != strconv.Itoa(int(v[0])) {
+			t.Fatal("cache kv mismatched")
+		}
+		if v[0]%2 == 0 {
+			c.Delete(key)
+		}
+		n++
+		return true
+	})
+	if n != 64 {
+		t.Fatalf("want 64 entries, got %d", n)
+	}
+	if c.Len() != 32 {
+		t.Fatalf("want 32 entries after deletion, got %d", c.Len())
+	}
+
+	n = 0
+	c.Range(func(_ string, _ []byte, _, _ time.Time) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("range did not stop, got %d entries", n)
+	}
+}
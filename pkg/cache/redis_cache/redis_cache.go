@@ -37,6 +37,8 @@ import (
 
 var nopLogger = zap.NewNop()
 
+const scanBatchSize = 256
+
 type RedisCacheOpts struct {
 	// Client cannot be nil.
 	Client redis.Cmdable
@@ -194,6 +196,67 @@ func (r *RedisCache) BatchStore(b []KV) {
 	}
 }
 
+// Range implements cache.Backend. It scans all keys in the database.
+// Values that are not stored by RedisCache are skipped.
+func (r *RedisCache) Range(f func(key string, v []byte, storedTime, expirationTime time.Time) bool) {
+	if r.disabled() {
+		return
+	}
+
+	var cursor uint64
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), r.opts.ClientTimeout)
+		keys, next, err := r.opts.Client.Scan(ctx, cursor, "*", scanBatchSize).Result()
+		if err != nil {
+			cancel()
+			r.opts.Logger.Warn("redis scan", zap.Error(err))
+			return
+		}
+		var values []any
+		if len(keys) > 0 {
+			values, err = r.opts.Client.MGet(ctx, keys...).Result()
+		}
+		cancel()
+		if err != nil {
+			r.opts.Logger.Warn("redis mget", zap.Error(err))
+			return
+		}
+
+		for i, key := range keys {
+			s, ok := values[i].(string)
+			if !ok { // Key was deleted.
+				continue
+			}
+			storedTime, expirationTime, v, err := unpackRedisValue([]byte(s))
+			if err != nil {
+				continue
+			}
+			if !f(key, v, storedTime, expirationTime) {
+				return
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// Delete implements cache.Backend.
+func (r *RedisCache) Delete(key string) {
+	if r.disabled() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ClientTimeout)
+	defer cancel()
+	if err := r.opts.Client.Del(ctx, key).Err(); err != nil {
+		r.opts.Logger.Warn("redis del", zap.Error(err))
+		r.disableClient()
+	}
+}
+
 // Close closes the redis client.
 func (r *RedisCache) Close() error {
 	if f := r.opts.ClientCloser; f != nil {
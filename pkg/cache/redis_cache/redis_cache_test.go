@@ -20,9 +20,13 @@
 package redis_cache
 
 import (
+	"context"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 func Test_RedisValue(t *testing.T) {
@@ -55,3 +59,104 @@ func Test_RedisValue(t *testing.T) {
 		})
 	}
 }
+
+// fakeRedis is an in-memory redis.Cmdable that only implements the
+// commands used by Range and Delete. Scan returns at most two keys
+// in a batch, so Range needs to follow the cursor.
+type fakeRedis struct {
+	redis.Cmdable
+	m map[string]string
+}
+
+func (f *fakeRedis) store(key string, storedTime, expirationTime time.Time, v []byte) {
+	data := packRedisData(storedTime, expirationTime, v)
+	defer data.Release()
+	f.m[key] = string(data.Bytes())
+}
+
+func (f *fakeRedis) Scan(_ context.Context, cursor uint64, _ string, _ int64) *redis.ScanCmd {
+	keys := make([]string, 0, len(f.m))
+	for k := range f.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	end := min(int(cursor)+2, len(keys))
+	next := uint64(end)
+	if end == len(keys) {
+		next = 0
+	}
+	return redis.NewScanCmdResult(keys[cursor:end], next, nil)
+}
+
+func (f *fakeRedis) MGet(_ context.Context, keys ...string) *redis.SliceCmd {
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		if v, ok := f.m[k]; ok {
+			values[i] = v
+		}
+	}
+	return redis.NewSliceResult(values, nil)
+}
+
+func (f *fakeRedis) Del(_ context.Context, keys ...string) *redis.IntCmd {
+	n := 0
+	for _, k := range keys {
+		if _, ok := f.m[k]; ok {
+			delete(f.m, k)
+			n++
+		}
+	}
+	return redis.NewIntResult(int64(n), nil)
+}
+
+func Test_RedisCache_Range_Delete(t *testing.T) {
+	f := &fakeRedis{m: make(map[string]string)}
+	r, err := NewRedisCache(RedisCacheOpts{Client: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		f.store(k, now, now.Add(time.Minute), []byte(k))
+	}
+	f.m["invalid"] = "short" // not stored by RedisCache, skipped.
+
+	got := make(map[string]string)
+	r.Range(func(key string, v []byte, storedTime, expirationTime time.Time) bool {
+		if !storedTime.Equal(now) || !expirationTime.Equal(now.Add(time.Minute)) {
+			t.Errorf("%s: unexpected times %v %v", key, storedTime, expirationTime)
+		}
+		got[key] = string(v)
+		return true
+	})
+	want := map[string]string{"a": "a", "b": "b", "c": "c", "d": "d", "e": "e"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Range: want %v, got %v", want, got)
+	}
+
+	n := 0
+	r.Range(func(string, []byte, time.Time, time.Time) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("Range should stop when f returns false, got %d calls", n)
+	}
+
+	r.Delete("c")
+	r.Delete("not_exist")
+	if _, ok := f.m["c"]; ok {
+		t.Fatal("key is not deleted")
+	}
+	if r.disabled() {
+		t.Fatal("client is disabled by deleting a missing key")
+	}
+	n = 0
+	r.Range(func(string, []byte, time.Time, time.Time) bool {
+		n++
+		return true
+	})
+	if n != 4 {
+		t.Fatalf("want 4 entries after delete, got %d", n)
+	}
+}
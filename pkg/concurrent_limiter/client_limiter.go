@@ -49,6 +49,10 @@ type HPLimiterOpts struct {
 
 	// Default is 10s. Negative value disables the cleaner.
 	CleanerInterval time.Duration
+
+	// IdleTimeout is how long a counter is kept after its interval
+	// started. Default is 10s or Interval, whichever is longer.
+	IdleTimeout time.Duration
 }
 
 func (opts *HPLimiterOpts) Init() error {
@@ -57,6 +61,7 @@ func (opts *HPLimiterOpts) Init() error {
 	}
 	utils.SetDefaultNum(&opts.Interval, time.Second)
 	utils.SetDefaultNum(&opts.CleanerInterval, time.Second*10)
+	utils.SetDefaultNum(&opts.IdleTimeout, max(counterIdleTimeout, opts.Interval))
 
 	if m := opts.IPv4Mask; m < 0 || m > 32 {
 		return fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
@@ -165,7 +170,7 @@ func (l *HPClientLimiter) GC(now time.Time) {
 		if !ok {
 			return nil, false, false
 		}
-		return nil, false, v.startTime.Add(counterIdleTimeout).Before(now)
+		return nil, false, v.startTime.Add(l.opts.IdleTimeout).Before(now)
 	}
 	l.m.RangeDo(f)
 }
@@ -72,6 +72,13 @@ func (c *ShardedLRU[V]) Get(key string) (v V, ok bool) {
 	return
 }
 
+// GetOrAdd returns the existing value of key. Otherwise, it adds and
+// returns the value from newV. loaded is true if the value was loaded.
+func (c *ShardedLRU[V]) GetOrAdd(key string, newV func() V) (v V, loaded bool) {
+	sl := c.getShard(key)
+	return sl.GetOrAdd(key, newV)
+}
+
 func (c *ShardedLRU[V]) Len() int {
 	sum := 0
 	for _, shard := range c.l {
@@ -135,6 +142,18 @@ func (c *ConcurrentLRU[K, V]) Get(key K) (v V, ok bool) {
 	return
 }
 
+func (c *ConcurrentLRU[K, V]) GetOrAdd(key K, newV func() V) (v V, loaded bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if v, ok := c.lru.Get(key); ok {
+		return v, true
+	}
+	v = newV()
+	c.lru.Add(key, v)
+	return v, false
+}
+
 func (c *ConcurrentLRU[K, V]) Len() int {
 	c.Lock()
 	defer c.Unlock()
@@ -22,6 +22,8 @@ package concurrent_lru
 import (
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -103,4 +105,37 @@ func TestConcurrentLRU(t *testing.T) {
 	}
 	mustGet(2, 4)
 	emptyGet(1, 3)
+
+	// test get or add
+	reset(4, 16)
+	add(1)
+	if v, loaded := cache.GetOrAdd("1", func() int { return 100 }); !loaded || v != 1 {
+		t.Fatalf("want loaded 1, got %v, %v", v, loaded)
+	}
+	if v, loaded := cache.GetOrAdd("2", func() int { return 2 }); loaded || v != 2 {
+		t.Fatalf("want added 2, got %v, %v", v, loaded)
+	}
+	mustGet(1, 2)
+}
+
+func TestShardedLRU_GetOrAdd_concurrent(t *testing.T) {
+	cache := NewShardedLRU[*atomic.Int64](4, 16, nil)
+	newCounter := func() *atomic.Int64 { return new(atomic.Int64) }
+
+	const n = 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, _ := cache.GetOrAdd("key", newCounter)
+			c.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	c, _ := cache.Get("key")
+	if got := c.Load(); got != n {
+		t.Fatalf("want %d, got %d", n, got)
+	}
 }
@@ -20,6 +20,7 @@
 package data_provider
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"sync"
@@ -58,16 +59,46 @@ func (m *DataManager) GetDataProvider(name string) *DataProvider {
 	return m.ps[name]
 }
 
+// Close closes all DataProvider in this DataManager.
+func (m *DataManager) Close() {
+	m.pm.Lock()
+	defer m.pm.Unlock()
+	for _, p := range m.ps {
+		p.Close()
+	}
+}
+
 type DataProviderConfig struct {
 	Tag        string `yaml:"tag"`
 	File       string `yaml:"file"`
 	AutoReload bool   `yaml:"auto_reload"`
+
+	// URL is the http or https url of the data. If URL is set, the data
+	// will be downloaded from it and refreshed every RefreshInterval. File
+	// is the local copy of the data, which is loaded on startup, so the
+	// data is available even if the remote is unreachable.
+	URL             string `yaml:"url"`
+	RefreshInterval int    `yaml:"refresh_interval"` // In seconds. Default is 86400.
+	Timeout         int    `yaml:"timeout"`          // In seconds. Default is 30.
+
+	// ChecksumURL is the url of the sha256 checksum of the data, in the
+	// format of the sha256sum output.
+	ChecksumURL string `yaml:"checksum_url"`
+	// SignatureURL is the url of the ed25519 signature of the data. The
+	// signature is verified by PublicKey, which is base64 encoded.
+	SignatureURL string `yaml:"signature_url"`
+	PublicKey    string `yaml:"public_key"`
 }
 
 type DataProvider struct {
 	logger     *zap.Logger
 	file       string
 	autoReload bool
+	remote     *remoteSource // nil if the data is a local file.
+
+	dm       sync.Mutex
+	data     []byte            // The latest data of a remote DataProvider.
+	dataHash [sha256.Size]byte // The hash of the latest data.
 
 	lm        sync.Mutex
 	listeners map[DataListener]struct{}
@@ -83,6 +114,14 @@ func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, err
 
 	dp.sc = safe_close.NewSafeClose()
 
+	if len(cfg.URL) > 0 {
+		r, err := newRemoteSource(cfg)
+		if err != nil {
+			return nil, err
+		}
+		dp.remote = r
+	}
+
 	if err := dp.init(); err != nil {
 		return nil, err
 	}
@@ -90,10 +129,15 @@ func NewDataProvider(lg *zap.Logger, cfg DataProviderConfig) (*DataProvider, err
 }
 
 func (ds *DataProvider) init() error {
-	_, err := ds.loadFromDisk()
+	if ds.remote != nil {
+		return ds.initRemote()
+	}
+
+	b, err := ds.loadFromDisk()
 	if err != nil {
 		return err
 	}
+	ds.dataHash = sha256.Sum256(b)
 
 	if ds.autoReload {
 		if err := ds.startFsWatcher(); err != nil {
@@ -136,11 +180,30 @@ func (ds *DataProvider) DeleteListener(l DataListener) {
 }
 
 func (ds *DataProvider) GetData() ([]byte, error) {
+	if ds.remote != nil {
+		ds.dm.Lock()
+		defer ds.dm.Unlock()
+		return ds.data, nil
+	}
 	return os.ReadFile(ds.file)
 }
 
 // pushData notify the notifier and trigger all listeners.
-func (ds *DataProvider) pushData(newData []byte) {
+// Listeners are notified only if the data was changed.
+// It reports whether the data was changed.
+func (ds *DataProvider) pushData(newData []byte) bool {
+	h := sha256.Sum256(newData)
+	ds.dm.Lock()
+	if h == ds.dataHash {
+		ds.dm.Unlock()
+		return false
+	}
+	ds.dataHash = h
+	if ds.remote != nil {
+		ds.data = newData
+	}
+	ds.dm.Unlock()
+
 	ds.lm.Lock()
 	ls := make([]DataListener, 0, len(ds.listeners))
 	for listener := range ds.listeners {
@@ -156,6 +219,7 @@ func (ds *DataProvider) pushData(newData []byte) {
 			)
 		}
 	}
+	return true
 }
 
 func (ds *DataProvider) loadFromDisk() ([]byte, error) {
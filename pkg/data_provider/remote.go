@@ -0,0 +1,306 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRefreshInterval = time.Hour * 24
+	defaultRemoteTimeout   = time.Second * 30
+	maxRemoteDataSize      = 64 << 20 // 64M
+	maxRemoteMetaSize      = 4 << 10  // checksum and signature files.
+)
+
+// remoteSource downloads data from a http/https url.
+type remoteSource struct {
+	url          string
+	checksumURL  string
+	signatureURL string
+	publicKey    ed25519.PublicKey
+	interval     time.Duration
+	timeout      time.Duration
+	client       *http.Client
+
+	// Validators of the last download. They are only accessed by
+	// the refresh goroutine.
+	etag         string
+	lastModified string
+}
+
+func newRemoteSource(cfg DataProviderConfig) (*remoteSource, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("invalid url %s, only http and https are supported", cfg.URL)
+	}
+	if cfg.AutoReload {
+		return nil, errors.New("auto_reload is not supported by remote data")
+	}
+
+	r := &remoteSource{
+		url:          cfg.URL,
+		checksumURL:  cfg.ChecksumURL,
+		signatureURL: cfg.SignatureURL,
+		interval:     time.Duration(cfg.RefreshInterval) * time.Second,
+		timeout:      time.Duration(cfg.Timeout) * time.Second,
+		client:       &http.Client{},
+	}
+	if r.interval <= 0 {
+		r.interval = defaultRefreshInterval
+	}
+	if r.timeout <= 0 {
+		r.timeout = defaultRemoteTimeout
+	}
+	if (len(cfg.SignatureURL) > 0) != (len(cfg.PublicKey) > 0) {
+		return nil, errors.New("signature_url and public_key must be set together")
+	}
+	if len(cfg.PublicKey) > 0 {
+		k, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key")
+		}
+		r.publicKey = k
+	}
+	return r, nil
+}
+
+// fetch downloads and verifies the data. It returns a nil b if the data
+// was not modified since the last download.
+func (r *remoteSource) fetch(ctx context.Context) (b []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.etag) > 0 {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if len(r.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err = readLimited(resp.Body, maxRemoteDataSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.verify(ctx, b); err != nil {
+		return nil, err
+	}
+
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	return b, nil
+}
+
+// verify verifies the checksum and signature of b, if they are configured.
+func (r *remoteSource) verify(ctx context.Context, b []byte) error {
+	if len(r.checksumURL) > 0 {
+		c, err := r.get(ctx, r.checksumURL)
+		if err != nil {
+			return fmt.Errorf("failed to download checksum, %w", err)
+		}
+		// Accepts the output of sha256sum, "<hex> <file name>".
+		fields := strings.Fields(string(c))
+		if len(fields) == 0 {
+			return errors.New("empty checksum")
+		}
+		want, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid checksum, %w", err)
+		}
+		if got := sha256.Sum256(b); !bytes.Equal(got[:], want) {
+			return fmt.Errorf("checksum mismatched, want %x, got %x", want, got)
+		}
+	}
+
+	if len(r.signatureURL) > 0 {
+		sig, err := r.get(ctx, r.signatureURL)
+		if err != nil {
+			return fmt.Errorf("failed to download signature, %w", err)
+		}
+		// The signature can be raw bytes or base64 encoded.
+		if len(sig) != ed25519.SignatureSize {
+			sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+			if err != nil {
+				return fmt.Errorf("invalid signature, %w", err)
+			}
+		}
+		if !ed25519.Verify(r.publicKey, b, sig) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+func (r *remoteSource) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return readLimited(resp.Body, maxRemoteMetaSize)
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("data is larger than %d bytes", limit)
+	}
+	return b, nil
+}
+
+// initRemote loads the data of a remote DataProvider and starts the
+// refresh loop. The local copy is loaded first, if there is one, so an
+// unreachable remote won't block the startup.
+func (ds *DataProvider) initRemote() error {
+	hasLocalCopy := false
+	if len(ds.file) > 0 {
+		b, err := os.ReadFile(ds.file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			hasLocalCopy = true
+			ds.pushData(b)
+			if fi, err := os.Stat(ds.file); err == nil {
+				ds.remote.lastModified = fi.ModTime().UTC().Format(http.TimeFormat)
+			}
+		}
+	}
+
+	if !hasLocalCopy {
+		if err := ds.refresh(context.Background()); err != nil {
+			return fmt.Errorf("failed to download %s, %w", ds.remote.url, err)
+		}
+	}
+	ds.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ds.refreshLoop(hasLocalCopy, closeSignal)
+	})
+	return nil
+}
+
+func (ds *DataProvider) refreshLoop(refreshNow bool, closeSignal <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-closeSignal:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(ds.remote.interval)
+	defer ticker.Stop()
+	for {
+		if refreshNow {
+			if err := ds.refresh(ctx); err != nil {
+				ds.logger.Warn("failed to refresh remote data", zap.String("url", ds.remote.url), zap.Error(err))
+			}
+		}
+		refreshNow = true
+		select {
+		case <-ticker.C:
+		case <-closeSignal:
+			return
+		}
+	}
+}
+
+// refresh downloads the remote data, saves it to the local copy and
+// notifies the listeners.
+func (ds *DataProvider) refresh(ctx context.Context) error {
+	b, err := ds.remote.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		ds.logger.Debug("remote data not modified", zap.String("url", ds.remote.url))
+		return nil
+	}
+	if len(ds.file) > 0 {
+		if err := writeFileAtomic(ds.file, b); err != nil {
+			ds.logger.Warn("failed to save the local copy", zap.String("file", ds.file), zap.Error(err))
+		}
+	}
+	if ds.pushData(b) {
+		ds.logger.Info("remote data updated", zap.String("url", ds.remote.url), zap.Int("size", len(b)))
+	}
+	return nil
+}
+
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
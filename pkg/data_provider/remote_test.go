@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type testListener struct {
+	m       sync.Mutex
+	updates [][]byte
+}
+
+func (l *testListener) Update(b []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.updates = append(l.updates, b)
+	return nil
+}
+
+func (l *testListener) len() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return len(l.updates)
+}
+
+type testRemote struct {
+	m        sync.Mutex
+	data     string
+	down     bool
+	requests int
+	notMod   int
+}
+
+func (s *testRemote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	s.requests++
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(s.data)))
+	switch req.URL.Path {
+	case "/data":
+		if req.Header.Get("If-None-Match") == etag {
+			s.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(s.data))
+	case "/data.sha256":
+		fmt.Fprintf(w, "%x  data\n", sha256.Sum256([]byte(s.data)))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *testRemote) set(data string, down bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.data, s.down = data, down
+}
+
+func Test_remoteDataProvider(t *testing.T) {
+	tr := &testRemote{data: "v1"}
+	server := httptest.NewServer(tr)
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "data.txt")
+	dp, err := NewDataProvider(zap.NewNop(), DataProviderConfig{
+		File:        file,
+		URL:         server.URL + "/data",
+		ChecksumURL: server.URL + "/data.sha256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Close()
+
+	l := new(testListener)
+	if err := dp.LoadAndAddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(file); string(b) != "v1" {
+		t.Fatalf("local copy is not saved, got %q", b)
+	}
+
+	// Not modified.
+	if err := dp.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tr.notMod != 1 || l.len() != 1 {
+		t.Fatalf("want a not modified response without update, got %d, %d", tr.notMod, l.len())
+	}
+
+	// Same content with a new etag won't notify listeners.
+	dp.remote.etag = ""
+	if err := dp.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if l.len() != 1 {
+		t.Fatal("listener should not be notified if the data was not changed")
+	}
+
+	tr.set("v2", false)
+	if err := dp.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if l.len() != 2 || string(l.updates[1]) != "v2" {
+		t.Fatal("listener was not updated")
+	}
+	if b, _ := dp.GetData(); string(b) != "v2" {
+		t.Fatalf("want v2, got %q", b)
+	}
+
+	// The local copy is used if the remote is down.
+	tr.set("v3", true)
+	dp2, err := NewDataProvider(zap.NewNop(), DataProviderConfig{File: file, URL: server.URL + "/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp2.Close()
+	if b, _ := dp2.GetData(); string(b) != "v2" {
+		t.Fatalf("want local copy v2, got %q", b)
+	}
+
+	// No local copy and the remote is down.
+	_, err = NewDataProvider(zap.NewNop(), DataProviderConfig{
+		File: filepath.Join(t.TempDir(), "data.txt"),
+		URL:  server.URL + "/data",
+	})
+	if err == nil {
+		t.Fatal("want an error")
+	}
+}
+
+func Test_remoteSource_verify(t *testing.T) {
+	data := []byte("data")
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(priv, data)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sig", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+	})
+	mux.HandleFunc("/raw_sig", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(sig)
+	})
+	mux.HandleFunc("/bad_checksum", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintf(w, "%x  data\n", sha256.Sum256([]byte("other")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	newSource := func(cfg DataProviderConfig) *remoteSource {
+		t.Helper()
+		cfg.URL = server.URL
+		r, err := newRemoteSource(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	pubKey := base64.StdEncoding.EncodeToString(pub)
+	ctx := context.Background()
+
+	if err := newSource(DataProviderConfig{SignatureURL: server.URL + "/sig", PublicKey: pubKey}).verify(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := newSource(DataProviderConfig{SignatureURL: server.URL + "/raw_sig", PublicKey: pubKey}).verify(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := newSource(DataProviderConfig{SignatureURL: server.URL + "/sig", PublicKey: pubKey}).verify(ctx, []byte("bad")); err == nil {
+		t.Fatal("bad signature passed")
+	}
+	if err := newSource(DataProviderConfig{ChecksumURL: server.URL + "/bad_checksum"}).verify(ctx, data); err == nil {
+		t.Fatal("bad checksum passed")
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+// maxNSEC3Iterations is the iteration limit from RFC 9276. NSEC3 records
+// with more iterations are treated as insecure.
+const maxNSEC3Iterations = 150
+
+// nsec3Hash returns the lower case base32hex encoded NSEC3 hash of name.
+func nsec3Hash(name string, iterations uint16, salt string) (string, bool) {
+	s, err := hex.DecodeString(salt)
+	if err != nil {
+		return "", false
+	}
+	wire, ok := nameToWire(name)
+	if !ok {
+		return "", false
+	}
+
+	h := sha1.New()
+	h.Write(wire)
+	h.Write(s)
+	b := h.Sum(nil)
+	for i := uint16(0); i < iterations; i++ {
+		h.Reset()
+		h.Write(b)
+		h.Write(s)
+		b = h.Sum(b[:0])
+	}
+	return strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), true
+}
+
+// nameToWire returns the lower case uncompressed wire format of fqdn name.
+func nameToWire(name string) ([]byte, bool) {
+	name = strings.ToLower(name)
+	b := make([]byte, 0, len(name)+1)
+	if name != "." {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, false
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), true
+}
+
+// nsecProof is the set of validated NSEC and NSEC3 records in a response.
+type nsecProof struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+func newNSECProof(rrs []dns.RR) *nsecProof {
+	p := new(nsecProof)
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			p.nsec = append(p.nsec, rr)
+		case *dns.NSEC3:
+			p.nsec3 = append(p.nsec3, rr)
+		}
+	}
+	return p
+}
+
+func (p *nsecProof) empty() bool {
+	return len(p.nsec) == 0 && len(p.nsec3) == 0
+}
+
+// nsecMatch returns the NSEC record owned by name.
+func (p *nsecProof) nsecMatch(name string) *dns.NSEC {
+	for _, rr := range p.nsec {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsecCover returns the NSEC record that proves name does not exist.
+func (p *nsecProof) nsecCover(name string) *dns.NSEC {
+	for _, rr := range p.nsec {
+		if covers(rr.Header().Name, rr.NextDomain, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsec3Match returns the NSEC3 record that matches name.
+func (p *nsecProof) nsec3Match(name string) *dns.NSEC3 {
+	for _, rr := range p.nsec3 {
+		h, ok := nsec3Hash(name, rr.Iterations, rr.Salt)
+		if ok && strings.EqualFold(firstLabel(rr.Header().Name), h) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsec3Cover returns the NSEC3 record that proves name does not exist.
+func (p *nsecProof) nsec3Cover(name string) *dns.NSEC3 {
+	for _, rr := range p.nsec3 {
+		h, ok := nsec3Hash(name, rr.Iterations, rr.Salt)
+		if ok && coversHash(firstLabel(rr.Header().Name), rr.NextDomain, h) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// nsec3Insecure reports whether the NSEC3 records use too many iterations.
+func (p *nsecProof) nsec3Insecure() bool {
+	for _, rr := range p.nsec3 {
+		if rr.Iterations > maxNSEC3Iterations {
+			return true
+		}
+	}
+	return false
+}
+
+// closestEncloser returns the closest encloser of name and the NSEC3 that
+// covers the next closer name, as RFC 5155 8.3 described.
+func (p *nsecProof) closestEncloser(name string) (ce string, nextCloser *dns.NSEC3, ok bool) {
+	for n := name; ; n = dnsutils.ParentName(n) {
+		if p.nsec3Match(n) != nil {
+			if n == name {
+				return "", nil, false // name exists.
+			}
+			nc := nextCloserName(n, name)
+			if c := p.nsec3Cover(nc); c != nil {
+				return n, c, true
+			}
+			return "", nil, false
+		}
+		if n == "." {
+			return "", nil, false
+		}
+	}
+}
+
+// proveNoData reports whether the proof shows that name exists but has
+// no qType (and CNAME) records.
+func (p *nsecProof) proveNoData(name string, qType uint16) bool {
+	if rr := p.nsecMatch(name); rr != nil {
+		return !hasType(rr.TypeBitMap, qType) && !hasType(rr.TypeBitMap, dns.TypeCNAME)
+	}
+	if rr := p.nsec3Match(name); rr != nil {
+		return !hasType(rr.TypeBitMap, qType) && !hasType(rr.TypeBitMap, dns.TypeCNAME)
+	}
+
+	// Wildcard NODATA.
+	if rr := p.nsecCover(name); rr != nil {
+		for ce := dnsutils.ParentName(name); ; ce = dnsutils.ParentName(ce) {
+			if w := p.nsecMatch(dnsutils.WildcardName(ce)); w != nil {
+				return !hasType(w.TypeBitMap, qType) && !hasType(w.TypeBitMap, dns.TypeCNAME)
+			}
+			if ce == "." {
+				break
+			}
+		}
+	}
+	if ce, _, ok := p.closestEncloser(name); ok {
+		if w := p.nsec3Match(dnsutils.WildcardName(ce)); w != nil {
+			return !hasType(w.TypeBitMap, qType) && !hasType(w.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	return false
+}
+
+// proveNXDomain reports whether the proof shows that name and the
+// wildcard that could match name do not exist.
+func (p *nsecProof) proveNXDomain(name string) bool {
+	if rr := p.nsecCover(name); rr != nil {
+		// The closest encloser is the longest common ancestor of name and
+		// the owner or the next name of the covering NSEC.
+		ce := commonAncestor(name, rr.Header().Name)
+		if c := commonAncestor(name, rr.NextDomain); len(c) > len(ce) {
+			ce = c
+		}
+		return p.nsecCover(dnsutils.WildcardName(ce)) != nil
+	}
+	if ce, _, ok := p.closestEncloser(name); ok {
+		return p.nsec3Cover(dnsutils.WildcardName(ce)) != nil
+	}
+	return false
+}
+
+// proveNoCloser reports whether the proof shows that there is no closer
+// match of name than the wildcard that has sigLabels labels.
+func (p *nsecProof) proveNoCloser(name string, sigLabels int) bool {
+	if p.nsecCover(name) != nil {
+		return true
+	}
+	ce := lastLabels(name, sigLabels)
+	return p.nsec3Cover(nextCloserName(ce, name)) != nil
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether name is between owner and next in the canonical order.
+func covers(owner, next, name string) bool {
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last NSEC of the zone.
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// coversHash is covers for base32hex encoded NSEC3 hashes.
+func coversHash(owner, next, h string) bool {
+	owner, next = strings.ToLower(owner), strings.ToLower(next)
+	if owner < next {
+		return owner < h && h < next
+	}
+	return owner < h || h < next
+}
+
+// canonicalCompare compares two names in the canonical order of RFC 4034 6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := labels(strings.ToLower(a)), labels(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// labels returns the labels of fqdn name. The root has no label.
+func labels(name string) []string {
+	if name == "." || len(name) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(name, "."), ".")
+}
+
+func countLabels(name string) int {
+	return len(labels(name))
+}
+
+// lastLabels returns the ancestor of name that has n labels.
+func lastLabels(name string, n int) string {
+	l := labels(name)
+	if n <= 0 {
+		return "."
+	}
+	if n >= len(l) {
+		return name
+	}
+	return strings.Join(l[len(l)-n:], ".") + "."
+}
+
+// nextCloserName returns the ancestor of name that has one more label than ce.
+func nextCloserName(ce, name string) string {
+	return lastLabels(name, countLabels(ce)+1)
+}
+
+func commonAncestor(a, b string) string {
+	la, lb := labels(strings.ToLower(a)), labels(strings.ToLower(b))
+	n := 0
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0 && la[i] == lb[j]; i, j = i-1, j-1 {
+		n++
+	}
+	return lastLabels(strings.ToLower(a), n)
+}
+
+func firstLabel(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"testing"
+)
+
+func Test_nsec3Hash(t *testing.T) {
+	// Test vectors from RFC 5155 Appendix A.
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+		{"a.example.", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+		{"ai.example.", "gjeqe526plbf1g8mklp59enfd789njgi"},
+		{"*.w.example.", "r53bq7cc2uvmubfu5ocmm6pers9tk9en"},
+	}
+	for _, tt := range tests {
+		got, ok := nsec3Hash(tt.name, 12, "aabbccdd")
+		if !ok || got != tt.want {
+			t.Errorf("nsec3Hash(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_canonicalCompare(t *testing.T) {
+	// Names in canonical order. RFC 4034 6.1.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := range names {
+		for j := range names {
+			got := canonicalCompare(names[i], names[j])
+			if (i < j && got >= 0) || (i > j && got <= 0) || (i == j && got != 0) {
+				t.Errorf("canonicalCompare(%q, %q) = %d", names[i], names[j], got)
+			}
+		}
+	}
+}
+
+func Test_covers(t *testing.T) {
+	tests := []struct {
+		owner, next, name string
+		want              bool
+	}{
+		{"a.example.", "c.example.", "b.example.", true},
+		{"a.example.", "c.example.", "x.b.example.", true},
+		{"a.example.", "c.example.", "c.example.", false},
+		{"a.example.", "c.example.", "a.example.", false},
+		{"z.example.", "example.", "zz.example.", true}, // last nsec
+		{"z.example.", "example.", "b.example.", false},
+	}
+	for _, tt := range tests {
+		if got := covers(tt.owner, tt.next, tt.name); got != tt.want {
+			t.Errorf("covers(%q, %q, %q) = %v, want %v", tt.owner, tt.next, tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_commonAncestor(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"a.b.example.", "c.b.example.", "b.example."},
+		{"a.example.", "a.example.", "a.example."},
+		{"a.example.", "com.", "."},
+		{"A.Example.", "b.example.", "example."},
+	}
+	for _, tt := range tests {
+		if got := commonAncestor(tt.a, tt.b); got != tt.want {
+			t.Errorf("commonAncestor(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
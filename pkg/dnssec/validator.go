@@ -0,0 +1,848 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// DefaultTrustAnchors are the DS records of the root KSKs published by IANA.
+const DefaultTrustAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+const (
+	minCacheTTL = time.Second * 5
+	maxCacheTTL = time.Hour * 24
+	cacheShards = 16
+
+	// maxQueries limits the number of DNSKEY and DS queries of a validation.
+	maxQueries = 32
+)
+
+// Result is the security status of a response. See RFC 4033 5.
+type Result int
+
+const (
+	Insecure Result = iota
+	Secure
+	Bogus
+)
+
+func (r Result) String() string {
+	switch r {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return "unknown"
+	}
+}
+
+// Exchanger sends query q and returns the response. The validator uses
+// it to fetch DNSKEY and DS records.
+type Exchanger func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+type ValidatorOpts struct {
+	// TrustAnchors are the DS or DNSKEY records of the trust anchors.
+	// Default is DefaultTrustAnchors.
+	TrustAnchors []dns.RR
+
+	// CacheSize is the max number of cached zone keys and delegations.
+	// Default is 4096.
+	CacheSize int
+
+	// Now returns the current time. It is used to check the validity
+	// periods of signatures. Default is time.Now.
+	Now func() time.Time
+}
+
+// Validator validates DNSSEC signed responses as RFC 4035 5 described.
+// Validated DNSKEY and DS records are cached. Validator is safe for
+// concurrent use.
+type Validator struct {
+	opts    ValidatorOpts
+	anchors map[string]*anchor // lower case zone -> anchor
+
+	keyCache *concurrent_lru.ShardedLRU[*zoneKeys]
+	cutCache *concurrent_lru.ShardedLRU[*zoneCut]
+}
+
+type anchor struct {
+	ds   []*dns.DS
+	keys []*dns.DNSKEY
+}
+
+// zoneKeys is the validated DNSKEY RRset of a zone.
+type zoneKeys struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	expire   time.Time
+}
+
+// zoneCut is the result of a DS lookup.
+type zoneCut struct {
+	kind   cutKind
+	expire time.Time
+}
+
+type cutKind int
+
+const (
+	cutNone     cutKind = iota // Not a zone cut.
+	cutSecure                  // A zone cut with valid DS records.
+	cutInsecure                // A zone cut without DS records, or an unsupported one.
+	cutNXDomain                // The name does not exist.
+)
+
+var (
+	errNoSig      = errors.New("missing signatures")
+	errChainLoop  = errors.New("loop in the chain of trust")
+	errMaxQueries = errors.New("too many queries")
+)
+
+// ParseTrustAnchors parses DS and DNSKEY records in zone file format from r.
+func ParseTrustAnchors(r io.Reader) ([]dns.RR, error) {
+	var rrs []dns.RR
+	parser := dns.NewZoneParser(r, ".", "")
+	for {
+		rr, ok := parser.Next()
+		if !ok {
+			break
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			rrs = append(rrs, rr)
+		default:
+			return nil, fmt.Errorf("%s is not a DS or DNSKEY record", rr.Header().Name)
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+func NewValidator(opts ValidatorOpts) (*Validator, error) {
+	if len(opts.TrustAnchors) == 0 {
+		rrs, err := ParseTrustAnchors(strings.NewReader(DefaultTrustAnchors))
+		if err != nil {
+			return nil, err
+		}
+		opts.TrustAnchors = rrs
+	}
+	utils.SetDefaultNum(&opts.CacheSize, 4096)
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	anchors := make(map[string]*anchor)
+	for _, rr := range opts.TrustAnchors {
+		zone := strings.ToLower(rr.Header().Name)
+		a := anchors[zone]
+		if a == nil {
+			a = new(anchor)
+			anchors[zone] = a
+		}
+		switch rr := rr.(type) {
+		case *dns.DS:
+			a.ds = append(a.ds, rr)
+		case *dns.DNSKEY:
+			a.keys = append(a.keys, rr)
+		default:
+			return nil, fmt.Errorf("invalid trust anchor type %s", dns.TypeToString[dns.RRToType(rr)])
+		}
+	}
+
+	sizePerShard := opts.CacheSize / cacheShards
+	if sizePerShard < 16 {
+		sizePerShard = 16
+	}
+	return &Validator{
+		opts:     opts,
+		anchors:  anchors,
+		keyCache: concurrent_lru.NewShardedLRU[*zoneKeys](cacheShards, sizePerShard, nil),
+		cutCache: concurrent_lru.NewShardedLRU[*zoneCut](cacheShards, sizePerShard, nil),
+	}, nil
+}
+
+// Validate validates response r of query q. Missing DNSKEY and DS records
+// will be fetched by exchange. An error is returned with Bogus to explain
+// why r is bogus.
+func (v *Validator) Validate(ctx context.Context, q, r *dns.Msg, exchange Exchanger) (Result, error) {
+	if len(q.Question) != 1 {
+		return Insecure, nil
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return Insecure, nil
+	}
+	question := q.Question[0]
+	qName := strings.ToLower(question.Header().Name)
+	qType := dns.RRToType(question)
+
+	vc := &validateCtx{v: v, ctx: ctx, exchange: exchange, visiting: make(map[string]struct{})}
+	result := Secure
+	merge := func(res Result, err error) error {
+		if res == Bogus {
+			return err
+		}
+		if res == Insecure {
+			result = Insecure
+		}
+		return nil
+	}
+
+	// Answer section.
+	sName := qName // The name at the end of the cname chain.
+	rrsets, sigs := splitRRsets(r.Answer)
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		owner := strings.ToLower(hdr.Name)
+		typ := dns.RRToType(rrset[0])
+		if typ == dns.TypeCNAME && qType != dns.TypeCNAME && owner == sName {
+			sName = strings.ToLower(rrset[0].(*dns.CNAME).Target)
+		}
+
+		s := sigs[rrsetKey(owner, typ)]
+		if len(s) == 0 && typ == dns.TypeCNAME && hasCoveringDNAME(rrsets, owner) {
+			continue // A CNAME synthesized from a validated DNAME.
+		}
+		res, err := vc.verifyRRset(rrset, s)
+		if err := merge(res, err); err != nil {
+			return Bogus, fmt.Errorf("answer %s %s: %w", hdr.Name, dns.TypeToString[typ], err)
+		}
+
+		// Wildcard expansion. RFC 4035 5.3.4.
+		if res == Secure && len(s) > 0 && int(s[0].Labels) < countLabels(owner) {
+			proof, res, err := vc.verifyProof(r.Ns)
+			if err := merge(res, err); err != nil {
+				return Bogus, fmt.Errorf("wildcard proof of %s: %w", hdr.Name, err)
+			}
+			if res == Secure && !proof.proveNoCloser(owner, int(s[0].Labels)) {
+				return Bogus, fmt.Errorf("no wildcard proof of %s", hdr.Name)
+			}
+		}
+	}
+
+	// Negative response. RFC 4035 5.4.
+	negative := r.Rcode == dns.RcodeNameError
+	if qType == dns.TypeANY {
+		negative = negative || !hasName(rrsets, sName)
+	} else {
+		negative = negative || !hasRRset(rrsets, sName, qType)
+	}
+	if negative {
+		proof, res, err := vc.verifyProof(r.Ns)
+		if err == errNoSig {
+			// No signed records in the authority section.
+			// The name must be in an insecure zone.
+			res, err = vc.nameSecurity(sName)
+			if res == Secure {
+				res, err = Bogus, errors.New("missing denial of existence")
+			}
+		}
+		if err := merge(res, err); err != nil {
+			return Bogus, fmt.Errorf("negative response of %s: %w", sName, err)
+		}
+		if res == Secure {
+			if proof.nsec3Insecure() {
+				result = Insecure
+			} else if r.Rcode == dns.RcodeNameError {
+				if !proof.proveNXDomain(sName) {
+					return Bogus, fmt.Errorf("no nxdomain proof of %s", sName)
+				}
+			} else if !proof.proveNoData(sName, qType) && !vc.optOut(proof, sName, qType) {
+				return Bogus, fmt.Errorf("no nodata proof of %s", sName)
+			}
+		}
+	}
+	return result, nil
+}
+
+// hasCoveringDNAME reports whether there is a DNAME RRset that can
+// synthesize a CNAME of name.
+func hasCoveringDNAME(rrsets [][]dns.RR, name string) bool {
+	for _, rrset := range rrsets {
+		if _, ok := rrset[0].(*dns.DNAME); ok {
+			owner := strings.ToLower(rrset[0].Header().Name)
+			if owner != name && dnsutils.IsSubDomain(owner, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasName(rrsets [][]dns.RR, name string) bool {
+	for _, rrset := range rrsets {
+		if strings.EqualFold(rrset[0].Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRRset(rrsets [][]dns.RR, name string, typ uint16) bool {
+	for _, rrset := range rrsets {
+		if dns.RRToType(rrset[0]) == typ && strings.EqualFold(rrset[0].Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCtx holds the states of a single validation.
+type validateCtx struct {
+	v        *Validator
+	ctx      context.Context
+	exchange Exchanger
+	queries  int
+
+	// visiting contains the zone keys and zone cuts that are being looked
+	// up, to break the loops in a malformed chain of trust.
+	visiting map[string]struct{}
+}
+
+func (vc *validateCtx) enter(k string) error {
+	if _, ok := vc.visiting[k]; ok {
+		return errChainLoop
+	}
+	vc.visiting[k] = struct{}{}
+	return nil
+}
+
+func (vc *validateCtx) leave(k string) {
+	delete(vc.visiting, k)
+}
+
+// verifyRRset verifies rrset by sigs.
+// It returns Insecure if the signer zone is insecure.
+func (vc *validateCtx) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) (Result, error) {
+	owner := rrset[0].Header().Name
+	if len(sigs) == 0 {
+		res, err := vc.nameSecurity(strings.ToLower(owner))
+		if res == Secure {
+			return Bogus, errNoSig
+		}
+		return res, err
+	}
+
+	var lastErr error
+	insecure := false
+	for _, sig := range sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dnsutils.IsSubDomain(signer, owner) {
+			lastErr = fmt.Errorf("signer %s is not an ancestor of %s", signer, owner)
+			continue
+		}
+		zk, err := vc.zoneKeys(signer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if zk.insecure {
+			insecure = true
+			continue
+		}
+		if err := verifySig(sig, zk.keys, rrset, vc.v.opts.Now()); err != nil {
+			lastErr = err
+			continue
+		}
+		return Secure, nil
+	}
+	if insecure {
+		return Insecure, nil
+	}
+	return Bogus, lastErr
+}
+
+// verifyProof verifies the NSEC, NSEC3 and SOA RRsets in the authority
+// section ns. It returns errNoSig if there is no signature.
+func (vc *validateCtx) verifyProof(ns []dns.RR) (*nsecProof, Result, error) {
+	rrsets, sigs := splitRRsets(ns)
+	result := Secure
+	var proofRRs []dns.RR
+	signed := false
+	for _, rrset := range rrsets {
+		typ := dns.RRToType(rrset[0])
+		switch typ {
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeSOA:
+		default:
+			continue
+		}
+		s := sigs[rrsetKey(strings.ToLower(rrset[0].Header().Name), typ)]
+		if len(s) == 0 {
+			continue
+		}
+		signed = true
+		res, err := vc.verifyRRset(rrset, s)
+		switch res {
+		case Bogus:
+			return nil, Bogus, err
+		case Insecure:
+			result = Insecure
+		}
+		if typ != dns.TypeSOA {
+			proofRRs = append(proofRRs, rrset...)
+		}
+	}
+	if !signed {
+		return nil, Bogus, errNoSig
+	}
+	return newNSECProof(proofRRs), result, nil
+}
+
+// optOut reports whether the NODATA response of a DS query is covered by
+// an opt-out NSEC3 span. RFC 5155 8.6.
+func (vc *validateCtx) optOut(proof *nsecProof, name string, qType uint16) bool {
+	if qType != dns.TypeDS {
+		return false
+	}
+	_, nc, ok := proof.closestEncloser(name)
+	return ok && nc.Flags&1 == 1
+}
+
+// zoneKeys returns the validated keys of zone.
+func (vc *validateCtx) zoneKeys(zone string) (*zoneKeys, error) {
+	v := vc.v
+	now := v.opts.Now()
+	if zk, ok := v.keyCache.Get(zone); ok && zk.expire.After(now) {
+		return zk, nil
+	}
+	if err := vc.enter("keys:" + zone); err != nil {
+		return nil, err
+	}
+	defer vc.leave("keys:" + zone)
+
+	var ds []*dns.DS
+	var trusted []*dns.DNSKEY
+	if a := v.anchors[zone]; a != nil {
+		ds, trusted = a.ds, a.keys
+	} else {
+		if zone == "." {
+			return nil, errors.New("no trust anchor of the root zone")
+		}
+		var (
+			insecure bool
+			err      error
+		)
+		ds, insecure, err = vc.lookupDS(zone)
+		if err != nil {
+			return nil, err
+		}
+		if insecure {
+			zk := &zoneKeys{insecure: true, expire: now.Add(minCacheTTL)}
+			v.keyCache.Add(zone, zk)
+			return zk, nil
+		}
+	}
+	if len(ds) > 0 && !anySupportedDS(ds) {
+		zk := &zoneKeys{insecure: true, expire: now.Add(minCacheTTL)}
+		v.keyCache.Add(zone, zk)
+		return zk, nil
+	}
+
+	r, err := vc.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dnskey of %s, %w", zone, err)
+	}
+	rrsets, sigs := splitRRsets(r.Answer)
+	var keyRRs []dns.RR
+	var keys []*dns.DNSKEY
+	for _, rrset := range rrsets {
+		if _, ok := rrset[0].(*dns.DNSKEY); ok && strings.EqualFold(rrset[0].Header().Name, zone) {
+			keyRRs = rrset
+			for _, rr := range rrset {
+				keys = append(keys, rr.(*dns.DNSKEY))
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no dnskey of %s", zone)
+	}
+
+	// Find the keys that match the DS records.
+	for _, k := range keys {
+		for _, d := range ds {
+			if matchDS(k, d) {
+				trusted = append(trusted, k)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no dnskey of %s matches its ds", zone)
+	}
+
+	keySigs := sigs[rrsetKey(zone, dns.TypeDNSKEY)]
+	var lastErr error = errNoSig
+	for _, sig := range keySigs {
+		if !strings.EqualFold(sig.SignerName, zone) {
+			continue
+		}
+		if lastErr = verifySig(sig, trusted, keyRRs, now); lastErr == nil {
+			zk := &zoneKeys{keys: keys, expire: now.Add(cacheTTL(keyRRs))}
+			v.keyCache.Add(zone, zk)
+			return zk, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid dnskey of %s, %w", zone, lastErr)
+}
+
+// lookupDS fetches and validates the DS records of zone.
+// insecure is true if there is a proof that zone has no DS record.
+func (vc *validateCtx) lookupDS(zone string) (ds []*dns.DS, insecure bool, err error) {
+	r, err := vc.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch ds of %s, %w", zone, err)
+	}
+	rrsets, sigs := splitRRsets(r.Answer)
+	for _, rrset := range rrsets {
+		if _, ok := rrset[0].(*dns.DS); !ok || !strings.EqualFold(rrset[0].Header().Name, zone) {
+			continue
+		}
+		// DS records are signed by the parent zone.
+		var dsSigs []*dns.RRSIG
+		for _, sig := range sigs[rrsetKey(zone, dns.TypeDS)] {
+			if !strings.EqualFold(sig.SignerName, zone) {
+				dsSigs = append(dsSigs, sig)
+			}
+		}
+		var res Result
+		if len(dsSigs) == 0 {
+			res, err = vc.nameSecurity(dnsutils.ParentName(zone))
+			if res == Secure {
+				res, err = Bogus, errNoSig
+			}
+		} else {
+			res, err = vc.verifyRRset(rrset, dsSigs)
+		}
+		switch res {
+		case Bogus:
+			return nil, false, fmt.Errorf("invalid ds of %s, %w", zone, err)
+		case Insecure:
+			return nil, true, nil
+		}
+		for _, rr := range rrset {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return ds, false, nil
+	}
+
+	kind, err := vc.classifyCut(zone, r)
+	if err != nil {
+		return nil, false, err
+	}
+	switch kind {
+	case cutInsecure:
+		return nil, true, nil
+	default:
+		return nil, false, fmt.Errorf("no ds of signed zone %s", zone)
+	}
+}
+
+// nameSecurity returns Secure if name is in a signed zone that chains to
+// a trust anchor, or Insecure if there is a proof that name is in an
+// unsigned zone or no trust anchor covers it.
+func (vc *validateCtx) nameSecurity(name string) (Result, error) {
+	// Find the closest trust anchor.
+	zone := ""
+	for n := name; ; n = dnsutils.ParentName(n) {
+		if _, ok := vc.v.anchors[n]; ok {
+			zone = n
+			break
+		}
+		if n == "." {
+			break
+		}
+	}
+	if len(zone) == 0 {
+		return Insecure, nil
+	}
+
+	// Walk down from the trust anchor to find the zone cuts.
+	for c := zone; c != name; {
+		c = nextCloserName(c, name)
+		kind, err := vc.lookupCut(c)
+		if err != nil {
+			return Bogus, err
+		}
+		switch kind {
+		case cutInsecure:
+			return Insecure, nil
+		case cutNXDomain:
+			return Secure, nil
+		}
+	}
+	return Secure, nil
+}
+
+// lookupCut finds out whether name is a zone cut.
+func (vc *validateCtx) lookupCut(name string) (cutKind, error) {
+	v := vc.v
+	now := v.opts.Now()
+	if zc, ok := v.cutCache.Get(name); ok && zc.expire.After(now) {
+		return zc.kind, nil
+	}
+	if err := vc.enter("cut:" + name); err != nil {
+		return 0, err
+	}
+	defer vc.leave("cut:" + name)
+
+	r, err := vc.query(name, dns.TypeDS)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch ds of %s, %w", name, err)
+	}
+
+	kind := cutNone
+	ttl := minCacheTTL
+	rrsets, _ := splitRRsets(r.Answer)
+	if hasRRset(rrsets, name, dns.TypeDS) {
+		zk, err := vc.zoneKeys(name) // This also validates the DS.
+		if err != nil {
+			return 0, err
+		}
+		if zk.insecure {
+			kind = cutInsecure
+		} else {
+			kind = cutSecure
+		}
+		ttl = time.Until(zk.expire)
+	} else {
+		kind, err = vc.classifyCut(name, r)
+		if err != nil {
+			return 0, err
+		}
+		if len(r.Ns) > 0 {
+			ttl = cacheTTL(r.Ns)
+		}
+	}
+	if ttl < minCacheTTL {
+		ttl = minCacheTTL
+	}
+	v.cutCache.Add(name, &zoneCut{kind: kind, expire: now.Add(ttl)})
+	return kind, nil
+}
+
+// classifyCut classifies name by the negative response r of its DS query.
+func (vc *validateCtx) classifyCut(name string, r *dns.Msg) (cutKind, error) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return 0, fmt.Errorf("ds query of %s failed with rcode %d", name, r.Rcode)
+	}
+
+	// The ds query is answered by a cname. A cname can not be a zone cut.
+	if rrsets, _ := splitRRsets(r.Answer); hasRRset(rrsets, name, dns.TypeCNAME) {
+		return cutNone, nil
+	}
+
+	proof, res, err := vc.verifyProof(r.Ns)
+	switch res {
+	case Bogus:
+		return 0, fmt.Errorf("invalid denial of ds of %s, %w", name, err)
+	case Insecure:
+		return cutInsecure, nil
+	}
+	if proof.nsec3Insecure() {
+		return cutInsecure, nil
+	}
+
+	if r.Rcode == dns.RcodeNameError {
+		if proof.proveNXDomain(name) {
+			return cutNXDomain, nil
+		}
+		return 0, fmt.Errorf("no nxdomain proof of %s", name)
+	}
+
+	if rr := proof.nsecMatch(name); rr != nil {
+		switch {
+		case hasType(rr.TypeBitMap, dns.TypeDS):
+			return 0, fmt.Errorf("nsec of %s denies its existing ds", name)
+		case hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA):
+			return cutInsecure, nil
+		}
+		return cutNone, nil
+	}
+	if rr := proof.nsec3Match(name); rr != nil {
+		switch {
+		case hasType(rr.TypeBitMap, dns.TypeDS):
+			return 0, fmt.Errorf("nsec3 of %s denies its existing ds", name)
+		case hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA):
+			return cutInsecure, nil
+		}
+		return cutNone, nil
+	}
+	if _, nc, ok := proof.closestEncloser(name); ok && nc.Flags&1 == 1 {
+		return cutInsecure, nil // Opt-out.
+	}
+	if proof.proveNoData(name, dns.TypeDS) {
+		return cutNone, nil // Wildcard
+	}
+	return 0, fmt.Errorf("no denial of ds of %s", name)
+}
+
+// query sends a DO query of name and qType by exchange.
+func (vc *validateCtx) query(name string, qType uint16) (*dns.Msg, error) {
+	if vc.queries >= maxQueries {
+		return nil, errMaxQueries
+	}
+	vc.queries++
+	q := dns.NewMsg(name, qType)
+	if q == nil {
+		return nil, fmt.Errorf("cannot build query of type %d", qType)
+	}
+	q.ID = dns.ID()
+	q.UDPSize = 1232
+	q.Security = true
+	r, err := vc.exchange(vc.ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("rcode %d", r.Rcode)
+	}
+	return r, nil
+}
+
+// verifySig verifies rrset by sig with one of keys.
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR, now time.Time) error {
+	if !sig.ValidityPeriod(now) {
+		return errors.New("signature expired or not yet valid")
+	}
+	lastErr := errors.New("no matched dnskey")
+	for _, k := range keys {
+		if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm || k.Flags&dns.ZONE == 0 {
+			continue
+		}
+		if lastErr = sig.Verify(k, rrset); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func matchDS(k *dns.DNSKEY, ds *dns.DS) bool {
+	if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+		return false
+	}
+	d := k.ToDS(ds.DigestType)
+	return d != nil && strings.EqualFold(d.Digest, ds.Digest)
+}
+
+// supportedAlgorithms are the signing algorithms that can be validated.
+var supportedAlgorithms = map[uint8]struct{}{
+	dns.RSASHA1:          {},
+	dns.RSASHA1NSEC3SHA1: {},
+	dns.RSASHA256:        {},
+	dns.RSASHA512:        {},
+	dns.ECDSAP256SHA256:  {},
+	dns.ECDSAP384SHA384:  {},
+	dns.ED25519:          {},
+}
+
+func anySupportedDS(ds []*dns.DS) bool {
+	for _, d := range ds {
+		if _, ok := supportedAlgorithms[d.Algorithm]; !ok {
+			continue
+		}
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			return true
+		}
+	}
+	return false
+}
+
+// splitRRsets groups rrs into RRsets. RRSIGs are grouped by the RRsets
+// they cover.
+func splitRRsets(rrs []dns.RR) (rrsets [][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	sigs = make(map[string][]*dns.RRSIG)
+	idx := make(map[string]int)
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := rrsetKey(owner, sig.TypeCovered)
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := rrsetKey(owner, dns.RRToType(rr))
+		if i, ok := idx[k]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+		idx[k] = len(rrsets)
+		rrsets = append(rrsets, []dns.RR{rr})
+	}
+	return rrsets, sigs
+}
+
+func rrsetKey(owner string, typ uint16) string {
+	return fmt.Sprintf("%s/%d", owner, typ)
+}
+
+// cacheTTL returns the min ttl of rrs within the cache ttl limits.
+func cacheTTL(rrs []dns.RR) time.Duration {
+	ttl := maxCacheTTL
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Header().TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if ttl < minCacheTTL {
+		ttl = minCacheTTL
+	}
+	return ttl
+}
+
+// StripDNSSEC removes DNSSEC records from r for a client that did not set
+// the DO bit, except the records of qType. RFC 4035 3.2.1.
+func StripDNSSEC(r *dns.Msg, qType uint16) {
+	r.Answer = stripDNSSEC(r.Answer, qType)
+	r.Ns = stripDNSSEC(r.Ns, 0)
+	r.Extra = stripDNSSEC(r.Extra, 0)
+}
+
+func stripDNSSEC(rrs []dns.RR, qType uint16) []dns.RR {
+	s := rrs[:0]
+	for _, rr := range rrs {
+		switch typ := dns.RRToType(rr); typ {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+			if typ != qType {
+				continue
+			}
+		}
+		s = append(s, rr)
+	}
+	return s
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+// The test zones are signed here with ed25519 (RFC 8080), so the tests
+// only depend on the zone parser of the dns library.
+
+const testTTL = 3600
+
+var (
+	testNow        = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	testInception  = testNow.AddDate(-1, 0, 0)
+	testExpiration = testNow.AddDate(1, 0, 0)
+)
+
+// testRR is a record and its canonical rdata.
+type testRR struct {
+	owner string
+	typ   uint16
+	rdata []byte
+	text  string // rdata in presentation format
+}
+
+func (r testRR) withOwner(owner string) testRR {
+	r.owner = owner
+	return r
+}
+
+func (r testRR) rr(t *testing.T) dns.RR {
+	t.Helper()
+	return parseTestRR(t, fmt.Sprintf("%s %d IN %s %s", r.owner, testTTL, dns.TypeToString[r.typ], r.text))
+}
+
+func parseTestRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	parser := dns.NewZoneParser(strings.NewReader(s), "", "")
+	rr, ok := parser.Next()
+	if !ok {
+		t.Fatalf("failed to parse %q, %v", s, parser.Err())
+	}
+	return rr
+}
+
+func testA(owner, addr string) testRR {
+	a := netip.MustParseAddr(addr).As4()
+	return testRR{owner: owner, typ: dns.TypeA, rdata: a[:], text: addr}
+}
+
+func testNSEC(owner, next string, types ...uint16) testRR {
+	next = strings.ToLower(next)
+	wire, _ := nameToWire(next)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	var bitmap [32]byte // Window 0 only.
+	maxLen := 0
+	var names []string
+	for _, typ := range types {
+		bitmap[typ/8] |= 0x80 >> (typ % 8)
+		maxLen = int(typ/8) + 1
+		names = append(names, dns.TypeToString[typ])
+	}
+	rdata := append(wire, 0, byte(maxLen))
+	rdata = append(rdata, bitmap[:maxLen]...)
+	return testRR{owner: owner, typ: dns.TypeNSEC, rdata: rdata, text: next + " " + strings.Join(names, " ")}
+}
+
+// testZone is a signed zone that has a single ed25519 key.
+type testZone struct {
+	name   string
+	priv   ed25519.PrivateKey
+	dnskey testRR
+	keyTag uint16
+}
+
+func newTestZone(name string) *testZone {
+	seed := sha256.Sum256([]byte(name))
+	priv := ed25519.NewKeyFromSeed(seed[:])
+	pub := priv.Public().(ed25519.PublicKey)
+	rdata := []byte{0x01, 0x01, 3, dns.ED25519} // Flags 257 (ZONE, SEP).
+	rdata = append(rdata, pub...)
+	return &testZone{
+		name: name,
+		priv: priv,
+		dnskey: testRR{
+			owner: name,
+			typ:   dns.TypeDNSKEY,
+			rdata: rdata,
+			text:  fmt.Sprintf("257 3 %d %s", dns.ED25519, base64.StdEncoding.EncodeToString(pub)),
+		},
+		keyTag: testKeyTag(rdata),
+	}
+}
+
+// testKeyTag computes the key tag of dnskey rdata. RFC 4034 Appendix B.
+func testKeyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac & 0xffff)
+}
+
+// ds returns the sha256 DS record of z. RFC 4034 5.1.4.
+func (z *testZone) ds() testRR {
+	wire, _ := nameToWire(z.name)
+	digest := sha256.Sum256(append(wire, z.dnskey.rdata...))
+	rdata := binary.BigEndian.AppendUint16(nil, z.keyTag)
+	rdata = append(rdata, dns.ED25519, dns.SHA256)
+	rdata = append(rdata, digest[:]...)
+	return testRR{
+		owner: z.name,
+		typ:   dns.TypeDS,
+		rdata: rdata,
+		text:  fmt.Sprintf("%d %d %d %s", z.keyTag, dns.ED25519, dns.SHA256, strings.ToUpper(hex.EncodeToString(digest[:]))),
+	}
+}
+
+// sign returns the RRSIG of the RRset rrs. RFC 4034 3.1.8.1.
+func (z *testZone) sign(t *testing.T, expiration time.Time, rrs ...testRR) dns.RR {
+	return z.signAs(t, rrs[0].owner, expiration, rrs...)
+}
+
+// signAs is sign, but the RRSIG is owned by owner. It is used to
+// expand wildcard records.
+func (z *testZone) signAs(t *testing.T, owner string, expiration time.Time, rrs ...testRR) dns.RR {
+	t.Helper()
+	signed := strings.ToLower(rrs[0].owner)
+	sigLabels := countLabels(signed)
+	if strings.HasPrefix(signed, "*.") {
+		sigLabels--
+	}
+	signer, _ := nameToWire(z.name)
+
+	data := binary.BigEndian.AppendUint16(nil, rrs[0].typ)
+	data = append(data, dns.ED25519, byte(sigLabels))
+	data = binary.BigEndian.AppendUint32(data, testTTL)
+	data = binary.BigEndian.AppendUint32(data, uint32(expiration.Unix()))
+	data = binary.BigEndian.AppendUint32(data, uint32(testInception.Unix()))
+	data = binary.BigEndian.AppendUint16(data, z.keyTag)
+	data = append(data, signer...)
+
+	sorted := append([]testRR(nil), rrs...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].rdata, sorted[j].rdata) < 0 })
+	ownerWire, _ := nameToWire(signed)
+	for _, r := range sorted {
+		data = append(data, ownerWire...)
+		data = binary.BigEndian.AppendUint16(data, r.typ)
+		data = binary.BigEndian.AppendUint16(data, dns.ClassINET)
+		data = binary.BigEndian.AppendUint32(data, testTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(r.rdata)))
+		data = append(data, r.rdata...)
+	}
+	sig := ed25519.Sign(z.priv, data)
+
+	const timeFormat = "20060102150405"
+	return parseTestRR(t, fmt.Sprintf("%s %d IN RRSIG %s %d %d %d %s %s %d %s %s",
+		owner, testTTL, dns.TypeToString[rrs[0].typ], dns.ED25519, sigLabels, testTTL,
+		expiration.UTC().Format(timeFormat), testInception.UTC().Format(timeFormat),
+		z.keyTag, z.name, base64.StdEncoding.EncodeToString(sig),
+	))
+}
+
+// testResolver answers the DNSKEY and DS queries of the validator.
+//
+//	example.          signed, the trust anchor.
+//	sub.example.      signed, has a DS in example.
+//	insecure.example. an unsigned delegation, proved by an NSEC.
+//	nods.example.     signed, but there is no DS and no proof in example.
+type testResolver struct {
+	example, sub, nods *testZone
+	responses          map[string]*dns.Msg
+}
+
+func newTestResolver(t *testing.T) *testResolver {
+	tr := &testResolver{
+		example:   newTestZone("example."),
+		sub:       newTestZone("sub.example."),
+		nods:      newTestZone("nods.example."),
+		responses: make(map[string]*dns.Msg),
+	}
+	for _, z := range []*testZone{tr.example, tr.sub, tr.nods} {
+		tr.add(z.name, dns.TypeDNSKEY, []dns.RR{z.dnskey.rr(t), z.sign(t, testExpiration, z.dnskey)}, nil)
+	}
+	subDS := tr.sub.ds()
+	tr.add("sub.example.", dns.TypeDS, []dns.RR{subDS.rr(t), tr.example.sign(t, testExpiration, subDS)}, nil)
+	nsec := testNSEC("insecure.example.", "nods.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)
+	tr.add("insecure.example.", dns.TypeDS, nil, []dns.RR{nsec.rr(t), tr.example.sign(t, testExpiration, nsec)})
+	tr.add("nods.example.", dns.TypeDS, nil, nil)
+	return tr
+}
+
+func (tr *testResolver) add(name string, qType uint16, answer, ns []dns.RR) {
+	r := new(dns.Msg)
+	r.Answer = answer
+	r.Ns = ns
+	tr.responses[fmt.Sprintf("%s/%d", name, qType)] = r
+}
+
+func (tr *testResolver) exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	question := q.Question[0]
+	k := fmt.Sprintf("%s/%d", strings.ToLower(question.Header().Name), dns.RRToType(question))
+	r, ok := tr.responses[k]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query %s", k)
+	}
+	return r, nil
+}
+
+func (tr *testResolver) newValidator(t *testing.T) *Validator {
+	t.Helper()
+	v, err := NewValidator(ValidatorOpts{
+		TrustAnchors: []dns.RR{tr.example.ds().rr(t)},
+		Now:          func() time.Time { return testNow },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestValidator_Validate(t *testing.T) {
+	tr := newTestResolver(t)
+
+	www := testA("www.example.", "192.0.2.1")
+	subHost := testA("host.sub.example.", "192.0.2.2")
+	insecureHost := testA("host.insecure.example.", "192.0.2.3")
+	nodsHost := testA("host.nods.example.", "192.0.2.4")
+	wildcard := testA("*.wild.example.", "192.0.2.5")
+	expanded := wildcard.withOwner("a.wild.example.")
+	wildcardNSEC := testNSEC("*.wild.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+
+	tests := []struct {
+		name   string
+		qName  string
+		answer []dns.RR
+		ns     []dns.RR
+		want   Result
+	}{
+		{
+			name:   "secure",
+			qName:  "www.example.",
+			answer: []dns.RR{www.rr(t), tr.example.sign(t, testExpiration, www)},
+			want:   Secure,
+		},
+		{
+			name:   "secure delegation",
+			qName:  "host.sub.example.",
+			answer: []dns.RR{subHost.rr(t), tr.sub.sign(t, testExpiration, subHost)},
+			want:   Secure,
+		},
+		{
+			name:   "insecure delegation",
+			qName:  "host.insecure.example.",
+			answer: []dns.RR{insecureHost.rr(t)},
+			want:   Insecure,
+		},
+		{
+			name:   "missing signature",
+			qName:  "www.example.",
+			answer: []dns.RR{www.rr(t)},
+			want:   Bogus,
+		},
+		{
+			name:   "bad signature",
+			qName:  "www.example.",
+			answer: []dns.RR{testA("www.example.", "192.0.2.100").rr(t), tr.example.sign(t, testExpiration, www)},
+			want:   Bogus,
+		},
+		{
+			name:   "signed by a wrong zone",
+			qName:  "host.sub.example.",
+			answer: []dns.RR{subHost.rr(t), tr.nods.signAs(t, "host.sub.example.", testExpiration, subHost)},
+			want:   Bogus,
+		},
+		{
+			name:   "expired signature",
+			qName:  "www.example.",
+			answer: []dns.RR{www.rr(t), tr.example.sign(t, testNow.Add(-time.Hour), www)},
+			want:   Bogus,
+		},
+		{
+			name:   "missing ds",
+			qName:  "host.nods.example.",
+			answer: []dns.RR{nodsHost.rr(t), tr.nods.sign(t, testExpiration, nodsHost)},
+			want:   Bogus,
+		},
+		{
+			name:   "wildcard expansion",
+			qName:  "a.wild.example.",
+			answer: []dns.RR{expanded.rr(t), tr.example.signAs(t, "a.wild.example.", testExpiration, wildcard)},
+			ns:     []dns.RR{wildcardNSEC.rr(t), tr.example.sign(t, testExpiration, wildcardNSEC)},
+			want:   Secure,
+		},
+		{
+			name:   "wildcard expansion without proof",
+			qName:  "a.wild.example.",
+			answer: []dns.RR{expanded.rr(t), tr.example.signAs(t, "a.wild.example.", testExpiration, wildcard)},
+			want:   Bogus,
+		},
+		{
+			name:   "wildcard expansion with a wrong proof",
+			qName:  "a.wild.example.",
+			answer: []dns.RR{expanded.rr(t), tr.example.signAs(t, "a.wild.example.", testExpiration, wildcard)},
+			ns: func() []dns.RR {
+				// Covers b.wild.example. but not a.wild.example..
+				nsec := testNSEC("a.wild.example.", "c.wild.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+				return []dns.RR{nsec.rr(t), tr.example.sign(t, testExpiration, nsec)}
+			}(),
+			want: Bogus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := dns.NewMsg(tt.qName, dns.TypeA)
+			r := new(dns.Msg)
+			r.Answer = tt.answer
+			r.Ns = tt.ns
+			got, err := tr.newValidator(t).Validate(context.Background(), q, r, tr.exchange)
+			if got != tt.want {
+				t.Fatalf("Validate() = %s, %v, want %s", got, err, tt.want)
+			}
+			if got == Bogus && err == nil {
+				t.Fatal("bogus result without an error")
+			}
+		})
+	}
+}
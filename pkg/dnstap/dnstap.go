@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dnstap encodes dnstap messages and sends them over Frame Streams.
+// See https://dnstap.info.
+package dnstap
+
+import (
+	"net/netip"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentType is the Frame Streams content type of dnstap.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// MessageType is the dnstap Message.Type.
+type MessageType int
+
+const (
+	MessageAuthQuery         MessageType = 1
+	MessageAuthResponse      MessageType = 2
+	MessageResolverQuery     MessageType = 3
+	MessageResolverResponse  MessageType = 4
+	MessageClientQuery       MessageType = 5
+	MessageClientResponse    MessageType = 6
+	MessageForwarderQuery    MessageType = 7
+	MessageForwarderResponse MessageType = 8
+)
+
+// SocketProtocol is the dnstap SocketProtocol.
+type SocketProtocol int
+
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDOT SocketProtocol = 3
+	ProtocolDOH SocketProtocol = 4
+	ProtocolDOQ SocketProtocol = 7
+)
+
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Message is a dnstap message. Zero value fields are omitted.
+type Message struct {
+	Type            MessageType
+	SocketProtocol  SocketProtocol
+	QueryAddr       netip.AddrPort
+	ResponseAddr    netip.AddrPort
+	QueryTime       time.Time
+	QueryMessage    []byte
+	ResponseTime    time.Time
+	ResponseMessage []byte
+}
+
+// Marshal encodes m into a dnstap.Dnstap protobuf message.
+func (m *Message) Marshal(identity, version []byte) []byte {
+	var msg []byte
+	msg = appendVarint(msg, 1, uint64(m.Type))
+	if f := socketFamily(m.QueryAddr, m.ResponseAddr); f != 0 {
+		msg = appendVarint(msg, 2, f)
+	}
+	if m.SocketProtocol != 0 {
+		msg = appendVarint(msg, 3, uint64(m.SocketProtocol))
+	}
+	if a := m.QueryAddr.Addr(); a.IsValid() {
+		msg = protowire.AppendTag(msg, 4, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, a.Unmap().AsSlice())
+	}
+	if a := m.ResponseAddr.Addr(); a.IsValid() {
+		msg = protowire.AppendTag(msg, 5, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, a.Unmap().AsSlice())
+	}
+	if p := m.QueryAddr.Port(); p != 0 {
+		msg = appendVarint(msg, 6, uint64(p))
+	}
+	if p := m.ResponseAddr.Port(); p != 0 {
+		msg = appendVarint(msg, 7, uint64(p))
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendTime(msg, 8, 9, m.QueryTime)
+	}
+	if m.QueryMessage != nil {
+		msg = protowire.AppendTag(msg, 10, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, m.QueryMessage)
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendTime(msg, 12, 13, m.ResponseTime)
+	}
+	if m.ResponseMessage != nil {
+		msg = protowire.AppendTag(msg, 14, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, m.ResponseMessage)
+	}
+
+	var b []byte
+	if len(identity) > 0 {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, identity)
+	}
+	if len(version) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, version)
+	}
+	b = protowire.AppendTag(b, 14, protowire.BytesType)
+	b = protowire.AppendBytes(b, msg)
+	b = appendVarint(b, 15, dnstapTypeMessage)
+	return b
+}
+
+func socketFamily(addrs ...netip.AddrPort) uint64 {
+	for _, a := range addrs {
+		if !a.Addr().IsValid() {
+			continue
+		}
+		if a.Addr().Unmap().Is4() {
+			return socketFamilyINET
+		}
+		return socketFamilyINET6
+	}
+	return 0
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendTime(b []byte, secNum, nsecNum protowire.Number, t time.Time) []byte {
+	b = appendVarint(b, secNum, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecNum, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// collect accepts one Frame Streams connection on l and returns the
+// received data frames after the writer stopped.
+func collect(t *testing.T, l net.Listener) <-chan [][]byte {
+	ch := make(chan [][]byte, 1)
+	go func() {
+		defer close(ch)
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		if typ, _, err := readControl(c); err != nil || typ != controlReady {
+			t.Errorf("want READY, got %d, %v", typ, err)
+			return
+		}
+		writeControl(c, controlAccept, ContentType)
+		if typ, _, err := readControl(c); err != nil || typ != controlStart {
+			t.Errorf("want START, got %d, %v", typ, err)
+			return
+		}
+
+		var frames [][]byte
+		for {
+			var h [4]byte
+			if _, err := io.ReadFull(c, h[:]); err != nil {
+				t.Error(err)
+				return
+			}
+			l := binary.BigEndian.Uint32(h[:])
+			if l == 0 { // control frame
+				b := make([]byte, 4)
+				io.ReadFull(c, b)
+				b = make([]byte, binary.BigEndian.Uint32(b))
+				io.ReadFull(c, b)
+				if binary.BigEndian.Uint32(b) != controlStop {
+					t.Error("want STOP")
+				}
+				writeControl(c, controlFinish, "")
+				ch <- frames
+				return
+			}
+			b := make([]byte, l)
+			if _, err := io.ReadFull(c, b); err != nil {
+				t.Error(err)
+				return
+			}
+			frames = append(frames, b)
+		}
+	}()
+	return ch
+}
+
+func TestOutput(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	frames := collect(t, l)
+
+	o, err := NewOutput(OutputOpts{Addr: addr, Identity: "mosdns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := []byte{1, 2, 3}
+	m := &Message{
+		Type:           MessageClientQuery,
+		SocketProtocol: ProtocolUDP,
+		QueryAddr:      netip.AddrPortFrom(netip.MustParseAddr("192.168.1.1"), 0),
+		QueryTime:      time.Unix(100, 5),
+		QueryMessage:   query,
+	}
+	if !o.Send(m) {
+		t.Fatal("message dropped")
+	}
+	o.Close()
+
+	var got [][]byte
+	select {
+	case got = <-frames:
+	case <-time.After(time.Second * 5):
+		t.Fatal("collector timeout")
+	}
+	if len(got) != 1 {
+		t.Fatalf("want 1 frame, got %d", len(got))
+	}
+	if !bytes.Equal(got[0], m.Marshal([]byte("mosdns"), nil)) {
+		t.Fatal("unexpected frame")
+	}
+}
+
+func TestMessage_Marshal(t *testing.T) {
+	m := &Message{
+		Type:            MessageForwarderResponse,
+		SocketProtocol:  ProtocolDOT,
+		ResponseAddr:    netip.MustParseAddrPort("[2001:db8::1]:853"),
+		ResponseTime:    time.Unix(100, 5),
+		ResponseMessage: []byte{4, 5, 6},
+	}
+	b := m.Marshal([]byte("id"), []byte("v1"))
+
+	fields := parseFields(t, b)
+	if string(fields[1]) != "id" || string(fields[2]) != "v1" {
+		t.Fatal("unexpected identity or version")
+	}
+	msg := parseFields(t, fields[14])
+	if v, _ := protowire.ConsumeVarint(msg[1]); v != uint64(MessageForwarderResponse) {
+		t.Fatalf("unexpected message type %d", v)
+	}
+	if v, _ := protowire.ConsumeVarint(msg[2]); v != socketFamilyINET6 {
+		t.Fatalf("unexpected socket family %d", v)
+	}
+	if !bytes.Equal(msg[5], netip.MustParseAddr("2001:db8::1").AsSlice()) {
+		t.Fatal("unexpected response address")
+	}
+	if v, _ := protowire.ConsumeVarint(msg[7]); v != 853 {
+		t.Fatalf("unexpected response port %d", v)
+	}
+	if v, _ := protowire.ConsumeFixed32(msg[13]); v != 5 {
+		t.Fatalf("unexpected response nsec %d", v)
+	}
+	if !bytes.Equal(msg[14], []byte{4, 5, 6}) {
+		t.Fatal("unexpected response message")
+	}
+}
+
+// parseFields returns the raw values of the fields in b.
+func parseFields(t *testing.T, b []byte) map[protowire.Number][]byte {
+	t.Helper()
+	m := make(map[protowire.Number][]byte)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		vn := protowire.ConsumeFieldValue(num, typ, b)
+		if vn < 0 {
+			t.Fatal(protowire.ParseError(vn))
+		}
+		v := b[:vn]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		m[num] = v
+		b = b[vn:]
+	}
+	return m
+}
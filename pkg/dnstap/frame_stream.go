@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Frame Streams control frame types.
+const (
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+
+	controlFieldContentType = 1
+
+	maxControlFrameSize = 512
+	handshakeTimeout    = time.Second * 5
+)
+
+// FrameWriter writes data frames to a bidirectional Frame Streams
+// connection. FrameWriter is not safe for concurrent use.
+type FrameWriter struct {
+	c net.Conn
+	w *bufio.Writer
+}
+
+// NewFrameWriter performs the READY/ACCEPT/START handshake on c.
+func NewFrameWriter(c net.Conn) (*FrameWriter, error) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	w := bufio.NewWriter(c)
+	if err := writeControl(w, controlReady, ContentType); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	typ, contentTypes, err := readControl(c)
+	if err != nil {
+		return nil, err
+	}
+	if typ != controlAccept {
+		return nil, fmt.Errorf("unexpected control frame type %d, want ACCEPT", typ)
+	}
+	accepted := false
+	for _, ct := range contentTypes {
+		if ct == ContentType {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return nil, fmt.Errorf("content type %s is not accepted", ContentType)
+	}
+	if err := writeControl(w, controlStart, ContentType); err != nil {
+		return nil, err
+	}
+	return &FrameWriter{c: c, w: w}, nil
+}
+
+// WriteFrame writes a data frame. The frame is buffered, call Flush
+// to send it.
+func (fw *FrameWriter) WriteFrame(b []byte) error {
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(len(b)))
+	if _, err := fw.w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(b)
+	return err
+}
+
+func (fw *FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// Close sends a STOP frame, waits for the FINISH frame and closes the
+// connection.
+func (fw *FrameWriter) Close() error {
+	defer fw.c.Close()
+	fw.c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeControl(fw.w, controlStop, ""); err != nil {
+		return err
+	}
+	if err := fw.w.Flush(); err != nil {
+		return err
+	}
+	typ, _, err := readControl(fw.c)
+	if err != nil {
+		return err
+	}
+	if typ != controlFinish {
+		return fmt.Errorf("unexpected control frame type %d, want FINISH", typ)
+	}
+	return nil
+}
+
+// writeControl writes a control frame with an optional content type field.
+func writeControl(w io.Writer, typ uint32, contentType string) error {
+	b := make([]byte, 0, 20+len(contentType))
+	b = binary.BigEndian.AppendUint32(b, 0) // escape
+	l := 4
+	if len(contentType) > 0 {
+		l += 8 + len(contentType)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(l))
+	b = binary.BigEndian.AppendUint32(b, typ)
+	if len(contentType) > 0 {
+		b = binary.BigEndian.AppendUint32(b, controlFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readControl reads a control frame and returns its type and content types.
+func readControl(r io.Reader) (uint32, []string, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(h[:4]) != 0 {
+		return 0, nil, errors.New("not a control frame")
+	}
+	l := binary.BigEndian.Uint32(h[4:])
+	if l < 4 || l > maxControlFrameSize {
+		return 0, nil, fmt.Errorf("invalid control frame length %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	typ := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	var contentTypes []string
+	for len(b) >= 8 {
+		field := binary.BigEndian.Uint32(b)
+		fl := binary.BigEndian.Uint32(b[4:])
+		b = b[8:]
+		if uint32(len(b)) < fl {
+			return 0, nil, errors.New("invalid control field length")
+		}
+		if field == controlFieldContentType {
+			contentTypes = append(contentTypes, string(b[:fl]))
+		}
+		b = b[fl:]
+	}
+	return typ, contentTypes, nil
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	defaultQueueSize = 4096
+	dialTimeout      = time.Second * 5
+	retryInterval    = time.Second * 5
+)
+
+type OutputOpts struct {
+	// Network is "unix" or "tcp". Default is "unix".
+	Network string
+	// Addr is the socket path or the tcp address of the collector. Required.
+	Addr string
+
+	Identity string
+	Version  string
+
+	// QueueSize is the maximum number of messages that wait to be sent.
+	// Default is 4096.
+	QueueSize int
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Output sends Messages to a Frame Streams collector in background.
+// Messages are dropped if the queue is full or the collector is
+// unreachable. So a slow collector never blocks the caller.
+type Output struct {
+	opts     OutputOpts
+	identity []byte
+	version  []byte
+
+	queue chan *Message
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+func NewOutput(opts OutputOpts) (*Output, error) {
+	if len(opts.Network) == 0 {
+		opts.Network = "unix"
+	}
+	if opts.Network != "unix" && opts.Network != "tcp" {
+		return nil, errors.New("network must be unix or tcp")
+	}
+	if len(opts.Addr) == 0 {
+		return nil, errors.New("missing addr")
+	}
+	utils.SetDefaultNum(&opts.QueueSize, defaultQueueSize)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	o := &Output{
+		opts:        opts,
+		identity:    []byte(opts.Identity),
+		version:     []byte(opts.Version),
+		queue:       make(chan *Message, opts.QueueSize),
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go o.run()
+	return o, nil
+}
+
+// Send queues m. It never blocks. It returns false if m was dropped.
+// m must not be modified after the call.
+func (o *Output) Send(m *Message) bool {
+	select {
+	case o.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *Output) run() {
+	defer close(o.done)
+	for {
+		fw, err := o.connect()
+		if err != nil {
+			o.opts.Logger.Warn("failed to connect to dnstap collector", zap.String("addr", o.opts.Addr), zap.Error(err))
+			select {
+			case <-time.After(retryInterval):
+				continue
+			case <-o.closeNotify:
+				return
+			}
+		}
+		if closed := o.writeLoop(fw); closed {
+			return
+		}
+	}
+}
+
+func (o *Output) connect() (*FrameWriter, error) {
+	c, err := net.DialTimeout(o.opts.Network, o.opts.Addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := NewFrameWriter(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return fw, nil
+}
+
+// writeLoop writes queued messages to fw until an error occurs or o is
+// closed. It reports whether o was closed.
+func (o *Output) writeLoop(fw *FrameWriter) (closed bool) {
+	write := func(m *Message) error {
+		if err := fw.WriteFrame(m.Marshal(o.identity, o.version)); err != nil {
+			return err
+		}
+		if len(o.queue) == 0 {
+			return fw.Flush()
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case m := <-o.queue:
+			if err := write(m); err != nil {
+				o.opts.Logger.Warn("failed to write dnstap message", zap.Error(err))
+				fw.c.Close()
+				return false
+			}
+		case <-o.closeNotify:
+			// Flush the remaining messages.
+			for {
+				select {
+				case m := <-o.queue:
+					if err := write(m); err != nil {
+						fw.c.Close()
+						return true
+					}
+				default:
+					if err := fw.Close(); err != nil {
+						o.opts.Logger.Warn("failed to close dnstap connection", zap.Error(err))
+					}
+					return true
+				}
+			}
+		}
+	}
+}
+
+// Close flushes the queued messages and closes the connection.
+func (o *Output) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.closeNotify)
+	})
+	<-o.done
+	return nil
+}
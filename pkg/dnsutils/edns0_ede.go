@@ -0,0 +1,39 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import "codeberg.org/miekg/dns"
+
+// Extended DNS Error codes. RFC 8914.
+const (
+	EDEStaleAnswer   uint16 = 3
+	EDEStaleNXDomain uint16 = 19
+)
+
+// AddEDE adds an Extended DNS Error option to m. m must be an EDNS0 msg.
+// If m already has an EDE option with the same code, AddEDE does nothing.
+func AddEDE(m *dns.Msg, code uint16, text string) {
+	for _, o := range m.Pseudo {
+		if ede, ok := o.(*dns.EDE); ok && ede.InfoCode == code {
+			return
+		}
+	}
+	m.Pseudo = append(m.Pseudo, &dns.EDE{InfoCode: code, ExtraText: text})
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import "strings"
+
+// ParentName returns the parent of fqdn name. The parent of root is root.
+func ParentName(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 || i == len(name)-1 {
+		return "."
+	}
+	return name[i+1:]
+}
+
+// WildcardName returns the wildcard name "*.name" of fqdn name.
+func WildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// IsSubDomain reports whether fqdn child is parent or a sub domain of parent.
+// Names are compared case-insensitively.
+func IsSubDomain(parent, child string) bool {
+	if parent == "." {
+		return true
+	}
+	if len(child) < len(parent) || !strings.EqualFold(child[len(child)-len(parent):], parent) {
+		return false
+	}
+	return len(child) == len(parent) || child[len(child)-len(parent)-1] == '.'
+}
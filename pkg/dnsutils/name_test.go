@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import "testing"
+
+func TestParentName(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.example.com.": "example.com.",
+		"com.":           ".",
+		".":              ".",
+	} {
+		if got := ParentName(name); got != want {
+			t.Errorf("ParentName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestIsSubDomain(t *testing.T) {
+	tests := []struct {
+		parent, child string
+		want          bool
+	}{
+		{".", "example.com.", true},
+		{"example.com.", "example.com.", true},
+		{"example.com.", "a.b.Example.COM.", true},
+		{"example.com.", "aexample.com.", false},
+		{"example.com.", "com.", false},
+		{"a.example.com.", "example.com.", false},
+	}
+	for _, tt := range tests {
+		if got := IsSubDomain(tt.parent, tt.child); got != tt.want {
+			t.Errorf("IsSubDomain(%q, %q) = %v, want %v", tt.parent, tt.child, got, tt.want)
+		}
+	}
+}
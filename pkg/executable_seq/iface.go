@@ -23,6 +23,7 @@ import (
 	"context"
 
 	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/tracing"
 )
 
 // Executable represents something that is executable.
@@ -47,6 +48,48 @@ type ExecutableNodeWrapper struct {
 	NodeLinker
 }
 
+// Exec executes the Executable in a child span if the query is traced.
+// The span only covers the Executable itself. It ends when the Executable
+// calls the next node, so the rest of the chain is not in it.
+func (w *ExecutableNodeWrapper) Exec(ctx context.Context, qCtx *query_context.Context, next ExecChainNode) error {
+	parent := tracing.SpanFromContext(ctx)
+	if parent == nil {
+		return w.Executable.Exec(ctx, qCtx, next)
+	}
+	name := "exec"
+	var attrs []tracing.Attr
+	if p, ok := w.Executable.(interface {
+		Tag() string
+		Type() string
+	}); ok {
+		name = "exec " + p.Tag()
+		attrs = append(attrs, tracing.String("mosdns.plugin.tag", p.Tag()), tracing.String("mosdns.plugin.type", p.Type()))
+	}
+	ctx, span := tracing.StartSpan(ctx, tracing.SpanKindInternal, name, attrs...)
+	if next != nil {
+		next = &spanEndNode{ExecChainNode: next, span: span, parent: parent}
+	}
+	err := w.Executable.Exec(ctx, qCtx, next)
+	span.End(err)
+	return err
+}
+
+// spanEndNode ends span before it executes the next node. The next node
+// runs in the parent span of span.
+type spanEndNode struct {
+	ExecChainNode
+	span   *tracing.Span
+	parent *tracing.Span
+}
+
+func (n *spanEndNode) Exec(ctx context.Context, qCtx *query_context.Context, next ExecChainNode) error {
+	if tracing.SpanFromContext(ctx) == n.span {
+		n.span.End(nil)
+		ctx = tracing.ContextWithSpan(ctx, n.parent)
+	}
+	return n.ExecChainNode.Exec(ctx, qCtx, next)
+}
+
 // WrapExecutable wraps a Executable to a ExecChainNode.
 func WrapExecutable(e Executable) ExecChainNode {
 	if ecn, ok := e.(ExecChainNode); ok {
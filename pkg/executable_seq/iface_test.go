@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package executable_seq
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/tracing"
+)
+
+// spanRecorder records the span in ctx and calls the next node.
+type spanRecorder struct {
+	span *tracing.Span
+}
+
+func (r *spanRecorder) Exec(ctx context.Context, qCtx *query_context.Context, next ExecChainNode) error {
+	r.span = tracing.SpanFromContext(ctx)
+	return ExecChain(ctx, qCtx, next)
+}
+
+func Test_ExecutableNodeWrapper_span(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	tracer, err := tracing.NewTracer(tracing.Opts{Endpoint: srv.URL, SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracer.Close()
+
+	e1, e2 := new(spanRecorder), new(spanRecorder)
+	n1, n2 := WrapExecutable(e1), WrapExecutable(e2)
+	n1.LinkNext(n2)
+
+	ctx, root := tracer.StartRoot(context.Background(), true, tracing.SpanKindServer, "query")
+	qCtx := query_context.NewContext(dns.NewMsg("example.com.", dns.TypeA), nil)
+	if err := ExecChain(ctx, qCtx, n1); err != nil {
+		t.Fatal(err)
+	}
+	root.End(nil)
+
+	if e1.span == nil || e1.span == root {
+		t.Fatal("the node should run in its own span")
+	}
+	if e2.span == nil || e2.span == e1.span {
+		t.Fatal("the next node should not run in the span of the previous node")
+	}
+	if e2.span == root {
+		t.Fatal("the next node should run in its own span")
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_observer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/concurrent_limiter"
+	"github.com/pmkol/mosdns-x/pkg/ext_exec"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	callbackTimeout = time.Second * 30
+)
+
+type BadIPObserverOpts struct {
+	// Threshold is the number of bad events a ip range can trigger in
+	// Interval before it gets banned. Threshold must be positive.
+	Threshold int
+	Interval  time.Duration // Default is 10s.
+	TTL       time.Duration // Default is 10min.
+
+	// OnUpdateCallBack will be called each time the ban list is changed.
+	// The path of a temporary file that contains the current ban list,
+	// one prefix per line, will be appended to its args.
+	OnUpdateCallBack string
+
+	// IP masks to aggregate an IP range.
+	IPv4Mask int // Default is 32.
+	IPv6Mask int // Default is 48.
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+func (opts *BadIPObserverOpts) Init() error {
+	if opts.Threshold <= 0 {
+		return errors.New("threshold must be positive")
+	}
+	if m := opts.IPv4Mask; m < 0 || m > 32 {
+		return fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
+	}
+	if m := opts.IPv6Mask; m < 0 || m > 128 {
+		return fmt.Errorf("invalid ipv6 mask %d, should be 0~128", m)
+	}
+	utils.SetDefaultNum(&opts.Interval, time.Second*10)
+	utils.SetDefaultNum(&opts.TTL, time.Minute*10)
+	utils.SetDefaultNum(&opts.IPv4Mask, 32)
+	utils.SetDefaultNum(&opts.IPv6Mask, 48)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return nil
+}
+
+var _ IPObserver = (*BadIPObserver)(nil)
+
+// BadIPObserver counts bad events per ip range and bans the
+// ranges that trigger more than Threshold events in Interval.
+type BadIPObserver struct {
+	opts    BadIPObserverOpts
+	limiter *concurrent_limiter.HPClientLimiter
+
+	m       sync.RWMutex
+	banned  map[netip.Prefix]time.Time // expiration time
+	updated chan struct{}
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// BanEntry is a banned ip range.
+type BanEntry struct {
+	Prefix     netip.Prefix
+	Expiration time.Time
+}
+
+func NewBadIPObserver(opts BadIPObserverOpts) (*BadIPObserver, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	limiter, err := concurrent_limiter.NewHPClientLimiter(concurrent_limiter.HPLimiterOpts{
+		Threshold: opts.Threshold,
+		Interval:  opts.Interval,
+		IPv4Mask:  opts.IPv4Mask,
+		IPv6Mask:  opts.IPv6Mask,
+
+		CleanerInterval: -1, // cleaned by BadIPObserver.GC
+		IdleTimeout:     opts.Interval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	o := &BadIPObserver{
+		opts:        opts,
+		limiter:     limiter,
+		banned:      make(map[netip.Prefix]time.Time),
+		updated:     make(chan struct{}, 1),
+		closeNotify: make(chan struct{}),
+	}
+	go o.cleanerLoop()
+	go o.callbackLoop()
+	return o, nil
+}
+
+// Observe records a bad event from addr.
+func (o *BadIPObserver) Observe(addr netip.Addr) {
+	if !addr.IsValid() {
+		return
+	}
+	if o.limiter.AcquireToken(addr) {
+		return
+	}
+	o.ban(o.limiter.ApplyMask(addr), time.Now())
+}
+
+// IsBanned implements IPObserver.
+func (o *BadIPObserver) IsBanned(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	p := o.limiter.ApplyMask(addr)
+	o.m.RLock()
+	expiration, ok := o.banned[p]
+	o.m.RUnlock()
+	return ok && expiration.After(time.Now())
+}
+
+// BanList returns a sorted copy of current banned ip ranges.
+func (o *BadIPObserver) BanList() []BanEntry {
+	now := time.Now()
+	o.m.RLock()
+	l := make([]BanEntry, 0, len(o.banned))
+	for p, expiration := range o.banned {
+		if expiration.After(now) {
+			l = append(l, BanEntry{Prefix: p, Expiration: expiration})
+		}
+	}
+	o.m.RUnlock()
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Prefix.Addr().Less(l[j].Prefix.Addr())
+	})
+	return l
+}
+
+func (o *BadIPObserver) ban(p netip.Prefix, now time.Time) {
+	o.m.Lock()
+	if expiration, ok := o.banned[p]; ok && expiration.After(now) {
+		o.m.Unlock()
+		return
+	}
+	o.banned[p] = now.Add(o.opts.TTL)
+	o.m.Unlock()
+
+	o.opts.Logger.Info("ip range banned", zap.Stringer("prefix", p), zap.Duration("ttl", o.opts.TTL))
+	o.notifyUpdate()
+}
+
+// GC removes expired bans and counters.
+func (o *BadIPObserver) GC(now time.Time) {
+	o.limiter.GC(now)
+
+	removed := false
+	o.m.Lock()
+	for p, expiration := range o.banned {
+		if !expiration.After(now) {
+			delete(o.banned, p)
+			removed = true
+		}
+	}
+	o.m.Unlock()
+	if removed {
+		o.notifyUpdate()
+	}
+}
+
+func (o *BadIPObserver) notifyUpdate() {
+	select {
+	case o.updated <- struct{}{}:
+	default:
+	}
+}
+
+func (o *BadIPObserver) cleanerLoop() {
+	ticker := time.NewTicker(o.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			o.GC(now)
+		case <-o.closeNotify:
+			return
+		}
+	}
+}
+
+func (o *BadIPObserver) callbackLoop() {
+	for {
+		select {
+		case <-o.updated:
+			if len(o.opts.OnUpdateCallBack) == 0 {
+				continue
+			}
+			if err := o.runCallback(); err != nil {
+				o.opts.Logger.Warn("failed to run on_update_callback", zap.Error(err))
+			}
+		case <-o.closeNotify:
+			return
+		}
+	}
+}
+
+func (o *BadIPObserver) runCallback() error {
+	f, err := os.CreateTemp("", "mosdns_bad_ip_*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	sb := new(strings.Builder)
+	for _, e := range o.BanList() {
+		sb.WriteString(e.Prefix.String())
+		sb.WriteByte('\n')
+	}
+	_, err = f.WriteString(sb.String())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	out, err := ext_exec.GetOutputFromCmd(ctx, o.opts.OnUpdateCallBack+" "+f.Name())
+	if err != nil {
+		return err
+	}
+	o.opts.Logger.Debug("on_update_callback finished", zap.ByteString("output", out))
+	return nil
+}
+
+// Close stops BadIPObserver's background goroutines.
+// Close always returns a nil error.
+func (o *BadIPObserver) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.closeNotify)
+		o.limiter.Close()
+	})
+	return nil
+}
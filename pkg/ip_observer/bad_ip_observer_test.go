@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_observer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_BadIPObserver(t *testing.T) {
+	o, err := NewBadIPObserver(BadIPObserverOpts{
+		Threshold: 4,
+		Interval:  time.Hour,
+		TTL:       time.Minute,
+		IPv4Mask:  24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	bad := netip.MustParseAddr("192.0.2.1")
+	sameRange := netip.MustParseAddr("192.0.2.254")
+	other := netip.MustParseAddr("198.51.100.1")
+
+	for i := 0; i < 4; i++ {
+		o.Observe(bad)
+	}
+	if o.IsBanned(bad) {
+		t.Fatal("banned before reaching the threshold")
+	}
+
+	o.Observe(sameRange)
+	if !o.IsBanned(bad) || !o.IsBanned(sameRange) {
+		t.Fatal("ip range should be banned")
+	}
+	if o.IsBanned(other) {
+		t.Fatal("unrelated ip should not be banned")
+	}
+
+	l := o.BanList()
+	if len(l) != 1 || l[0].Prefix != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Fatalf("unexpected ban list %v", l)
+	}
+
+	o.GC(time.Now().Add(time.Hour)) // all bans should be expired
+	if o.IsBanned(bad) || len(o.BanList()) != 0 {
+		t.Fatal("gc test failed")
+	}
+}
+
+func Test_BadIPObserver_longInterval(t *testing.T) {
+	o, err := NewBadIPObserver(BadIPObserverOpts{
+		Threshold: 2,
+		Interval:  time.Minute,
+		TTL:       time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	bad := netip.MustParseAddr("192.0.2.1")
+	o.Observe(bad)
+	o.Observe(bad)
+	o.GC(time.Now().Add(time.Second * 30)) // counters must survive gc within the interval
+	o.Observe(bad)
+	if !o.IsBanned(bad) {
+		t.Fatal("ip should be banned within the interval")
+	}
+}
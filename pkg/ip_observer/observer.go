@@ -26,6 +26,9 @@ import (
 type IPObserver interface {
 	// Observe notifies the IPObserver. addr must be valid.
 	Observe(addr netip.Addr)
+
+	// IsBanned reports whether addr is in a banned ip range.
+	IsBanned(addr netip.Addr) bool
 }
 
 type NopObserver struct{}
@@ -34,3 +37,6 @@ func NewNopObserver() NopObserver {
 	return NopObserver{}
 }
 func (n NopObserver) Observe(_ netip.Addr) {}
+func (n NopObserver) IsBanned(_ netip.Addr) bool {
+	return false
+}
@@ -0,0 +1,329 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+var _ WriteableMatcher[any] = (*AdblockMatcher[any])(nil)
+
+// AdblockMatcher is a domain matcher built from an adblock style rule list
+// (AdGuard/uBlock syntax).
+// A domain is matched if it is matched by a block rule and is not matched
+// by an exception rule (@@). Block rules with the $important modifier
+// override exception rules. In a MatcherGroup, the exception and important
+// rules apply to all the matchers of the group.
+type AdblockMatcher[T any] struct {
+	block     *MixMatcher[T]
+	important *MixMatcher[T]
+	allow     *MixMatcher[T]
+}
+
+func NewAdblockMatcher[T any]() *AdblockMatcher[T] {
+	return &AdblockMatcher[T]{
+		block:     NewMixMatcher[T](),
+		important: NewMixMatcher[T](),
+		allow:     NewMixMatcher[T](),
+	}
+}
+
+func (m *AdblockMatcher[T]) Match(s string) (v T, ok bool) {
+	if v, ok := m.matchImportant(s); ok {
+		return v, true
+	}
+	if m.matchException(s) {
+		return v, false
+	}
+	return m.matchBlock(s)
+}
+
+func (m *AdblockMatcher[T]) matchImportant(s string) (v T, ok bool) {
+	return m.important.Match(s)
+}
+
+func (m *AdblockMatcher[T]) matchException(s string) bool {
+	_, ok := m.allow.Match(s)
+	return ok
+}
+
+func (m *AdblockMatcher[T]) matchBlock(s string) (v T, ok bool) {
+	return m.block.Match(s)
+}
+
+// Len returns the number of block rules.
+func (m *AdblockMatcher[T]) Len() int {
+	return m.block.Len() + m.important.Len()
+}
+
+// Add adds an adblock rule to m. Rules that are not supported,
+// e.g. cosmetic rules, url rules and rules with unsupported modifiers,
+// are ignored.
+func (m *AdblockMatcher[T]) Add(rule string, v T) error {
+	_, err := m.add(rule, func() T { return v })
+	return err
+}
+
+// add adds rule to m. newV is only called if rule is supported.
+func (m *AdblockMatcher[T]) add(rule string, newV func() T) (added bool, err error) {
+	if names, ok := parseHostsLine(rule); ok {
+		if len(names) == 0 {
+			return false, nil
+		}
+		v := newV()
+		for _, name := range names {
+			if err := m.block.GetSubMatcher(MatcherFull).Add(name, v); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	r, ok := parseAdblockRule(rule)
+	if !ok {
+		return false, nil
+	}
+	mm := m.block
+	switch {
+	case r.exception:
+		mm = m.allow
+	case r.important:
+		mm = m.important
+	}
+	return true, mm.GetSubMatcher(r.typ).Add(r.pattern, newV())
+}
+
+type adblockRule struct {
+	typ       string // MixMatcher sub matcher type
+	pattern   string
+	exception bool
+	important bool
+}
+
+// adblockPatternChars are the valid chars of a non-regexp domain pattern.
+var adblockPatternChars = regexp.MustCompile(`^[a-z0-9._*-]+$`)
+
+// parseAdblockRule parses an adblock rule. ok is false if the rule is a
+// comment or is not supported.
+//
+//	||example.com^    example.com and its sub domains.
+//	|example.com^     example.com only.
+//	example.com       example.com and its sub domains (a domains-only list).
+//	||example.com     domains that start with a label example.com, e.g. www.example.com.cn.
+//	|example.com      domains that start with example.com, e.g. example.com.cn.
+//	example.com^      domains that end with example.com, e.g. myexample.com.
+//	||ads*.example^   wildcard.
+//	/^ads\d+\./       regexp.
+//	@@||example.com^  exception.
+//	rule$important    overrides exceptions.
+func parseAdblockRule(s string) (r adblockRule, ok bool) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || s[0] == '!' || s[0] == '#' || s[0] == '[' {
+		return r, false // comments and headers
+	}
+	if strings.Contains(s, "##") || strings.Contains(s, "#@#") || strings.Contains(s, "#?#") || strings.Contains(s, "#$#") {
+		return r, false // cosmetic rules
+	}
+
+	if strings.HasPrefix(s, "@@") {
+		r.exception = true
+		s = s[2:]
+	}
+
+	// Modifiers.
+	var modifiers string
+	if strings.HasPrefix(s, "/") {
+		end := strings.LastIndexByte(s, '/')
+		if end == 0 {
+			return r, false
+		}
+		rest := s[end+1:]
+		if len(rest) > 0 {
+			if rest[0] != '$' {
+				return r, false
+			}
+			modifiers = rest[1:]
+		}
+		s = s[:end+1]
+	} else {
+		s, modifiers, _ = strings.Cut(s, "$")
+	}
+	if len(modifiers) > 0 {
+		for _, m := range strings.Split(modifiers, ",") {
+			if m != "important" {
+				return r, false // Other modifiers cannot be applied to dns queries.
+			}
+			r.important = true
+		}
+	}
+
+	// Regexp.
+	if len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		expr := s[1 : len(s)-1]
+		if _, err := regexp.Compile(expr); err != nil {
+			return r, false
+		}
+		r.typ, r.pattern = MatcherRegexp, expr
+		return r, true
+	}
+
+	var domainAnchor, startAnchor, endAnchor bool
+	switch {
+	case strings.HasPrefix(s, "||"):
+		domainAnchor, s = true, s[2:]
+	case strings.HasPrefix(s, "|"):
+		startAnchor, s = true, s[1:]
+	}
+	for _, suffix := range [...]string{"^|", "^", "|"} {
+		if strings.HasSuffix(s, suffix) {
+			endAnchor, s = true, strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+	s = strings.ToLower(s)
+	if !adblockPatternChars.MatchString(s) || strings.Trim(s, "*.") == "" {
+		return r, false // e.g. url rules
+	}
+
+	if !strings.Contains(s, "*") {
+		switch {
+		case domainAnchor && endAnchor, !domainAnchor && !startAnchor && !endAnchor:
+			r.typ, r.pattern = MatcherDomain, s
+			return r, true
+		case startAnchor && endAnchor:
+			r.typ, r.pattern = MatcherFull, s
+			return r, true
+		}
+	}
+
+	// Patterns that are only anchored on one side match a part of the domain.
+	sb := new(strings.Builder)
+	switch {
+	case domainAnchor:
+		sb.WriteString(`(^|\.)`)
+	case startAnchor:
+		sb.WriteString(`^`)
+	}
+	sb.WriteString(strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, `.*`))
+	if endAnchor {
+		sb.WriteString(`$`)
+	}
+	r.typ, r.pattern = MatcherRegexp, sb.String()
+	return r, true
+}
+
+// ParseAdblockFile parses an adblock style rule list. Lines in hosts
+// format are also accepted.
+func ParseAdblockFile(in []byte) (*AdblockMatcher[struct{}], error) {
+	return parseAdblockFile(in, noValue)
+}
+
+func parseAdblockFile[T any](in []byte, newV newValueFunc[T]) (*AdblockMatcher[T], error) {
+	m := NewAdblockMatcher[T]()
+	line := 0
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	for scanner.Scan() {
+		line++
+		rule := strings.TrimSpace(scanner.Text())
+		if _, err := m.add(rule, func() T { return newV(rule, line) }); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ParseHostsFile parses a hosts file. e.g. "0.0.0.0 ads.example.com".
+// Host names only match themselves, not their sub domains.
+func ParseHostsFile(in []byte) (*MixMatcher[struct{}], error) {
+	return parseHostsFile(in, noValue)
+}
+
+func parseHostsFile[T any](in []byte, newV newValueFunc[T]) (*MixMatcher[T], error) {
+	m := NewMixMatcher[T]()
+	line := 0
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(utils.RemoveComment(scanner.Text(), "#"))
+		names, _ := parseHostsLine(s)
+		if len(names) == 0 {
+			continue
+		}
+		v := newV(s, line)
+		for _, name := range names {
+			if err := m.GetSubMatcher(MatcherFull).Add(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// hostsLocalNames are the names that are usually in a hosts file
+// for the local host. They should not be matched.
+var hostsLocalNames = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// parseHostsLine parses a hosts file line "ip name [name...]".
+// ok is false if s is not a hosts line.
+func parseHostsLine(s string) (names []string, ok bool) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, false
+	}
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return nil, false
+	}
+	for _, name := range fields[1:] {
+		if strings.HasPrefix(name, "#") {
+			break // comment
+		}
+		if _, local := hostsLocalNames[strings.ToLower(name)]; local {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
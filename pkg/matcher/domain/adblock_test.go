@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"testing"
+)
+
+func TestParseAdblockFile(t *testing.T) {
+	list := `
+[Adblock Plus 2.0]
+! comment
+# comment
+example.com##.banner
+||ads.example.com^
+||tracker.example.com^$third-party
+|full.example.com^
+|start.example.com
+end.example.com^
+||label.example.com
+plain.example.org
+||img*.example.net^
+/^ad[0-9]+\.example\.io$/
+||allowed.ads.example.com^
+@@||ok.ads.example.com^
+@@||good.example.edu^
+||bad.good.example.edu^$important
+||example.org/path^
+0.0.0.0 hosts.example.com localhost
+`
+	m, err := ParseAdblockFile([]byte(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"ads.example.com.", true},
+		{"sub.ads.example.com.", true},
+		{"example.com.", false},
+		{"tracker.example.com.", false}, // unsupported modifier
+		{"full.example.com.", true},
+		{"sub.full.example.com.", false},
+		{"start.example.com.", true},
+		{"start.example.com.cn.", true},
+		{"sub.start.example.com.", false},
+		{"end.example.com.", true},
+		{"sub.end.example.com.", true},
+		{"myend.example.com.", true},
+		{"end.example.com.cn.", false},
+		{"label.example.com.", true},
+		{"sub.label.example.com.cn.", true},
+		{"mylabel.example.com.", false},
+		{"plain.example.org.", true},
+		{"sub.plain.example.org.", true},
+		{"img1.example.net.", true},
+		{"a.img1.example.net.", true},
+		{"img1.example.net.cn.", false},
+		{"ad12.example.io.", true},
+		{"ad.example.io.", false},
+		{"allowed.ads.example.com.", true},
+		{"ok.ads.example.com.", false}, // exception
+		{"sub.ok.ads.example.com.", false},
+		{"good.example.edu.", false},
+		{"bad.good.example.edu.", true}, // important overrides exception
+		{"example.org.", false},         // url rule
+		{"hosts.example.com.", true},
+		{"sub.hosts.example.com.", false},
+		{"localhost.", false},
+	}
+	for _, tt := range tests {
+		if _, got := m.Match(tt.domain); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestParseHostsFile(t *testing.T) {
+	hosts := `
+# comment
+127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com tracker.example.com # comment
+0.0.0.0 Upper.Example.com
+invalid line
+`
+	m, err := ParseHostsFile([]byte(hosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 3 {
+		t.Fatalf("want 3 names, got %d", m.Len())
+	}
+	for _, d := range []string{"ads.example.com.", "tracker.example.com.", "upper.example.com."} {
+		if _, ok := m.Match(d); !ok {
+			t.Errorf("%s should be matched", d)
+		}
+	}
+	for _, d := range []string{"localhost.", "sub.ads.example.com.", "comment."} {
+		if _, ok := m.Match(d); ok {
+			t.Errorf("%s should not be matched", d)
+		}
+	}
+}
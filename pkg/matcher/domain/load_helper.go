@@ -31,6 +31,7 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 	"github.com/pmkol/mosdns-x/pkg/matcher/v2data"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
@@ -81,9 +82,38 @@ func (m *MatcherGroup[T]) Close() error {
 	return nil
 }
 
+// exceptionMatcher is a Matcher that has exception rules, e.g. AdblockMatcher.
+type exceptionMatcher[T any] interface {
+	// matchImportant matches s with the rules that override exceptions.
+	matchImportant(s string) (v T, ok bool)
+	// matchException reports whether s is matched by an exception rule.
+	matchException(s string) bool
+	// matchBlock matches s with the other rules, ignoring the exceptions.
+	matchBlock(s string) (v T, ok bool)
+}
+
+// Match matches s with the sub matchers. The exception rules of a sub
+// matcher apply to all the sub matchers.
 func (m *MatcherGroup[T]) Match(s string) (v T, ok bool) {
 	for _, sub := range m.g {
-		v, ok = sub.Match(s)
+		if em, isEm := sub.(exceptionMatcher[T]); isEm {
+			if v, ok = em.matchImportant(s); ok {
+				return v, true
+			}
+		}
+	}
+	for _, sub := range m.g {
+		if em, isEm := sub.(exceptionMatcher[T]); isEm && em.matchException(s) {
+			var zeroT T
+			return zeroT, false
+		}
+	}
+	for _, sub := range m.g {
+		if em, isEm := sub.(exceptionMatcher[T]); isEm {
+			v, ok = em.matchBlock(s)
+		} else {
+			v, ok = sub.Match(s)
+		}
 		if ok {
 			return v, true
 		}
@@ -147,35 +177,83 @@ func BatchLoadProvider[T any](
 	return mg, nil
 }
 
+// Data formats of domain providers, other than the mosdns text format
+// and v2ray geosite dat.
+const (
+	FormatAdblock = "adblock"
+	FormatHosts   = "hosts"
+)
+
 // BatchLoadDomainProvider loads multiple domain entries.
+// The format of a provider entry is "provider:tag[:format]". format can be
+// FormatAdblock, FormatHosts, or a v2ray geosite filter (See ParseV2Suffix).
+// Without format, the data is in the mosdns text format.
+// An entry that starts with "@@" is an adblock exception rule. It applies to
+// all the entries, e.g. "@@||example.com^".
+// The value of a matched domain is its rule, if reg is not nil. Otherwise,
+// the value is nil.
 // Caller must call MatcherGroup.Close to detach this matcher from data_provider.DataManager to
 // avoid leaking.
 func BatchLoadDomainProvider(
 	e []string,
 	dm *data_provider.DataManager,
-) (*MatcherGroup[struct{}], error) {
-	mg := new(MatcherGroup[struct{}])
-	staticMatcher := NewDomainMixMatcher()
+	reg *rule_stats.Registry,
+) (*MatcherGroup[*rule_stats.Rule], error) {
+	mg := new(MatcherGroup[*rule_stats.Rule])
+	staticMatcher := NewMixMatcher[*rule_stats.Rule]()
+	staticMatcher.SetDefaultMatcher(MatcherDomain)
 	mg.Append(staticMatcher)
+	staticExceptions := NewAdblockMatcher[*rule_stats.Rule]()
+	staticRules := reg.NewSource("static").NewBatch()
 	for _, s := range e {
-		if strings.HasPrefix(s, "provider:") {
+		if strings.HasPrefix(s, "@@") {
+			added, err := staticExceptions.add(s, func() *rule_stats.Rule { return staticRules.Add(s, 0) })
+			if err != nil {
+				return nil, fmt.Errorf("failed to load data %s: %w", s, err)
+			}
+			if !added {
+				return nil, fmt.Errorf("invalid exception rule %s", s)
+			}
+		} else if strings.HasPrefix(s, "provider:") {
 			providerTag := strings.TrimPrefix(s, "provider:")
 			providerTag, v2suffix, _ := strings.Cut(providerTag, ":")
 			provider := dm.GetDataProvider(providerTag)
 			if provider == nil {
 				return nil, fmt.Errorf("cannot find provider %s", providerTag)
 			}
-			var parseFunc func(b []byte) (Matcher[struct{}], error)
-			if len(v2suffix) > 0 {
-				parseFunc = func(b []byte) (Matcher[struct{}], error) {
-					return ParseV2rayDomainFile(b, ParseV2Suffix(v2suffix)...)
+			src := reg.NewSource(s)
+			var parseFunc func(b []byte, newV newValueFunc[*rule_stats.Rule]) (Matcher[*rule_stats.Rule], error)
+			switch v2suffix {
+			case FormatAdblock:
+				parseFunc = func(b []byte, newV newValueFunc[*rule_stats.Rule]) (Matcher[*rule_stats.Rule], error) {
+					return parseAdblockFile(b, newV)
+				}
+			case FormatHosts:
+				parseFunc = func(b []byte, newV newValueFunc[*rule_stats.Rule]) (Matcher[*rule_stats.Rule], error) {
+					return parseHostsFile(b, newV)
 				}
-			} else {
-				parseFunc = func(b []byte) (Matcher[struct{}], error) {
-					return ParseTextDomainFile(b)
+			case "":
+				parseFunc = func(b []byte, newV newValueFunc[*rule_stats.Rule]) (Matcher[*rule_stats.Rule], error) {
+					return parseTextDomainFile(b, newV)
+				}
+			default:
+				parseFunc = func(b []byte, newV newValueFunc[*rule_stats.Rule]) (Matcher[*rule_stats.Rule], error) {
+					v, err := LoadGeoSiteList(b)
+					if err != nil {
+						return nil, err
+					}
+					return newV2rayDomainDat(v, newV, ParseV2Suffix(v2suffix)...)
 				}
 			}
-			m := NewDynamicMatcher[struct{}](parseFunc)
+			m := NewDynamicMatcher[*rule_stats.Rule](func(b []byte) (Matcher[*rule_stats.Rule], error) {
+				rules := src.NewBatch()
+				m, err := parseFunc(b, rules.Add)
+				if err != nil {
+					return nil, err
+				}
+				rules.Commit()
+				return m, nil
+			})
 			if err := provider.LoadAndAddListener(m); err != nil {
 				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerTag, err)
 			}
@@ -184,15 +262,30 @@ func BatchLoadDomainProvider(
 				provider.DeleteListener(m)
 			})
 		} else {
-			err := Load[struct{}](staticMatcher, s, nil)
+			err := Load[*rule_stats.Rule](staticMatcher, s, func(s string) (string, *rule_stats.Rule, error) {
+				pattern, _, err := patternOnly[struct{}](s)
+				if err != nil {
+					return "", nil, err
+				}
+				return pattern, staticRules.Add(pattern, 0), nil
+			})
 			if err != nil {
 				return nil, fmt.Errorf("failed to load data %s: %w", s, err)
 			}
 		}
 	}
+	staticRules.Commit()
+	if staticExceptions.allow.Len() > 0 {
+		mg.Append(staticExceptions)
+	}
 	return mg, nil
 }
 
+// newValueFunc returns the value of a pattern at line of the data.
+type newValueFunc[T any] func(pattern string, line int) T
+
+func noValue(string, int) (v struct{}) { return }
+
 type DynamicMatcher[T any] struct {
 	parserFunc func(b []byte) (Matcher[T], error)
 	l          sync.RWMutex
@@ -210,6 +303,36 @@ func (d *DynamicMatcher[T]) Match(s string) (v T, ok bool) {
 	return m.Match(s)
 }
 
+func (d *DynamicMatcher[T]) matchImportant(s string) (v T, ok bool) {
+	d.l.RLock()
+	m := d.m
+	d.l.RUnlock()
+	if em, isEm := m.(exceptionMatcher[T]); isEm {
+		return em.matchImportant(s)
+	}
+	return v, false
+}
+
+func (d *DynamicMatcher[T]) matchException(s string) bool {
+	d.l.RLock()
+	m := d.m
+	d.l.RUnlock()
+	if em, isEm := m.(exceptionMatcher[T]); isEm {
+		return em.matchException(s)
+	}
+	return false
+}
+
+func (d *DynamicMatcher[T]) matchBlock(s string) (v T, ok bool) {
+	d.l.RLock()
+	m := d.m
+	d.l.RUnlock()
+	if em, isEm := m.(exceptionMatcher[T]); isEm {
+		return em.matchBlock(s)
+	}
+	return m.Match(s)
+}
+
 func (d *DynamicMatcher[T]) Len() int {
 	d.l.RLock()
 	m := d.m
@@ -230,6 +353,13 @@ func (d *DynamicMatcher[T]) Update(b []byte) error {
 
 // LoadFromTextReader loads multiple lines from reader r. r
 func LoadFromTextReader[T any](m WriteableMatcher[T], r io.Reader, parseString ParseStringFunc[T]) error {
+	return scanTextLines(r, func(s string, _ int) error {
+		return Load(m, s, parseString)
+	})
+}
+
+// scanTextLines calls f for each non-empty line in r with comments removed.
+func scanTextLines(r io.Reader, f func(s string, line int) error) error {
 	lineCounter := 0
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
@@ -241,8 +371,7 @@ func LoadFromTextReader[T any](m WriteableMatcher[T], r io.Reader, parseString P
 			continue
 		}
 
-		err := Load(m, s, parseString)
-		if err != nil {
+		if err := f(s, lineCounter); err != nil {
 			return fmt.Errorf("line %d: %v", lineCounter, err)
 		}
 	}
@@ -287,12 +416,16 @@ func ParseV2Suffix(s string) []*V2filter {
 // The format of args is "tag1@attr1@attr2,tag2@attr1...".
 // Only domains that are matched by the args will be loaded to V2rayDomainDat.
 func NewV2rayDomainDat(v *v2data.GeoSiteList, filters ...*V2filter) (*MixMatcher[struct{}], error) {
+	return newV2rayDomainDat(v, noValue, filters...)
+}
+
+func newV2rayDomainDat[T any](v *v2data.GeoSiteList, newV newValueFunc[T], filters ...*V2filter) (*MixMatcher[T], error) {
 	dataTags := make(map[string][]*v2data.Domain)
 	for _, gs := range v.GetEntry() {
 		dataTags[strings.ToLower(gs.GetCountryCode())] = gs.Domain
 	}
 
-	m := NewMixMatcher[struct{}]()
+	m := NewMixMatcher[T]()
 	for _, f := range filters {
 		tag := f.Tag
 		attrs := f.Attrs
@@ -300,7 +433,7 @@ func NewV2rayDomainDat(v *v2data.GeoSiteList, filters ...*V2filter) (*MixMatcher
 		if domains == nil {
 			return nil, fmt.Errorf("tag %s does not exist", tag)
 		}
-		_, err := BuildDomainMatcher(domains, attrs, m)
+		_, err := buildDomainMatcher(domains, attrs, m, newV)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load tag %s, %w", tag, err)
 		}
@@ -310,6 +443,10 @@ func NewV2rayDomainDat(v *v2data.GeoSiteList, filters ...*V2filter) (*MixMatcher
 }
 
 func BuildDomainMatcher(domains []*v2data.Domain, attrs []string, m *MixMatcher[struct{}]) (*MixMatcher[struct{}], error) {
+	return buildDomainMatcher(domains, attrs, m, noValue)
+}
+
+func buildDomainMatcher[T any](domains []*v2data.Domain, attrs []string, m *MixMatcher[T], newV newValueFunc[T]) (*MixMatcher[T], error) {
 	am := make(map[string]struct{})
 	if len(attrs) > 0 {
 		for _, attr := range attrs {
@@ -318,7 +455,7 @@ func BuildDomainMatcher(domains []*v2data.Domain, attrs []string, m *MixMatcher[
 	}
 
 	if m == nil {
-		m = NewMixMatcher[struct{}]()
+		m = NewMixMatcher[T]()
 	}
 
 getDomainLoop:
@@ -355,7 +492,7 @@ getDomainLoop:
 			return nil, fmt.Errorf("invalid MixMatcher, missing submatcher %s", subMatcherType)
 		}
 
-		if err := sm.Add(d.Value, struct{}{}); err != nil {
+		if err := sm.Add(d.Value, newV(subMatcherType+":"+d.Value, 0)); err != nil {
 			return nil, fmt.Errorf("failed to load value %s, %w", d.Value, err)
 		}
 	}
@@ -371,14 +508,26 @@ func LoadGeoSiteList(b []byte) (*v2data.GeoSiteList, error) {
 }
 
 func ParseTextDomainFile(in []byte) (*MixMatcher[struct{}], error) {
-	mixMatcher := NewDomainMixMatcher()
-	if err := LoadFromTextReader[struct{}](mixMatcher, bytes.NewReader(in), nil); err != nil {
+	return parseTextDomainFile(in, noValue)
+}
+
+func parseTextDomainFile[T any](in []byte, newV newValueFunc[T]) (*MixMatcher[T], error) {
+	mixMatcher := NewMixMatcher[T]()
+	mixMatcher.SetDefaultMatcher(MatcherDomain)
+	err := scanTextLines(bytes.NewReader(in), func(s string, line int) error {
+		pattern, _, err := patternOnly[struct{}](s)
+		if err != nil {
+			return err
+		}
+		return mixMatcher.Add(pattern, newV(pattern, line))
+	})
+	if err != nil {
 		return nil, err
 	}
 	return mixMatcher, nil
 }
 
-// NewDomainMixMatcher is a helper function for BatchLoadDomainProvider.
+// NewDomainMixMatcher returns a MixMatcher that uses MatcherDomain as its default matcher.
 func NewDomainMixMatcher() *MixMatcher[struct{}] {
 	mixMatcher := NewMixMatcher[struct{}]()
 	mixMatcher.SetDefaultMatcher(MatcherDomain)
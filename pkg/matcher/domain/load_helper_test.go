@@ -20,8 +20,14 @@
 package domain
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/data_provider"
 )
 
 func TestParseV2Suffix(t *testing.T) {
@@ -41,3 +47,59 @@ func TestParseV2Suffix(t *testing.T) {
 		})
 	}
 }
+
+func TestBatchLoadDomainProvider_exceptions(t *testing.T) {
+	dir := t.TempDir()
+	dm := data_provider.NewDataManager()
+	addProvider := func(tag, data string) {
+		file := filepath.Join(dir, tag)
+		if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := data_provider.NewDataProvider(zap.NewNop(), data_provider.DataProviderConfig{Tag: tag, File: file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(p.Close)
+		dm.AddDataProvider(tag, p)
+	}
+	addProvider("text", "domain:example.com\n")
+	addProvider("adblock", "||example.net^\n@@||ok.example.com^\n||bad.good.example.com^$important\n")
+	addProvider("hosts", "0.0.0.0 ads.example.org\n")
+
+	mg, err := BatchLoadDomainProvider([]string{
+		"provider:text",
+		"provider:adblock:adblock",
+		"provider:hosts:hosts",
+		"example.edu",
+		"@@||good.example.com^",
+		"@@|ads.example.org^",
+	}, dm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mg.Close()
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com.", true},
+		{"sub.example.com.", true},
+		{"ok.example.com.", false},      // exception in a provider, over a text provider
+		{"good.example.com.", false},    // inline exception
+		{"bad.good.example.com.", true}, // important overrides the inline exception
+		{"example.net.", true},
+		{"ads.example.org.", false}, // inline exception, over a hosts provider
+		{"example.edu.", true},
+	}
+	for _, tt := range tests {
+		if _, got := mg.Match(tt.domain); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	if _, err := BatchLoadDomainProvider([]string{"@@example.com/path"}, dm, nil); err == nil {
+		t.Error("invalid exception rule should be rejected")
+	}
+}
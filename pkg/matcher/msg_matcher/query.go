@@ -21,6 +21,7 @@ package msg_matcher
 
 import (
 	"context"
+	"crypto/x509"
 
 	"codeberg.org/miekg/dns"
 
@@ -39,12 +40,110 @@ func NewClientIPMatcher(ipMatcher netlist.Matcher) *ClientIPMatcher {
 	return &ClientIPMatcher{ipMatcher: ipMatcher}
 }
 
-func (m *ClientIPMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+func (m *ClientIPMatcher) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, err error) {
 	clientAddr := qCtx.ReqMeta().GetClientAddr()
 	if !clientAddr.IsValid() {
 		return false, nil
 	}
-	return m.ipMatcher.Match(clientAddr)
+	return matchIP(ctx, qCtx, m.ipMatcher, clientAddr)
+}
+
+// ClientIDMatcher matches the client id of the request.
+type ClientIDMatcher struct {
+	ids map[string]struct{}
+}
+
+func NewClientIDMatcher(ids []string) *ClientIDMatcher {
+	m := &ClientIDMatcher{ids: make(map[string]struct{}, len(ids))}
+	for _, id := range ids {
+		m.ids[id] = struct{}{}
+	}
+	return m
+}
+
+func (m *ClientIDMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	id := qCtx.ReqMeta().GetClientID()
+	if len(id) == 0 {
+		return false, nil
+	}
+	_, ok := m.ids[id]
+	return ok, nil
+}
+
+// ClientCertMatcher matches the identity of the verified tls client
+// certificate. The identity can be the subject common name or any dns,
+// email or uri subject alternative name of the certificate.
+type ClientCertMatcher struct {
+	ids map[string]struct{}
+}
+
+func NewClientCertMatcher(ids []string) *ClientCertMatcher {
+	m := &ClientCertMatcher{ids: make(map[string]struct{}, len(ids))}
+	for _, id := range ids {
+		m.ids[id] = struct{}{}
+	}
+	return m
+}
+
+func (m *ClientCertMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+	return m.MatchCert(qCtx.ReqMeta().GetClientCert()), nil
+}
+
+// MatchCert reports whether cert has an identity in m. cert can be nil.
+func (m *ClientCertMatcher) MatchCert(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	if m.has(cert.Subject.CommonName) {
+		return true
+	}
+	for _, s := range cert.DNSNames {
+		if m.has(s) {
+			return true
+		}
+	}
+	for _, s := range cert.EmailAddresses {
+		if m.has(s) {
+			return true
+		}
+	}
+	for _, u := range cert.URIs {
+		if m.has(u.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ClientCertMatcher) has(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+	_, ok := m.ids[id]
+	return ok
+}
+
+// ServerNameMatcher matches the tls server name (SNI) of the request.
+type ServerNameMatcher[T any] struct {
+	domainMatcher domain.Matcher[T]
+}
+
+// NewServerNameMatcher returns a ServerNameMatcher. If the values of
+// domainMatcher are *rule_stats.Rule, the matched rules will be recorded.
+func NewServerNameMatcher[T any](domainMatcher domain.Matcher[T]) *ServerNameMatcher[T] {
+	return &ServerNameMatcher[T]{domainMatcher: domainMatcher}
+}
+
+func (m *ServerNameMatcher[T]) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, _ error) {
+	serverName := qCtx.ReqMeta().GetServerName()
+	if len(serverName) == 0 {
+		return false, nil
+	}
+	v, ok := m.domainMatcher.Match(serverName)
+	if ok {
+		recordRule(ctx, qCtx, v)
+	}
+	return ok, nil
 }
 
 type ClientECSMatcher struct {
@@ -55,34 +154,45 @@ func NewClientECSMatcher(ipMatcher netlist.Matcher) *ClientECSMatcher {
 	return &ClientECSMatcher{ipMatcher: ipMatcher}
 }
 
-func (m *ClientECSMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, err error) {
+func (m *ClientECSMatcher) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, err error) {
 	if ecs := dnsutils.GetECS(qCtx.Q()); ecs != nil {
-		addr := ecs.Address
-		return m.ipMatcher.Match(addr)
+		return matchIP(ctx, qCtx, m.ipMatcher, ecs.Address)
 	}
 	return false, nil
 }
 
-type QNameMatcher struct {
-	domainMatcher domain.Matcher[struct{}]
+type QNameMatcher[T any] struct {
+	domainMatcher domain.Matcher[T]
 }
 
-func NewQNameMatcher(domainMatcher domain.Matcher[struct{}]) *QNameMatcher {
-	return &QNameMatcher{domainMatcher: domainMatcher}
+// NewQNameMatcher returns a QNameMatcher. If the values of domainMatcher
+// are *rule_stats.Rule, the matched rules will be recorded.
+func NewQNameMatcher[T any](domainMatcher domain.Matcher[T]) *QNameMatcher[T] {
+	return &QNameMatcher[T]{domainMatcher: domainMatcher}
 }
 
-func (m *QNameMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, _ error) {
-	return m.MatchMsg(qCtx.Q()), nil
+func (m *QNameMatcher[T]) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, _ error) {
+	v, ok := m.matchMsg(qCtx.Q())
+	if ok {
+		recordRule(ctx, qCtx, v)
+	}
+	return ok, nil
+}
+
+func (m *QNameMatcher[T]) MatchMsg(msg *dns.Msg) bool {
+	_, ok := m.matchMsg(msg)
+	return ok
 }
 
-func (m *QNameMatcher) MatchMsg(msg *dns.Msg) bool {
+func (m *QNameMatcher[T]) matchMsg(msg *dns.Msg) (T, bool) {
 	for i := range msg.Question {
-		_, ok := m.domainMatcher.Match(msg.Question[i].Header().Name)
+		v, ok := m.domainMatcher.Match(msg.Question[i].Header().Name)
 		if ok {
-			return true
+			return v, true
 		}
 	}
-	return false
+	var zero T
+	return zero, false
 }
 
 type QTypeMatcher struct {
@@ -21,7 +21,10 @@ package msg_matcher
 
 import (
 	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/netip"
+	"net/url"
 	"testing"
 
 	"codeberg.org/miekg/dns"
@@ -79,6 +82,55 @@ func TestClientIPMatcher_Match(t *testing.T) {
 	}
 }
 
+func TestClientCertMatcher_Match(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.org/laptop")
+	certs := map[string]*x509.Certificate{
+		"cn":    {Subject: pkix.Name{CommonName: "alice"}},
+		"dns":   {DNSNames: []string{"phone.example.org"}},
+		"email": {EmailAddresses: []string{"bob@example.org"}},
+		"uri":   {URIs: []*url.URL{u}},
+		"other": {Subject: pkix.Name{CommonName: "mallory"}},
+	}
+	m := NewClientCertMatcher([]string{"alice", "phone.example.org", "bob@example.org", "spiffe://example.org/laptop"})
+	for name, cert := range certs {
+		meta := new(C.RequestMeta)
+		meta.SetClientCert(cert)
+		matched, err := m.Match(context.Background(), C.NewContext(new(dns.Msg), meta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := name != "other"; matched != want {
+			t.Errorf("%s: Match() = %v, want %v", name, matched, want)
+		}
+	}
+	if matched, _ := m.Match(context.Background(), C.NewContext(new(dns.Msg), nil)); matched {
+		t.Error("matched a client without certificate")
+	}
+}
+
+func TestServerNameMatcher_Match(t *testing.T) {
+	dm := domain.NewSubDomainMatcher[struct{}]()
+	dm.Add("tenant-a.example", struct{}{})
+	m := NewServerNameMatcher(dm)
+
+	for serverName, want := range map[string]bool{
+		"tenant-a.example":     true,
+		"dot.tenant-a.example": true,
+		"tenant-b.example":     false,
+		"":                     false,
+	} {
+		meta := new(C.RequestMeta)
+		meta.SetServerName(serverName)
+		matched, err := m.Match(context.Background(), C.NewContext(new(dns.Msg), meta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != want {
+			t.Errorf("%q: Match() = %v, want %v", serverName, matched, want)
+		}
+	}
+}
+
 func TestClientECSMatcher_Match(t *testing.T) {
 	nl := netlist.NewList()
 	if err := netlist.LoadFromText(nl, "127.0.0.0/24"); err != nil {
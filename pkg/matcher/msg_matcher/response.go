@@ -39,16 +39,20 @@ func NewAAAAAIPMatcher(ipMatcher netlist.Matcher) *AAAAAIPMatcher {
 	return &AAAAAIPMatcher{ipMatcher: ipMatcher}
 }
 
-func (m *AAAAAIPMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+func (m *AAAAAIPMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
 	r := qCtx.R()
 	if r == nil {
 		return false, nil
 	}
 
-	return m.MatchMsg(r)
+	return m.matchMsg(ctx, qCtx, r)
 }
 
 func (m *AAAAAIPMatcher) MatchMsg(msg *dns.Msg) (bool, error) {
+	return m.matchMsg(context.Background(), nil, msg)
+}
+
+func (m *AAAAAIPMatcher) matchMsg(ctx context.Context, qCtx *query_context.Context, msg *dns.Msg) (bool, error) {
 	for _, rr := range msg.Answer {
 		var ip netip.Addr
 		switch rr := rr.(type) {
@@ -59,7 +63,7 @@ func (m *AAAAAIPMatcher) MatchMsg(msg *dns.Msg) (bool, error) {
 		default:
 			continue
 		}
-		matched, err := m.ipMatcher.Match(ip)
+		matched, err := matchIP(ctx, qCtx, m.ipMatcher, ip)
 		if err != nil {
 			return false, err
 		}
@@ -70,32 +74,44 @@ func (m *AAAAAIPMatcher) MatchMsg(msg *dns.Msg) (bool, error) {
 	return false, nil
 }
 
-type CNameMatcher struct {
-	domainMatcher domain.Matcher[struct{}]
+type CNameMatcher[T any] struct {
+	domainMatcher domain.Matcher[T]
 }
 
-func NewCNameMatcher(domainMatcher domain.Matcher[struct{}]) *CNameMatcher {
-	return &CNameMatcher{domainMatcher: domainMatcher}
+// NewCNameMatcher returns a CNameMatcher. If the values of domainMatcher
+// are *rule_stats.Rule, the matched rules will be recorded.
+func NewCNameMatcher[T any](domainMatcher domain.Matcher[T]) *CNameMatcher[T] {
+	return &CNameMatcher[T]{domainMatcher: domainMatcher}
 }
 
-func (m *CNameMatcher) Match(_ context.Context, qCtx *query_context.Context) (matched bool, _ error) {
+func (m *CNameMatcher[T]) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, _ error) {
 	r := qCtx.R()
 	if r == nil {
 		return false, nil
 	}
 
-	return m.MatchMsg(r), nil
+	v, ok := m.matchMsg(r)
+	if ok {
+		recordRule(ctx, qCtx, v)
+	}
+	return ok, nil
+}
+
+func (m *CNameMatcher[T]) MatchMsg(msg *dns.Msg) bool {
+	_, ok := m.matchMsg(msg)
+	return ok
 }
 
-func (m *CNameMatcher) MatchMsg(msg *dns.Msg) bool {
+func (m *CNameMatcher[T]) matchMsg(msg *dns.Msg) (T, bool) {
 	for _, rr := range msg.Answer {
 		if cname, ok := rr.(*dns.CNAME); ok {
-			if _, ok := m.domainMatcher.Match(cname.Target); ok {
-				return true
+			if v, ok := m.domainMatcher.Match(cname.Target); ok {
+				return v, true
 			}
 		}
 	}
-	return false
+	var zero T
+	return zero, false
 }
 
 type RCodeMatcher struct {
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package msg_matcher
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+type ruleCollectorKey struct{}
+
+// RuleCollector collects the rules that are matched by the matchers of
+// a group, so they can be recorded only if the whole group matched.
+type RuleCollector struct {
+	rules []*rule_stats.Rule
+}
+
+// WithRuleCollector returns a copy of ctx. The matchers in this package
+// that are called with it add their matched rules to rc instead of
+// recording them.
+func WithRuleCollector(ctx context.Context, rc *RuleCollector) context.Context {
+	return context.WithValue(ctx, ruleCollectorKey{}, rc)
+}
+
+// Record records the hits of the collected rules to qCtx. qCtx can be nil.
+func (rc *RuleCollector) Record(qCtx *query_context.Context) {
+	for _, r := range rc.rules {
+		hitRule(qCtx, r)
+	}
+}
+
+// recordRule records the hit of v to qCtx if v is a non-nil *rule_stats.Rule.
+// If ctx has a RuleCollector, v is added to it instead.
+func recordRule(ctx context.Context, qCtx *query_context.Context, v any) {
+	r, ok := v.(*rule_stats.Rule)
+	if !ok || r == nil {
+		return
+	}
+	if rc, _ := ctx.Value(ruleCollectorKey{}).(*RuleCollector); rc != nil {
+		rc.rules = append(rc.rules, r)
+		return
+	}
+	hitRule(qCtx, r)
+}
+
+func hitRule(qCtx *query_context.Context, r *rule_stats.Rule) {
+	r.Hit()
+	if qCtx != nil {
+		qCtx.AddMatchedRule(r.String())
+	}
+}
+
+// matchIP matches addr with m. If m is a netlist.RuleMatcher, the
+// matched rule will be recorded. qCtx can be nil.
+func matchIP(ctx context.Context, qCtx *query_context.Context, m netlist.Matcher, addr netip.Addr) (bool, error) {
+	rm, ok := m.(netlist.RuleMatcher)
+	if !ok {
+		return m.Match(addr)
+	}
+	r, ok, err := rm.MatchRule(addr)
+	if ok {
+		recordRule(ctx, qCtx, r)
+	}
+	return ok, err
+}
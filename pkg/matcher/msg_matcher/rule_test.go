@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package msg_matcher
+
+import (
+	"context"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/domain"
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
+	C "github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func TestRuleCollector(t *testing.T) {
+	b := rule_stats.NewRegistry().NewSource("static").NewBatch()
+	r := b.Add("example.com", 0)
+	b.Commit()
+	dm := domain.NewMixMatcher[*rule_stats.Rule]()
+	dm.SetDefaultMatcher(domain.MatcherDomain)
+	if err := dm.Add("example.com", r); err != nil {
+		t.Fatal(err)
+	}
+	m := NewQNameMatcher[*rule_stats.Rule](dm)
+	qCtx := C.NewContext(dns.NewMsg("www.example.com.", dns.TypeA), nil)
+
+	rc := new(RuleCollector)
+	if matched, _ := m.Match(WithRuleCollector(context.Background(), rc), qCtx); !matched {
+		t.Fatal("qname should be matched")
+	}
+	if r.Hits() != 0 || len(qCtx.MatchedRules()) != 0 {
+		t.Fatal("collected rule is recorded before Record")
+	}
+	rc.Record(qCtx)
+	if r.Hits() != 1 || len(qCtx.MatchedRules()) != 1 {
+		t.Fatalf("collected rule is not recorded, hits %d, rules %v", r.Hits(), qCtx.MatchedRules())
+	}
+
+	// Without a collector, the rule is recorded by the matcher.
+	m.Match(context.Background(), qCtx)
+	if r.Hits() != 2 {
+		t.Fatalf("want 2 hits, got %d", r.Hits())
+	}
+}
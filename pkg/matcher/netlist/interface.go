@@ -21,9 +21,17 @@ package netlist
 
 import (
 	"net/netip"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 )
 
 type Matcher interface {
 	Match(addr netip.Addr) (bool, error)
 	Len() int
 }
+
+// RuleMatcher is a Matcher that can also return the matched rule.
+type RuleMatcher interface {
+	Matcher
+	MatchRule(addr netip.Addr) (r *rule_stats.Rule, ok bool, err error)
+}
@@ -24,6 +24,8 @@ import (
 	"fmt"
 	"net/netip"
 	"sort"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 )
 
 var (
@@ -36,7 +38,13 @@ var (
 // It is suitable for large static cidr search.
 type List struct {
 	// stores valid and masked netip.Prefix(s)
-	e      []netip.Prefix
+	e []netip.Prefix
+	// rules of e, nil if the List has no rule.
+	rules []*rule_stats.Rule
+	// nested[i] is a sorted List of the prefixes that were merged into
+	// e[i] by Sort, so their rules are still matched. nil if the List
+	// has no rule.
+	nested []*List
 	sorted bool
 }
 
@@ -68,36 +76,74 @@ func (list *List) Append(newNet ...netip.Prefix) {
 	}
 	mustValid(newNet)
 	list.e = append(list.e, newNet...)
+	if list.rules != nil {
+		list.rules = append(list.rules, make([]*rule_stats.Rule, len(newNet))...)
+	}
 	list.sorted = false
 }
 
+// AppendRule appends a new netip.Prefix with its rule to the list.
+// See Append.
+func (list *List) AppendRule(n netip.Prefix, r *rule_stats.Rule) {
+	if list.rules == nil && r != nil {
+		list.rules = make([]*rule_stats.Rule, len(list.e))
+	}
+	list.Append(n)
+	if r != nil {
+		list.rules[len(list.rules)-1] = r
+	}
+}
+
 // Sort sorts the list, this must be called after
 // list being modified and before calling List.Contains().
+// Prefixes that are contained by other prefixes are merged. If they
+// have rules, they are kept in nested lists, so MatchRule still returns
+// the rule of the most specific prefix.
 func (list *List) Sort() {
 	if list.sorted {
 		return
 	}
 
-	sort.Sort(list)
+	sort.Stable(list)
 	out := make([]netip.Prefix, 0)
+	var outRules []*rule_stats.Rule
+	var nested []*List
 	for i, n := range list.e {
-		if i == 0 {
-			out = append(out, n)
-		} else {
-			lv := &out[len(out)-1]
-			switch {
-			case n.Addr() == lv.Addr():
-				if n.Bits() < lv.Bits() {
-					*lv = n
+		var r *rule_stats.Rule
+		if list.rules != nil {
+			r = list.rules[i]
+		}
+		if len(out) > 0 {
+			// Larger prefixes are sorted before the smaller ones that
+			// have the same address, so lv contains n.
+			lv := out[len(out)-1]
+			if lv.Contains(n.Addr()) {
+				if r != nil && n != lv {
+					sub := nested[len(nested)-1]
+					if sub == nil {
+						sub = NewList()
+						nested[len(nested)-1] = sub
+					}
+					sub.AppendRule(n, r)
 				}
-			case !lv.Contains(n.Addr()):
-				out = append(out, n)
+				continue
 			}
 		}
-
+		out = append(out, n)
+		if list.rules != nil {
+			outRules = append(outRules, r)
+			nested = append(nested, nil)
+		}
+	}
+	for _, sub := range nested {
+		if sub != nil {
+			sub.Sort()
+		}
 	}
 
 	list.e = out
+	list.rules = outRules
+	list.nested = nested
 	list.sorted = true
 }
 
@@ -108,25 +154,55 @@ func (list *List) Len() int {
 
 // Less implements sort Interface.
 func (list *List) Less(i, j int) bool {
-	return list.e[i].Addr().Less(list.e[j].Addr())
+	if c := list.e[i].Addr().Compare(list.e[j].Addr()); c != 0 {
+		return c < 0
+	}
+	return list.e[i].Bits() < list.e[j].Bits()
 }
 
 // Swap implements sort Interface.
 func (list *List) Swap(i, j int) {
 	list.e[i], list.e[j] = list.e[j], list.e[i]
+	if list.rules != nil {
+		list.rules[i], list.rules[j] = list.rules[j], list.rules[i]
+	}
 }
 
 func (list *List) Match(addr netip.Addr) (bool, error) {
 	return list.Contains(addr)
 }
 
+// MatchRule implements RuleMatcher. The returned rule is nil if the
+// List has no rule.
+func (list *List) MatchRule(addr netip.Addr) (*rule_stats.Rule, bool, error) {
+	i, err := list.search(addr)
+	if i < 0 || err != nil {
+		return nil, false, err
+	}
+	if list.rules == nil {
+		return nil, true, nil
+	}
+	if sub := list.nested[i]; sub != nil {
+		if r, ok, _ := sub.MatchRule(addr); ok {
+			return r, true, nil
+		}
+	}
+	return list.rules[i], true, nil
+}
+
 // Contains reports whether the list includes the given netip.Addr.
 func (list *List) Contains(addr netip.Addr) (bool, error) {
+	i, err := list.search(addr)
+	return i >= 0, err
+}
+
+// search returns the index of the prefix that contains addr, or -1.
+func (list *List) search(addr netip.Addr) (int, error) {
 	if !list.sorted {
-		return false, ErrNotSorted
+		return -1, ErrNotSorted
 	}
 	if !addr.IsValid() {
-		return false, ErrInvalidAddr
+		return -1, ErrInvalidAddr
 	}
 
 	addr = to6(addr)
@@ -141,11 +217,10 @@ func (list *List) Contains(addr netip.Addr) (bool, error) {
 		}
 	}
 
-	if i == 0 {
-		return false, nil
+	if i == 0 || !list.e[i-1].Contains(addr) {
+		return -1, nil
 	}
-
-	return list.e[i-1].Contains(addr), nil
+	return i - 1, nil
 }
 
 func to6(addr netip.Addr) netip.Addr {
@@ -31,12 +31,13 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/pmkol/mosdns-x/pkg/data_provider"
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 	"github.com/pmkol/mosdns-x/pkg/matcher/v2data"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 type MatcherGroup struct {
-	g      []Matcher
+	g      []RuleMatcher
 	closer []func()
 }
 
@@ -49,16 +50,22 @@ func (m *MatcherGroup) Len() int {
 }
 
 func (m *MatcherGroup) Match(addr netip.Addr) (bool, error) {
+	_, ok, err := m.MatchRule(addr)
+	return ok, err
+}
+
+// MatchRule implements RuleMatcher.
+func (m *MatcherGroup) MatchRule(addr netip.Addr) (*rule_stats.Rule, bool, error) {
 	for _, list := range m.g {
-		ok, err := list.Match(addr)
+		r, ok, err := list.MatchRule(addr)
 		if err != nil {
-			return false, err
+			return nil, false, err
 		}
 		if ok {
-			return true, nil
+			return r, true, nil
 		}
 	}
-	return false, nil
+	return nil, false, nil
 }
 
 func (m *MatcherGroup) Close() error {
@@ -90,17 +97,23 @@ func (d *DynamicMatcher) Match(addr netip.Addr) (bool, error) {
 	return d.v.Load().(*List).Match(addr)
 }
 
+func (d *DynamicMatcher) MatchRule(addr netip.Addr) (*rule_stats.Rule, bool, error) {
+	return d.v.Load().(*List).MatchRule(addr)
+}
+
 func (d *DynamicMatcher) Len() int {
 	return d.v.Load().(*List).Len()
 }
 
 // BatchLoadProvider is a helper func to load multiple files using Load.
+// If reg is not nil, rules of the ips will be added to reg. See MatcherGroup.MatchRule.
 // Caller must call MatcherGroup.Close to detach this matcher from data_provider.DataManager to
 // avoid leaking.
-func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup, error) {
+func BatchLoadProvider(e []string, dm *data_provider.DataManager, reg *rule_stats.Registry) (*MatcherGroup, error) {
 	mg := new(MatcherGroup)
 	staticMatcher := NewList()
 	mg.g = append(mg.g, staticMatcher)
+	staticRules := reg.NewSource("static").NewBatch()
 	for _, s := range e {
 		if strings.HasPrefix(s, "provider:") {
 			providerName := strings.TrimPrefix(s, "provider:")
@@ -109,22 +122,35 @@ func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup
 			if provider == nil {
 				return nil, fmt.Errorf("cannot find provider %s", providerName)
 			}
-			var parseFunc func(in []byte) (*List, error)
+			src := reg.NewSource(s)
+			var parseFunc func(in []byte, rules *rule_stats.Batch) (*List, error)
 			if len(v2suffix) > 0 {
-				parseFunc = func(in []byte) (*List, error) {
-					return ParseV2rayIPDat(in, v2suffix)
+				parseFunc = func(in []byte, rules *rule_stats.Batch) (*List, error) {
+					v, err := LoadGeoIPListFromDAT(in)
+					if err != nil {
+						return nil, err
+					}
+					return newV2rayIPDat(v, v2suffix, rules)
 				}
 			} else {
-				parseFunc = func(in []byte) (*List, error) {
+				parseFunc = func(in []byte, rules *rule_stats.Batch) (*List, error) {
 					l := NewList()
-					if err := LoadFromReader(l, bytes.NewReader(in)); err != nil {
+					if err := loadFromReader(l, bytes.NewReader(in), rules); err != nil {
 						return nil, err
 					}
 					l.Sort()
 					return l, nil
 				}
 			}
-			m := NewDynamicMatcher(parseFunc)
+			m := NewDynamicMatcher(func(in []byte) (*List, error) {
+				rules := src.NewBatch()
+				l, err := parseFunc(in, rules)
+				if err != nil {
+					return nil, err
+				}
+				rules.Commit()
+				return l, nil
+			})
 			if err := provider.LoadAndAddListener(m); err != nil {
 				return nil, fmt.Errorf("failed to load data from provider %s, %w", providerName, err)
 			}
@@ -133,13 +159,15 @@ func BatchLoadProvider(e []string, dm *data_provider.DataManager) (*MatcherGroup
 				provider.DeleteListener(m)
 			})
 		} else {
-			if err := LoadFromText(staticMatcher, s); err != nil {
+			s = strings.TrimSpace(s)
+			if err := loadFromText(staticMatcher, s, staticRules, 0); err != nil {
 				return nil, fmt.Errorf("failed to load data %s, %w", s, err)
 			}
 		}
 	}
 
 	staticMatcher.Sort()
+	staticRules.Commit()
 	return mg, nil
 }
 
@@ -154,6 +182,12 @@ func Load(l *List, ip string) error {
 // LoadFromReader loads IP list from a reader.
 // It might modify the List and causes List unsorted.
 func LoadFromReader(l *List, reader io.Reader) error {
+	return loadFromReader(l, reader, nil)
+}
+
+// loadFromReader loads IP list from a reader. If rules is not nil, a rule
+// will be added to it for each ip.
+func loadFromReader(l *List, reader io.Reader, rules *rule_stats.Batch) error {
 	scanner := bufio.NewScanner(reader)
 
 	// count how many lines we have read.
@@ -167,7 +201,7 @@ func LoadFromReader(l *List, reader io.Reader) error {
 		if len(s) == 0 {
 			continue
 		}
-		err := LoadFromText(l, s)
+		err := loadFromText(l, s, rules, lineCounter)
 		if err != nil {
 			return fmt.Errorf("invalid data at line #%d: %w", lineCounter, err)
 		}
@@ -178,24 +212,27 @@ func LoadFromReader(l *List, reader io.Reader) error {
 // LoadFromText loads an IP from s.
 // It might modify the List and causes List unsorted.
 func LoadFromText(l *List, s string) error {
+	return loadFromText(l, s, nil, 0)
+}
+
+// loadFromText loads an IP from s. If rules is not nil, a rule of s at
+// line will be added to it after s is parsed.
+func loadFromText(l *List, s string, rules *rule_stats.Batch, line int) error {
+	var prefix netip.Prefix
 	if strings.ContainsRune(s, '/') {
-		ipNet, err := netip.ParsePrefix(s)
+		var err error
+		prefix, err = netip.ParsePrefix(s)
 		if err != nil {
 			return err
 		}
-		l.Append(ipNet)
-		return nil
-	}
-
-	addr, err := netip.ParseAddr(s)
-	if err != nil {
-		return err
-	}
-	bits := 32
-	if addr.Is6() {
-		bits = 128
+	} else {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
 	}
-	l.Append(netip.PrefixFrom(addr, bits))
+	l.AppendRule(prefix, rules.Add(s, line))
 	return nil
 }
 
@@ -211,6 +248,10 @@ func ParseV2rayIPDat(in []byte, args string) (*List, error) {
 // The format of args is "tag1,tag2,...".
 // Only lists that are matched by given tags will be loaded to List.
 func NewV2rayIPDat(v *v2data.GeoIPList, args string) (*List, error) {
+	return newV2rayIPDat(v, args, nil)
+}
+
+func newV2rayIPDat(v *v2data.GeoIPList, args string, rules *rule_stats.Batch) (*List, error) {
 	m := make(map[string][]*v2data.CIDR)
 	for _, gs := range v.GetEntry() {
 		m[strings.ToLower(gs.GetCountryCode())] = gs.GetCidr()
@@ -222,7 +263,7 @@ func NewV2rayIPDat(v *v2data.GeoIPList, args string) (*List, error) {
 		if cidrs == nil {
 			return nil, fmt.Errorf("tag %s does not exist", tag)
 		}
-		if err := LoadFromV2CIDR(l, cidrs); err != nil {
+		if err := loadFromV2CIDR(l, cidrs, rules); err != nil {
 			return nil, fmt.Errorf("failed to parse v2 cidr data, %w", err)
 		}
 
@@ -234,6 +275,10 @@ func NewV2rayIPDat(v *v2data.GeoIPList, args string) (*List, error) {
 // LoadFromV2CIDR loads ip from v2ray CIDR.
 // It might modify the List and causes List unsorted.
 func LoadFromV2CIDR(l *List, cidr []*v2data.CIDR) error {
+	return loadFromV2CIDR(l, cidr, nil)
+}
+
+func loadFromV2CIDR(l *List, cidr []*v2data.CIDR, rules *rule_stats.Batch) error {
 	for i, e := range cidr {
 		ip, ok := netip.AddrFromSlice(e.Ip)
 		if !ok {
@@ -244,7 +289,7 @@ func LoadFromV2CIDR(l *List, cidr []*v2data.CIDR) error {
 		if !prefix.IsValid() {
 			return fmt.Errorf("invalid cidr data at index #%d: %s", i, e.String())
 		}
-		l.Append(prefix)
+		l.AppendRule(prefix, rules.Add(prefix.String(), 0))
 	}
 	return nil
 }
@@ -23,6 +23,8 @@ import (
 	"bytes"
 	"net/netip"
 	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 )
 
 func TestIPNetList_Sort_And_Merge(t *testing.T) {
@@ -113,3 +115,101 @@ func TestIPNetList_New_And_Contains(t *testing.T) {
 		})
 	}
 }
+
+func TestIPNetList_MatchRule(t *testing.T) {
+	raw := `
+1.0.0.0/24
+# comment
+2.0.0.1
+`
+	reg := rule_stats.NewRegistry()
+	b := reg.NewSource("ips").NewBatch()
+	l := NewList()
+	if err := loadFromReader(l, bytes.NewBufferString(raw), b); err != nil {
+		t.Fatal(err)
+	}
+	b.Commit()
+	l.Sort()
+
+	tests := []struct {
+		addr     string
+		wantRule string
+	}{
+		{"1.0.0.1", "1.0.0.0/24 (ips:2)"},
+		{"2.0.0.1", "2.0.0.1 (ips:4)"},
+		{"3.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		r, ok, err := l.MatchRule(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (len(tt.wantRule) > 0) {
+			t.Fatalf("%s: MatchRule() matched = %v", tt.addr, ok)
+		}
+		if ok && r.String() != tt.wantRule {
+			t.Fatalf("%s: MatchRule() rule = %s, want %s", tt.addr, r, tt.wantRule)
+		}
+	}
+}
+
+func TestIPNetList_MatchRule_nested(t *testing.T) {
+	raw := `
+10.1.0.0/16
+10.0.0.0/8
+10.1.1.1
+10.1.0.0/16
+192.168.0.0/24
+`
+	reg := rule_stats.NewRegistry()
+	b := reg.NewSource("ips").NewBatch()
+	l := NewList()
+	if err := loadFromReader(l, bytes.NewBufferString(raw), b); err != nil {
+		t.Fatal(err)
+	}
+	b.Commit()
+	l.Sort()
+	if l.Len() != 2 {
+		t.Fatalf("want 2 merged prefixes, got %d", l.Len())
+	}
+
+	// The rule of the most specific prefix is returned.
+	tests := []struct {
+		addr     string
+		wantRule string
+	}{
+		{"10.1.1.1", "10.1.1.1 (ips:4)"},
+		{"10.1.2.1", "10.1.0.0/16 (ips:2)"},
+		{"10.2.0.1", "10.0.0.0/8 (ips:3)"},
+		{"192.168.0.1", "192.168.0.0/24 (ips:6)"},
+	}
+	for _, tt := range tests {
+		r, ok, err := l.MatchRule(netip.MustParseAddr(tt.addr))
+		if err != nil || !ok {
+			t.Fatalf("%s: MatchRule() = %v, %v", tt.addr, ok, err)
+		}
+		if r.String() != tt.wantRule {
+			t.Fatalf("%s: MatchRule() rule = %s, want %s", tt.addr, r, tt.wantRule)
+		}
+	}
+}
+
+func TestBatchLoadProvider_invalidStatic(t *testing.T) {
+	reg := rule_stats.NewRegistry()
+	if _, err := BatchLoadProvider([]string{"10.0.0.0/8", "invalid"}, nil, reg); err == nil {
+		t.Fatal("invalid static entry should be rejected")
+	}
+	if n := len(reg.Rules()); n != 0 {
+		t.Fatalf("want no rule after a failed load, got %d", n)
+	}
+
+	l := NewList()
+	b := reg.NewSource("s").NewBatch()
+	if err := loadFromText(l, "invalid", b, 1); err == nil {
+		t.Fatal("invalid ip should be rejected")
+	}
+	b.Commit()
+	if n := len(reg.Rules()); n != 0 {
+		t.Fatalf("invalid ip should not add a rule, got %d rules", n)
+	}
+}
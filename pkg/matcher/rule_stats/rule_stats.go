@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rule_stats records which rule of a matcher was hit.
+package rule_stats
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Rule is a rule of a matcher.
+type Rule struct {
+	Pattern string
+	Source  string // The name of the Source.
+	Line    int    // The line number in the source, 0 if it is unknown.
+
+	hits atomic.Uint64
+}
+
+// Hit increases the hit count of r. r can be nil.
+func (r *Rule) Hit() {
+	if r != nil {
+		r.hits.Add(1)
+	}
+}
+
+func (r *Rule) Hits() uint64 {
+	return r.hits.Load()
+}
+
+// String returns "pattern (source:line)".
+func (r *Rule) String() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("%s (%s:%d)", r.Pattern, r.Source, r.Line)
+	}
+	return fmt.Sprintf("%s (%s)", r.Pattern, r.Source)
+}
+
+// Registry collects the rules of matchers. All methods are safe for
+// concurrent use. A nil *Registry is valid, it does nothing.
+type Registry struct {
+	prefix string // prefix of the names of new sources
+	d      *registryData
+}
+
+type registryData struct {
+	m       sync.Mutex
+	sources []*Source
+}
+
+func NewRegistry() *Registry {
+	return &Registry{d: new(registryData)}
+}
+
+// Named returns a Registry that shares the rules with reg, but prefixes
+// the names of its new sources with "name:". It is used to tell apart
+// the sources of different matchers in one Registry.
+func (reg *Registry) Named(name string) *Registry {
+	if reg == nil {
+		return nil
+	}
+	return &Registry{prefix: reg.prefix + name + ":", d: reg.d}
+}
+
+// Source is a source of rules, e.g. a data provider or the static
+// entries in the config. A nil *Source is valid, it does nothing.
+type Source struct {
+	d     *registryData
+	name  string
+	rules []*Rule // guarded by d.m
+}
+
+// NewSource adds a new Source to reg.
+func (reg *Registry) NewSource(name string) *Source {
+	if reg == nil {
+		return nil
+	}
+	s := &Source{d: reg.d, name: reg.prefix + name}
+	reg.d.m.Lock()
+	reg.d.sources = append(reg.d.sources, s)
+	reg.d.m.Unlock()
+	return s
+}
+
+// NewBatch returns a Batch that builds a new set of rules of s.
+func (s *Source) NewBatch() *Batch {
+	if s == nil {
+		return nil
+	}
+	return &Batch{s: s}
+}
+
+// Batch builds a new set of rules of a Source. e.g. when the data
+// of a provider is reloaded. A nil *Batch is valid, it does nothing.
+type Batch struct {
+	s     *Source
+	rules []*Rule
+}
+
+// Add adds a new rule to b. It returns nil if b is nil.
+func (b *Batch) Add(pattern string, line int) *Rule {
+	if b == nil {
+		return nil
+	}
+	r := &Rule{Pattern: pattern, Source: b.s.name, Line: line}
+	b.rules = append(b.rules, r)
+	return r
+}
+
+// Commit replaces the rules of the Source with the rules in b.
+// The hit counts of the rules that have the same pattern are kept.
+func (b *Batch) Commit() {
+	if b == nil {
+		return
+	}
+	d := b.s.d
+	d.m.Lock()
+	defer d.m.Unlock()
+	old := make(map[string]uint64, len(b.s.rules))
+	for _, r := range b.s.rules {
+		if n := r.Hits(); n > 0 {
+			old[r.Pattern] = n
+		}
+	}
+	for _, r := range b.rules {
+		if n, ok := old[r.Pattern]; ok {
+			r.hits.Store(n)
+		}
+	}
+	b.s.rules = b.rules
+}
+
+// Rules returns all rules in reg.
+func (reg *Registry) Rules() []*Rule {
+	if reg == nil {
+		return nil
+	}
+	reg.d.m.Lock()
+	defer reg.d.m.Unlock()
+	var rs []*Rule
+	for _, s := range reg.d.sources {
+		rs = append(rs, s.rules...)
+	}
+	return rs
+}
+
+// Top returns at most n rules that have the most hits.
+func (reg *Registry) Top(n int) []*Rule {
+	var rs []*Rule
+	for _, r := range reg.Rules() {
+		if r.Hits() > 0 {
+			rs = append(rs, r)
+		}
+	}
+	slices.SortStableFunc(rs, func(a, b *Rule) int {
+		ha, hb := a.Hits(), b.Hits()
+		switch {
+		case ha > hb:
+			return -1
+		case ha < hb:
+			return 1
+		}
+		return 0
+	})
+	return rs[:min(n, len(rs))]
+}
+
+// NeverHit returns at most n rules that were never hit.
+func (reg *Registry) NeverHit(n int) []*Rule {
+	var rs []*Rule
+	for _, r := range reg.Rules() {
+		if len(rs) >= n {
+			break
+		}
+		if r.Hits() == 0 {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+const defaultReportLimit = 100
+
+// ServeHTTP serves the rule reports. The path of req should end with
+// "/top" or "/never_hit". The "n" parameter limits the number of rules.
+// Default is 100.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n := defaultReportLimit
+	if s := req.URL.Query().Get("n"); len(s) > 0 {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var rs []*Rule
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/top"):
+		rs = reg.Top(n)
+	case strings.HasSuffix(req.URL.Path, "/never_hit"):
+		rs = reg.NeverHit(n)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	sb := new(strings.Builder)
+	for _, r := range rs {
+		fmt.Fprintf(sb, "%d\t%s\n", r.Hits(), r)
+	}
+	w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rule_stats
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	src := reg.NewSource("provider:ads")
+	b := src.NewBatch()
+	r1 := b.Add("domain:a.com", 1)
+	r2 := b.Add("domain:b.com", 2)
+	b.Add("domain:c.com", 3)
+	b.Commit()
+
+	r1.Hit()
+	r1.Hit()
+	r2.Hit()
+
+	top := reg.Top(2)
+	if len(top) != 2 || top[0] != r1 || top[1] != r2 {
+		t.Fatalf("unexpected top rules %v", top)
+	}
+	if nh := reg.NeverHit(10); len(nh) != 1 || nh[0].Pattern != "domain:c.com" {
+		t.Fatalf("unexpected never hit rules %v", nh)
+	}
+	if s := r1.String(); s != "domain:a.com (provider:ads:1)" {
+		t.Fatalf("unexpected rule string %s", s)
+	}
+
+	// Hit counts should be kept after reloading.
+	b = src.NewBatch()
+	nr1 := b.Add("domain:a.com", 5)
+	b.Commit()
+	if nr1.Hits() != 2 {
+		t.Fatalf("hit count is not kept, want 2, got %d", nr1.Hits())
+	}
+	if n := len(reg.Rules()); n != 1 {
+		t.Fatalf("want 1 rule, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/plugins/m/top?n=1", nil))
+	if got := w.Body.String(); got != "2\tdomain:a.com (provider:ads:5)\n" {
+		t.Fatalf("unexpected top report %q", got)
+	}
+
+	// nil Registry should be valid.
+	var nilReg *Registry
+	nilReg.NewSource("s").NewBatch().Add("p", 1).Hit()
+	nilReg.NewSource("s").NewBatch().Commit()
+}
+
+func TestRegistry_Named(t *testing.T) {
+	reg := NewRegistry()
+	reg.Named("client_ip").NewSource("static").NewBatch().Add("10.0.0.0/8", 0)
+	b := reg.Named("client_ip").NewSource("static").NewBatch()
+	b.Add("10.0.0.0/8", 0)
+	b.Commit()
+	b = reg.Named("ecs").NewSource("static").NewBatch()
+	b.Add("10.0.0.0/8", 0)
+	b.Commit()
+
+	rs := reg.Rules()
+	if len(rs) != 2 {
+		t.Fatalf("want 2 rules, got %d", len(rs))
+	}
+	if rs[0].String() != "10.0.0.0/8 (client_ip:static)" || rs[1].String() != "10.0.0.0/8 (ecs:static)" {
+		t.Fatalf("unexpected rules %v %v", rs[0], rs[1])
+	}
+}
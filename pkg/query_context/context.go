@@ -20,6 +20,7 @@
 package query_context
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -51,6 +52,13 @@ type RequestMeta struct {
 	serverName string
 
 	protocol string
+
+	// clientID is the client id that was authenticated by the server.
+	// It might be empty.
+	clientID string
+
+	// clientCert is the verified tls client certificate. It might be nil.
+	clientCert *x509.Certificate
 }
 
 func NewRequestMeta(addr netip.Addr) *RequestMeta {
@@ -77,6 +85,16 @@ func (m *RequestMeta) SetServerName(serverName string) {
 	m.serverName = serverName
 }
 
+func (m *RequestMeta) SetClientID(id string) {
+	m.clientID = id
+}
+
+// SetClientCert sets the verified tls client certificate.
+// cert SHOULD NOT be modified after it was set.
+func (m *RequestMeta) SetClientCert(cert *x509.Certificate) {
+	m.clientCert = cert
+}
+
 func (m *RequestMeta) GetClientAddr() netip.Addr {
 	return m.clientAddr
 }
@@ -89,6 +107,17 @@ func (m *RequestMeta) GetServerName() string {
 	return m.serverName
 }
 
+func (m *RequestMeta) GetClientID() string {
+	return m.clientID
+}
+
+// GetClientCert returns the verified tls client certificate. It returns
+// nil if the client has no verified certificate.
+// The returned certificate SHOULD NOT be modified.
+func (m *RequestMeta) GetClientCert() *x509.Certificate {
+	return m.clientCert
+}
+
 // Context is a query context that pass through plugins
 // A Context will always have a non-nil Q.
 // Context MUST be created using NewContext.
@@ -105,8 +134,29 @@ type Context struct {
 	from   string
 	status error
 	marks  map[uint]struct{}
+
+	// matchedRules are the matcher rules that this query hit.
+	matchedRules []string
+
+	exchangeObservers []ExchangeObserver
 }
 
+// UpstreamExchange is an exchange between mosdns and an upstream.
+type UpstreamExchange struct {
+	Upstream     string // The address of the upstream.
+	UpstreamAddr string // The ip address of the upstream. It might be empty.
+	Query        *dns.Msg
+	Response     *dns.Msg // nil if the exchange failed.
+	QueryTime    time.Time
+	ResponseTime time.Time
+	Err          error
+}
+
+// ExchangeObserver observes upstream exchanges. It must be safe for
+// concurrent use. It may pack the msgs of e but must not retain or
+// modify them otherwise.
+type ExchangeObserver func(e *UpstreamExchange)
+
 var (
 	contextUid      uint32
 	zeroRequestMeta = &RequestMeta{}
@@ -240,9 +290,34 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 	for m := range ctx.marks {
 		d.AddMark(m)
 	}
+	d.matchedRules = append(d.matchedRules[:0], ctx.matchedRules...)
+	d.exchangeObservers = append(d.exchangeObservers[:0], ctx.exchangeObservers...)
 	return d
 }
 
+// AddExchangeObserver adds o to this Context. Plugins that exchange
+// with upstreams will call o after each exchange.
+func (ctx *Context) AddExchangeObserver(o ExchangeObserver) {
+	ctx.exchangeObservers = append(ctx.exchangeObservers, o)
+}
+
+// ExchangeObservers returns the ExchangeObserver(s) of this Context.
+// The returned slice should not be modified.
+func (ctx *Context) ExchangeObservers() []ExchangeObserver {
+	return ctx.exchangeObservers
+}
+
+// AddMatchedRule records that this Context hit the matcher rule.
+func (ctx *Context) AddMatchedRule(rule string) {
+	ctx.matchedRules = append(ctx.matchedRules, rule)
+}
+
+// MatchedRules returns the matcher rules that this Context hit.
+// The returned slice should not be modified.
+func (ctx *Context) MatchedRules() []string {
+	return ctx.matchedRules
+}
+
 // AddMark adds mark m to this Context.
 func (ctx *Context) AddMark(m uint) {
 	if ctx.marks == nil {
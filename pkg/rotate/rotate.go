@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rotate implements a file writer that rotates the file by
+// size and time.
+package rotate
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000"
+
+type Opts struct {
+	// Path is the path of the file. Required.
+	Path string
+
+	// MaxSize is the maximum size in bytes of the file before it gets
+	// rotated. Zero means no size limit.
+	MaxSize int64
+
+	// Interval is the maximum age of the file before it gets rotated.
+	// Zero means no time limit.
+	Interval time.Duration
+
+	// MaxBackups is the maximum number of rotated files to keep.
+	// Zero means all rotated files are kept.
+	MaxBackups int
+
+	// Compress compresses the rotated files with gzip.
+	Compress bool
+}
+
+// Writer is an io.WriteCloser that writes to Opts.Path. Rotated files
+// are renamed to "Path.timestamp" (with a ".gz" suffix if they were
+// compressed). Writer is safe for concurrent use.
+type Writer struct {
+	opts Opts
+
+	m          sync.Mutex
+	f          *os.File
+	size       int64
+	nextRotate time.Time
+	lastBackup time.Time
+	closed     bool
+
+	bgM  sync.Mutex // serializes compression and cleanup
+	bgWg sync.WaitGroup
+}
+
+var _ io.WriteCloser = (*Writer)(nil)
+
+var errClosed = errors.New("writer closed")
+
+func NewWriter(opts Opts) (*Writer, error) {
+	if len(opts.Path) == 0 {
+		return nil, errors.New("empty path")
+	}
+	w := &Writer{opts: opts}
+	if err := w.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the file in append mode. Caller must hold the lock.
+func (w *Writer) open(now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(w.opts.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	if w.opts.Interval > 0 {
+		w.nextRotate = now.Add(w.opts.Interval)
+	}
+	return nil
+}
+
+// Write writes p to the file. The file will be rotated before p is
+// written if p cannot fit in it or it is older than Opts.Interval.
+// If the rotation fails, p is still written to Opts.Path and the
+// rotation error is returned.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return 0, errClosed
+	}
+
+	now := time.Now()
+	if w.f == nil { // A previous rotation failed to reopen the file.
+		if err := w.open(now); err != nil {
+			return 0, err
+		}
+	}
+
+	var rotateErr error
+	needRotate := w.opts.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.opts.MaxSize
+	needRotate = needRotate || (!w.nextRotate.IsZero() && !now.Before(w.nextRotate))
+	if needRotate {
+		if err := w.rotate(now); err != nil {
+			if w.f == nil {
+				return 0, fmt.Errorf("failed to rotate file, %w", err)
+			}
+			rotateErr = fmt.Errorf("failed to rotate file, %w", err)
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Rotate rotates the file immediately.
+func (w *Writer) Rotate() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	now := time.Now()
+	if w.f == nil {
+		if err := w.open(now); err != nil {
+			return err
+		}
+	}
+	return w.rotate(now)
+}
+
+// rotate renames current file and opens a new one. Caller must hold the lock.
+// If the rotation fails, rotate reopens Opts.Path so that later writes
+// are not lost. w.f is nil if the reopen fails as well.
+func (w *Writer) rotate(now time.Time) error {
+	// The file must be closed before it is renamed on windows.
+	err := w.f.Close()
+	w.f = nil
+
+	// Backup names must be unique and in time order.
+	t := now.Truncate(time.Millisecond)
+	if !t.After(w.lastBackup) {
+		t = w.lastBackup.Add(time.Millisecond)
+	}
+	w.lastBackup = t
+	backup := w.opts.Path + "." + t.Format(backupTimeFormat)
+	if err == nil {
+		err = os.Rename(w.opts.Path, backup)
+	}
+	if err == nil {
+		err = w.open(now)
+	}
+	if err != nil {
+		w.open(now) // best effort
+		return err
+	}
+
+	w.bgWg.Add(1)
+	go func() {
+		defer w.bgWg.Done()
+		w.bgM.Lock()
+		defer w.bgM.Unlock()
+		if w.opts.Compress {
+			compressFile(backup) // best effort
+		}
+		w.removeOldBackups()
+	}()
+	return nil
+}
+
+// Backups returns the rotated files, oldest first.
+func (w *Writer) Backups() ([]string, error) {
+	l, err := filepath.Glob(globEscape(w.opts.Path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// Timestamps are fixed length, so lexical order is the time order.
+	slices.Sort(l)
+	return l, nil
+}
+
+func (w *Writer) removeOldBackups() {
+	if w.opts.MaxBackups <= 0 {
+		return
+	}
+	l, err := w.Backups()
+	if err != nil {
+		return
+	}
+	// Do not remove the file that is being compressed.
+	l = slices.DeleteFunc(l, func(s string) bool { return strings.HasSuffix(s, ".gz.tmp") })
+	for len(l) > w.opts.MaxBackups {
+		os.Remove(l[0])
+		l = l[1:]
+	}
+}
+
+// Close closes the file and waits for the background compression to finish.
+func (w *Writer) Close() error {
+	w.m.Lock()
+	if w.closed {
+		w.m.Unlock()
+		return nil
+	}
+	w.closed = true
+	var err error
+	if w.f != nil {
+		err = w.f.Close()
+	}
+	w.m.Unlock()
+
+	w.bgWg.Wait()
+	return err
+}
+
+// compressFile compresses name to name.gz and removes name.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := name + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if closeErr := gw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+func globEscape(s string) string {
+	r := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`)
+	return r.Replace(s)
+}
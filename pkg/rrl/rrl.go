@@ -0,0 +1,341 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package rrl implements DNS Response Rate Limiting, in the spirit of
+// BIND's RRL. It limits identical responses to a client ip range to
+// mitigate reflection attacks that spoof the addresses of victims.
+package rrl
+
+import (
+	"fmt"
+	"hash/maphash"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/concurrent_map"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// Action is the decision of a Limiter for a response.
+type Action int
+
+const (
+	// Send sends the response.
+	Send Action = iota
+	// Drop drops the response.
+	Drop
+	// Slip sends a truncated response instead, so legitimate clients can
+	// retry over tcp.
+	Slip
+)
+
+const (
+	defaultSlip       = 2
+	defaultIPv4Mask   = 24
+	defaultIPv6Mask   = 56
+	gcInterval        = time.Second * 10
+	bucketIdleTimeout = time.Second * 10
+)
+
+type Opts struct {
+	// ResponsesPerSecond is the limit of identical responses per second
+	// to a client ip range. It must be positive.
+	ResponsesPerSecond int
+
+	// Slip sends every Slip-th limited response as a truncated response.
+	// Default is 2. Negative value disables slips, all limited responses
+	// are dropped.
+	Slip int
+
+	// IP masks to aggregate a client ip range.
+	IPv4Mask int // Default is 24.
+	IPv6Mask int // Default is 56.
+
+	// LogOnly only logs and counts the responses that would be limited.
+	LogOnly bool
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+func (opts *Opts) Init() error {
+	if opts.ResponsesPerSecond <= 0 {
+		return fmt.Errorf("invalid responses per second %d, should be positive", opts.ResponsesPerSecond)
+	}
+	if m := opts.IPv4Mask; m < 0 || m > 32 {
+		return fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
+	}
+	if m := opts.IPv6Mask; m < 0 || m > 128 {
+		return fmt.Errorf("invalid ipv6 mask %d, should be 0~128", m)
+	}
+	utils.SetDefaultNum(&opts.Slip, defaultSlip)
+	utils.SetDefaultNum(&opts.IPv4Mask, defaultIPv4Mask)
+	utils.SetDefaultNum(&opts.IPv6Mask, defaultIPv6Mask)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return nil
+}
+
+// Limiter limits identical responses per (client ip range, name, response
+// class). Limiter is safe for concurrent use.
+type Limiter struct {
+	opts Opts
+	m    *concurrent_map.Map[key, *bucket]
+
+	limitedTotal *prometheus.CounterVec
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func NewLimiter(opts Opts) (*Limiter, error) {
+	if err := opts.Init(); err != nil {
+		return nil, err
+	}
+	l := &Limiter{
+		opts: opts,
+		m:    concurrent_map.NewMap[key, *bucket](),
+		limitedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rrl_limited_response_total",
+			Help: "The total number of responses that were limited by rrl by action. If rrl is in log only mode, the responses were sent",
+		}, []string{"action"}),
+		closeNotify: make(chan struct{}),
+	}
+	go l.gcLoop()
+	return l, nil
+}
+
+// response classes
+const (
+	classAnswer uint8 = iota
+	classNoData
+	classNXDomain
+	classError
+)
+
+var hashSeed = maphash.MakeSeed()
+
+type key struct {
+	prefix netip.Prefix
+	name   string
+	qType  uint16
+	class  uint8
+	rcode  uint16
+}
+
+func (k key) MapHash() int {
+	h := new(maphash.Hash)
+	h.SetSeed(hashSeed)
+	b, _ := k.prefix.MarshalBinary()
+	h.Write(b)
+	h.WriteString(k.name)
+	return int(h.Sum64() & 0x7fffffff)
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited int // number of limited responses since the bucket became empty
+}
+
+// Check checks response r to client and returns the Action of it.
+// In LogOnly mode, Check always returns Send.
+func (l *Limiter) Check(client netip.Addr, r *dns.Msg) Action {
+	if !client.IsValid() || len(r.Question) == 0 {
+		return Send
+	}
+	k := l.key(client, r)
+	now := time.Now()
+	rate := float64(l.opts.ResponsesPerSecond)
+
+	action := Send
+	startLimiting := false
+	l.m.TestAndSet(k, func(_ key, b *bucket, ok bool) (*bucket, bool, bool) {
+		if !ok {
+			b = &bucket{tokens: rate, last: now}
+		}
+		b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.limited = 0
+			return b, !ok, false
+		}
+		b.limited++
+		startLimiting = b.limited == 1
+		if l.opts.Slip > 0 && b.limited%l.opts.Slip == 0 {
+			action = Slip
+		} else {
+			action = Drop
+		}
+		return b, !ok, false
+	})
+
+	switch action {
+	case Send:
+		return Send
+	case Drop:
+		l.limitedTotal.WithLabelValues("drop").Inc()
+	case Slip:
+		l.limitedTotal.WithLabelValues("slip").Inc()
+	}
+	if startLimiting {
+		l.opts.Logger.Info("rrl starts limiting responses",
+			zap.Stringer("client", k.prefix),
+			zap.String("name", k.name),
+			zap.Uint16("qtype", k.qType),
+			zap.Uint16("rcode", k.rcode),
+			zap.Bool("log_only", l.opts.LogOnly),
+		)
+	}
+	if l.opts.LogOnly {
+		return Send
+	}
+	return action
+}
+
+func (l *Limiter) key(client netip.Addr, r *dns.Msg) key {
+	q := r.Question[0]
+	k := key{
+		prefix: l.applyMask(client),
+		name:   strings.ToLower(q.Header().Name),
+		qType:  dns.RRToType(q),
+		rcode:  r.Rcode,
+	}
+	switch {
+	case r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0:
+		k.class = classAnswer
+		// Answers synthesized from a wildcard are limited by the
+		// wildcard, so random sub domains are counted together.
+		if w := wildcardName(k.name, r.Answer); len(w) > 0 {
+			k.name = w
+		}
+	case r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError:
+		// NODATA, NXDOMAIN and referrals are limited by their zone
+		// instead of qname, so random sub domains are counted together.
+		k.class = classNoData
+		if r.Rcode == dns.RcodeNameError {
+			k.class = classNXDomain
+		}
+		k.qType = 0
+		if z := zoneName(r.Ns); len(z) > 0 {
+			k.name = z
+		}
+	default:
+		// All errors to a client range are counted together.
+		k.class = classError
+		k.name = ""
+		k.qType = 0
+	}
+	return k
+}
+
+// wildcardName returns the wildcard that the answer of qName was
+// synthesized from, e.g. "*.example.com.". It is known from the RRSIG
+// of qName, whose labels field is less than the labels of qName
+// (RFC 4035 5.3.4). It returns "" if the answer is not from a wildcard
+// or is not signed.
+func wildcardName(qName string, answer []dns.RR) string {
+	for _, rr := range answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || !strings.EqualFold(sig.Header().Name, qName) {
+			continue
+		}
+		labels := dnsLabels(qName)
+		if n := int(sig.Labels); n < len(labels) {
+			return "*." + strings.Join(labels[len(labels)-n:], ".") + "."
+		}
+	}
+	return ""
+}
+
+// zoneName returns the owner of the SOA in the authority section ns.
+// If there is no SOA, it returns the owner of the first record (e.g. the
+// NS of a referral), or "" if ns is empty.
+func zoneName(ns []dns.RR) string {
+	for _, rr := range ns {
+		if _, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(rr.Header().Name)
+		}
+	}
+	if len(ns) > 0 {
+		return strings.ToLower(ns[0].Header().Name)
+	}
+	return ""
+}
+
+// dnsLabels returns the labels of fqdn name. The root has no label.
+func dnsLabels(name string) []string {
+	if name == "." || len(name) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(name, "."), ".")
+}
+
+func (l *Limiter) applyMask(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, l.opts.IPv4Mask).Masked()
+	}
+	return netip.PrefixFrom(addr, l.opts.IPv6Mask).Masked()
+}
+
+func (l *Limiter) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.GC(now)
+		case <-l.closeNotify:
+			return
+		}
+	}
+}
+
+// GC removes the idle buckets.
+func (l *Limiter) GC(now time.Time) {
+	l.m.RangeDo(func(_ key, b *bucket, ok bool) (*bucket, bool, bool) {
+		return nil, false, ok && now.Sub(b.last) > bucketIdleTimeout
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.limitedTotal.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.limitedTotal.Collect(ch)
+}
+
+// Close stops the background gc goroutine.
+// Close always returns a nil error.
+func (l *Limiter) Close() error {
+	l.closeOnce.Do(func() { close(l.closeNotify) })
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rrl
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func newResponse(name string, rcode uint16) *dns.Msg {
+	q := dns.NewMsg(name, dns.TypeA)
+	r := new(dns.Msg)
+	dnsutil.SetReply(r, q)
+	r.Rcode = rcode
+	return r
+}
+
+func TestLimiter_Check(t *testing.T) {
+	l, err := NewLimiter(Opts{ResponsesPerSecond: 2, Slip: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := netip.MustParseAddr("192.0.2.1")
+	r := newResponse("example.com.", dns.RcodeSuccess)
+	want := []Action{Send, Send, Drop, Slip, Drop, Slip}
+	for i, w := range want {
+		if got := l.Check(client, r); got != w {
+			t.Fatalf("#%d: want action %d, got %d", i, w, got)
+		}
+	}
+
+	// Clients in the same /24 share the limit.
+	if got := l.Check(netip.MustParseAddr("192.0.2.200"), r); got == Send {
+		t.Fatal("client range was not limited")
+	}
+	// Other clients and names are not limited.
+	if got := l.Check(netip.MustParseAddr("198.51.100.1"), r); got != Send {
+		t.Fatal("other client was limited")
+	}
+	if got := l.Check(client, newResponse("example.org.", dns.RcodeSuccess)); got != Send {
+		t.Fatal("other name was limited")
+	}
+}
+
+func TestLimiter_LogOnly(t *testing.T) {
+	l, err := NewLimiter(Opts{ResponsesPerSecond: 1, LogOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := netip.MustParseAddr("2001:db8::1")
+	r := newResponse("example.com.", dns.RcodeServerFailure)
+	for i := 0; i < 5; i++ {
+		if got := l.Check(client, r); got != Send {
+			t.Fatalf("#%d: log only limiter returned %d", i, got)
+		}
+	}
+}
+
+func TestLimiter_Check_randomSubdomains(t *testing.T) {
+	wildcardAnswer := func(name string) *dns.Msg {
+		r := newResponse(name, dns.RcodeSuccess)
+		hdr := dns.Header{Name: name, Class: dns.ClassINET, TTL: 60}
+		r.Answer = []dns.RR{
+			&dns.A{Hdr: hdr, A: rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+			&dns.RRSIG{Hdr: hdr, RRSIG: rdata.RRSIG{TypeCovered: dns.TypeA, Labels: 2, SignerName: "example.com."}},
+		}
+		return r
+	}
+	negative := func(rcode uint16) func(name string) *dns.Msg {
+		return func(name string) *dns.Msg {
+			r := newResponse(name, rcode)
+			nsec := &dns.NSEC{Hdr: dns.Header{Name: "a.example.com.", Class: dns.ClassINET, TTL: 60}}
+			r.Ns = []dns.RR{nsec, dnsutils.FakeSOA("example.com.")}
+			return r
+		}
+	}
+	tests := []struct {
+		name     string
+		response func(name string) *dns.Msg
+	}{
+		{"wildcard", wildcardAnswer},
+		{"nxdomain", negative(dns.RcodeNameError)},
+		{"nodata", negative(dns.RcodeSuccess)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLimiter(Opts{ResponsesPerSecond: 2, Slip: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			client := netip.MustParseAddr("192.0.2.1")
+			want := []Action{Send, Send, Drop, Drop}
+			for i, w := range want {
+				r := tt.response(fmt.Sprintf("r%d.example.com.", i))
+				if got := l.Check(client, r); got != w {
+					t.Fatalf("#%d: want action %d, got %d", i, w, got)
+				}
+			}
+		})
+	}
+
+	// Answers that are not from a wildcard are limited by their names.
+	l, err := NewLimiter(Opts{ResponsesPerSecond: 1, Slip: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		r := newResponse(fmt.Sprintf("r%d.example.com.", i), dns.RcodeSuccess)
+		hdr := dns.Header{Name: r.Question[0].Header().Name, Class: dns.ClassINET, TTL: 60}
+		r.Answer = []dns.RR{
+			&dns.A{Hdr: hdr, A: rdata.A{Addr: netip.MustParseAddr("192.0.2.1")}},
+			&dns.RRSIG{Hdr: hdr, RRSIG: rdata.RRSIG{TypeCovered: dns.TypeA, Labels: 3, SignerName: "example.com."}},
+		}
+		if got := l.Check(netip.MustParseAddr("192.0.2.1"), r); got != Send {
+			t.Fatalf("#%d: want Send, got %d", i, got)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"gitlab.com/go-extension/tls"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+// ACL controls which clients can access a server. Its lists can be
+// replaced by Set while the server is running.
+type ACL struct {
+	lists atomic.Pointer[aclLists]
+}
+
+type aclLists struct {
+	allow netlist.Matcher
+	deny  netlist.Matcher
+}
+
+// NewACL returns an ACL. If allow is nil, all clients are allowed.
+// deny has priority over allow.
+func NewACL(allow, deny netlist.Matcher) *ACL {
+	a := new(ACL)
+	a.Set(allow, deny)
+	return a
+}
+
+// Set replaces the lists of a. It is concurrent safe.
+func (a *ACL) Set(allow, deny netlist.Matcher) {
+	a.lists.Store(&aclLists{allow: allow, deny: deny})
+}
+
+// Allowed reports whether addr can access the server. If a is nil, all
+// clients are allowed. If addr is invalid (e.g. a unix socket client),
+// it is only allowed if there is no allow list.
+func (a *ACL) Allowed(addr netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	l := a.lists.Load()
+	if !addr.IsValid() {
+		return l.allow == nil
+	}
+	addr = addr.Unmap()
+	if l.deny != nil {
+		if denied, _ := l.deny.Match(addr); denied {
+			return false
+		}
+	}
+	if l.allow != nil {
+		allowed, _ := l.allow.Match(addr)
+		return allowed
+	}
+	return true
+}
+
+// refusedResponse returns a REFUSED response of the raw query msg q
+// without parsing it. It returns nil if q is shorter than a header.
+// The response has no question section, which is allowed by RFC 1035.
+func refusedResponse(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	if q[2]&0x80 != 0 { // not a query
+		return nil
+	}
+	r := make([]byte, 12)
+	r[0], r[1] = q[0], q[1] // id
+	r[2] = 0x80 | q[2]&0x79 // qr, opcode, rd
+	r[3] = 5                // rcode REFUSED
+	return r
+}
+
+// aclListener closes the connections from denied clients. A tls listener
+// must be placed over it (see CreateETLSListner), the tls connections
+// that it accepts have been checked and are passed through.
+type aclListener struct {
+	net.Listener
+	acl *ACL
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		switch c := c.(type) {
+		case *tls.Conn:
+			return c, nil
+		case *net.TCPConn:
+			// RemoteAddr does not block. The conn is not wrapped so
+			// that kernel tls can be enabled on it.
+			if l.acl.Allowed(utils.GetAddrFromAddr(c.RemoteAddr())) {
+				return c, nil
+			}
+			c.Close()
+		default:
+			return &aclConn{Conn: c, acl: l.acl}, nil
+		}
+	}
+}
+
+var errClientDenied = errors.New("client is denied by acl")
+
+// aclConn closes the connection on its first Read if the client is
+// denied. The check is not done in Accept because RemoteAddr may block
+// the accept loop, e.g. a proxy protocol connection reads its header
+// in RemoteAddr.
+type aclConn struct {
+	net.Conn
+	acl *ACL
+
+	once sync.Once
+	err  error
+}
+
+func (c *aclConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		if !c.acl.Allowed(utils.GetAddrFromAddr(c.Conn.RemoteAddr())) {
+			c.err = errClientDenied
+			c.Conn.Close()
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// quicACLConfig sets c.GetConfigForClient, so connections from denied
+// clients are refused before the handshake.
+func quicACLConfig(c *quic.Config, acl *ACL) {
+	c.GetConfigForClient = func(info *quic.ClientInfo) (*quic.Config, error) {
+		if !acl.Allowed(utils.GetAddrFromAddr(info.RemoteAddr)) {
+			return nil, errClientDenied
+		}
+		return c, nil
+	}
+}
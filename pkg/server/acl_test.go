@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+)
+
+func newTestList(prefixes ...string) *netlist.List {
+	l := netlist.NewList()
+	for _, s := range prefixes {
+		l.Append(netip.MustParsePrefix(s))
+	}
+	l.Sort()
+	return l
+}
+
+func TestACL_Allowed(t *testing.T) {
+	acl := NewACL(
+		newTestList("192.168.0.0/16", "2001:db8::/32"),
+		newTestList("192.168.1.0/24"),
+	)
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.168.0.1", true},
+		{"::ffff:192.168.0.1", true},
+		{"192.168.1.1", false},
+		{"10.0.0.1", false},
+		{"2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		if got := acl.Allowed(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if acl.Allowed(netip.Addr{}) {
+		t.Error("invalid addr should be denied if there is an allow list")
+	}
+
+	acl.Set(nil, newTestList("10.0.0.0/8"))
+	if acl.Allowed(netip.MustParseAddr("10.0.0.1")) || !acl.Allowed(netip.MustParseAddr("192.168.1.1")) {
+		t.Error("acl lists are not replaced by Set")
+	}
+
+	var nilACL *ACL
+	if !nilACL.Allowed(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("nil acl should allow all clients")
+	}
+}
+
+func Test_refusedResponse(t *testing.T) {
+	q := []byte{0x12, 0x34, 0x01, 0x20, 0, 1, 0, 0, 0, 0, 0, 1, 0xff}
+	r := refusedResponse(q)
+	want := []byte{0x12, 0x34, 0x81, 0x05, 0, 0, 0, 0, 0, 0, 0, 0}
+	if string(r) != string(want) {
+		t.Fatalf("want %x, got %x", want, r)
+	}
+	if refusedResponse(q[:11]) != nil {
+		t.Fatal("short msg should have no response")
+	}
+	if refusedResponse(want) != nil {
+		t.Fatal("response should have no response")
+	}
+}
+
+// lazyAddrConn counts the calls of RemoteAddr, like a proxy protocol
+// conn that reads its header in RemoteAddr.
+type lazyAddrConn struct {
+	net.Conn
+	addr  netip.AddrPort
+	calls atomic.Int32
+}
+
+func (c *lazyAddrConn) RemoteAddr() net.Addr {
+	c.calls.Add(1)
+	return net.TCPAddrFromAddrPort(c.addr)
+}
+
+type testListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func Test_aclListener(t *testing.T) {
+	l := &testListener{conns: make(chan net.Conn, 2)}
+	acl := NewACL(nil, newTestList("10.0.0.0/8"))
+	al := &aclListener{Listener: l, acl: acl}
+
+	for _, tt := range []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.0.0.1:53", false},
+		{"192.168.0.1:53", true},
+	} {
+		c1, c2 := net.Pipe()
+		conn := &lazyAddrConn{Conn: c1, addr: netip.MustParseAddrPort(tt.addr)}
+		l.conns <- conn
+		c, err := al.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := conn.calls.Load(); n != 0 {
+			t.Fatalf("%s: RemoteAddr was called %d times by Accept", tt.addr, n)
+		}
+
+		go c2.Write([]byte("a"))
+		b := make([]byte, 1)
+		_, err = c.Read(b)
+		if tt.allowed {
+			if err != nil || b[0] != 'a' {
+				t.Fatalf("%s: want data, got %q, %v", tt.addr, b, err)
+			}
+		} else if !errors.Is(err, errClientDenied) {
+			t.Fatalf("%s: want errClientDenied, got %v", tt.addr, err)
+		}
+		c.Close()
+		c2.Close()
+	}
+}
+
+func Test_quicACLConfig(t *testing.T) {
+	c := &quic.Config{Allow0RTT: true}
+	quicACLConfig(c, NewACL(nil, newTestList("10.0.0.0/8")))
+
+	addr := func(s string) *quic.ClientInfo {
+		return &quic.ClientInfo{RemoteAddr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s))}
+	}
+	if _, err := c.GetConfigForClient(addr("10.0.0.1:53")); !errors.Is(err, errClientDenied) {
+		t.Fatalf("want errClientDenied, got %v", err)
+	}
+	got, err := c.GetConfigForClient(addr("192.168.0.1:53"))
+	if err != nil || got != c {
+		t.Fatalf("want the listener config, got %v, %v", got, err)
+	}
+}
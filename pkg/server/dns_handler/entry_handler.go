@@ -22,6 +22,7 @@ package dns_handler
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -30,7 +31,9 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/ip_observer"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/tracing"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -66,6 +69,13 @@ type EntryHandlerOpts struct {
 
 	// RecursionAvailable sets the dns.Msg.RecursionAvailable flag globally.
 	RecursionAvailable bool
+
+	// IPObserver will be notified when a client sends a malformed query.
+	// Default is a ip_observer.NopObserver.
+	IPObserver ip_observer.IPObserver
+
+	// Tracer creates a root span for each sampled query. Nil disables tracing.
+	Tracer *tracing.Tracer
 }
 
 func (opts *EntryHandlerOpts) Init() error {
@@ -75,19 +85,47 @@ func (opts *EntryHandlerOpts) Init() error {
 	if opts.Entry == nil {
 		return errors.New("nil entry")
 	}
+	if opts.IPObserver == nil {
+		opts.IPObserver = ip_observer.NewNopObserver()
+	}
 	utils.SetDefaultNum(&opts.QueryTimeout, defaultQueryTimeout)
 	return nil
 }
 
 type EntryHandler struct {
 	opts EntryHandlerOpts
+
+	em       sync.RWMutex
+	entry    executable_seq.Executable
+	inflight *sync.WaitGroup
 }
 
 func NewEntryHandler(opts EntryHandlerOpts) (*EntryHandler, error) {
 	if err := opts.Init(); err != nil {
 		return nil, err
 	}
-	return &EntryHandler{opts: opts}, nil
+	return &EntryHandler{opts: opts, entry: opts.Entry, inflight: new(sync.WaitGroup)}, nil
+}
+
+// SetEntry replaces the entry of h. Queries that arrive after SetEntry
+// is called will be handled by e. SetEntry blocks until all queries that
+// are being handled by the old entry are done.
+func (h *EntryHandler) SetEntry(e executable_seq.Executable) {
+	h.em.Lock()
+	wg := h.inflight
+	h.entry = e
+	h.inflight = new(sync.WaitGroup)
+	h.em.Unlock()
+	wg.Wait()
+}
+
+// acquireEntry returns current entry. Caller must call release
+// after the entry is no longer used.
+func (h *EntryHandler) acquireEntry() (e executable_seq.Executable, release func()) {
+	h.em.RLock()
+	defer h.em.RUnlock()
+	h.inflight.Add(1)
+	return h.entry, h.inflight.Done
 }
 
 // ServeDNS implements Handler.
@@ -104,11 +142,13 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	// return FORMERR response
 	if len(req.Question) == 0 {
 		h.opts.Logger.Warn("zero question")
+		h.observeBadClient(meta)
 		return h.responseFormErr(req), nil
 	}
 	for _, question := range req.Question {
 		if ok := dnsutil.IsName(question.Header().Name); !ok {
 			h.opts.Logger.Warn("invalid question name: " + question.Header().Name)
+			h.observeBadClient(meta)
 			return h.responseFormErr(req), nil
 		}
 	}
@@ -116,12 +156,27 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	id := req.ID
 
 	// exec entry
+	entry, release := h.acquireEntry()
+	defer release()
 	qCtx := query_context.NewContext(req, meta)
-	err := h.opts.Entry.Exec(ctx, qCtx, nil)
+	var span *tracing.Span
+	if h.opts.Tracer.Sample(meta.GetClientAddr()) {
+		ctx, span = h.opts.Tracer.StartRoot(ctx, true, tracing.SpanKindServer, "query",
+			tracing.String("dns.qname", req.Question[0].Header().Name),
+			tracing.Int("dns.qtype", int(dns.RRToType(req.Question[0]))),
+			tracing.String("client.address", meta.GetClientAddr().String()),
+			tracing.String("network.protocol.name", meta.GetProtocol()),
+		)
+	}
+	err := entry.Exec(ctx, qCtx, nil)
 	respMsg := qCtx.R()
 	if err == nil {
 		err = ctx.Err()
 	}
+	if respMsg != nil {
+		span.SetAttributes(tracing.Int("dns.rcode", int(respMsg.Rcode)))
+	}
+	span.End(err)
 	if err != nil {
 		h.opts.Logger.Warn("entry", zap.String("status", err.Error()), qCtx.InfoField())
 	} else if respMsg == nil {
@@ -143,6 +198,12 @@ func (h *EntryHandler) ServeDNS(ctx context.Context, req *dns.Msg, meta *query_c
 	return respMsg, nil
 }
 
+func (h *EntryHandler) observeBadClient(meta *query_context.RequestMeta) {
+	if addr := meta.GetClientAddr(); addr.IsValid() {
+		h.opts.IPObserver.Observe(addr)
+	}
+}
+
 func (h *EntryHandler) responseFormErr(req *dns.Msg) *dns.Msg {
 	res := new(dns.Msg)
 	dnsutil.SetReply(res, req)
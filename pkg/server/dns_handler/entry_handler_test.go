@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_handler
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// blockingEntry blocks the first query until release is closed.
+type blockingEntry struct {
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingEntry) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecChainNode) error {
+	first := false
+	e.once.Do(func() { first = true })
+	if first {
+		close(e.started)
+		<-e.release
+	}
+	return nil
+}
+
+type countingEntry struct {
+	n atomic.Int32
+}
+
+func (e *countingEntry) Exec(_ context.Context, _ *query_context.Context, _ executable_seq.ExecChainNode) error {
+	e.n.Add(1)
+	return nil
+}
+
+func TestEntryHandler_SetEntry(t *testing.T) {
+	old := &blockingEntry{started: make(chan struct{}), release: make(chan struct{})}
+	h, err := NewEntryHandler(EntryHandlerOpts{Entry: old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func() {
+		q := dns.NewMsg("example.com.", dns.TypeA)
+		h.ServeDNS(context.Background(), q, query_context.NewRequestMeta(netip.Addr{}))
+	}
+
+	inflightDone := make(chan struct{})
+	go func() {
+		defer close(inflightDone)
+		serve()
+	}()
+	<-old.started
+
+	newEntry := new(countingEntry)
+	setDone := make(chan struct{})
+	go func() {
+		defer close(setDone)
+		h.SetEntry(newEntry)
+	}()
+
+	// New queries are handled by the new entry while the old one is draining.
+	deadline := time.Now().Add(time.Second * 5)
+	for newEntry.n.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("new entry is not used")
+		}
+		serve()
+	}
+
+	select {
+	case <-setDone:
+		t.Fatal("SetEntry returned before the in-flight query is done")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(old.release)
+	select {
+	case <-setDone:
+	case <-time.After(time.Second * 5):
+		t.Fatal("SetEntry did not return after the in-flight query is done")
+	}
+	<-inflightDone
+}
@@ -38,6 +38,9 @@ func (s *Server) ServeHTTP(l net.Listener) error {
 	if s.opts.HttpHandler == nil {
 		return errMissingHTTPHandler
 	}
+	if s.opts.ACL != nil {
+		l = &aclListener{Listener: l, acl: s.opts.ACL}
+	}
 
 	idleTimeout := s.opts.IdleTimeout
 	if idleTimeout == 0 {
@@ -89,6 +92,7 @@ func (r *eRequest) TLS() *H.TlsInfo {
 		Version:            r.r.TLS.Version,
 		ServerName:         r.r.TLS.ServerName,
 		NegotiatedProtocol: r.r.TLS.NegotiatedProtocol,
+		ClientCert:         verifiedClientCert(r.r.TLS.VerifiedChains),
 	}
 }
 
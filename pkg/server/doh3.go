@@ -90,6 +90,7 @@ func (r *sRequest) TLS() *H.TlsInfo {
 		Version:            r.r.TLS.Version,
 		ServerName:         r.r.TLS.ServerName,
 		NegotiatedProtocol: r.r.TLS.NegotiatedProtocol,
+		ClientCert:         verifiedClientCert(r.r.TLS.VerifiedChains),
 	}
 }
 
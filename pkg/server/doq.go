@@ -97,11 +97,33 @@ func (s *Server) ServeQUIC(l *quic.EarlyListener) error {
 			}
 
 			clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
+			if s.opts.IPObserver.IsBanned(clientAddr) || !s.opts.ACL.Allowed(clientAddr) {
+				closer.close(1)
+				return
+			}
 			meta := C.NewRequestMeta(clientAddr)
 			meta.SetProtocol(C.ProtocolQUIC)
-			meta.SetServerName(c.ConnectionState().TLS.ServerName)
 			defer s.trackCloser(closer, false)
 
+			if s.opts.ClientCAs != nil {
+				// Accept returns before the client certificate is verified.
+				select {
+				case <-c.HandshakeComplete():
+				case <-time.After(idleTimeout):
+					closer.close(1)
+					return
+				case <-c.Context().Done(): // handshake failed
+					closer.close(1)
+					return
+				case <-quicConnCtx.Done():
+					closer.close(1)
+					return
+				}
+			}
+			tlsState := c.ConnectionState().TLS
+			meta.SetServerName(tlsState.ServerName)
+			meta.SetClientCert(verifiedClientCert(tlsState.VerifiedChains))
+
 			timeout := time.AfterFunc(firstReadTimeout, cancelConn)
 			for {
 				stream, err := c.AcceptStream(quicConnCtx)
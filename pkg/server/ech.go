@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	eTLS "gitlab.com/go-extension/tls"
+)
+
+// loadECHKeys loads the Encrypted Client Hello keys from files.
+func loadECHKeys(files []string) ([]eTLS.EncryptedClientHelloKey, error) {
+	var keys []eTLS.EncryptedClientHelloKey
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		k, err := parseECHKeys(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ech key file %s, %w", file, err)
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
+
+// parseECHKeys parses the keys of a PEM file that has a "PRIVATE KEY"
+// block and an "ECHCONFIG" block.
+func parseECHKeys(b []byte) ([]eTLS.EncryptedClientHelloKey, error) {
+	var privateKey *ecdh.PrivateKey
+	var configList []byte
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ek, ok := k.(*ecdh.PrivateKey)
+			if !ok || ek.Curve() != ecdh.X25519() {
+				return nil, errors.New("private key is not a x25519 key")
+			}
+			privateKey = ek
+		case "ECHCONFIG":
+			configList = block.Bytes
+		}
+	}
+	if privateKey == nil {
+		return nil, errors.New("missing private key")
+	}
+	if configList == nil {
+		return nil, errors.New("missing ech config")
+	}
+
+	configs, err := splitECHConfigList(configList)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]eTLS.EncryptedClientHelloKey, 0, len(configs))
+	for _, c := range configs {
+		keys = append(keys, eTLS.EncryptedClientHelloKey{
+			Config:      c,
+			PrivateKey:  privateKey.Bytes(),
+			SendAsRetry: true,
+		})
+	}
+	return keys, nil
+}
+
+// splitECHConfigList splits an ECHConfigList into ECHConfigs.
+func splitECHConfigList(b []byte) ([][]byte, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, errors.New("invalid ech config list length")
+	}
+	b = b[2:]
+	var configs [][]byte
+	for len(b) > 0 {
+		// version(2) + length(2) + contents
+		if len(b) < 4 {
+			return nil, errors.New("invalid ech config")
+		}
+		l := 4 + int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < l {
+			return nil, errors.New("invalid ech config length")
+		}
+		configs = append(configs, b[:l])
+		b = b[l:]
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("empty ech config list")
+	}
+	return configs, nil
+}
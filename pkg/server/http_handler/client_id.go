@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ClientIDPlaceholder is the path segment of HandlerOpts.Path that
+// contains the client id.
+const ClientIDPlaceholder = "{client_id}"
+
+// pathTemplate matches request paths that contain a client id.
+type pathTemplate struct {
+	prefix, suffix string
+}
+
+func parsePathTemplate(path string) (*pathTemplate, error) {
+	prefix, suffix, ok := strings.Cut(path, ClientIDPlaceholder)
+	if !ok {
+		return nil, nil
+	}
+	if strings.Contains(suffix, ClientIDPlaceholder) {
+		return nil, fmt.Errorf("path %s has multiple %s", path, ClientIDPlaceholder)
+	}
+	if !strings.HasSuffix(prefix, "/") || (len(suffix) > 0 && !strings.HasPrefix(suffix, "/")) {
+		return nil, fmt.Errorf("%s must be a whole path segment", ClientIDPlaceholder)
+	}
+	return &pathTemplate{prefix: prefix, suffix: suffix}, nil
+}
+
+// match returns the client id in path. ok is false if path does not
+// match the template or the client id is empty.
+func (t *pathTemplate) match(path string) (id string, ok bool) {
+	if !strings.HasPrefix(path, t.prefix) || !strings.HasSuffix(path, t.suffix) ||
+		len(path) < len(t.prefix)+len(t.suffix) {
+		return "", false
+	}
+	id = path[len(t.prefix) : len(path)-len(t.suffix)]
+	if len(id) == 0 || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
+
+type bearerToken struct {
+	clientID string
+	token    []byte
+}
+
+func parseTokens(tokens map[string]string) ([]bearerToken, error) {
+	l := make([]bearerToken, 0, len(tokens))
+	for id, token := range tokens {
+		if len(id) == 0 || len(token) == 0 {
+			return nil, errors.New("empty client id or token")
+		}
+		l = append(l, bearerToken{clientID: id, token: []byte(token)})
+	}
+	return l, nil
+}
+
+// authenticate returns the client id of the bearer token in the
+// Authorization header. ok is false if the token is missing or invalid.
+func authenticate(tokens []bearerToken, authorization string) (id string, ok bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	b := []byte(strings.TrimSpace(token))
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(t.token, b) == 1 {
+			return t.clientID, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package http_handler
+
+import (
+	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
+)
+
+func Test_pathTemplate(t *testing.T) {
+	pt, err := parsePathTemplate("/dns-query/{client_id}")
+	if err != nil || pt == nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		wantID string
+		wantOk bool
+	}{
+		{"/dns-query/abc", "abc", true},
+		{"/dns-query/", "", false},
+		{"/dns-query/a/b", "", false},
+		{"/other/abc", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := pt.match(tt.path)
+		if id != tt.wantID || ok != tt.wantOk {
+			t.Errorf("match(%s) = %s, %v, want %s, %v", tt.path, id, ok, tt.wantID, tt.wantOk)
+		}
+	}
+
+	if pt, err := parsePathTemplate("/dns-query"); pt != nil || err != nil {
+		t.Fatal("want nil template for a static path")
+	}
+	if _, err := parsePathTemplate("/dns-query-{client_id}"); err == nil {
+		t.Fatal("want an error for a partial segment")
+	}
+}
+
+func Test_authenticate(t *testing.T) {
+	tokens, err := parseTokens(map[string]string{"alice": "t1", "bob": "t2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		authorization string
+		wantID        string
+		wantOk        bool
+	}{
+		{"Bearer t1", "alice", true},
+		{"bearer t2", "bob", true},
+		{"Bearer t3", "", false},
+		{"Basic t1", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := authenticate(tokens, tt.authorization)
+		if id != tt.wantID || ok != tt.wantOk {
+			t.Errorf("authenticate(%q) = %s, %v, want %s, %v", tt.authorization, id, ok, tt.wantID, tt.wantOk)
+		}
+	}
+}
+
+func Test_NewHandler_clientID(t *testing.T) {
+	dh := &dns_handler.DummyServerHandler{T: t}
+	tests := []struct {
+		name    string
+		opts    HandlerOpts
+		wantErr bool
+	}{
+		{"no client id", HandlerOpts{Path: "/dns-query"}, false},
+		{"client id without tokens", HandlerOpts{Path: "/dns-query/{client_id}"}, true},
+		{"client id with tokens", HandlerOpts{Path: "/dns-query/{client_id}", Tokens: map[string]string{"alice": "t1"}}, false},
+		{"unauthenticated client id", HandlerOpts{Path: "/dns-query/{client_id}", UnauthenticatedClientID: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.DNSHandler = dh
+			if _, err := NewHandler(tt.opts); (err != nil) != tt.wantErr {
+				t.Fatalf("NewHandler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
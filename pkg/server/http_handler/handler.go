@@ -21,6 +21,7 @@ package http_handler
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -36,6 +37,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/ip_observer"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 )
@@ -48,12 +50,30 @@ type HandlerOpts struct {
 
 	// Path specifies the query endpoint. If it is empty, Handler
 	// will ignore the request path.
+	// Path can have a "{client_id}" segment, e.g. "/dns-query/{client_id}".
+	// Then the segment is required and will be used as the client id of
+	// the query. It requires Tokens, unless UnauthenticatedClientID is set.
 	Path string
 
+	// Tokens maps client ids to bearer tokens. If it is not empty,
+	// requests must have a valid "Authorization: Bearer <token>" header,
+	// and the client id of the token will be used as the client id of
+	// the query. If Path also has a client id, they must be the same.
+	Tokens map[string]string
+
+	// UnauthenticatedClientID allows a client id in Path without Tokens.
+	// Any client can use any client id then, so the id should only be used
+	// to tell clients apart (e.g. in logs), not for access control.
+	UnauthenticatedClientID bool
+
 	// SrcIPHeader specifies the header that contain client source address.
 	// "True-Client-IP" "X-Real-IP" "X-Forwarded-For" will parse automatically.
 	SrcIPHeader string
 
+	// IPObserver is used to reject requests from banned clients.
+	// Default is a ip_observer.NopObserver.
+	IPObserver ip_observer.IPObserver
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
@@ -66,18 +86,35 @@ func (opts *HandlerOpts) Init() error {
 	if opts.Logger == nil {
 		opts.Logger = nopLogger
 	}
+	if opts.IPObserver == nil {
+		opts.IPObserver = ip_observer.NewNopObserver()
+	}
 	return nil
 }
 
 type Handler struct {
 	opts HandlerOpts
+
+	pathTemplate *pathTemplate // nil if Path has no client id
+	tokens       []bearerToken
 }
 
 func NewHandler(opts HandlerOpts) (*Handler, error) {
 	if err := opts.Init(); err != nil {
 		return nil, err
 	}
-	return &Handler{opts: opts}, nil
+	pt, err := parsePathTemplate(opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path, %w", err)
+	}
+	tokens, err := parseTokens(opts.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tokens, %w", err)
+	}
+	if pt != nil && len(tokens) == 0 && !opts.UnauthenticatedClientID {
+		return nil, fmt.Errorf("path with %s requires tokens to authenticate the client id", ClientIDPlaceholder)
+	}
+	return &Handler{opts: opts, pathTemplate: pt, tokens: tokens}, nil
 }
 
 func (h *Handler) warnErr(req Request, err error) {
@@ -111,6 +148,7 @@ type TlsInfo struct {
 	Version            uint16
 	ServerName         string
 	NegotiatedProtocol string
+	ClientCert         *x509.Certificate // the verified client certificate, might be nil
 }
 
 func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
@@ -119,9 +157,14 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 	if addr, err := getRemoteAddr(req, h.opts.SrcIPHeader); err == nil {
 		meta.SetClientAddr(addr)
 	}
+	if h.opts.IPObserver.IsBanned(meta.GetClientAddr()) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
 	if tlsInfo := req.TLS(); tlsInfo != nil {
 		meta.SetServerName(tlsInfo.ServerName)
+		meta.SetClientCert(tlsInfo.ClientCert)
 		switch tlsInfo.NegotiatedProtocol {
 		case http3.NextProtoH3:
 			meta.SetProtocol(C.ProtocolH3)
@@ -135,13 +178,40 @@ func (h *Handler) ServeHTTP(w ResponseWriter, req Request) {
 	}
 
 	// check url path
-	if len(h.opts.Path) != 0 && req.URL().Path != h.opts.Path {
+	var clientID string
+	if h.pathTemplate != nil {
+		var ok bool
+		clientID, ok = h.pathTemplate.match(req.URL().Path)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("invalid request path"))
+			h.warnErr(req, fmt.Errorf("invalid request path %s", req.URL().Path))
+			return
+		}
+	} else if len(h.opts.Path) != 0 && req.URL().Path != h.opts.Path {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("invalid request path"))
 		h.warnErr(req, fmt.Errorf("invalid request path %s", req.URL().Path))
 		return
 	}
 
+	// check bearer token
+	if len(h.tokens) > 0 {
+		id, ok := authenticate(h.tokens, req.Header().Get("Authorization"))
+		if !ok || (len(clientID) > 0 && clientID != id) {
+			if addr := meta.GetClientAddr(); addr.IsValid() {
+				h.opts.IPObserver.Observe(addr)
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid token"))
+			h.warnErr(req, errors.New("invalid token"))
+			return
+		}
+		clientID = id
+	}
+	meta.SetClientID(clientID)
+
 	var b []byte
 	var err error
 
@@ -20,6 +20,7 @@
 package server
 
 import (
+	"crypto/x509"
 	"errors"
 	"io"
 	"sync"
@@ -27,6 +28,9 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/acme"
+	"github.com/pmkol/mosdns-x/pkg/ip_observer"
+	"github.com/pmkol/mosdns-x/pkg/rrl"
 	D "github.com/pmkol/mosdns-x/pkg/server/dns_handler"
 	H "github.com/pmkol/mosdns-x/pkg/server/http_handler"
 )
@@ -54,6 +58,31 @@ type ServerOpts struct {
 	// Only useful if there is no server certificate specified in TLSConfig.
 	Cert, Key string
 
+	// Certs are additional certificates of DoT, DoH, DoQ and DoH3 servers.
+	// The certificate whose dns names match the tls server name (SNI) of
+	// the client is used. Exact names have priority over wildcard names.
+	// If no certificate matches, the default certificate, Cert and Key or
+	// the first one of Certs if they are empty, is used.
+	Certs []KeyPair
+
+	// ECHKeys are the Encrypted Client Hello key files of DoT and DoH
+	// servers. A file has a PEM "PRIVATE KEY" block, which is a PKCS #8
+	// X25519 key, and a PEM "ECHCONFIG" block, which is the ECHConfigList
+	// that is published to clients.
+	ECHKeys []string
+
+	// ACME, if not nil, provides the certificates of DoT, DoH, DoQ and DoH3
+	// servers instead of Cert and Key.
+	ACME *acme.Manager
+
+	// ClientCAs enables mutual tls for DoT, DoH, DoQ and DoH3 servers. It is
+	// the set of CAs that verifies client certificates. The verified client
+	// certificate will be set to the query_context.RequestMeta.
+	// If RequireClientCert is false, clients without a certificate are
+	// also accepted. Default is nil, mutual tls is disabled.
+	ClientCAs         *x509.CertPool
+	RequireClientCert bool
+
 	// KernelTX and KernelRX control whether kernel TLS offloading is enabled
 	// If the kernel is not supported, it is automatically downgraded to the application implementation
 	//
@@ -64,6 +93,25 @@ type ServerOpts struct {
 	// IdleTimeout limits the maximum time period that a connection
 	// can idle. Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// IPObserver is used to drop traffic from banned clients, and will be
+	// notified when a client sends an invalid msg.
+	// Default is a ip_observer.NopObserver.
+	IPObserver ip_observer.IPObserver
+
+	// ACL controls which clients can access the server. Queries from denied
+	// UDP clients are dropped, connections from denied TCP, DoT, DoH and
+	// DoQ clients are closed. DoH3 connections are refused by the
+	// listeners from CreateQUICListner. Default is nil, all clients are
+	// allowed.
+	ACL *ACL
+
+	// RefuseDenied makes the UDP server reply REFUSED to denied clients
+	// instead of dropping their queries.
+	RefuseDenied bool
+
+	// RRL limits the responses of the UDP server. Default is nil, no limit.
+	RRL *rrl.Limiter
 }
 
 func (opts *ServerOpts) init() {
@@ -74,6 +122,10 @@ func (opts *ServerOpts) init() {
 	if opts.IdleTimeout <= 0 {
 		opts.IdleTimeout = 0
 	}
+
+	if opts.IPObserver == nil {
+		opts.IPObserver = ip_observer.NewNopObserver()
+	}
 }
 
 // Server is a DNS server.
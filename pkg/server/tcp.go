@@ -104,6 +104,9 @@ func (s *Server) handleConnectionTcp(ctx context.Context, c *TCPConn) {
 	defer cancel()
 
 	clientAddr := utils.GetAddrFromAddr(c.RemoteAddr())
+	if s.opts.IPObserver.IsBanned(clientAddr) || !s.opts.ACL.Allowed(clientAddr) {
+		return
+	}
 	meta := C.NewRequestMeta(clientAddr)
 
 	protocol := C.ProtocolTCP
@@ -121,7 +124,9 @@ func (s *Server) handleConnectionTcp(ctx context.Context, c *TCPConn) {
 			return
 		}
 
-		meta.SetServerName(tlsConn.ConnectionState().ServerName)
+		state := tlsConn.ConnectionState()
+		meta.SetServerName(state.ServerName)
+		meta.SetClientCert(verifiedClientCert(state.VerifiedChains))
 		protocol = C.ProtocolTLS
 	}
 	meta.SetProtocol(protocol)
@@ -21,13 +21,18 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/quic-go/quic-go"
 	eTLS "gitlab.com/go-extension/tls"
+
+	"github.com/pmkol/mosdns-x/pkg/acme"
 )
 
 type cert[T tls.Certificate | eTLS.Certificate] struct {
@@ -83,48 +88,218 @@ func tryCreateWatchCert[T tls.Certificate | eTLS.Certificate](certFile string, k
 	return cc, nil
 }
 
-func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string) (*quic.EarlyListener, error) {
-	if s.opts.Cert == "" || s.opts.Key == "" {
+// KeyPair is a pair of certificate and key files.
+type KeyPair struct {
+	Cert, Key string
+}
+
+// keyPairs returns the certificates of the server. The default one is the first.
+func (s *Server) keyPairs() []KeyPair {
+	var pairs []KeyPair
+	if s.opts.Cert != "" || s.opts.Key != "" {
+		pairs = append(pairs, KeyPair{Cert: s.opts.Cert, Key: s.opts.Key})
+	}
+	return append(pairs, s.opts.Certs...)
+}
+
+// certSelector selects a certificate by the server name of the client.
+type certSelector[T tls.Certificate | eTLS.Certificate] struct {
+	certs []*cert[T] // The first one is the default certificate.
+	leaf  func(c *T) *x509.Certificate
+}
+
+func loadCertSelector[T tls.Certificate | eTLS.Certificate](
+	pairs []KeyPair,
+	createFunc func(string, string) (T, error),
+	leaf func(c *T) *x509.Certificate,
+) (*certSelector[T], error) {
+	if len(pairs) == 0 {
 		return nil, errors.New("missing certificate for tls listener")
 	}
-	c, err := tryCreateWatchCert(s.opts.Cert, s.opts.Key, tls.LoadX509KeyPair)
-	if err != nil {
-		return nil, err
+	cs := &certSelector[T]{leaf: leaf}
+	for _, p := range pairs {
+		if p.Cert == "" || p.Key == "" {
+			return nil, errors.New("missing certificate for tls listener")
+		}
+		c, err := tryCreateWatchCert(p.Cert, p.Key, createFunc)
+		if err != nil {
+			return nil, err
+		}
+		cs.certs = append(cs.certs, c)
 	}
-	return quic.ListenEarly(conn, &tls.Config{
-		NextProtos: nextProtos,
-		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			return c.c, nil
-		},
-	}, &quic.Config{
-		Allow0RTT:                      true,
+	return cs, nil
+}
+
+// get returns the certificate that has serverName. Exact names have
+// priority over wildcard names. If no certificate has serverName,
+// the default certificate will be returned.
+func (cs *certSelector[T]) get(serverName string) *T {
+	if len(cs.certs) == 1 || len(serverName) == 0 {
+		return cs.certs[0].c
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	var wildcard *T
+	for _, cc := range cs.certs {
+		c := cc.c
+		leaf := cs.leaf(c)
+		if leaf == nil {
+			continue
+		}
+		for _, name := range leaf.DNSNames {
+			name = strings.ToLower(name)
+			if name == serverName {
+				return c
+			}
+			if wildcard == nil && matchWildcard(name, serverName) {
+				wildcard = c
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return cs.certs[0].c
+}
+
+// matchWildcard reports whether the wildcard name, e.g. "*.example.com",
+// matches serverName. The wildcard only matches a single label.
+func matchWildcard(name, serverName string) bool {
+	suffix, ok := strings.CutPrefix(name, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, ok := strings.CutSuffix(serverName, suffix)
+	return ok && len(label) > 0 && !strings.Contains(label, ".")
+}
+
+func (s *Server) CreateQUICListner(conn net.PacketConn, nextProtos []string) (*quic.EarlyListener, error) {
+	tlsConfig := &tls.Config{NextProtos: nextProtos}
+	if s.opts.ACME != nil {
+		tlsConfig.GetCertificate = s.opts.ACME.GetCertificate
+	} else {
+		cs, err := loadCertSelector(s.keyPairs(), tls.LoadX509KeyPair, func(c *tls.Certificate) *x509.Certificate {
+			return c.Leaf
+		})
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cs.get(chi.ServerName), nil
+		}
+	}
+	if s.opts.ClientCAs != nil {
+		tlsConfig.ClientCAs = s.opts.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.opts.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	quicConfig := &quic.Config{
+		// 0-RTT data is received before the client certificate is verified.
+		Allow0RTT:                      s.opts.ClientCAs == nil,
 		InitialStreamReceiveWindow:     1252,
 		MaxStreamReceiveWindow:         4 * 1024,
 		InitialConnectionReceiveWindow: 8 * 1024,
 		MaxConnectionReceiveWindow:     16 * 1024,
-	})
+	}
+	if s.opts.ACL != nil {
+		quicACLConfig(quicConfig, s.opts.ACL)
+	}
+	return quic.ListenEarly(conn, tlsConfig, quicConfig)
 }
 
 func (s *Server) CreateETLSListner(l net.Listener, nextProtos []string) (net.Listener, error) {
-	if s.opts.Cert == "" || s.opts.Key == "" {
-		return nil, errors.New("missing certificate for tls listener")
-	}
-	c, err := tryCreateWatchCert(s.opts.Cert, s.opts.Key, eTLS.LoadX509KeyPair)
-	if err != nil {
-		return nil, err
-	}
-	return eTLS.NewListener(l, &eTLS.Config{
-		KernelTX:       s.opts.KernelTX,
-		KernelRX:       s.opts.KernelRX,
-		AllowEarlyData: true,
+	tlsConfig := &eTLS.Config{
+		KernelTX: s.opts.KernelTX,
+		KernelRX: s.opts.KernelRX,
+		// Early data is received before the client certificate is verified.
+		AllowEarlyData: s.opts.ClientCAs == nil,
 		MaxEarlyData:   4096,
 		NextProtos:     nextProtos,
 		Defaults: eTLS.Defaults{
 			AllSecureCipherSuites: true,
-			AllSecureCurves: true,
-		},
-		GetCertificate: func(_ *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
-			return c.c, nil
+			AllSecureCurves:       true,
 		},
-	}), nil
+	}
+	if s.opts.ACME != nil {
+		// Answer the TLS-ALPN-01 challenges.
+		tlsConfig.NextProtos = append(append([]string(nil), nextProtos...), acme.ALPNProto)
+		tlsConfig.GetCertificate = func(chi *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
+			c, err := s.opts.ACME.GetCertificate(toStdClientHello(chi))
+			if err != nil {
+				return nil, err
+			}
+			return fromStdCertificate(c), nil
+		}
+	} else {
+		cs, err := loadCertSelector(s.keyPairs(), eTLS.LoadX509KeyPair, func(c *eTLS.Certificate) *x509.Certificate {
+			return c.Leaf
+		})
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = func(chi *eTLS.ClientHelloInfo) (*eTLS.Certificate, error) {
+			return cs.get(chi.ServerName), nil
+		}
+	}
+	if len(s.opts.ECHKeys) > 0 {
+		keys, err := loadECHKeys(s.opts.ECHKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ech keys, %w", err)
+		}
+		tlsConfig.EncryptedClientHelloKeys = keys
+	}
+	if s.opts.ClientCAs != nil {
+		tlsConfig.ClientCAs = s.opts.ClientCAs
+		tlsConfig.ClientAuth = eTLS.VerifyClientCertIfGiven
+		if s.opts.RequireClientCert {
+			tlsConfig.ClientAuth = eTLS.RequireAndVerifyClientCert
+		}
+	}
+	if s.opts.ACL != nil {
+		// Denied clients are closed before the handshake.
+		l = &aclListener{Listener: l, acl: s.opts.ACL}
+	}
+	return eTLS.NewListener(l, tlsConfig), nil
+}
+
+// toStdClientHello converts an eTLS client hello to a crypto/tls one.
+func toStdClientHello(chi *eTLS.ClientHelloInfo) *tls.ClientHelloInfo {
+	h := &tls.ClientHelloInfo{
+		CipherSuites:      chi.CipherSuites,
+		ServerName:        chi.ServerName,
+		SupportedPoints:   chi.SupportedPoints,
+		SupportedProtos:   chi.SupportedProtos,
+		SupportedVersions: chi.SupportedVersions,
+	}
+	for _, c := range chi.SupportedCurves {
+		h.SupportedCurves = append(h.SupportedCurves, tls.CurveID(c))
+	}
+	for _, s := range chi.SignatureSchemes {
+		h.SignatureSchemes = append(h.SignatureSchemes, tls.SignatureScheme(s))
+	}
+	return h
+}
+
+// fromStdCertificate converts a crypto/tls certificate to an eTLS one.
+func fromStdCertificate(c *tls.Certificate) *eTLS.Certificate {
+	if c == nil {
+		return nil
+	}
+	return &eTLS.Certificate{
+		Certificate:                 c.Certificate,
+		PrivateKey:                  c.PrivateKey,
+		OCSPStaple:                  c.OCSPStaple,
+		SignedCertificateTimestamps: c.SignedCertificateTimestamps,
+		Leaf:                        c.Leaf,
+	}
+}
+
+// verifiedClientCert returns the verified leaf certificate of a client.
+// It returns nil if the client has no verified certificate.
+func verifiedClientCert(verifiedChains [][]*x509.Certificate) *x509.Certificate {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+	return verifiedChains[0][0]
 }
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestCertSelector_get(t *testing.T) {
+	newCert := func(names ...string) *cert[tls.Certificate] {
+		return &cert[tls.Certificate]{c: &tls.Certificate{Leaf: &x509.Certificate{DNSNames: names}}}
+	}
+	def := newCert("dns.example")
+	a := newCert("*.a.example")
+	b := newCert("dns.b.example", "*.b.example")
+	wildcard := newCert("*.example")
+	cs := &certSelector[tls.Certificate]{
+		certs: []*cert[tls.Certificate]{def, a, b, wildcard},
+		leaf:  func(c *tls.Certificate) *x509.Certificate { return c.Leaf },
+	}
+
+	tests := []struct {
+		serverName string
+		want       *cert[tls.Certificate]
+	}{
+		{"", def},
+		{"dns.example", def},
+		{"dot.a.example", a},
+		{"DOT.A.EXAMPLE.", a},
+		{"a.example", wildcard},
+		{"x.dot.a.example", def},
+		{"dns.b.example", b},
+		{"foo.example", wildcard},
+		{"unknown.test", def},
+	}
+	for _, tt := range tests {
+		if got := cs.get(tt.serverName); got != tt.want.c {
+			t.Errorf("get(%q) = %v, want %v", tt.serverName, got.Leaf.DNSNames, tt.want.c.Leaf.DNSNames)
+		}
+	}
+}
+
+func TestParseECHKeys(t *testing.T) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config1 := []byte{0xfe, 0x0d, 0x00, 0x02, 0x01, 0x02}
+	config2 := []byte{0xfe, 0x0d, 0x00, 0x01, 0x03}
+	configList := append([]byte{0x00, byte(len(config1) + len(config2))}, config1...)
+	configList = append(configList, config2...)
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: configList})...)
+	keys, err := parseECHKeys(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys[0].Config) != string(config1) || string(keys[1].Config) != string(config2) {
+		t.Fatalf("unexpected configs %v", keys)
+	}
+	if string(keys[0].PrivateKey) != string(k.Bytes()) {
+		t.Fatal("unexpected private key")
+	}
+
+	if _, err := parseECHKeys(b[:len(b)/2]); err == nil {
+		t.Fatal("want an error for a file without ech config")
+	}
+	configList[1]++
+	b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "ECHCONFIG", Bytes: configList})...)
+	if _, err := parseECHKeys(b); err == nil {
+		t.Fatal("want an error for an invalid ech config list")
+	}
+}
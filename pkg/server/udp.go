@@ -25,10 +25,12 @@ import (
 	"net"
 
 	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
 	"go.uber.org/zap"
 
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	C "github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/rrl"
 	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
@@ -79,12 +81,28 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 			return fmt.Errorf("unexpected read err: %w", err)
 		}
 		clientAddr := utils.GetAddrFromAddr(remoteAddr)
+		if s.opts.IPObserver.IsBanned(clientAddr) {
+			continue
+		}
+		if !s.opts.ACL.Allowed(clientAddr) {
+			if s.opts.RefuseDenied {
+				if r := refusedResponse(rb[:n]); r != nil {
+					if _, err := cmc.writeTo(r, localAddr, ifIndex, remoteAddr); err != nil {
+						s.opts.Logger.Warn("failed to write response", zap.Error(err))
+					}
+				}
+			}
+			continue
+		}
 
 		q := new(dns.Msg)
 		q.Data = make([]byte, n)
 		copy(q.Data, rb[:n])
 		if err := q.Unpack(); err != nil {
 			s.opts.Logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", q.Data))
+			if clientAddr.IsValid() {
+				s.opts.IPObserver.Observe(clientAddr)
+			}
 			continue
 		}
 
@@ -98,6 +116,14 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 				s.opts.Logger.Warn("handler err", zap.Error(err))
 				return
 			}
+			if r != nil && s.opts.RRL != nil {
+				switch s.opts.RRL.Check(clientAddr, r) {
+				case rrl.Drop:
+					return
+				case rrl.Slip:
+					r = truncatedResponse(q, r)
+				}
+			}
 			if r != nil {
 				err := r.Pack()
 				if err != nil {
@@ -112,6 +138,15 @@ func (s *Server) ServeUDP(c net.PacketConn) error {
 	}
 }
 
+// truncatedResponse returns an empty truncated response of r.
+func truncatedResponse(q, r *dns.Msg) *dns.Msg {
+	tc := new(dns.Msg)
+	dnsutil.SetReply(tc, q)
+	tc.Rcode = r.Rcode
+	tc.Truncated = true
+	return tc
+}
+
 // newDummyCmc returns a dummyCmcWrapper.
 func newDummyCmc(c net.PacketConn) cmcUDPConn {
 	return dummyCmcWrapper{c: c}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package tracing is a minimal OpenTelemetry compatible tracer. Spans
+// are exported to an OTLP/HTTP endpoint with json encoding.
+//
+// The OpenTelemetry SDK and its OTLP exporters are not dependencies of
+// mosdns, and they would pull in grpc and a lot of other modules for a few
+// spans per query. mosdns only needs to start spans, sample by client and
+// export batches, so the small subset of the OTLP/JSON encoding is
+// implemented here instead.
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"sync/atomic"
+	"time"
+)
+
+// SpanKind is the OpenTelemetry SpanKind.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Attr is a span attribute. Value can be a string, int64 or bool.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(k, v string) Attr    { return Attr{Key: k, Value: v} }
+func Int(k string, v int) Attr   { return Attr{Key: k, Value: int64(v)} }
+func Bool(k string, v bool) Attr { return Attr{Key: k, Value: v} }
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+// Span is a sampled span. A nil *Span is valid, all its methods do nothing.
+// A Span is not safe for concurrent use.
+type Span struct {
+	tracer   *Tracer
+	traceID  TraceID
+	spanID   SpanID
+	parentID SpanID // zero if it is a root span
+	name     string
+	kind     SpanKind
+	start    time.Time
+	end      time.Time
+	attrs    []Attr
+	err      error
+	ended    atomic.Bool
+}
+
+type spanCtxKey struct{}
+
+// ContextWithSpan returns a copy of ctx that carries s. If s is nil,
+// ctx is returned.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanCtxKey{}, s)
+}
+
+// SpanFromContext returns the span in ctx. It returns nil if ctx has no span.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanCtxKey{}).(*Span)
+	return s
+}
+
+// StartSpan starts a child span of the span in ctx. If ctx has no span,
+// which means the trace is not sampled, it returns ctx and a nil *Span.
+func StartSpan(ctx context.Context, kind SpanKind, name string, attrs ...Attr) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer:   parent.tracer,
+		traceID:  parent.traceID,
+		spanID:   newSpanID(),
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// End ends s and queues it for export. If err is not nil, the status
+// of s will be error. Only the first call of End takes effect, it can be
+// called from another goroutine.
+func (s *Span) End(err error) {
+	if s == nil || !s.ended.CompareAndSwap(false, true) {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.tracer.enqueue(s)
+}
+
+func newSpanID() (id SpanID) {
+	crand.Read(id[:])
+	return id
+}
+
+func newTraceID() (id TraceID) {
+	crand.Read(id[:])
+	return id
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	defaultQueueSize     = 4096
+	defaultBatchSize     = 512
+	defaultFlushInterval = time.Second * 5
+	exportTimeout        = time.Second * 10
+)
+
+type Opts struct {
+	// Endpoint is the OTLP/HTTP traces endpoint, e.g.
+	// "http://127.0.0.1:4318/v1/traces". Required.
+	Endpoint string
+	Headers  map[string]string
+
+	// ServiceName is the "service.name" resource attribute.
+	// Default is "mosdns".
+	ServiceName string
+
+	// SampleRate is the fraction of queries that will be traced, 0~1.
+	SampleRate float64
+	// AlwaysSample contains the client prefixes whose queries are always traced.
+	AlwaysSample []netip.Prefix
+
+	QueueSize     int           // Default is 4096. Spans are dropped if the queue is full.
+	BatchSize     int           // Default is 512.
+	FlushInterval time.Duration // Default is 5s.
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Tracer creates root spans and exports ended spans in background.
+// A nil *Tracer is valid, it never samples.
+type Tracer struct {
+	opts   Opts
+	client *http.Client
+	queue  chan *Span
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+func NewTracer(opts Opts) (*Tracer, error) {
+	if len(opts.Endpoint) == 0 {
+		return nil, errors.New("missing endpoint")
+	}
+	if r := opts.SampleRate; r < 0 || r > 1 {
+		return nil, fmt.Errorf("invalid sample rate %v, should be 0~1", r)
+	}
+	if len(opts.ServiceName) == 0 {
+		opts.ServiceName = "mosdns"
+	}
+	utils.SetDefaultNum(&opts.QueueSize, defaultQueueSize)
+	utils.SetDefaultNum(&opts.BatchSize, defaultBatchSize)
+	utils.SetDefaultNum(&opts.FlushInterval, defaultFlushInterval)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	t := &Tracer{
+		opts:        opts,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, opts.QueueSize),
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.exportLoop()
+	return t, nil
+}
+
+// Sample reports whether the query from client should be traced.
+func (t *Tracer) Sample(client netip.Addr) bool {
+	if t == nil {
+		return false
+	}
+	if client.IsValid() {
+		client = client.Unmap()
+		for _, p := range t.opts.AlwaysSample {
+			if p.Contains(client) {
+				return true
+			}
+		}
+	}
+	r := t.opts.SampleRate
+	return r >= 1 || (r > 0 && rand.Float64() < r)
+}
+
+// StartRoot starts a new trace with a root span. If sampled is false or
+// t is nil, it returns ctx and a nil *Span.
+func (t *Tracer) StartRoot(ctx context.Context, sampled bool, kind SpanKind, name string, attrs ...Attr) (context.Context, *Span) {
+	if t == nil || !sampled {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer:  t,
+		traceID: newTraceID(),
+		spanID:  newSpanID(),
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+		attrs:   attrs,
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.opts.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			t.opts.Logger.Warn("failed to export spans", zap.Int("spans", len(batch)), zap.Error(err))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= t.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.closeNotify:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	b, err := json.Marshal(t.newExportRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.opts.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close exports the queued spans and stops the Tracer.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closeOnce.Do(func() { close(t.closeNotify) })
+	<-t.done
+	return nil
+}
+
+// OTLP json encoding. See opentelemetry-proto/opentelemetry/proto/trace/v1.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            *status    `json:"status,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const statusCodeError = 2
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 is encoded as a string.
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func (t *Tracer) newExportRequest(spans []*Span) *exportRequest {
+	js := make([]jsonSpan, 0, len(spans))
+	for _, s := range spans {
+		j := jsonSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        toKeyValues(s.attrs),
+		}
+		if s.parentID != (SpanID{}) {
+			j.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			j.Status = &status{Code: statusCodeError, Message: s.err.Error()}
+		}
+		js = append(js, j)
+	}
+	return &exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: toKeyValues([]Attr{String("service.name", t.opts.ServiceName)})},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "mosdns"}, Spans: js}},
+	}}}
+}
+
+func toKeyValues(attrs []Attr) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v anyValue
+		switch x := a.Value.(type) {
+		case string:
+			v.StringValue = &x
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, keyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	reqs := make(chan *exportRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected content type")
+		}
+		er := new(exportRequest)
+		if err := json.NewDecoder(r.Body).Decode(er); err != nil {
+			t.Error(err)
+		}
+		reqs <- er
+	}))
+	defer srv.Close()
+
+	tracer, err := NewTracer(Opts{
+		Endpoint:     srv.URL,
+		AlwaysSample: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracer.Sample(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("zero sample rate should not sample")
+	}
+	if !tracer.Sample(netip.MustParseAddr("192.168.1.1")) {
+		t.Fatal("debug client should always be sampled")
+	}
+
+	ctx, root := tracer.StartRoot(context.Background(), true, SpanKindServer, "query", String("dns.qname", "example.com."))
+	_, child := StartSpan(ctx, SpanKindClient, "exchange", Int("n", 1))
+	child.End(errors.New("timeout"))
+	child.End(nil) // Only the first End takes effect.
+	root.End(nil)
+	tracer.Close()
+
+	er := <-reqs
+	spans := er.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("want 2 spans, got %d", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || len(r.ParentSpanID) != 0 {
+		t.Fatal("invalid span relationship")
+	}
+	if c.Status == nil || c.Status.Code != statusCodeError || c.Status.Message != "timeout" {
+		t.Fatalf("unexpected child status %+v", c.Status)
+	}
+	if *c.Attributes[0].Value.IntValue != "1" || *r.Attributes[0].Value.StringValue != "example.com." {
+		t.Fatal("unexpected attributes")
+	}
+
+	// Not sampled.
+	ctx, s := tracer.StartRoot(context.Background(), false, SpanKindServer, "query")
+	if s != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("unsampled trace should not have spans")
+	}
+	_, s = StartSpan(ctx, SpanKindInternal, "exec")
+	s.End(nil) // nil span should be valid
+}
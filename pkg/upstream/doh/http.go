@@ -20,9 +20,9 @@
 package doh
 
 import (
+	"bytes"
 	"context"
 	"io"
-	"net/url"
 
 	"codeberg.org/miekg/dns"
 	"gitlab.com/go-extension/http"
@@ -31,12 +31,12 @@ import (
 )
 
 type Upstream struct {
-	url       *url.URL
+	template  *Template
 	transport *http.Transport
 }
 
-func NewUpstream(url *url.URL, transport *http.Transport) *Upstream {
-	return &Upstream{url, transport}
+func NewUpstream(template *Template, transport *http.Transport) *Upstream {
+	return &Upstream{template, transport}
 }
 
 func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
@@ -45,11 +45,19 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url.String(), q)
+	hr := u.template.NewRequest(ctx, q)
+	var body io.Reader
+	if hr.Body != nil {
+		body = bytes.NewReader(hr.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, hr.Method, hr.URL, body)
 	if err != nil {
 		return nil, err
 	}
 	C.MakeHeader(req)
+	for k, v := range hr.Header {
+		req.Header.Set(k, v)
+	}
 	res, err := u.transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
@@ -68,6 +76,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	if err != nil {
 		return nil, err
 	}
+	r.ID = q.ID
 	return r, nil
 }
 
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+)
+
+// ClientIDPlaceholder in the url and header values of a Template will
+// be replaced by the client id of the query. See WithClientID.
+const ClientIDPlaceholder = "{client_id}"
+
+type clientIDKey struct{}
+
+// WithClientID returns a context that carries the client id of a query.
+func WithClientID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientIDKey{}, id)
+}
+
+func clientIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDKey{}).(string)
+	return id
+}
+
+// Template is the template of DoH requests.
+type Template struct {
+	url    string
+	method string
+	header map[string]string
+	// hasClientID is true if url or header has the ClientIDPlaceholder.
+	hasClientID bool
+}
+
+// NewTemplate returns a Template. method can be "POST" (default) or "GET".
+// GET requests use the RFC 8484 "dns" parameter and a zero message id,
+// so they are cacheable by http caches.
+func NewTemplate(u *url.URL, method string, header map[string]string) (*Template, error) {
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("invalid http method %s", method)
+	}
+
+	// url.URL.String() escapes the braces in the path.
+	s := strings.ReplaceAll(u.String(), url.PathEscape(ClientIDPlaceholder), ClientIDPlaceholder)
+	t := &Template{url: s, method: method, header: header}
+	t.hasClientID = strings.Contains(s, ClientIDPlaceholder)
+	for _, v := range header {
+		if strings.Contains(v, ClientIDPlaceholder) {
+			t.hasClientID = true
+		}
+	}
+	return t, nil
+}
+
+// Request is a DoH request built from a Template.
+type Request struct {
+	Method string
+	URL    string
+	Body   []byte // nil if Method is GET
+	Header map[string]string
+}
+
+// NewRequest builds the request of q. q must be packed.
+func (t *Template) NewRequest(ctx context.Context, q *dns.Msg) *Request {
+	r := &Request{Method: t.method, URL: t.url, Header: t.header}
+	if t.hasClientID {
+		id := clientIDFromContext(ctx)
+		r.URL = strings.ReplaceAll(r.URL, ClientIDPlaceholder, url.PathEscape(id))
+		r.Header = make(map[string]string, len(t.header))
+		for k, v := range t.header {
+			r.Header[k] = strings.ReplaceAll(v, ClientIDPlaceholder, id)
+		}
+	}
+
+	if t.method == http.MethodGet {
+		b := make([]byte, len(q.Data))
+		copy(b, q.Data)
+		b[0], b[1] = 0, 0 // RFC 8484 4.1, use 0 id for cache friendliness.
+		sep := "?"
+		if strings.Contains(r.URL, "?") {
+			sep = "&"
+		}
+		r.URL += sep + "dns=" + base64.RawURLEncoding.EncodeToString(b)
+		return r
+	}
+	r.Body = q.Data
+	return r
+}
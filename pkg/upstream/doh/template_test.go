@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+func TestTemplate_NewRequest(t *testing.T) {
+	q := dns.NewMsg("example.com.", dns.TypeA)
+	q.ID = 1234
+	if err := q.Pack(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("https://dns.example/{client_id}/dns-query?k=v")
+	tpl, err := NewTemplate(u, "GET", map[string]string{"X-Client": "id-{client_id}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tpl.NewRequest(WithClientID(context.Background(), "c1"), q)
+	prefix := "https://dns.example/c1/dns-query?k=v&dns="
+	if r.Method != "GET" || r.Body != nil || !strings.HasPrefix(r.URL, prefix) {
+		t.Fatalf("unexpected request %+v", r)
+	}
+	if got := r.Header["X-Client"]; got != "id-c1" {
+		t.Fatalf("want header id-c1, got %s", got)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(r.URL, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0 || b[1] != 0 {
+		t.Fatal("GET request should have a zero id")
+	}
+	if q.Data[0] == 0 && q.Data[1] == 0 {
+		t.Fatal("query was modified")
+	}
+
+	u, _ = url.Parse("https://dns.example/dns-query")
+	tpl, err = NewTemplate(u, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = tpl.NewRequest(context.Background(), q)
+	if r.Method != "POST" || r.URL != "https://dns.example/dns-query" || len(r.Body) != len(q.Data) {
+		t.Fatalf("unexpected request %+v", r)
+	}
+
+	if _, err := NewTemplate(u, "PUT", nil); err == nil {
+		t.Fatal("want an error for invalid method")
+	}
+}
@@ -20,12 +20,12 @@
 package doh3
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"net/http"
-	"net/url"
 	"strings"
 
 	"codeberg.org/miekg/dns"
@@ -33,16 +33,17 @@ import (
 	"golang.org/x/sync/singleflight"
 
 	C "github.com/pmkol/mosdns-x/constant"
+	"github.com/pmkol/mosdns-x/pkg/upstream/doh"
 )
 
 type Upstream struct {
-	url       *url.URL
+	template  *doh.Template
 	transport *http3.Transport
 	group     singleflight.Group
 }
 
-func NewUpstream(url *url.URL, transport *http3.Transport) *Upstream {
-	return &Upstream{url: url, transport: transport}
+func NewUpstream(template *doh.Template, transport *http3.Transport) *Upstream {
+	return &Upstream{template: template, transport: transport}
 }
 
 func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
@@ -51,11 +52,19 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url.String(), q)
+	hr := u.template.NewRequest(ctx, q)
+	var body io.Reader
+	if hr.Body != nil {
+		body = bytes.NewReader(hr.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, hr.Method, hr.URL, body)
 	if err != nil {
 		return nil, err
 	}
 	C.MakeHeader(req)
+	for k, v := range hr.Header {
+		req.Header.Set(k, v)
+	}
 
 	res, err := u.transport.RoundTrip(req)
 	if err != nil {
@@ -84,6 +93,7 @@ func (u *Upstream) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, e
 	if err != nil {
 		return nil, err
 	}
+	r.ID = q.ID
 	return r, nil
 }
 
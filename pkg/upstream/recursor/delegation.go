@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const (
+	delegationKeyPrefix = "recursor_delegation:"
+	minDelegationTTL    = time.Second * 5
+	maxDelegationTTL    = time.Hour * 24
+)
+
+// delegation is a zone cut and its name servers.
+type delegation struct {
+	zone  string                  // lower case zone name
+	ns    []string                // lower case name server names
+	addrs map[string][]netip.Addr // addresses (glue) of the name servers
+}
+
+// newDelegation builds a delegation of zone from the NS records in nss
+// and the address records in glue. Records that do not belong to the
+// delegation are ignored.
+func newDelegation(zone string, nss, glue []dns.RR) *delegation {
+	d := &delegation{
+		zone:  zone,
+		addrs: make(map[string][]netip.Addr),
+	}
+	for _, rr := range nss {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		d.ns = append(d.ns, strings.ToLower(ns.Ns))
+	}
+	for _, rr := range glue {
+		name := strings.ToLower(rr.Header().Name)
+		if !d.hasNS(name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			d.addrs[name] = append(d.addrs[name], rr.A.Addr)
+		case *dns.AAAA:
+			d.addrs[name] = append(d.addrs[name], rr.AAAA.Addr)
+		}
+	}
+	return d
+}
+
+func (d *delegation) hasNS(name string) bool {
+	for _, ns := range d.ns {
+		if ns == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRootHints parses root hints in zone file format from r.
+func parseRootHints(r io.Reader) (*delegation, error) {
+	var rrs []dns.RR
+	parser := dns.NewZoneParser(r, ".", "")
+	for {
+		rr, ok := parser.Next()
+		if !ok {
+			break
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	d := newDelegation(".", rrs, rrs)
+	if len(d.ns) == 0 {
+		return nil, errors.New("no root name server")
+	}
+	if len(d.addrs) == 0 {
+		return nil, errors.New("no address of root name servers")
+	}
+	return d, nil
+}
+
+// findDelegation returns the closest cached delegation of name.
+// If there is no cached delegation, root hints will be returned.
+func (r *Recursor) findDelegation(name string) *delegation {
+	for z := name; z != "."; z = dnsutils.ParentName(z) {
+		if d := r.loadDelegation(z); d != nil {
+			return d
+		}
+	}
+	return r.rootHints
+}
+
+func (r *Recursor) loadDelegation(zone string) *delegation {
+	v, _, expirationTime := r.cache.Get(delegationKeyPrefix + zone)
+	if v == nil || expirationTime.Before(time.Now()) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.Data = v
+	if err := m.Unpack(); err != nil {
+		return nil
+	}
+	d := newDelegation(zone, m.Ns, m.Extra)
+	if len(d.ns) == 0 {
+		return nil
+	}
+	return d
+}
+
+func (r *Recursor) storeDelegation(zone string, nss, glue []dns.RR) {
+	ttl := maxDelegationTTL
+	for _, rr := range nss {
+		if t := time.Duration(rr.Header().TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if ttl < minDelegationTTL {
+		ttl = minDelegationTTL
+	}
+
+	m := new(dns.Msg)
+	m.Ns = nss
+	m.Extra = glue
+	if err := m.Pack(); err != nil {
+		return
+	}
+	now := time.Now()
+	r.cache.Store(delegationKeyPrefix+zone, m.Data, now, now.Add(ttl))
+}
+
+// referral returns the zone cut and its records if resp is a referral
+// from the servers of zone to a sub zone that covers name.
+func referral(resp *dns.Msg, zone, name string) (child string, nss, glue []dns.RR) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		return "", nil, nil
+	}
+	for _, rr := range resp.Ns {
+		if _, ok := rr.(*dns.NS); !ok {
+			continue
+		}
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == zone || !dnsutils.IsSubDomain(zone, owner) || !dnsutils.IsSubDomain(owner, name) {
+			continue
+		}
+		if len(child) == 0 {
+			child = owner
+		}
+		if owner == child {
+			nss = append(nss, rr)
+		}
+	}
+	if len(child) == 0 {
+		return "", nil, nil
+	}
+
+	// Only accept the in-bailiwick glue.
+	for _, rr := range resp.Extra {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			if dnsutils.IsSubDomain(zone, strings.ToLower(rr.Header().Name)) {
+				glue = append(glue, rr)
+			}
+		}
+	}
+	return child, nss, glue
+}
+
+// isLame reports whether resp, which is not a referral, is a
+// useless response from a lame server.
+func isLame(resp *dns.Msg) bool {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return true
+	}
+	if resp.Authoritative || len(resp.Answer) != 0 {
+		return false
+	}
+	// A non-authoritative upward or sideways referral.
+	for _, rr := range resp.Ns {
+		if _, ok := rr.(*dns.SOA); ok {
+			return false
+		}
+	}
+	for _, rr := range resp.Ns {
+		if _, ok := rr.(*dns.NS); ok {
+			return true
+		}
+	}
+	return false
+}
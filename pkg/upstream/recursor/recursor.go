@@ -0,0 +1,460 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/cache"
+	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/upstream/dialer"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	udpSize       = 1232
+	maxReferrals  = 32
+	maxDepth      = 4 // nested lookups of glueless name servers
+	maxCNAMEChain = 8
+)
+
+var (
+	errMaxDepth         = errors.New("max lookup depth exceeded")
+	errTooManyReferrals = errors.New("too many referrals")
+	errCNAMEChain       = errors.New("cname chain is too long")
+	errNoServer         = errors.New("no available name server")
+)
+
+type Opts struct {
+	// Dialer is used to connect to the authoritative servers. Required.
+	Dialer dialer.Dialer
+
+	// RootHints specifies a root hints file in zone file format.
+	// Default is the built-in root hints.
+	RootHints string
+
+	// Cache is used to cache the delegations. Default is a memory cache.
+	// Recursor does not close it.
+	Cache cache.Backend
+
+	// Port is the port of the authoritative servers. Default is 53.
+	Port uint16
+
+	// Timeout is the timeout of each exchange with a server.
+	// Default is 1s.
+	Timeout time.Duration
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Recursor is an iterative resolver that resolves queries from the
+// root servers. It implements upstream.Upstream.
+type Recursor struct {
+	opts      Opts
+	rootHints *delegation
+	cache     cache.Backend
+	ownCache  bool
+}
+
+func NewRecursor(opts Opts) (*Recursor, error) {
+	if opts.Dialer == nil {
+		return nil, errors.New("missing dialer")
+	}
+	utils.SetDefaultNum(&opts.Port, 53)
+	utils.SetDefaultNum(&opts.Timeout, time.Second)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	var (
+		rootHints *delegation
+		err       error
+	)
+	if len(opts.RootHints) > 0 {
+		f, openErr := os.Open(opts.RootHints)
+		if openErr != nil {
+			return nil, openErr
+		}
+		rootHints, err = parseRootHints(f)
+		f.Close()
+	} else {
+		rootHints, err = parseRootHints(strings.NewReader(defaultRootHints))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid root hints, %w", err)
+	}
+
+	r := &Recursor{
+		opts:      opts,
+		rootHints: rootHints,
+		cache:     opts.Cache,
+	}
+	if r.cache == nil {
+		r.cache = mem_cache.NewMemCache(1024, 0)
+		r.ownCache = true
+	}
+	return r, nil
+}
+
+// ExchangeContext implements upstream.Upstream.
+func (r *Recursor) ExchangeContext(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("query must have exactly one question")
+	}
+	question := q.Question[0]
+	if question.Header().Class != dns.ClassINET {
+		return nil, errors.New("only class IN is supported")
+	}
+
+	name := strings.ToLower(dnsutil.Fqdn(question.Header().Name))
+	resp, err := r.resolve(ctx, name, dns.RRToType(question), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	dnsutil.SetReply(m, q)
+	m.RecursionAvailable = true
+	m.Rcode = resp.Rcode
+	m.Answer = resp.Answer
+	m.Ns = resp.Ns
+	return m, nil
+}
+
+// Close closes the delegation cache if it was created by Recursor.
+func (r *Recursor) Close() error {
+	if r.ownCache {
+		return r.cache.Close()
+	}
+	return nil
+}
+
+// resolve resolves name and follows the cname chain in the answers.
+func (r *Recursor) resolve(ctx context.Context, name string, qType uint16, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, errMaxDepth
+	}
+
+	var answer []dns.RR
+	for i := 0; i < maxCNAMEChain; i++ {
+		resp, err := r.lookup(ctx, name, qType, depth)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, resp.Answer...)
+		target := cnameTarget(resp, name, qType)
+		if len(target) == 0 {
+			resp.Answer = answer
+			return resp, nil
+		}
+		name = strings.ToLower(target)
+	}
+	return nil, errCNAMEChain
+}
+
+// lookup resolves name iteratively from the closest known delegation.
+// The query name is minimised as RFC 9156 described.
+func (r *Recursor) lookup(ctx context.Context, name string, qType uint16, depth int) (*dns.Msg, error) {
+	// DS records are served by the parent side of the zone cut.
+	start := name
+	if qType == dns.TypeDS && name != "." {
+		start = dnsutils.ParentName(name)
+	}
+	d := r.findDelegation(start)
+
+	cut := d.zone // The longest ancestor of name that is known to be served by d.
+	minimise := true
+	for i := 0; i < maxReferrals; i++ {
+		qName, qt := name, qType
+		if minimise {
+			if n := nextName(cut, name); n != name {
+				qName, qt = n, dns.TypeA
+			}
+		}
+
+		resp, err := r.queryServers(ctx, d, qName, qt, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		if child, nss, glue := referral(resp, d.zone, qName); len(child) > 0 {
+			r.storeDelegation(child, nss, glue)
+			d = newDelegation(child, nss, glue)
+			cut = child
+			continue
+		}
+
+		if qName == name {
+			return resp, nil
+		}
+		// There is no zone cut at qName.
+		if resp.Rcode == dns.RcodeSuccess {
+			cut = qName
+		} else {
+			// Some servers do not handle empty non-terminals correctly.
+			// Query the full name instead.
+			minimise = false
+		}
+	}
+	return nil, errTooManyReferrals
+}
+
+// queryServers sends the query to the name servers of d until one of them
+// gives a useful response.
+func (r *Recursor) queryServers(ctx context.Context, d *delegation, name string, qType uint16, depth int) (*dns.Msg, error) {
+	lastErr := errNoServer
+	tryAddrs := func(addrs []netip.Addr) *dns.Msg {
+		for _, addr := range preferIPv4(addrs) {
+			if ctx.Err() != nil {
+				lastErr = ctx.Err()
+				return nil
+			}
+			resp, err := r.exchange(ctx, addr, name, qType)
+			if err != nil {
+				r.opts.Logger.Debug("failed to query name server", zap.Stringer("server", addr), zap.String("name", name), zap.Error(err))
+				lastErr = err
+				continue
+			}
+			if isLame(resp) {
+				lastErr = fmt.Errorf("lame response from %s, rcode %d", addr, resp.Rcode)
+				continue
+			}
+			return resp
+		}
+		return nil
+	}
+
+	nss := make([]string, len(d.ns))
+	copy(nss, d.ns)
+	rand.Shuffle(len(nss), func(i, j int) { nss[i], nss[j] = nss[j], nss[i] })
+
+	// Try the servers that have glue first.
+	var glueless []string
+	for _, ns := range nss {
+		addrs := d.addrs[ns]
+		if len(addrs) == 0 {
+			glueless = append(glueless, ns)
+			continue
+		}
+		if resp := tryAddrs(addrs); resp != nil {
+			return resp, nil
+		}
+	}
+	for _, ns := range glueless {
+		addrs, err := r.lookupAddrs(ctx, ns, depth+1)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to resolve name server %s, %w", ns, err)
+			continue
+		}
+		if resp := tryAddrs(addrs); resp != nil {
+			return resp, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// lookupAddrs resolves the addresses of a name server.
+func (r *Recursor) lookupAddrs(ctx context.Context, ns string, depth int) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var lastErr error
+	for _, qType := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := r.resolve(ctx, ns, qType, depth)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.Addr)
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.Addr)
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no address record")
+	}
+	return nil, lastErr
+}
+
+// exchange sends a non-recursive query to the server addr. The query will
+// be retried over TCP if the UDP response was truncated.
+func (r *Recursor) exchange(ctx context.Context, addr netip.Addr, name string, qType uint16) (*dns.Msg, error) {
+	q := dns.NewMsg(name, qType)
+	if q == nil {
+		return nil, fmt.Errorf("unsupported query type %d", qType)
+	}
+	q.ID = dns.ID()
+	q.RecursionDesired = false
+	q.UDPSize = udpSize
+
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+	server := netip.AddrPortFrom(addr, r.opts.Port).String()
+
+	resp, err := r.exchangeUDP(ctx, server, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		return r.exchangeTCP(ctx, server, q)
+	}
+	return resp, nil
+}
+
+func (r *Recursor) exchangeUDP(ctx context.Context, server string, q *dns.Msg) (*dns.Msg, error) {
+	c, err := r.opts.Dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if ddl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(ddl)
+	}
+
+	if _, err := dnsutils.WriteMsgToUDP(c, q); err != nil {
+		return nil, err
+	}
+	conn := dnsutils.Conn{Conn: c}
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		resp, err := conn.ReadMsg(buf)
+		if err != nil {
+			if resp != nil { // Invalid msg.
+				continue
+			}
+			return nil, err
+		}
+		if isResponseTo(resp, q) {
+			return resp, nil
+		}
+	}
+}
+
+func (r *Recursor) exchangeTCP(ctx context.Context, server string, q *dns.Msg) (*dns.Msg, error) {
+	c, err := r.opts.Dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if ddl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(ddl)
+	}
+
+	if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+		return nil, err
+	}
+	resp, _, err := dnsutils.ReadMsgFromTCP(c)
+	if err != nil {
+		return nil, err
+	}
+	if !isResponseTo(resp, q) {
+		return nil, errors.New("response does not match the query")
+	}
+	return resp, nil
+}
+
+func isResponseTo(resp, q *dns.Msg) bool {
+	if !resp.Response || resp.ID != q.ID || len(resp.Question) != 1 {
+		return false
+	}
+	rq, qq := resp.Question[0], q.Question[0]
+	return dns.RRToType(rq) == dns.RRToType(qq) && strings.EqualFold(rq.Header().Name, qq.Header().Name)
+}
+
+// cnameTarget returns the name that the resolution of name should continue
+// with, or an empty string if resp is the final answer.
+func cnameTarget(resp *dns.Msg, name string, qType uint16) string {
+	if resp.Rcode != dns.RcodeSuccess || qType == dns.TypeCNAME || qType == dns.TypeANY {
+		return ""
+	}
+	target := name
+	for i := 0; i < maxCNAMEChain; i++ {
+		next := ""
+		for _, rr := range resp.Answer {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			} else if dns.RRToType(rr) == qType {
+				return ""
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		target = next
+	}
+	if strings.EqualFold(target, name) {
+		return ""
+	}
+	return target
+}
+
+func preferIPv4(addrs []netip.Addr) []netip.Addr {
+	s := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Is4() || addr.Is4In6() {
+			s = append(s, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if !addr.Is4() && !addr.Is4In6() {
+			s = append(s, addr)
+		}
+	}
+	return s
+}
+
+// nextName returns the ancestor of name that has one more label than zone.
+// name must be a sub domain of zone.
+func nextName(zone, name string) string {
+	if name == zone {
+		return name
+	}
+	prefix := name
+	if zone != "." {
+		prefix = name[:len(name)-len(zone)]
+	}
+	// prefix has a trailing dot.
+	i := strings.LastIndexByte(prefix[:len(prefix)-1], '.')
+	if zone == "." {
+		return prefix[i+1:]
+	}
+	return prefix[i+1:] + zone
+}
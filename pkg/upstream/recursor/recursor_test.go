@@ -0,0 +1,253 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+
+	"github.com/pmkol/mosdns-x/pkg/upstream/dialer"
+	"github.com/pmkol/mosdns-x/pkg/zone_file"
+)
+
+const (
+	rootZone = `
+.                 SOA  a.root. admin. 1 3600 600 86400 300
+.                 NS   a.root.
+a.root.           A    127.0.0.1
+test.             NS   ns.test.
+ns.test.          A    127.0.0.2
+`
+	testZone = `
+test.             SOA  ns.test. admin. 1 3600 600 86400 300
+test.             NS   ns.test.
+ns.test.          A    127.0.0.2
+example.test.     NS   ns.example.test.
+ns.example.test.  A    127.0.0.3
+`
+	exampleZone = `
+example.test.           SOA    ns.example.test. admin. 1 3600 600 86400 300
+example.test.           NS     ns.example.test.
+ns.example.test.        A      127.0.0.3
+www.example.test.       CNAME  web.example.test.
+web.example.test.       A      192.0.2.1
+a.b.c.example.test.     A      192.0.2.2
+tc.example.test.        A      192.0.2.3
+`
+)
+
+// authServer is a stand-in authoritative server.
+type authServer struct {
+	z   *zone_file.Zone
+	udp bool
+
+	m     sync.Mutex
+	names []string
+}
+
+func (s *authServer) ServeDNS(_ context.Context, w dns.ResponseWriter, q *dns.Msg) {
+	name := q.Question[0].Header().Name
+	s.m.Lock()
+	s.names = append(s.names, name)
+	s.m.Unlock()
+
+	r := s.z.Reply(q)
+	if r == nil {
+		r = new(dns.Msg)
+		dnsutil.SetReply(r, q)
+		r.Rcode = dns.RcodeRefused
+	}
+	if s.udp && strings.HasPrefix(name, "tc.") {
+		r.Truncated = true
+		r.Answer = nil
+	}
+	r.Pack()
+	io.Copy(w, r)
+}
+
+func (s *authServer) queried(name string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, n := range s.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *authServer) count() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.names)
+}
+
+// startAuthServer starts udp and tcp servers of zone on ip:port.
+// It returns the udp handler.
+func startAuthServer(t *testing.T, ip string, port int, zone string) *authServer {
+	t.Helper()
+	z, err := zone_file.ParseZone(strings.NewReader(zone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s, %v", addr, err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.Close()
+		t.Skipf("cannot listen on %s, %v", addr, err)
+	}
+
+	udpHandler := &authServer{z: z, udp: true}
+	udpServer := &dns.Server{PacketConn: c, Handler: udpHandler}
+	tcpServer := &dns.Server{Listener: l, Handler: &authServer{z: z}, MaxTCPQueries: -1}
+	go udpServer.ListenAndServe()
+	go tcpServer.ListenAndServe()
+	t.Cleanup(func() {
+		udpServer.Shutdown(nil)
+		tcpServer.Shutdown(nil)
+	})
+	return udpHandler
+}
+
+func TestRecursor(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	c.Close()
+
+	root := startAuthServer(t, "127.0.0.1", port, rootZone)
+	startAuthServer(t, "127.0.0.2", port, testZone)
+	example := startAuthServer(t, "127.0.0.3", port, exampleZone)
+
+	d, err := dialer.NewDialer(dialer.DialerOpts{Dialer: new(net.Dialer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRecursor(Opts{
+		Dialer:    d,
+		RootHints: writeHints(t, rootZone),
+		Port:      uint16(port),
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		name      string
+		qName     string
+		qType     uint16
+		wantRcode uint16
+		wantAns   []string // Name of answer records.
+	}{
+		{"cname chain", "www.example.test.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.test.", "web.example.test."}},
+		{"empty non-terminals", "a.b.c.example.test.", dns.TypeA, dns.RcodeSuccess, []string{"a.b.c.example.test."}},
+		{"nodata", "web.example.test.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"nxdomain", "x.y.example.test.", dns.TypeA, dns.RcodeNameError, nil},
+		{"tcp fallback", "tc.example.test.", dns.TypeA, dns.RcodeSuccess, []string{"tc.example.test."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := dns.NewMsg(tt.qName, tt.qType)
+			resp, err := r.ExchangeContext(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ID != q.ID {
+				t.Fatal("id mismatched")
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, resp.Rcode)
+			}
+			var gotAns []string
+			for _, rr := range resp.Answer {
+				gotAns = append(gotAns, rr.Header().Name)
+			}
+			if fmt.Sprint(gotAns) != fmt.Sprint(tt.wantAns) {
+				t.Fatalf("want answer %v, got %v", tt.wantAns, gotAns)
+			}
+		})
+	}
+
+	// Root servers should only see the minimised query name.
+	if root.queried("www.example.test.") || !root.queried("test.") {
+		t.Fatalf("qname is not minimised, root got %v", root.names)
+	}
+
+	// Delegations are cached.
+	n := root.count()
+	if _, err := r.ExchangeContext(context.Background(), dns.NewMsg("web.example.test.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if root.count() != n {
+		t.Fatal("delegation is not cached")
+	}
+	if !example.queried("web.example.test.") {
+		t.Fatal("query was not sent to the authoritative server")
+	}
+}
+
+func writeHints(t *testing.T, hints string) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "root_hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(hints); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func Test_nextName(t *testing.T) {
+	tests := []struct {
+		zone, name, want string
+	}{
+		{".", ".", "."},
+		{".", "com.", "com."},
+		{".", "a.b.com.", "com."},
+		{"com.", "a.b.com.", "b.com."},
+		{"b.com.", "a.b.com.", "a.b.com."},
+	}
+	for _, tt := range tests {
+		if got := nextName(tt.zone, tt.name); got != tt.want {
+			t.Errorf("nextName(%q, %q) = %q, want %q", tt.zone, tt.name, got, tt.want)
+		}
+	}
+}
@@ -38,12 +38,14 @@ import (
 	eTLS "gitlab.com/go-extension/tls"
 	"go.uber.org/zap"
 
+	"github.com/pmkol/mosdns-x/pkg/cache"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/upstream/bootstrap"
 	D "github.com/pmkol/mosdns-x/pkg/upstream/dialer"
 	"github.com/pmkol/mosdns-x/pkg/upstream/doh"
 	"github.com/pmkol/mosdns-x/pkg/upstream/doh3"
 	mQUIC "github.com/pmkol/mosdns-x/pkg/upstream/quic"
+	"github.com/pmkol/mosdns-x/pkg/upstream/recursor"
 	"github.com/pmkol/mosdns-x/pkg/upstream/transport"
 	"github.com/pmkol/mosdns-x/pkg/upstream/udp"
 )
@@ -57,6 +59,13 @@ type Upstream interface {
 	io.Closer
 }
 
+// WithClientID returns a context that carries the client id of a query.
+// DoH upstreams use it to replace the "{client_id}" in their url and
+// headers. See Opt.HTTPHeaders.
+func WithClientID(ctx context.Context, id string) context.Context {
+	return doh.WithClientID(ctx, id)
+}
+
 type Opt struct {
 	// DialAddr specifies the address the upstream will
 	// actually dial to.
@@ -98,12 +107,34 @@ type Opt struct {
 	// HTTP3 is not supported.
 	Bootstrap string
 
+	// RootHints specifies the root hints file of the recursive upstream.
+	// Default is the built-in root hints.
+	RootHints string
+
+	// RecursiveCache caches the delegations of the recursive upstream.
+	// The upstream does not close it. Default is a private memory cache.
+	RecursiveCache cache.Backend
+
+	// RecursiveTimeout is the timeout of each exchange between the
+	// recursive upstream and an authoritative server. Default is 1s.
+	RecursiveTimeout time.Duration
+
 	// TLS skip certificate verify
 	Insecure bool
 
 	// The set of root certificate authorities that clients use when verifying server certificates.
 	RootCAs *x509.CertPool
 
+	// HTTPMethod specifies the request method of DoH upstreams, can be
+	// "POST" or "GET". Default is "POST".
+	HTTPMethod string
+
+	// HTTPHeaders specifies additional request headers of DoH upstreams.
+	// The url path, query and header values of DoH upstreams can contain
+	// "{client_id}", which will be replaced by the client id of the query.
+	// See WithClientID.
+	HTTPHeaders map[string]string
+
 	// Logger specifies the logger that the upstream will use.
 	Logger *zap.Logger
 
@@ -124,6 +155,8 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 	if !strings.Contains(addr, "://") {
 		addr = "udp://" + addr
 	}
+	// RFC 8484 uri template, the "dns" variable is added by GET requests.
+	addr = strings.Replace(addr, "{?dns}", "", 1)
 	addrURL, err := url.Parse(addr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid server address, %w", err)
@@ -239,7 +272,11 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 			idleConnTimeout = opt.IdleTimeout
 		}
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 80)
-		return doh.NewUpstream(addrURL, &http.Transport{
+		t, err := doh.NewTemplate(addrURL, opt.HTTPMethod, opt.HTTPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		return doh.NewUpstream(t, &http.Transport{
 			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
 				return d.DialContext(ctx, "tcp", dialAddr)
 			},
@@ -253,7 +290,11 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		addrURL.Scheme = "https"
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 443)
 		tlsConfig := createETLSConfig(opt, "h2", addrURL.Hostname())
-		return doh.NewUpstream(addrURL, &http.Transport{
+		t, err := doh.NewTemplate(addrURL, opt.HTTPMethod, opt.HTTPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		return doh.NewUpstream(t, &http.Transport{
 			DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
 				conn, err := d.DialContext(ctx, "tcp", dialAddr)
 				if err != nil {
@@ -276,7 +317,11 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 		}
 		addrURL.Scheme = "https"
 		dialAddr := getDialAddrWithPort(addrURL.Host, opt.DialAddr, 443)
-		return doh3.NewUpstream(addrURL, &http3.Transport{
+		t, err := doh.NewTemplate(addrURL, opt.HTTPMethod, opt.HTTPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		return doh3.NewUpstream(t, &http3.Transport{
 			TLSClientConfig: createTLSConfig(opt, "h3", addrURL.Hostname()),
 			QUICConfig: &quic.Config{
 				TokenStore:                     quic.NewLRUTokenStore(1, 10),
@@ -299,6 +344,14 @@ func NewUpstream(addr string, opt *Opt) (Upstream, error) {
 				return quic.DialEarly(ctx, pc, c.RemoteAddr(), tlsCfg, cfg)
 			},
 		}), nil
+	case "recursive":
+		return recursor.NewRecursor(recursor.Opts{
+			Dialer:    d,
+			RootHints: opt.RootHints,
+			Cache:     opt.RecursiveCache,
+			Timeout:   opt.RecursiveTimeout,
+			Logger:    opt.Logger,
+		})
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const maxCNAMEChain = 8
+
+// Zone is an authoritative zone loaded from a RFC 1035 zone file.
+// Zone is read-only after it was created, so it is safe for concurrent use.
+type Zone struct {
+	origin string
+	soa    *dns.SOA
+	nodes  map[string]*node // lower case owner name -> node
+
+	// ents contains the empty non-terminals of this zone.
+	ents map[string]struct{}
+}
+
+type node struct {
+	rrsets map[uint16][]dns.RR
+}
+
+// ParseZone parses a zone from r. If origin is empty, the owner of the
+// SOA record will be used. The zone must have exactly one SOA record
+// at its apex.
+func ParseZone(r io.Reader, origin string) (*Zone, error) {
+	if len(origin) > 0 {
+		origin = dnsutil.Fqdn(origin)
+	}
+
+	var rrs []dns.RR
+	var soa *dns.SOA
+	parser := dns.NewZoneParser(r, origin, "")
+	parser.SetDefaultTTL(3600)
+	for {
+		rr, ok := parser.Next()
+		if !ok {
+			break
+		}
+		if s, ok := rr.(*dns.SOA); ok {
+			if soa != nil {
+				return nil, errors.New("multiple soa records")
+			}
+			soa = s
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if soa == nil {
+		return nil, errors.New("missing soa record")
+	}
+
+	z := &Zone{
+		origin: strings.ToLower(soa.Header().Name),
+		soa:    soa,
+		nodes:  make(map[string]*node),
+		ents:   make(map[string]struct{}),
+	}
+	if len(origin) > 0 && !strings.EqualFold(origin, z.origin) {
+		return nil, fmt.Errorf("soa owner %s is not the zone origin %s", z.origin, origin)
+	}
+
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if !dnsutils.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("record %s is out of zone %s", rr.Header().Name, z.origin)
+		}
+		if rr.Header().Class != dns.ClassINET {
+			return nil, fmt.Errorf("record %s is not in class IN", rr.Header().Name)
+		}
+		n := z.nodes[name]
+		if n == nil {
+			n = &node{rrsets: make(map[uint16][]dns.RR)}
+			z.nodes[name] = n
+		}
+		typ := dns.RRToType(rr)
+		n.rrsets[typ] = append(n.rrsets[typ], rr)
+	}
+
+	for name := range z.nodes {
+		for p := dnsutils.ParentName(name); len(p) > len(z.origin); p = dnsutils.ParentName(p) {
+			if _, ok := z.nodes[p]; !ok {
+				z.ents[p] = struct{}{}
+			}
+		}
+	}
+	return z, nil
+}
+
+// Origin returns the lower case origin of the zone.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// Contains reports whether name is in the zone.
+func (z *Zone) Contains(name string) bool {
+	return dnsutils.IsSubDomain(z.origin, strings.ToLower(name))
+}
+
+// Reply returns an authoritative response for query q. It returns nil if
+// q is not a standard IN query or its question is not in the zone.
+// The returned msg is a copy and can be modified by the caller.
+func (z *Zone) Reply(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	hdr := question.Header()
+	if hdr.Class != dns.ClassINET || !z.Contains(hdr.Name) {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	dnsutil.SetReply(r, q)
+	r.Authoritative = true
+	z.resolve(r, hdr.Name, dns.RRToType(question), 0)
+	return r.Copy()
+}
+
+// resolve looks up name and appends the result to r.
+func (z *Zone) resolve(r *dns.Msg, name string, qType uint16, depth int) {
+	lName := strings.ToLower(name)
+
+	// Find the zone cut.
+	if cut := z.findCut(lName, qType); cut != nil {
+		if len(r.Answer) == 0 {
+			r.Authoritative = false
+		}
+		r.Ns = append(r.Ns, cut.rrsets[dns.TypeNS]...)
+		z.appendGlue(r, cut.rrsets[dns.TypeNS])
+		return
+	}
+
+	n, ok := z.nodes[lName]
+	if !ok {
+		if _, isENT := z.ents[lName]; isENT {
+			z.appendSOA(r) // NODATA
+			return
+		}
+		n = z.findWildcard(lName)
+		if n == nil {
+			if len(r.Answer) == 0 {
+				r.Rcode = dns.RcodeNameError
+			}
+			z.appendSOA(r)
+			return
+		}
+		n = synthesize(n, name)
+	}
+
+	if qType == dns.TypeANY {
+		for _, rrs := range n.rrsets {
+			r.Answer = append(r.Answer, rrs...)
+		}
+		return
+	}
+
+	if rrs, ok := n.rrsets[qType]; ok {
+		r.Answer = append(r.Answer, rrs...)
+		if qType == dns.TypeNS {
+			z.appendGlue(r, rrs)
+		}
+		return
+	}
+
+	if cnames, ok := n.rrsets[dns.TypeCNAME]; ok && len(cnames) > 0 {
+		r.Answer = append(r.Answer, cnames[0])
+		target := cnames[0].(*dns.CNAME).Target
+		if depth+1 < maxCNAMEChain && z.Contains(target) {
+			z.resolve(r, target, qType, depth+1)
+		}
+		return
+	}
+
+	z.appendSOA(r) // NODATA
+}
+
+// findCut returns the node of the delegation point that covers name,
+// or nil if name is not delegated.
+// A DS query for the delegation point itself is not delegated.
+func (z *Zone) findCut(name string, qType uint16) *node {
+	var owners []string
+	for p := name; p != z.origin && p != "."; p = dnsutils.ParentName(p) {
+		owners = append(owners, p)
+	}
+	for i := len(owners) - 1; i >= 0; i-- {
+		owner := owners[i]
+		n, ok := z.nodes[owner]
+		if !ok {
+			continue
+		}
+		if _, ok := n.rrsets[dns.TypeNS]; !ok {
+			continue
+		}
+		if owner == name && qType == dns.TypeDS {
+			return nil
+		}
+		return n
+	}
+	return nil
+}
+
+// findWildcard returns the wildcard node that can synthesize name.
+func (z *Zone) findWildcard(name string) *node {
+	for p := dnsutils.ParentName(name); len(p) >= len(z.origin); p = dnsutils.ParentName(p) {
+		_, isNode := z.nodes[p]
+		_, isENT := z.ents[p]
+		if isNode || isENT || p == z.origin {
+			// p is the closest encloser.
+			return z.nodes[dnsutils.WildcardName(p)]
+		}
+	}
+	return nil
+}
+
+func (z *Zone) appendSOA(r *dns.Msg) {
+	soa := *z.soa
+	if soa.Minttl < soa.Hdr.TTL {
+		soa.Hdr.TTL = soa.Minttl
+	}
+	r.Ns = append(r.Ns, &soa)
+}
+
+// appendGlue appends the in-zone address records of the ns targets to r.Extra.
+func (z *Zone) appendGlue(r *dns.Msg, nss []dns.RR) {
+	for _, rr := range nss {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		n, ok := z.nodes[strings.ToLower(ns.Ns)]
+		if !ok {
+			continue
+		}
+		r.Extra = append(r.Extra, n.rrsets[dns.TypeA]...)
+		r.Extra = append(r.Extra, n.rrsets[dns.TypeAAAA]...)
+	}
+}
+
+// synthesize returns a copy of wildcard node n whose owner is name.
+func synthesize(n *node, name string) *node {
+	sn := &node{rrsets: make(map[uint16][]dns.RR, len(n.rrsets))}
+	for typ, rrs := range n.rrsets {
+		m := &dns.Msg{Answer: rrs}
+		c := m.Copy().Answer
+		for _, rr := range c {
+			rr.Header().Name = name
+		}
+		sn.rrsets[typ] = c
+	}
+	return sn
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"strings"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+const zoneData = `
+$ORIGIN example.com.
+$TTL 3600
+@          IN SOA   ns1 hostmaster 2024010101 7200 3600 1209600 300
+@          IN NS    ns1
+ns1        IN A     192.0.2.53
+www        IN A     192.0.2.1
+alias      IN CNAME www
+a.b.c      IN A     192.0.2.2
+*.wild     IN A     192.0.2.3
+sub        IN NS    ns.sub
+ns.sub     IN A     192.0.2.54
+`
+
+func TestZone_Reply(t *testing.T) {
+	z, err := ParseZone(strings.NewReader(zoneData), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.Origin() != "example.com." {
+		t.Fatalf("unexpected origin %s", z.Origin())
+	}
+
+	tests := []struct {
+		name      string
+		qName     string
+		qType     uint16
+		wantRcode uint16
+		wantAA    bool
+		wantAns   int
+		wantNs    int
+		wantExtra int
+	}{
+		{"answer", "www.example.com.", dns.TypeA, dns.RcodeSuccess, true, 1, 0, 0},
+		{"case insensitive", "WWW.example.com.", dns.TypeA, dns.RcodeSuccess, true, 1, 0, 0},
+		{"nodata", "www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, 0, 1, 0},
+		{"nxdomain", "nx.example.com.", dns.TypeA, dns.RcodeNameError, true, 0, 1, 0},
+		{"empty non-terminal", "b.c.example.com.", dns.TypeA, dns.RcodeSuccess, true, 0, 1, 0},
+		{"cname chasing", "alias.example.com.", dns.TypeA, dns.RcodeSuccess, true, 2, 0, 0},
+		{"cname query", "alias.example.com.", dns.TypeCNAME, dns.RcodeSuccess, true, 1, 0, 0},
+		{"wildcard", "x.wild.example.com.", dns.TypeA, dns.RcodeSuccess, true, 1, 0, 0},
+		{"delegation", "www.sub.example.com.", dns.TypeA, dns.RcodeSuccess, false, 0, 1, 1},
+		{"apex ns", "example.com.", dns.TypeNS, dns.RcodeSuccess, true, 1, 0, 1},
+		{"apex soa", "example.com.", dns.TypeSOA, dns.RcodeSuccess, true, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := z.Reply(dns.NewMsg(tt.qName, tt.qType))
+			if r == nil {
+				t.Fatal("nil response")
+			}
+			if r.Rcode != tt.wantRcode || r.Authoritative != tt.wantAA {
+				t.Fatalf("want rcode %d aa %v, got rcode %d aa %v", tt.wantRcode, tt.wantAA, r.Rcode, r.Authoritative)
+			}
+			if len(r.Answer) != tt.wantAns || len(r.Ns) != tt.wantNs || len(r.Extra) != tt.wantExtra {
+				t.Fatalf("unexpected sections\n%s", r)
+			}
+		})
+	}
+
+	if r := z.Reply(dns.NewMsg("x.wild.example.com.", dns.TypeA)); r.Answer[0].Header().Name != "x.wild.example.com." {
+		t.Fatalf("wildcard owner not synthesized: %s", r.Answer[0].Header().Name)
+	}
+	if r := z.Reply(dns.NewMsg("example.org.", dns.TypeA)); r != nil {
+		t.Fatal("out of zone query should not be answered")
+	}
+}
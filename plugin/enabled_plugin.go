@@ -26,6 +26,8 @@ import (
 	_ "github.com/pmkol/mosdns-x/plugin/executable/bufsize"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/cache"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/client_limiter"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/dnssec_validate"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/dnstap"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/dual_selector"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ecs"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/edns0_filter"
@@ -37,6 +39,7 @@ import (
 	_ "github.com/pmkol/mosdns-x/plugin/executable/misc_optm"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/nftset"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/padding"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/query_log"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/query_summary"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/redirect"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/reject_any"
@@ -44,6 +47,7 @@ import (
 	_ "github.com/pmkol/mosdns-x/plugin/executable/sequence"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/sleep"
 	_ "github.com/pmkol/mosdns-x/plugin/executable/ttl"
+	_ "github.com/pmkol/mosdns-x/plugin/executable/zone"
 	_ "github.com/pmkol/mosdns-x/plugin/matcher/query_matcher"
 	_ "github.com/pmkol/mosdns-x/plugin/matcher/response_matcher"
 )
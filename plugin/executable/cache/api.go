@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+const defaultEntriesLimit = 1000
+
+// ServeHTTP serves the cache management api.
+//
+//	GET  entries?name=|suffix=[&limit=]: lists the cached entries of a domain.
+//	POST purge?name=|suffix=: removes the cached entries of a domain.
+//	POST flush: removes all cached entries.
+//
+// name matches the domain itself only. suffix also matches its sub domains.
+func (c *cachePlugin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/plugins/"+c.Tag()+"/")
+	switch path {
+	case "entries":
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.serveEntries(w, req)
+	case "purge", "flush":
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var match func(name string) bool
+		if path == "purge" {
+			var err error
+			match, err = parseNameMatcher(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		n := c.purge(match)
+		c.L().Info("cache entries purged", zap.String("path", path), zap.String("query", req.URL.RawQuery), zap.Int("entries", n))
+		fmt.Fprintf(w, "%d entries purged\n", n)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (c *cachePlugin) serveEntries(w http.ResponseWriter, req *http.Request) {
+	match, err := parseNameMatcher(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultEntriesLimit
+	if s := req.URL.Query().Get("limit"); len(s) > 0 {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sb := new(strings.Builder)
+	n := 0
+	now := time.Now()
+	c.backend.Range(func(key string, v []byte, storedTime, expirationTime time.Time) bool {
+		q := unpackMsgKey(key)
+		if q == nil {
+			return true
+		}
+		hdr := q.Question[0].Header()
+		if !match(hdr.Name) {
+			return true
+		}
+		r, err := c.unpackCachedMsg(v)
+		if err != nil {
+			return true
+		}
+
+		ttlLeft := time.Until(storedTime.Add(c.cachedMsgTTL(r))).Truncate(time.Second)
+		if ttlLeft > 0 {
+			dnsutils.SubtractTTL(r, uint32(now.Sub(storedTime).Seconds()))
+		} else {
+			ttlLeft = 0 // Expired, only kept for lazy cache.
+		}
+		fmt.Fprintf(sb, ";; %s %s %s, ttl_left: %s, stored: %s, expire: %s\n",
+			hdr.Name, dns.ClassToString[hdr.Class], dns.TypeToString[dns.RRToType(q.Question[0])],
+			ttlLeft, storedTime.Format(time.RFC3339), expirationTime.Format(time.RFC3339),
+		)
+		sb.WriteString(r.String())
+		sb.WriteString("\n\n")
+		n++
+		return n < limit
+	})
+	fmt.Fprintf(sb, ";; %d entries\n", n)
+	w.Write([]byte(sb.String()))
+}
+
+// purge removes the entries that match. If match is nil, all entries
+// will be removed. It returns the number of removed entries.
+func (c *cachePlugin) purge(match func(name string) bool) int {
+	var keys []string
+	c.backend.Range(func(key string, _ []byte, _, _ time.Time) bool {
+		// Ignore keys that are not stored by the cache plugin.
+		// e.g. keys from other applications in a shared redis db.
+		q := unpackMsgKey(key)
+		if q == nil {
+			return true
+		}
+		if match == nil || match(q.Question[0].Header().Name) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		c.backend.Delete(key)
+		if c.hits != nil {
+			c.hits.Del(key)
+		}
+	}
+	if len(keys) > 0 {
+		c.updated.Store(true)
+	}
+	return len(keys)
+}
+
+// parseNameMatcher returns a matcher from the "name" or "suffix" query
+// parameter of req.
+func parseNameMatcher(req *http.Request) (func(name string) bool, error) {
+	params := req.URL.Query()
+	name, suffix := params.Get("name"), params.Get("suffix")
+	switch {
+	case len(name) > 0 && len(suffix) > 0:
+		return nil, errors.New("name and suffix cannot be both set")
+	case len(name) > 0:
+		name = strings.ToLower(dnsutil.Fqdn(name))
+		return func(s string) bool {
+			return strings.ToLower(s) == name
+		}, nil
+	case len(suffix) > 0:
+		suffix = strings.ToLower(dnsutil.Fqdn(suffix))
+		return func(s string) bool {
+			s = strings.ToLower(s)
+			return suffix == "." || s == suffix || strings.HasSuffix(s, "."+suffix)
+		}, nil
+	default:
+		return nil, errors.New("missing name or suffix")
+	}
+}
+
+// isMsgKey reports whether key was generated by getMsgKey. Msg keys
+// have a zero id, so keys of other plugins that share the backend (e.g.
+// "recursor_delegation:...") are never msg keys.
+func isMsgKey(key string) bool {
+	return len(key) >= 12 && key[0] == 0 && key[1] == 0
+}
+
+// unpackMsgKey unpacks the query from a key that was generated by
+// getMsgKey. It returns nil if key is not a valid query.
+func unpackMsgKey(key string) *dns.Msg {
+	if !isMsgKey(key) {
+		return nil
+	}
+	q := new(dns.Msg)
+	q.Data = []byte(key)
+	if err := q.Unpack(); err != nil || q.Response || len(q.Question) != 1 {
+		return nil
+	}
+	return q
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+// storeTestMsg stores an A response of name to c and returns its msg key.
+func storeTestMsg(t *testing.T, c *cachePlugin, name string) string {
+	t.Helper()
+	q := dns.NewMsg(name, dns.TypeA)
+	key, err := c.getMsgKey(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	dnsutil.SetReply(r, q)
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.Header{Name: name, Class: dns.ClassINET, TTL: 300},
+		A:   rdata.A{Addr: netip.MustParseAddr("127.0.0.1")},
+	}}
+	if err := c.tryStoreMsg(key, r); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_cachePlugin_ServeHTTP(t *testing.T) {
+	c := newTestCachePlugin(t, &Args{Size: 1024})
+	keyA := storeTestMsg(t, c, "a.example.com.")
+	keyB := storeTestMsg(t, c, "b.example.com.")
+	keyOther := storeTestMsg(t, c, "example.org.")
+	now := time.Now()
+	c.backend.Store("recursor_delegation:com.", []byte("delegation"), now, now.Add(time.Hour))
+
+	serve := func(method, path string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(method, "/plugins/cache/"+path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		wantBody []string
+	}{
+		{"entries by name", http.MethodGet, "entries?name=a.example.com", http.StatusOK, []string{"a.example.com.", ";; 1 entries"}},
+		{"entries by suffix", http.MethodGet, "entries?suffix=example.com", http.StatusOK, []string{"a.example.com.", "b.example.com.", ";; 2 entries"}},
+		{"entries limit", http.MethodGet, "entries?suffix=.&limit=1", http.StatusOK, []string{";; 1 entries"}},
+		{"entries of root", http.MethodGet, "entries?suffix=.", http.StatusOK, []string{";; 3 entries"}},
+		{"entries without name", http.MethodGet, "entries", http.StatusBadRequest, nil},
+		{"entries with name and suffix", http.MethodGet, "entries?name=a.example.com&suffix=com", http.StatusBadRequest, nil},
+		{"entries invalid limit", http.MethodGet, "entries?name=a.example.com&limit=0", http.StatusBadRequest, nil},
+		{"entries by post", http.MethodPost, "entries?name=a.example.com", http.StatusMethodNotAllowed, nil},
+		{"purge by get", http.MethodGet, "purge?name=a.example.com", http.StatusMethodNotAllowed, nil},
+		{"flush by get", http.MethodGet, "flush", http.StatusMethodNotAllowed, nil},
+		{"purge without name", http.MethodPost, "purge", http.StatusBadRequest, nil},
+		{"unknown path", http.MethodGet, "unknown", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := serve(tt.method, tt.path)
+			if code != tt.wantCode {
+				t.Fatalf("want code %d, got %d, body: %s", tt.wantCode, code, body)
+			}
+			for _, s := range tt.wantBody {
+				if !strings.Contains(body, s) {
+					t.Fatalf("body should contain %q, got: %s", s, body)
+				}
+			}
+		})
+	}
+
+	if code, body := serve(http.MethodPost, "purge?suffix=example.com"); code != http.StatusOK || !strings.Contains(body, "2 entries purged") {
+		t.Fatalf("purge: got %d, %s", code, body)
+	}
+	for _, key := range []string{keyA, keyB} {
+		if v, _, _ := c.backend.Get(key); v != nil {
+			t.Fatal("purged entry is still in the cache")
+		}
+	}
+	if v, _, _ := c.backend.Get(keyOther); v == nil {
+		t.Fatal("entry that does not match is purged")
+	}
+
+	if code, body := serve(http.MethodPost, "flush"); code != http.StatusOK || !strings.Contains(body, "1 entries purged") {
+		t.Fatalf("flush: got %d, %s", code, body)
+	}
+	if v, _, _ := c.backend.Get(keyOther); v != nil {
+		t.Fatal("flushed entry is still in the cache")
+	}
+	if v, _, _ := c.backend.Get("recursor_delegation:com."); v == nil {
+		t.Fatal("keys of other plugins should not be flushed")
+	}
+}
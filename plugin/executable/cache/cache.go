@@ -21,7 +21,11 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/miekg/dns"
@@ -35,10 +39,12 @@ import (
 	"github.com/pmkol/mosdns-x/pkg/cache"
 	"github.com/pmkol/mosdns-x/pkg/cache/mem_cache"
 	"github.com/pmkol/mosdns-x/pkg/cache/redis_cache"
+	"github.com/pmkol/mosdns-x/pkg/concurrent_lru"
 	"github.com/pmkol/mosdns-x/pkg/dnsutils"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/pool"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 const (
@@ -54,11 +60,22 @@ func init() {
 }
 
 const (
-	lazyUpdateTimeout = time.Second * 5
-	emptyAnswerTTL    = time.Second * 300
+	lazyUpdateTimeout   = time.Second * 5
+	prefetchTimeout     = time.Second * 5
+	defaultDumpInterval = time.Second * 600
+
+	defaultPrefetchRatio       = 0.1
+	defaultPrefetchConcurrency = 8
+	defaultNegativeTTLMax      = 10800
+	defaultErrorTTL            = 5
+	defaultStaleAnswerTimeout  = 1800 // RFC 8767 5.
 )
 
-var _ coremain.ExecutablePlugin = (*cachePlugin)(nil)
+var (
+	_ coremain.ExecutablePlugin = (*cachePlugin)(nil)
+	_ coremain.DumperPlugin     = (*cachePlugin)(nil)
+	_ http.Handler              = (*cachePlugin)(nil)
+)
 
 type Args struct {
 	Size              int    `yaml:"size"`
@@ -69,6 +86,36 @@ type Args struct {
 	CacheEverything   bool   `yaml:"cache_everything"`
 	CompressResp      bool   `yaml:"compress_resp"`
 	WhenHit           string `yaml:"when_hit"`
+
+	// DumpFile is the file that the memory cache will be dumped to
+	// periodically and when the plugin is closed. The dump is loaded on startup.
+	DumpFile     string `yaml:"dump_file"`
+	DumpInterval int    `yaml:"dump_interval"` // In seconds. Default is 600.
+
+	// PrefetchThreshold is the number of hits an entry needs before it
+	// can be prefetched. Zero disables prefetch.
+	PrefetchThreshold int `yaml:"prefetch_threshold"`
+	// PrefetchRatio is the fraction of the ttl. The entry will be prefetched
+	// when its remaining ttl is less than it. Default is 0.1.
+	PrefetchRatio float64 `yaml:"prefetch_ratio"`
+	// PrefetchConcurrency limits the number of concurrent prefetches.
+	// Default is 8.
+	PrefetchConcurrency int `yaml:"prefetch_concurrency"`
+
+	// NegativeTTLMin and NegativeTTLMax clamp the ttl of NXDOMAIN and NODATA
+	// responses, which comes from the SOA record in their authority section.
+	// In seconds. Default is 0 and 10800.
+	NegativeTTLMin int `yaml:"negative_ttl_min"`
+	NegativeTTLMax int `yaml:"negative_ttl_max"`
+	// ErrorTTL is the ttl of SERVFAIL responses and failed queries. In seconds.
+	// Default is 5. A negative value disables the error caching.
+	ErrorTTL int `yaml:"error_ttl"`
+
+	// ServeStale enables the serve-stale mode (RFC 8767). Expired entries
+	// within lazy_cache_ttl are served only if the refresh failed or did not
+	// finish in StaleAnswerTimeout. Otherwise, they are always served.
+	ServeStale         bool `yaml:"serve_stale"`
+	StaleAnswerTimeout int  `yaml:"stale_answer_timeout"` // In milliseconds. Default is 1800.
 }
 
 type cachePlugin struct {
@@ -79,10 +126,23 @@ type cachePlugin struct {
 	backend      cache.Backend
 	lazyUpdateSF singleflight.Group
 
-	queryTotal   prometheus.Counter
-	hitTotal     prometheus.Counter
-	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	memCache    *mem_cache.MemCache // nil if backend is not a memory cache.
+	updated     atomic.Bool         // cache was updated since the last dump.
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	dumpDone    chan struct{}
+
+	hits        *concurrent_lru.ShardedLRU[*hitCounter] // nil if prefetch is disabled.
+	prefetchSF  singleflight.Group
+	prefetchSem chan struct{}
+
+	queryTotal          prometheus.Counter
+	hitTotal            prometheus.Counter
+	lazyHitTotal        prometheus.Counter
+	prefetchTotal       prometheus.Counter
+	prefetchHitTotal    prometheus.Counter
+	prefetchFailedTotal prometheus.Counter
+	size                prometheus.GaugeFunc
 }
 
 func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
@@ -91,7 +151,11 @@ func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
 
 func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 	var c cache.Backend
+	var mc *mem_cache.MemCache
 	if len(args.Redis) != 0 {
+		if len(args.DumpFile) != 0 {
+			return nil, errors.New("dump_file is not supported by redis cache")
+		}
 		opt, err := redis.ParseURL(args.Redis)
 		if err != nil {
 			return nil, fmt.Errorf("invalid redis url, %w", err)
@@ -110,12 +174,27 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 		}
 		c = rc
 	} else {
-		c = mem_cache.NewMemCache(args.Size, 0)
+		mc = mem_cache.NewMemCache(args.Size, 0)
+		c = mc
 	}
 
 	if args.LazyCacheReplyTTL <= 0 {
 		args.LazyCacheReplyTTL = 5
 	}
+	if args.PrefetchRatio < 0 || args.PrefetchRatio >= 1 {
+		return nil, fmt.Errorf("invalid prefetch_ratio %f, should be 0~1", args.PrefetchRatio)
+	}
+	utils.SetDefaultNum(&args.PrefetchRatio, defaultPrefetchRatio)
+	utils.SetDefaultNum(&args.PrefetchConcurrency, defaultPrefetchConcurrency)
+	utils.SetDefaultNum(&args.NegativeTTLMax, defaultNegativeTTLMax)
+	utils.SetDefaultNum(&args.ErrorTTL, defaultErrorTTL)
+	utils.SetDefaultNum(&args.StaleAnswerTimeout, defaultStaleAnswerTimeout)
+	if args.ServeStale && args.LazyCacheTTL <= 0 {
+		return nil, errors.New("serve_stale requires lazy_cache_ttl")
+	}
+	if args.NegativeTTLMin < 0 || args.NegativeTTLMax < args.NegativeTTLMin {
+		return nil, fmt.Errorf("invalid negative ttl range %d~%d", args.NegativeTTLMin, args.NegativeTTLMax)
+	}
 
 	var whenHit executable_seq.Executable
 	if tag := args.WhenHit; len(tag) > 0 {
@@ -127,10 +206,13 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 	}
 
 	p := &cachePlugin{
-		BP:      bp,
-		args:    args,
-		whenHit: whenHit,
-		backend: c,
+		BP:          bp,
+		args:        args,
+		whenHit:     whenHit,
+		backend:     c,
+		memCache:    mc,
+		closeNotify: make(chan struct{}),
+		dumpDone:    make(chan struct{}),
 
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "query_total",
@@ -144,6 +226,18 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 			Name: "lazy_hit_total",
 			Help: "The total number of queries that hit the expired cache",
 		}),
+		prefetchTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_total",
+			Help: "The total number of prefetches",
+		}),
+		prefetchHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_hit_total",
+			Help: "The total number of queries that hit the prefetched cache",
+		}),
+		prefetchFailedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_failed_total",
+			Help: "The total number of failed prefetches",
+		}),
 		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name: "cache_size",
 			Help: "Current cache size in records",
@@ -151,7 +245,29 @@ func newCachePlugin(bp *coremain.BP, args *Args) (*cachePlugin, error) {
 			return float64(c.Len())
 		}),
 	}
-	bp.GetMetricsReg().MustRegister(p.queryTotal, p.hitTotal, p.lazyHitTotal, p.size)
+	bp.GetMetricsReg().MustRegister(
+		p.queryTotal, p.hitTotal, p.lazyHitTotal,
+		p.prefetchTotal, p.prefetchHitTotal, p.prefetchFailedTotal,
+		p.size,
+	)
+
+	if args.PrefetchThreshold > 0 {
+		sizePerShard := args.Size / hitsShards
+		if sizePerShard < 16 {
+			sizePerShard = 16
+		}
+		p.hits = concurrent_lru.NewShardedLRU[*hitCounter](hitsShards, sizePerShard, nil)
+		p.prefetchSem = make(chan struct{}, args.PrefetchConcurrency)
+	}
+
+	if len(args.DumpFile) != 0 {
+		if err := p.loadDump(); err != nil {
+			bp.L().Warn("failed to load cache dump, skipped", zap.String("file", args.DumpFile), zap.Error(err))
+		}
+		go p.dumpLoop()
+	} else {
+		close(p.dumpDone)
+	}
 	return p, nil
 }
 
@@ -167,14 +283,28 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 		return executable_seq.ExecChain(ctx, qCtx, next)
 	}
 
-	cachedResp, lazyHit, err := c.lookupCache(msgKey)
+	cachedResp, lazyHit, ttlLeft, err := c.lookupCache(msgKey)
 	if err != nil {
 		c.L().Error("lookup cache", qCtx.InfoField(), zap.Error(err))
 	}
-	if lazyHit {
+	if lazyHit && c.args.ServeStale {
+		// Try to refresh the entry first, the stale one is used only if
+		// the refresh failed or timed out. RFC 8767.
+		if r := c.waitLazyUpdate(ctx, c.doLazyUpdate(msgKey, qCtx, next)); r != nil {
+			r.ID = q.ID
+			c.L().Debug("stale cache refreshed", qCtx.InfoField())
+			qCtx.SetResponse(r)
+			return nil
+		}
+		c.lazyHitTotal.Inc()
+		addStaleEDE(q, cachedResp)
+	} else if lazyHit {
 		c.lazyHitTotal.Inc()
 		c.doLazyUpdate(msgKey, qCtx, next)
 	}
+	if cachedResp != nil && !lazyHit && c.hits != nil {
+		c.countHit(msgKey, ttlLeft, qCtx, next)
+	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
 		cachedResp.ID = q.ID // change msg id
@@ -191,14 +321,39 @@ func (c *cachePlugin) Exec(ctx context.Context, qCtx *query_context.Context, nex
 	c.L().Debug("cache miss", qCtx.InfoField())
 	err = executable_seq.ExecChain(ctx, qCtx, next)
 	r := qCtx.R()
+	if r == nil && (err != nil || qCtx.Status() != nil) {
+		// Cache the failure, so a broken upstream is not hammered. RFC 9520.
+		r = dnsutils.GenEmptyReply(q, dns.RcodeServerFailure)
+	} else if r != nil && isNegativeResponse(r) {
+		r = r.Copy() // tryStoreMsg modifies the ttl of negative responses.
+	}
 	if r != nil {
 		if err := c.tryStoreMsg(msgKey, r); err != nil {
 			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
 		}
+		if c.hits != nil {
+			c.hits.Del(msgKey)
+		}
 	}
 	return err
 }
 
+// addStaleEDE marks the stale response r with an Extended DNS Error if
+// the client's query q supports EDNS0. RFC 8914 4.4 and 4.20.
+func addStaleEDE(q, r *dns.Msg) {
+	if !q.IsEdns0() {
+		return
+	}
+	if !dnsutils.IsEdnsResp(r) {
+		dnsutils.UpgradeEDNS0(r)
+	}
+	code := dnsutils.EDEStaleAnswer
+	if r.Rcode == dns.RcodeNameError {
+		code = dnsutils.EDEStaleNXDomain
+	}
+	dnsutils.AddEDE(r, code, "")
+}
+
 // getMsgKey returns a string key for the query msg, or an empty
 // string if query should not be cached.
 func (c *cachePlugin) getMsgKey(q *dns.Msg) (string, error) {
@@ -214,62 +369,68 @@ func (c *cachePlugin) getMsgKey(q *dns.Msg) (string, error) {
 }
 
 // lookupCache returns the cached response. The ttl of returned msg will be changed properly.
+// ttlLeft is the remaining fraction of the msg ttl if it is not expired.
 // Remember, caller must change the msg id.
-func (c *cachePlugin) lookupCache(msgKey string) (r *dns.Msg, lazyHit bool, err error) {
+func (c *cachePlugin) lookupCache(msgKey string) (r *dns.Msg, lazyHit bool, ttlLeft float64, err error) {
 	// lookup in cache
 	v, storedTime, _ := c.backend.Get(msgKey)
 
 	// cache hit
 	if v != nil {
-		if c.args.CompressResp {
-			decodeLen, err := snappy.DecodedLen(v)
-			if err != nil {
-				return nil, false, fmt.Errorf("snappy decode err: %w", err)
-			}
-			if decodeLen > dns.MaxMsgSize {
-				return nil, false, fmt.Errorf("invalid snappy data, not a dns msg, data len: %d", decodeLen)
-			}
-			decompressBuf := pool.GetBuf(decodeLen)
-			defer decompressBuf.Release()
-			v, err = snappy.Decode(decompressBuf.Bytes(), v)
-			if err != nil {
-				return nil, false, fmt.Errorf("snappy decode err: %w", err)
-			}
-		}
-		r = new(dns.Msg)
-		r.Data = v
-		if err := r.Unpack(); err != nil {
-			return nil, false, fmt.Errorf("failed to unpack cached data, %w", err)
+		r, err = c.unpackCachedMsg(v)
+		if err != nil {
+			return nil, false, 0, err
 		}
 
-		var msgTTL time.Duration
-		if len(r.Answer) == 0 {
-			msgTTL = emptyAnswerTTL
-		} else {
-			msgTTL = time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
-		}
+		msgTTL := c.cachedMsgTTL(r)
 
 		// not expired
-		if storedTime.Add(msgTTL).After(time.Now()) {
+		if left := time.Until(storedTime.Add(msgTTL)); left > 0 {
 			dnsutils.SubtractTTL(r, uint32(time.Since(storedTime).Seconds()))
-			return r, false, nil
+			return r, false, float64(left) / float64(msgTTL), nil
 		}
 
-		// expired but lazy update enabled
-		if c.args.LazyCacheTTL > 0 {
+		// expired but lazy update enabled, failures are never served from the lazy cache.
+		if c.args.LazyCacheTTL > 0 && !isErrorResponse(r) {
 			// set the default ttl
 			dnsutils.SetTTL(r, uint32(c.args.LazyCacheReplyTTL))
-			return r, true, nil
+			return r, true, 0, nil
 		}
 	}
 
 	// cache miss
-	return nil, false, nil
+	return nil, false, 0, nil
+}
+
+// unpackCachedMsg unpacks the msg from the cached value v.
+func (c *cachePlugin) unpackCachedMsg(v []byte) (*dns.Msg, error) {
+	if c.args.CompressResp {
+		decodeLen, err := snappy.DecodedLen(v)
+		if err != nil {
+			return nil, fmt.Errorf("snappy decode err: %w", err)
+		}
+		if decodeLen > dns.MaxMsgSize {
+			return nil, fmt.Errorf("invalid snappy data, not a dns msg, data len: %d", decodeLen)
+		}
+		decompressBuf := pool.GetBuf(decodeLen)
+		defer decompressBuf.Release()
+		v, err = snappy.Decode(decompressBuf.Bytes(), v)
+		if err != nil {
+			return nil, fmt.Errorf("snappy decode err: %w", err)
+		}
+	}
+	r := new(dns.Msg)
+	r.Data = v
+	if err := r.Unpack(); err != nil {
+		return nil, fmt.Errorf("failed to unpack cached data, %w", err)
+	}
+	return r, nil
 }
 
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
 // It has an inner singleflight.Group to de-duplicate same msgKey.
-func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, next executable_seq.ExecChainNode) {
+// The returned channel receives the new response, or nil if the update failed.
+func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, next executable_seq.ExecChainNode) <-chan singleflight.Result {
 	lazyQCtx := qCtx.Copy()
 	lazyUpdateFunc := func() (any, error) {
 		c.L().Debug("start lazy cache update", lazyQCtx.InfoField())
@@ -285,21 +446,47 @@ func (c *cachePlugin) doLazyUpdate(msgKey string, qCtx *query_context.Context, n
 			c.L().Warn("failed to update lazy cache", lazyQCtx.InfoField(), zap.Error(err))
 		}
 
+		// Keep the stale response if the update failed.
 		r := lazyQCtx.R()
-		if r != nil {
-			if err := c.tryStoreMsg(msgKey, r); err != nil {
-				c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
-			}
+		if r == nil || isErrorResponse(r) {
+			return (*dns.Msg)(nil), nil
+		}
+		if err := c.tryStoreMsg(msgKey, r); err != nil {
+			c.L().Error("cache store", qCtx.InfoField(), zap.Error(err))
 		}
 		c.L().Debug("lazy cache updated", lazyQCtx.InfoField())
-		return nil, nil
+		return r, nil
+	}
+	return c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+}
+
+// waitLazyUpdate waits the result of doLazyUpdate for at most the
+// stale_answer_timeout. It returns a copy of the new response, or nil if
+// the update failed or timed out.
+func (c *cachePlugin) waitLazyUpdate(ctx context.Context, ch <-chan singleflight.Result) *dns.Msg {
+	timer := pool.GetTimer(time.Duration(c.args.StaleAnswerTimeout) * time.Millisecond)
+	defer pool.ReleaseTimer(timer)
+	select {
+	case res := <-ch:
+		if r := res.Val.(*dns.Msg); r != nil {
+			return r.Copy() // r is shared by all waiters.
+		}
+		return nil
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return nil
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
 // tryStoreMsg tries to store r to cache. If r should be cached.
+// The ttl of negative responses will be modified.
 func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
-	if r.Rcode != dns.RcodeSuccess || r.Truncated != false {
+	if r.Truncated {
+		return nil
+	}
+	msgTTL, ok := c.responseTTL(r)
+	if !ok {
 		return nil
 	}
 
@@ -311,14 +498,10 @@ func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 
 	now := time.Now()
 	var expirationTime time.Time
-	if c.args.LazyCacheTTL > 0 {
+	if c.args.LazyCacheTTL > 0 && !isErrorResponse(r) {
 		expirationTime = now.Add(time.Duration(c.args.LazyCacheTTL) * time.Second)
 	} else {
-		minTTL := dnsutils.GetMinimalTTL(r)
-		if minTTL == 0 {
-			return nil
-		}
-		expirationTime = now.Add(time.Duration(minTTL) * time.Second)
+		expirationTime = now.Add(msgTTL)
 	}
 	if c.args.CompressResp {
 		compressBuf := pool.GetBuf(snappy.MaxEncodedLen(len(v)))
@@ -326,9 +509,39 @@ func (c *cachePlugin) tryStoreMsg(key string, r *dns.Msg) error {
 		defer compressBuf.Release()
 	}
 	c.backend.Store(key, v, now, expirationTime)
+	c.updated.Store(true)
 	return nil
 }
 
-func (c *cachePlugin) Shutdown() error {
-	return c.backend.Close()
+// Backend returns the cache backend. Other plugins can share it, e.g. to
+// cache the delegations of recursive upstreams. Their keys must not start
+// with two zero bytes, which is the key space of msg keys (see isMsgKey).
+// Their entries are not dumped, listed or purged by the cache plugin.
+func (c *cachePlugin) Backend() cache.Backend {
+	return c.backend
+}
+
+// Dump dumps the memory cache to the dump file if it is configured.
+func (c *cachePlugin) Dump() error {
+	if len(c.args.DumpFile) == 0 {
+		return nil
+	}
+	return c.dump()
+}
+
+// Close stops the dump loop, dumps the memory cache to the dump file
+// if it is configured, and closes the cache backend.
+func (c *cachePlugin) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closeNotify)
+		<-c.dumpDone
+		if len(c.args.DumpFile) != 0 {
+			if err := c.dump(); err != nil {
+				c.L().Error("failed to dump cache", zap.String("file", c.args.DumpFile), zap.Error(err))
+			}
+		}
+		err = c.backend.Close()
+	})
+	return err
 }
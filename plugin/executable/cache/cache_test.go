@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// newTestCachePlugin builds a cache plugin from args. The plugin is
+// closed when the test finishes.
+func newTestCachePlugin(t *testing.T, args *Args) *cachePlugin {
+	t.Helper()
+	p, err := newCachePlugin(coremain.NewBP("cache", PluginType, nil, nil), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func Test_addStaleEDE(t *testing.T) {
+	tests := []struct {
+		name     string
+		qEDNS    bool
+		rEDNS    bool
+		rcode    uint16
+		wantCode uint16
+		wantEDE  bool
+	}{
+		{"edns query", true, true, dns.RcodeSuccess, dnsutils.EDEStaleAnswer, true},
+		{"edns query nxdomain", true, true, dns.RcodeNameError, dnsutils.EDEStaleNXDomain, true},
+		{"edns query, cached without edns", true, false, dns.RcodeSuccess, dnsutils.EDEStaleAnswer, true},
+		{"no edns query, cached with edns", false, true, dns.RcodeSuccess, 0, false},
+		{"no edns query", false, false, dns.RcodeSuccess, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := dns.NewMsg("example.com.", dns.TypeA)
+			r := new(dns.Msg)
+			dnsutil.SetReply(r, q)
+			r.Rcode = tt.rcode
+			if tt.qEDNS {
+				dnsutils.UpgradeEDNS0(q)
+			}
+			if tt.rEDNS {
+				dnsutils.UpgradeEDNS0(r)
+			}
+
+			addStaleEDE(q, r)
+			got := findEDE(r)
+			if (got != nil) != tt.wantEDE {
+				t.Fatalf("want ede %v, got %v", tt.wantEDE, got)
+			}
+			if got != nil {
+				if got.InfoCode != tt.wantCode {
+					t.Fatalf("want ede code %d, got %d", tt.wantCode, got.InfoCode)
+				}
+				if !dnsutils.IsEdnsResp(r) {
+					t.Fatal("response with ede is not an edns0 msg")
+				}
+			}
+		})
+	}
+}
+
+func findEDE(r *dns.Msg) *dns.EDE {
+	for _, o := range r.Pseudo {
+		if ede, ok := o.(*dns.EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func newTestAResponse(q *dns.Msg, addr string) *dns.Msg {
+	r := new(dns.Msg)
+	dnsutil.SetReply(r, q)
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.Header{Name: q.Question[0].Header().Name, Class: dns.ClassINET, TTL: 60},
+		A:   rdata.A{Addr: netip.MustParseAddr(addr)},
+	}}
+	return r
+}
+
+// staleUpstream replies 127.0.0.2 after delay, or fails if rcode is
+// not NOERROR or err is set.
+type staleUpstream struct {
+	delay time.Duration
+	rcode uint16
+	err   error
+	calls atomic.Int32
+}
+
+func (u *staleUpstream) Exec(ctx context.Context, qCtx *query_context.Context, _ executable_seq.ExecChainNode) error {
+	u.calls.Add(1)
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if u.err != nil {
+		return u.err
+	}
+	if u.rcode != dns.RcodeSuccess {
+		qCtx.SetResponse(dnsutils.GenEmptyReply(qCtx.Q(), u.rcode))
+		return nil
+	}
+	qCtx.SetResponse(newTestAResponse(qCtx.Q(), "127.0.0.2"))
+	return nil
+}
+
+func Test_cachePlugin_Exec_serveStale(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstream  *staleUpstream
+		wantAddr  string
+		wantStale bool
+	}{
+		{"refreshed", &staleUpstream{}, "127.0.0.2", false},
+		{"refreshed within timeout", &staleUpstream{delay: 50 * time.Millisecond}, "127.0.0.2", false},
+		{"upstream error", &staleUpstream{err: errors.New("upstream error")}, "127.0.0.1", true},
+		{"upstream servfail", &staleUpstream{rcode: dns.RcodeServerFailure}, "127.0.0.1", true},
+		{"upstream timeout", &staleUpstream{delay: time.Second}, "127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCachePlugin(t, &Args{
+				Size:               1024,
+				LazyCacheTTL:       3600,
+				ServeStale:         true,
+				StaleAnswerTimeout: 200,
+			})
+			q := dns.NewMsg("example.com.", dns.TypeA)
+			dnsutils.UpgradeEDNS0(q)
+			key, err := c.getMsgKey(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Store an entry that expired a minute ago.
+			stale := newTestAResponse(q, "127.0.0.1")
+			if err := stale.Pack(); err != nil {
+				t.Fatal(err)
+			}
+			storedTime := time.Now().Add(-2 * time.Minute)
+			c.backend.Store(key, stale.Data, storedTime, storedTime.Add(time.Hour))
+
+			qCtx := query_context.NewContext(q, nil)
+			start := time.Now()
+			if err := c.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(tt.upstream)); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+
+			if tt.upstream.calls.Load() != 1 {
+				t.Fatal("upstream should be tried before serving the stale entry")
+			}
+			r := qCtx.R()
+			if r == nil || len(r.Answer) != 1 {
+				t.Fatalf("unexpected response %v", r)
+			}
+			if got := r.Answer[0].(*dns.A).A.Addr.String(); got != tt.wantAddr {
+				t.Fatalf("want answer %s, got %s", tt.wantAddr, got)
+			}
+			if ede := findEDE(r); (ede != nil) != tt.wantStale {
+				t.Fatalf("want stale ede %v, got %v", tt.wantStale, ede)
+			}
+			if tt.wantStale && elapsed > 500*time.Millisecond {
+				t.Fatalf("stale answer is not served after stale_answer_timeout, took %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// loadDump loads the entries in the dump file into the memory cache.
+// A missing dump file is not an error.
+func (c *cachePlugin) loadDump() error {
+	f, err := os.Open(c.args.DumpFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	n, err := c.memCache.Load(f)
+	if err != nil {
+		return err
+	}
+	c.L().Info("cache dump loaded", zap.String("file", c.args.DumpFile), zap.Int("entries", n))
+	return nil
+}
+
+// dump writes the memory cache to a temporary file and then
+// renames it to the dump file. Entries that are not stored by the
+// cache plugin (see cachePlugin.Backend) are not dumped.
+func (c *cachePlugin) dump() error {
+	f, err := os.CreateTemp(filepath.Dir(c.args.DumpFile), filepath.Base(c.args.DumpFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := c.memCache.Dump(f, isMsgKey)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), c.args.DumpFile); err != nil {
+		return err
+	}
+	c.L().Debug("cache dumped", zap.String("file", c.args.DumpFile), zap.Int("entries", n))
+	return nil
+}
+
+func (c *cachePlugin) dumpLoop() {
+	defer close(c.dumpDone)
+	interval := defaultDumpInterval
+	if c.args.DumpInterval > 0 {
+		interval = time.Duration(c.args.DumpInterval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !c.updated.Swap(false) {
+				continue
+			}
+			if err := c.dump(); err != nil {
+				c.L().Error("failed to dump cache", zap.String("file", c.args.DumpFile), zap.Error(err))
+			}
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func newTestDumpPlugin(t *testing.T, dumpFile string) *cachePlugin {
+	return newTestCachePlugin(t, &Args{Size: 1024, DumpFile: dumpFile, DumpInterval: 3600})
+}
+
+func Test_cachePlugin_Close_dump(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	now := time.Now()
+
+	p := newTestDumpPlugin(t, dumpFile)
+	p.memCache.Store("key", []byte("value"), now, now.Add(time.Hour))
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil { // Close can be called more than once.
+		t.Fatal(err)
+	}
+
+	// The entry is dumped by Close, not by the periodic dump,
+	// and is loaded by the new plugin.
+	p2 := newTestDumpPlugin(t, dumpFile)
+	v, _, _ := p2.memCache.Get("key")
+	if string(v) != "value" {
+		t.Fatalf("want dumped value, got %q", v)
+	}
+}
+
+func Test_cachePlugin_Dump(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	now := time.Now()
+
+	p := newTestDumpPlugin(t, dumpFile)
+	p.memCache.Store("key", []byte("value"), now, now.Add(time.Hour))
+	if err := p.Dump(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new plugin can load the entries while the old one is running,
+	// which is what happens in a reload.
+	p2 := newTestDumpPlugin(t, dumpFile)
+	v, _, _ := p2.memCache.Get("key")
+	if string(v) != "value" {
+		t.Fatalf("want dumped value, got %q", v)
+	}
+}
+
+func Test_cachePlugin_dump_sharedKeys(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	now := time.Now()
+	msgKey, err := dnsutils.GetMsgKey(dns.NewMsg("example.com.", dns.TypeA), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestDumpPlugin(t, dumpFile)
+	p.memCache.Store(msgKey, []byte("msg"), now, now.Add(time.Hour))
+	p.memCache.Store("recursor_delegation:com.", []byte("delegation"), now, now.Add(time.Hour))
+	if err := p.Dump(); err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := newTestDumpPlugin(t, dumpFile)
+	if v, _, _ := p2.memCache.Get(msgKey); string(v) != "msg" {
+		t.Fatalf("want dumped msg, got %q", v)
+	}
+	if v, _, _ := p2.memCache.Get("recursor_delegation:com."); v != nil {
+		t.Fatal("keys of other plugins should not be dumped")
+	}
+}
+
+func Test_newCachePlugin_dumpFileWithRedis(t *testing.T) {
+	_, err := newCachePlugin(nil, &Args{Redis: "redis://127.0.0.1:6379/0", DumpFile: "cache.dump"})
+	if err == nil {
+		t.Fatal("dump_file with redis should be rejected")
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+// isErrorResponse reports whether r is a resolution failure (RFC 9520).
+func isErrorResponse(r *dns.Msg) bool {
+	return r.Rcode == dns.RcodeServerFailure
+}
+
+// isNegativeResponse reports whether r is a NXDOMAIN or NODATA response (RFC 2308).
+func isNegativeResponse(r *dns.Msg) bool {
+	return r.Rcode == dns.RcodeNameError || (r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0)
+}
+
+// soaNegativeTTL returns the negative caching ttl of r, which is the minimum
+// of the SOA ttl and the SOA MINIMUM field. ok is false if r has no SOA
+// record in its authority section.
+func soaNegativeTTL(r *dns.Msg) (ttl uint32, ok bool) {
+	for _, rr := range r.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			return min(soa.Hdr.TTL, soa.Minttl), true
+		}
+	}
+	return 0, false
+}
+
+// responseTTL returns the ttl of r when it is stored to the cache. The ttl of
+// a negative response is set to the ttl of its authority section. r should
+// be a copy if it is a negative response, because it may be modified.
+// ok is false if r should not be cached.
+func (c *cachePlugin) responseTTL(r *dns.Msg) (ttl time.Duration, ok bool) {
+	switch {
+	case isErrorResponse(r):
+		if c.args.ErrorTTL <= 0 {
+			return 0, false
+		}
+		return time.Duration(c.args.ErrorTTL) * time.Second, true
+	case isNegativeResponse(r):
+		// Responses without SOA should not be cached. RFC 2308 5.
+		negTTL, ok := soaNegativeTTL(r)
+		if !ok {
+			return 0, false
+		}
+		negTTL = max(negTTL, uint32(c.args.NegativeTTLMin))
+		negTTL = min(negTTL, uint32(c.args.NegativeTTLMax))
+		for _, rr := range r.Ns {
+			rr.Header().TTL = negTTL
+		}
+		// NXDOMAIN may have a CNAME chain in the answer section.
+		return time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second, negTTL > 0
+	case r.Rcode == dns.RcodeSuccess:
+		minTTL := dnsutils.GetMinimalTTL(r)
+		return time.Duration(minTTL) * time.Second, minTTL > 0
+	default:
+		return 0, false
+	}
+}
+
+// cachedMsgTTL returns the ttl of a cached msg.
+func (c *cachePlugin) cachedMsgTTL(r *dns.Msg) time.Duration {
+	if isErrorResponse(r) {
+		return time.Duration(c.args.ErrorTTL) * time.Second
+	}
+	return time.Duration(dnsutils.GetMinimalTTL(r)) * time.Second
+}
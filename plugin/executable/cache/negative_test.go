@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+)
+
+func Test_cachePlugin_responseTTL(t *testing.T) {
+	c := &cachePlugin{args: &Args{NegativeTTLMin: 30, NegativeTTLMax: 600, ErrorTTL: 5}}
+
+	soa := func(ttl, minTTL uint32) *dns.SOA {
+		s := dnsutils.FakeSOA("example.com.")
+		s.Hdr.TTL = ttl
+		s.Minttl = minTTL
+		return s
+	}
+	a := func(ttl uint32) *dns.A {
+		return &dns.A{
+			Hdr: dns.Header{Name: "example.com.", Class: dns.ClassINET, TTL: ttl},
+			A:   rdata.A{Addr: netip.MustParseAddr("127.0.0.1")},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		rcode   uint16
+		answer  []dns.RR
+		ns      []dns.RR
+		wantTTL time.Duration
+		wantOk  bool
+	}{
+		{"answer", dns.RcodeSuccess, []dns.RR{a(100), a(50)}, nil, 50 * time.Second, true},
+		{"zero ttl answer", dns.RcodeSuccess, []dns.RR{a(0)}, nil, 0, false},
+		{"nodata soa ttl", dns.RcodeSuccess, nil, []dns.RR{soa(60, 300)}, 60 * time.Second, true},
+		{"nxdomain soa minimum", dns.RcodeNameError, nil, []dns.RR{soa(300, 120)}, 120 * time.Second, true},
+		{"negative floor", dns.RcodeNameError, nil, []dns.RR{soa(300, 1)}, 30 * time.Second, true},
+		{"negative ceiling", dns.RcodeNameError, nil, []dns.RR{soa(86400, 86400)}, 600 * time.Second, true},
+		{"nxdomain with cname", dns.RcodeNameError, []dns.RR{a(10)}, []dns.RR{soa(300, 300)}, 10 * time.Second, true},
+		{"negative without soa", dns.RcodeNameError, nil, nil, 0, false},
+		{"servfail", dns.RcodeServerFailure, nil, nil, 5 * time.Second, true},
+		{"refused", dns.RcodeRefused, nil, nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.Rcode = tt.rcode
+			r.Answer = tt.answer
+			r.Ns = tt.ns
+			gotTTL, gotOk := c.responseTTL(r)
+			if gotOk != tt.wantOk || (gotOk && gotTTL != tt.wantTTL) {
+				t.Fatalf("responseTTL() = %v, %v, want %v, %v", gotTTL, gotOk, tt.wantTTL, tt.wantOk)
+			}
+			if gotOk && c.cachedMsgTTL(r) != gotTTL {
+				t.Fatalf("cachedMsgTTL() = %v, want %v", c.cachedMsgTTL(r), gotTTL)
+			}
+		})
+	}
+
+	c.args.ErrorTTL = -1
+	r := new(dns.Msg)
+	r.Rcode = dns.RcodeServerFailure
+	if _, ok := c.responseTTL(r); ok {
+		t.Fatal("error caching should be disabled")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"codeberg.org/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const hitsShards = 64
+
+// hitCounter counts the hits of a cache entry.
+type hitCounter struct {
+	hits       atomic.Int64
+	prefetched atomic.Bool // the entry was stored by a prefetch.
+}
+
+func newHitCounter() *hitCounter {
+	return new(hitCounter)
+}
+
+// countHit counts a hit of msgKey, and prefetches it if it is a hot entry
+// that is about to expire.
+func (c *cachePlugin) countHit(msgKey string, ttlLeft float64, qCtx *query_context.Context, next executable_seq.ExecChainNode) {
+	hc, _ := c.hits.GetOrAdd(msgKey, newHitCounter)
+	if hc.prefetched.Load() {
+		c.prefetchHitTotal.Inc()
+	}
+	if hc.hits.Add(1) >= int64(c.args.PrefetchThreshold) && ttlLeft < c.args.PrefetchRatio {
+		c.doPrefetch(msgKey, qCtx, next)
+	}
+}
+
+// doPrefetch starts a new goroutine to execute next node and update the cache
+// in the background. It has an inner singleflight.Group to de-duplicate same
+// msgKey. The prefetch is skipped if there are too many prefetches.
+func (c *cachePlugin) doPrefetch(msgKey string, qCtx *query_context.Context, next executable_seq.ExecChainNode) {
+	if len(c.prefetchSem) == cap(c.prefetchSem) {
+		return
+	}
+	prefetchQCtx := qCtx.Copy()
+	prefetchFunc := func() (any, error) {
+		defer c.prefetchSF.Forget(msgKey)
+		select {
+		case c.prefetchSem <- struct{}{}:
+			defer func() { <-c.prefetchSem }()
+		default:
+			return nil, nil
+		}
+
+		c.prefetchTotal.Inc()
+		c.L().Debug("start prefetch", prefetchQCtx.InfoField())
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		defer cancel()
+
+		err := executable_seq.ExecChain(ctx, prefetchQCtx, next)
+		if err == nil {
+			err = prefetchQCtx.Status()
+		}
+		r := prefetchQCtx.R()
+		// NXDOMAIN is a valid answer, so it is stored like NOERROR.
+		if err == nil && r != nil && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("rcode %d", r.Rcode)
+		}
+		if err != nil || r == nil {
+			c.prefetchFailedTotal.Inc()
+			c.L().Warn("failed to prefetch", prefetchQCtx.InfoField(), zap.Error(err))
+			return nil, nil
+		}
+		if err := c.tryStoreMsg(msgKey, r); err != nil {
+			c.prefetchFailedTotal.Inc()
+			c.L().Error("cache store", prefetchQCtx.InfoField(), zap.Error(err))
+			return nil, nil
+		}
+
+		hc := new(hitCounter)
+		hc.prefetched.Store(true)
+		c.hits.Add(msgKey, hc)
+		c.L().Debug("prefetched", prefetchQCtx.InfoField())
+		return nil, nil
+	}
+	c.prefetchSF.DoChan(msgKey, prefetchFunc) // DoChan won't block this goroutine
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newTestPrefetchPlugin(t *testing.T, threshold int, ratio float64, concurrency int) *cachePlugin {
+	return newTestCachePlugin(t, &Args{
+		Size:                1024,
+		PrefetchThreshold:   threshold,
+		PrefetchRatio:       ratio,
+		PrefetchConcurrency: concurrency,
+	})
+}
+
+// prefetchExec replies the query with rcode. It blocks until release is closed.
+type prefetchExec struct {
+	rcode   uint16
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func newPrefetchExec() *prefetchExec {
+	return &prefetchExec{started: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (e *prefetchExec) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecChainNode) error {
+	e.calls.Add(1)
+	e.started <- struct{}{}
+	<-e.release
+	qCtx.SetResponse(dnsutils.GenEmptyReply(qCtx.Q(), e.rcode))
+	return nil
+}
+
+func newPrefetchQCtx() *query_context.Context {
+	return query_context.NewContext(dns.NewMsg("example.com.", dns.TypeA), nil)
+}
+
+func Test_cachePlugin_countHit(t *testing.T) {
+	tests := []struct {
+		name         string
+		hits         int
+		ttlLeft      float64
+		wantPrefetch bool
+	}{
+		{"below threshold", 2, 0.05, false},
+		{"ttl not low enough", 3, 0.5, false},
+		{"ttl equals ratio", 3, 0.1, false},
+		{"hot and expiring", 3, 0.05, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestPrefetchPlugin(t, 3, 0.1, 8)
+			e := newPrefetchExec()
+			close(e.release)
+			next := executable_seq.WrapExecutable(e)
+			for i := 0; i < tt.hits; i++ {
+				c.countHit("key", tt.ttlLeft, newPrefetchQCtx(), next)
+			}
+
+			select {
+			case <-e.started:
+				if !tt.wantPrefetch {
+					t.Fatal("unexpected prefetch")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantPrefetch {
+					t.Fatal("entry was not prefetched")
+				}
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_countHit_concurrent(t *testing.T) {
+	c := newTestPrefetchPlugin(t, 1<<20, 0.1, 8)
+	next := executable_seq.WrapExecutable(newPrefetchExec())
+
+	const n = 64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.countHit("key", 1, newPrefetchQCtx(), next)
+		}()
+	}
+	wg.Wait()
+
+	hc, ok := c.hits.Get("key")
+	if !ok || hc.hits.Load() != n {
+		t.Fatalf("want %d hits, got %v", n, hc)
+	}
+}
+
+func Test_cachePlugin_doPrefetch_concurrency(t *testing.T) {
+	const concurrency = 2
+	c := newTestPrefetchPlugin(t, 1, 0.1, concurrency)
+	e := newPrefetchExec()
+	next := executable_seq.WrapExecutable(e)
+
+	for i := 0; i < 4; i++ {
+		c.countHit(strconv.Itoa(i), 0, newPrefetchQCtx(), next)
+	}
+	for i := 0; i < concurrency; i++ {
+		select {
+		case <-e.started:
+		case <-time.After(time.Second):
+			t.Fatal("prefetch was not started")
+		}
+	}
+	select {
+	case <-e.started:
+		t.Fatal("too many concurrent prefetches")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The prefetches over the limit are dropped, not queued.
+	close(e.release)
+	time.Sleep(100 * time.Millisecond)
+	if got := e.calls.Load(); got != concurrency {
+		t.Fatalf("want %d prefetches, got %d", concurrency, got)
+	}
+	c.countHit("0", 0, newPrefetchQCtx(), next)
+	select {
+	case <-e.started:
+	case <-time.After(time.Second):
+		t.Fatal("prefetch was not started after the limit was released")
+	}
+}
+
+func Test_cachePlugin_doPrefetch_nxdomain(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       uint16
+		wantSuccess bool
+	}{
+		{"noerror", dns.RcodeSuccess, true},
+		{"nxdomain", dns.RcodeNameError, true},
+		{"refused", dns.RcodeRefused, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestPrefetchPlugin(t, 1, 0.1, 8)
+			e := newPrefetchExec()
+			e.rcode = tt.rcode
+			close(e.release)
+			c.countHit("key", 0, newPrefetchQCtx(), executable_seq.WrapExecutable(e))
+			<-e.started
+
+			// The hit counter of the key is replaced after a successful prefetch.
+			succeeded := false
+			for deadline := time.Now().Add(time.Second); !succeeded && time.Now().Before(deadline); {
+				hc, _ := c.hits.Get("key")
+				succeeded = hc != nil && hc.prefetched.Load()
+				time.Sleep(10 * time.Millisecond)
+			}
+			if succeeded != tt.wantSuccess {
+				t.Fatalf("want prefetch succeeded %v, got %v", tt.wantSuccess, succeeded)
+			}
+		})
+	}
+}
@@ -78,6 +78,7 @@ func (l *Limiter) Exec(ctx context.Context, qCtx *query_context.Context, next ex
 		return executable_seq.ExecChain(ctx, qCtx, next)
 	}
 	if ok := l.hpLimiter.AcquireToken(addr); !ok {
+		l.M().GetIPObserver().Observe(addr)
 		r := new(dns.Msg)
 		dnsutil.SetReply(r, qCtx.Q())
 		r.Rcode = dns.RcodeRefused
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"codeberg.org/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnssec"
+	"github.com/pmkol/mosdns-x/pkg/dnsutils"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "dnssec_validate"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*dnssecValidate)(nil)
+
+type Args struct {
+	// TrustAnchors are DS or DNSKEY records in zone file format.
+	// Default is the root KSKs.
+	TrustAnchors []string `yaml:"trust_anchors"`
+
+	// TrustAnchorFile is a zone file of DS or DNSKEY records.
+	TrustAnchorFile string `yaml:"trust_anchor_file"`
+
+	// CacheSize is the size of the DNSKEY and DS cache.
+	CacheSize int `yaml:"cache_size"`
+}
+
+// dnssecValidate sets the DO bit of the query and validates the response
+// from the rest of the sequence. DNSKEY and DS records are also fetched by
+// the rest of the sequence. Bogus responses are replaced with SERVFAIL.
+// The AD bit of secure responses is set, so the responses cached by a cache
+// plugin in front of it keep their security status.
+type dnssecValidate struct {
+	*coremain.BP
+	v *dnssec.Validator
+}
+
+func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
+	return newValidate(bp, args.(*Args))
+}
+
+func newValidate(bp *coremain.BP, args *Args) (*dnssecValidate, error) {
+	var anchors []dns.RR
+	if len(args.TrustAnchors) > 0 {
+		rrs, err := dnssec.ParseTrustAnchors(strings.NewReader(strings.Join(args.TrustAnchors, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchors, %w", err)
+		}
+		anchors = append(anchors, rrs...)
+	}
+	if len(args.TrustAnchorFile) > 0 {
+		f, err := os.Open(args.TrustAnchorFile)
+		if err != nil {
+			return nil, err
+		}
+		rrs, err := dnssec.ParseTrustAnchors(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor file, %w", err)
+		}
+		anchors = append(anchors, rrs...)
+	}
+
+	v, err := dnssec.NewValidator(dnssec.ValidatorOpts{
+		TrustAnchors: anchors,
+		CacheSize:    args.CacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dnssecValidate{BP: bp, v: v}, nil
+}
+
+func (d *dnssecValidate) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecChainNode) error {
+	q := qCtx.Q()
+	if q.CheckingDisabled || len(q.Question) != 1 {
+		// The client will validate the response by itself.
+		return executable_seq.ExecChain(ctx, qCtx, next)
+	}
+
+	isEdns, do, ad := q.IsEdns0(), q.Security, q.AuthenticatedData
+	if !isEdns {
+		q.UDPSize = 1232
+	}
+	q.Security = true
+	err := executable_seq.ExecChain(ctx, qCtx, next)
+	q.Security = do
+	if !isEdns {
+		q.UDPSize = 0
+	}
+
+	r := qCtx.R()
+	if err != nil || r == nil {
+		return err
+	}
+
+	res, err := d.v.Validate(ctx, q, r, d.exchanger(qCtx, next))
+	switch res {
+	case dnssec.Bogus:
+		d.L().Warn("bogus response", qCtx.InfoField(), zap.Error(err))
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeServerFailure))
+		return nil
+	case dnssec.Secure:
+		// RFC 6840 5.8.
+		r.AuthenticatedData = do || ad
+	default:
+		r.AuthenticatedData = false
+	}
+
+	if !do {
+		dnssec.StripDNSSEC(r, dns.RRToType(q.Question[0]))
+		r.Security = false
+	}
+	if !isEdns {
+		dnsutils.RemoveEDNS0(r)
+	}
+	return nil
+}
+
+// exchanger sends the queries of the validator to the rest of the sequence.
+func (d *dnssecValidate) exchanger(qCtx *query_context.Context, next executable_seq.ExecChainNode) dnssec.Exchanger {
+	return func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		subCtx := query_context.NewContext(q, qCtx.ReqMeta())
+		if err := executable_seq.ExecChain(ctx, subCtx, next); err != nil {
+			return nil, err
+		}
+		if r := subCtx.R(); r != nil {
+			return r, nil
+		}
+		if err := subCtx.Status(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("no response")
+	}
+}
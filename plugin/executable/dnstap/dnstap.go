@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/constant"
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/dnstap"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+const PluginType = "dnstap"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*dnstapPlugin)(nil)
+
+type Args struct {
+	// Network is "unix" or "tcp". Default is "unix".
+	Network string `yaml:"network"`
+	// Addr is the socket path or the tcp address of the Frame Streams
+	// collector. Required.
+	Addr string `yaml:"addr"`
+
+	Identity string `yaml:"identity"` // Default is the hostname.
+	Version  string `yaml:"version"`  // Default is "mosdns-x {version}".
+
+	// QueueSize is the maximum number of messages that wait to be sent.
+	// Messages are dropped if the queue is full. Default is 4096.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// dnstapPlugin sends CLIENT_QUERY/CLIENT_RESPONSE messages of queries
+// and FORWARDER_QUERY/FORWARDER_RESPONSE messages of upstream exchanges
+// that happen after it in the sequence.
+type dnstapPlugin struct {
+	*coremain.BP
+	out *dnstap.Output
+
+	droppedTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args any) (coremain.Plugin, error) {
+	return newDnstap(bp, args.(*Args))
+}
+
+func newDnstap(bp *coremain.BP, args *Args) (*dnstapPlugin, error) {
+	if len(args.Identity) == 0 {
+		args.Identity, _ = os.Hostname()
+	}
+	if len(args.Version) == 0 {
+		args.Version = "mosdns-x " + constant.Version
+	}
+	out, err := dnstap.NewOutput(dnstap.OutputOpts{
+		Network:   args.Network,
+		Addr:      args.Addr,
+		Identity:  args.Identity,
+		Version:   args.Version,
+		QueueSize: args.QueueSize,
+		Logger:    bp.L(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &dnstapPlugin{
+		BP:  bp,
+		out: out,
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of dnstap messages that were dropped because the queue was full",
+		}),
+	}
+	bp.GetMetricsReg().MustRegister(p.droppedTotal)
+	return p, nil
+}
+
+func (p *dnstapPlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecChainNode) error {
+	meta := qCtx.ReqMeta()
+	proto := clientProtocol(meta.GetProtocol())
+	clientAddr := netip.AddrPortFrom(meta.GetClientAddr(), 0)
+
+	p.send(&dnstap.Message{
+		Type:           dnstap.MessageClientQuery,
+		SocketProtocol: proto,
+		QueryAddr:      clientAddr,
+		QueryTime:      qCtx.StartTime(),
+		QueryMessage:   packCopy(qCtx.OriginalQuery()),
+	})
+
+	qCtx.AddExchangeObserver(p.observeExchange)
+	err := executable_seq.ExecChain(ctx, qCtx, next)
+
+	if r := qCtx.R(); r != nil {
+		p.send(&dnstap.Message{
+			Type:            dnstap.MessageClientResponse,
+			SocketProtocol:  proto,
+			QueryAddr:       clientAddr,
+			QueryTime:       qCtx.StartTime(),
+			ResponseTime:    time.Now(),
+			ResponseMessage: packCopy(r),
+		})
+	}
+	return err
+}
+
+// observeExchange is a query_context.ExchangeObserver.
+func (p *dnstapPlugin) observeExchange(e *query_context.UpstreamExchange) {
+	proto, addr := upstreamAddr(e.Upstream, e.UpstreamAddr)
+	var queryMsg []byte
+	if err := e.Query.Pack(); err == nil {
+		queryMsg = bytes.Clone(e.Query.Data)
+	}
+	p.send(&dnstap.Message{
+		Type:           dnstap.MessageForwarderQuery,
+		SocketProtocol: proto,
+		ResponseAddr:   addr,
+		QueryTime:      e.QueryTime,
+		QueryMessage:   queryMsg,
+	})
+	if e.Response == nil {
+		return
+	}
+	var respMsg []byte
+	if err := e.Response.Pack(); err == nil {
+		respMsg = bytes.Clone(e.Response.Data)
+	}
+	p.send(&dnstap.Message{
+		Type:            dnstap.MessageForwarderResponse,
+		SocketProtocol:  proto,
+		ResponseAddr:    addr,
+		QueryTime:       e.QueryTime,
+		ResponseTime:    e.ResponseTime,
+		ResponseMessage: respMsg,
+	})
+}
+
+func (p *dnstapPlugin) send(m *dnstap.Message) {
+	if !p.out.Send(m) {
+		p.droppedTotal.Inc()
+	}
+}
+
+func (p *dnstapPlugin) Close() error {
+	return p.out.Close()
+}
+
+// packCopy returns the wire format of m. It returns nil if m cannot be packed.
+func packCopy(m *dns.Msg) []byte {
+	m = m.Copy()
+	if err := m.Pack(); err != nil {
+		return nil
+	}
+	return m.Data
+}
+
+func clientProtocol(p string) dnstap.SocketProtocol {
+	switch p {
+	case query_context.ProtocolUDP:
+		return dnstap.ProtocolUDP
+	case query_context.ProtocolTCP:
+		return dnstap.ProtocolTCP
+	case query_context.ProtocolTLS:
+		return dnstap.ProtocolDOT
+	case query_context.ProtocolQUIC:
+		return dnstap.ProtocolDOQ
+	case query_context.ProtocolHTTP, query_context.ProtocolHTTPS, query_context.ProtocolH2, query_context.ProtocolH3:
+		return dnstap.ProtocolDOH
+	default:
+		return 0
+	}
+}
+
+// upstreamAddr returns the protocol and the address of an upstream.
+// ipAddr is the dial address of the upstream, it might be empty.
+func upstreamAddr(upstream, ipAddr string) (dnstap.SocketProtocol, netip.AddrPort) {
+	scheme, _, ok := strings.Cut(upstream, "://")
+	if !ok {
+		scheme = ""
+	}
+	var proto dnstap.SocketProtocol
+	var defaultPort uint16
+	switch scheme {
+	case "", "udp":
+		proto, defaultPort = dnstap.ProtocolUDP, 53
+	case "tcp":
+		proto, defaultPort = dnstap.ProtocolTCP, 53
+	case "dot", "tls":
+		proto, defaultPort = dnstap.ProtocolDOT, 853
+	case "doq", "quic":
+		proto, defaultPort = dnstap.ProtocolDOQ, 853
+	case "https", "h2", "doh", "h3", "doh3":
+		proto, defaultPort = dnstap.ProtocolDOH, 443
+	case "http":
+		proto, defaultPort = dnstap.ProtocolDOH, 80
+	}
+
+	host := ipAddr
+	if len(host) == 0 {
+		if !ok {
+			upstream = "udp://" + upstream
+		}
+		if u, err := url.Parse(upstream); err == nil {
+			host = u.Host
+		}
+	}
+	if ap, err := netip.ParseAddrPort(host); err == nil {
+		return proto, ap
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if a, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return proto, netip.AddrPortFrom(a, defaultPort)
+	}
+	return proto, netip.AddrPort{}
+}
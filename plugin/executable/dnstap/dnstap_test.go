@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"testing"
+
+	"github.com/pmkol/mosdns-x/pkg/dnstap"
+)
+
+func Test_upstreamAddr(t *testing.T) {
+	tests := []struct {
+		upstream, ipAddr string
+		wantProto        dnstap.SocketProtocol
+		wantAddr         string
+	}{
+		{"8.8.8.8", "", dnstap.ProtocolUDP, "8.8.8.8:53"},
+		{"tcp://8.8.8.8:5353", "", dnstap.ProtocolTCP, "8.8.8.8:5353"},
+		{"tls://dns.google", "8.8.4.4", dnstap.ProtocolDOT, "8.8.4.4:853"},
+		{"https://[2001:db8::1]/dns-query", "", dnstap.ProtocolDOH, "[2001:db8::1]:443"},
+		{"quic://dns.adguard.com", "", dnstap.ProtocolDOQ, "invalid AddrPort"},
+	}
+	for _, tt := range tests {
+		proto, addr := upstreamAddr(tt.upstream, tt.ipAddr)
+		if proto != tt.wantProto || addr.String() != tt.wantAddr {
+			t.Errorf("upstreamAddr(%s, %s) = %d, %s, want %d, %s", tt.upstream, tt.ipAddr, proto, addr, tt.wantProto, tt.wantAddr)
+		}
+	}
+}
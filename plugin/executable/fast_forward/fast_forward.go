@@ -25,6 +25,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -34,6 +36,7 @@ import (
 
 	"github.com/pmkol/mosdns-x/coremain"
 	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/cache"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 	"github.com/pmkol/mosdns-x/pkg/upstream"
@@ -42,6 +45,11 @@ import (
 
 const PluginType = "fast_forward"
 
+const (
+	defaultTimeout          = time.Second * 3
+	defaultRecursiveTimeout = time.Second * 10
+)
+
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() interface{} { return new(Args) })
 }
@@ -52,13 +60,50 @@ type fastForward struct {
 	*coremain.BP
 	args *Args
 
-	upstreamWrappers []bundled_upstream.Upstream
-	upstreamsCloser  []io.Closer
+	upstreams       []*forwardUpstream
+	upstreamsCloser []io.Closer
+	metrics         *upstreamMetrics
+	health          *healthChecker // nil if health_check is disabled
+	selector        selector
+	timeout         time.Duration
 }
 
 type Args struct {
 	Upstream []*UpstreamConfig `yaml:"upstream"`
 	CA       []string          `yaml:"ca"`
+
+	// Timeout is the timeout of a query in seconds. Default is 3, or 10
+	// if there is a recursive upstream, because a cold iterative lookup
+	// needs many round trips. Note that it is also limited by the query
+	// timeout of the server.
+	Timeout int `yaml:"timeout"`
+
+	// HealthCheck enables the health checking of upstreams. Unhealthy
+	// upstreams are ejected and won't receive queries until they are
+	// re-admitted. See HealthCheckConfig. The upstreams must have
+	// different addrs, which identify them in the health states and metrics.
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+
+	// Strategy is the upstream selection strategy. Can be:
+	// "parallel": queries all upstreams in parallel. This is the default.
+	// "round_robin": queries one upstream in turn. Faster upstreams get
+	// more turns, an upstream that is n times slower than the fastest one
+	// gets 1/n of the turns.
+	// "weighted_random": queries one random upstream. See UpstreamConfig.Weight.
+	// The weights are scaled by the latency as round_robin does.
+	// "lowest_latency": queries the upstream that has the lowest latency.
+	// A fraction (ExploreRate) of queries are sent to a random upstream
+	// to refresh the latency history of others.
+	// "fastest_n": queries the Concurrent upstreams that have the lowest
+	// latency in parallel.
+	// The latency of an upstream is the ewma of its response times.
+	// The strategies that query one upstream accept its response whatever
+	// its rcode is, UpstreamConfig.Trusted only applies to parallel queries.
+	// If the selected upstreams fail, the query is sent to the upstreams
+	// that the strategy selects from the others.
+	Strategy    string  `yaml:"strategy"`
+	ExploreRate float64 `yaml:"explore_rate"` // Default is 0.05.
+	Concurrent  int     `yaml:"concurrent"`   // Default is 2.
 }
 
 type UpstreamConfig struct {
@@ -74,9 +119,23 @@ type UpstreamConfig struct {
 	MaxConns       int      `yaml:"max_conns"`
 	EnablePipeline bool     `yaml:"enable_pipeline"`
 	Bootstrap      string   `yaml:"bootstrap"`
-	Insecure       bool     `yaml:"insecure"`
-	KernelTX       bool     `yaml:"kernel_tx"` // use kernel tls to send data
-	KernelRX       bool     `yaml:"kernel_rx"` // use kernel tls to receive data
+	RootHints      string   `yaml:"root_hints"` // for recursive upstream
+	// RecursiveCache is the tag of a cache plugin. If it is set, the recursive
+	// upstream caches the delegations in its backend.
+	RecursiveCache string `yaml:"recursive_cache"`
+	// RecursiveTimeout is the timeout of each exchange with an authoritative
+	// server in milliseconds. Default is 1000.
+	RecursiveTimeout int  `yaml:"recursive_timeout"`
+	Insecure         bool `yaml:"insecure"`
+	KernelTX         bool `yaml:"kernel_tx"` // use kernel tls to send data
+	KernelRX         bool `yaml:"kernel_rx"` // use kernel tls to receive data
+
+	// For doh upstreams. The url and header values can contain "{client_id}",
+	// which will be replaced by the client id of the query.
+	HTTPMethod  string            `yaml:"http_method"` // "POST" (default) or "GET"
+	HTTPHeaders map[string]string `yaml:"http_headers"`
+
+	Weight int `yaml:"weight"` // for weighted_random strategy, default is 1
 }
 
 func Init(bp *coremain.BP, args interface{}) (p coremain.Plugin, err error) {
@@ -87,16 +146,44 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 	if len(args.Upstream) == 0 {
 		return nil, errors.New("no upstream is configured")
 	}
+	if args.HealthCheck != nil {
+		addrs := make(map[string]struct{}, len(args.Upstream))
+		for _, c := range args.Upstream {
+			if _, dup := addrs[c.Addr]; dup {
+				return nil, fmt.Errorf("duplicate upstream %s, upstreams must have different addrs if health_check is enabled", c.Addr)
+			}
+			addrs[c.Addr] = struct{}{}
+		}
+	}
 
+	sel, err := newSelector(args)
+	if err != nil {
+		return nil, err
+	}
 	f := &fastForward{
-		BP:   bp,
-		args: args,
+		BP:       bp,
+		args:     args,
+		metrics:  newUpstreamMetrics(bp.GetMetricsReg()),
+		selector: sel,
+		timeout:  defaultTimeout,
+	}
+	if args.Timeout > 0 {
+		f.timeout = time.Duration(args.Timeout) * time.Second
+	} else {
+		for _, c := range args.Upstream {
+			if strings.HasPrefix(c.Addr, "recursive://") {
+				f.timeout = defaultRecursiveTimeout
+				break
+			}
+		}
+	}
+	if args.HealthCheck != nil {
+		f.health = newHealthChecker(args.HealthCheck, bp.L(), bp.GetMetricsReg())
 	}
 
 	// rootCAs
 	var rootCAs *x509.CertPool
 	if len(args.CA) != 0 {
-		var err error
 		rootCAs, err = utils.LoadCertPool(args.CA)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load ca: %w", err)
@@ -107,11 +194,14 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 		if len(c.Addr) == 0 {
 			return nil, errors.New("missing server addr")
 		}
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d of upstream %s", c.Weight, c.Addr)
+		}
 
 		trusted := c.Trusted || i == 0 // Set first upstream as trusted upstream.
 		if strings.HasPrefix(c.Addr, "udpme://") {
 			u := newUDPME(c.Addr[8:], trusted)
-			f.upstreamWrappers = append(f.upstreamWrappers, u)
+			f.addUpstream(u, c.Weight)
 		} else {
 			u, addr, err := newUpstream(bp, c, rootCAs)
 			if err != nil {
@@ -126,14 +216,52 @@ func newFastForward(bp *coremain.BP, args *Args) (*fastForward, error) {
 				u:       u,
 			}
 
-			f.upstreamWrappers = append(f.upstreamWrappers, w)
+			f.addUpstream(w, c.Weight)
 			f.upstreamsCloser = append(f.upstreamsCloser, u)
 		}
 	}
+	if f.health != nil && f.health.cfg.ProbeInterval > 0 {
+		go f.health.probeLoop()
+	}
 	return f, nil
 }
 
+// forwardUpstream is an upstream of fastForward.
+type forwardUpstream struct {
+	bundled_upstream.Upstream
+	weight  int
+	latency *latencyStat
+	health  *upstreamHealth // nil if health_check is disabled
+}
+
+func (f *fastForward) addUpstream(u bundled_upstream.Upstream, weight int) {
+	utils.SetDefaultNum(&weight, 1)
+	fu := &forwardUpstream{weight: weight, latency: new(latencyStat)}
+	u = &latencyUpstream{Upstream: u, s: fu.latency}
+	if f.health != nil {
+		hu := f.health.wrap(u)
+		fu.health = hu.h
+		u = hu
+	}
+	fu.Upstream = &metricsUpstream{Upstream: u, m: f.metrics}
+	f.upstreams = append(f.upstreams, fu)
+}
+
+// cacheBackendProvider is implemented by the cache plugin.
+type cacheBackendProvider interface {
+	Backend() cache.Backend
+}
+
 func newUpstream(bp *coremain.BP, c *UpstreamConfig, ca *x509.CertPool) (upstream.Upstream, string, error) {
+	var recursiveCache cache.Backend
+	if tag := c.RecursiveCache; len(tag) > 0 {
+		p, ok := bp.M().GetExecutables()[tag].(cacheBackendProvider)
+		if !ok {
+			return nil, "", fmt.Errorf("cannot find cache plugin %s", tag)
+		}
+		recursiveCache = p.Backend()
+	}
+
 	dialAdders := c.DialAdders
 	if len(dialAdders) == 0 {
 		dialAdders = append(dialAdders, "")
@@ -142,21 +270,26 @@ func newUpstream(bp *coremain.BP, c *UpstreamConfig, ca *x509.CertPool) (upstrea
 
 	for _, addr := range dialAdders {
 		opt := &upstream.Opt{
-			DialAddr:       addr,
-			Socks5:         c.Socks5,
-			S5Username:     c.S5Username,
-			S5Password:     c.S5Password,
-			SoMark:         c.SoMark,
-			BindToDevice:   c.BindToDevice,
-			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
-			MaxConns:       c.MaxConns,
-			EnablePipeline: c.EnablePipeline,
-			Bootstrap:      c.Bootstrap,
-			Insecure:       c.Insecure,
-			RootCAs:        ca,
-			KernelTX:       c.KernelTX,
-			KernelRX:       c.KernelRX,
-			Logger:         bp.L(),
+			DialAddr:         addr,
+			Socks5:           c.Socks5,
+			S5Username:       c.S5Username,
+			S5Password:       c.S5Password,
+			SoMark:           c.SoMark,
+			BindToDevice:     c.BindToDevice,
+			IdleTimeout:      time.Duration(c.IdleTimeout) * time.Second,
+			MaxConns:         c.MaxConns,
+			EnablePipeline:   c.EnablePipeline,
+			Bootstrap:        c.Bootstrap,
+			RootHints:        c.RootHints,
+			RecursiveCache:   recursiveCache,
+			RecursiveTimeout: time.Duration(c.RecursiveTimeout) * time.Millisecond,
+			Insecure:         c.Insecure,
+			RootCAs:          ca,
+			KernelTX:         c.KernelTX,
+			KernelRX:         c.KernelRX,
+			HTTPMethod:       c.HTTPMethod,
+			HTTPHeaders:      c.HTTPHeaders,
+			Logger:           bp.L(),
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, opt)
@@ -250,23 +383,74 @@ func (f *fastForward) exec(ctx context.Context, qCtx *query_context.Context) (er
 	var r *dns.Msg
 	var addr string
 
-	deadline := time.Now().Add(time.Second * 3)
+	deadline := time.Now().Add(f.timeout)
 	if ddl, ok := ctx.Deadline(); !ok || ddl.After(deadline) {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, deadline)
 		defer cancel()
 	}
 
-	r, err, addr = bundled_upstream.ExchangeParallel(ctx, qCtx, f.upstreamWrappers, f.L())
+	if id := qCtx.ReqMeta().GetClientID(); len(id) > 0 {
+		ctx = upstream.WithClientID(ctx, id)
+	}
+	candidates := f.upstreams
+	if f.health != nil {
+		candidates = f.health.candidates(candidates)
+	}
+	for {
+		selected := candidates
+		if len(candidates) > 0 {
+			selected = f.selector.selectUpstreams(candidates)
+		}
+		upstreams := make([]bundled_upstream.Upstream, 0, len(selected))
+		for _, u := range selected {
+			upstreams = append(upstreams, u)
+		}
+		r, err, addr = bundled_upstream.ExchangeParallel(ctx, qCtx, upstreams, f.L())
+		if err == nil || ctx.Err() != nil || len(selected) >= len(candidates) {
+			break
+		}
+		// The strategy selected a part of the candidates and they all
+		// failed. Fall back to the next selected upstream of the others.
+		candidates = slices.DeleteFunc(slices.Clone(candidates), func(u *forwardUpstream) bool {
+			return slices.Contains(selected, u)
+		})
+	}
 
 	if r != nil {
+		f.metrics.winTotal.WithLabelValues(addr).Inc()
 		qCtx.SetResponse(r)
 		qCtx.SetFrom(f.Tag() + "@" + addr)
 	}
 	return err
 }
 
-func (f *fastForward) Shutdown() error {
+// ServeHTTP serves the health states of the upstreams if health_check
+// is enabled.
+//
+//	GET health: one upstream per line,
+//	"addr healthy|ejected consecutive_fails ejected_until last_error".
+func (f *fastForward) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/plugins/"+f.Tag()+"/")
+	if path != "health" {
+		http.NotFound(w, req)
+		return
+	}
+	if f.health == nil {
+		http.Error(w, "health_check is disabled", http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f.health.serveHealth(w)
+}
+
+func (f *fastForward) Close() error {
+	if f.health != nil {
+		f.health.close()
+	}
 	for _, u := range f.upstreamsCloser {
 		u.Close()
 	}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const probeTimeout = time.Second * 5
+
+type HealthCheckConfig struct {
+	// MaxFails is the number of consecutive failures that ejects an
+	// upstream. Default is 3.
+	MaxFails int `yaml:"max_fails"`
+	// MaxLatency (ms) counts the responses that are slower than it as
+	// failures. Default is 0 (disabled).
+	MaxLatency int `yaml:"max_latency"`
+	// EjectTime (sec) is the ejection time of the first ejection. It is
+	// doubled by each consecutive ejection up to MaxEjectTime.
+	// Default is 10 and 300.
+	EjectTime    int `yaml:"eject_time"`
+	MaxEjectTime int `yaml:"max_eject_time"`
+
+	// ProbeInterval (sec) enables active probes of all upstreams. A successful
+	// probe re-admits an ejected upstream. Default is 0 (disabled).
+	ProbeInterval int    `yaml:"probe_interval"`
+	ProbeQName    string `yaml:"probe_qname"` // Default is ".". The probe query type is NS.
+}
+
+func (c *HealthCheckConfig) init() {
+	utils.SetDefaultNum(&c.MaxFails, 3)
+	utils.SetDefaultNum(&c.EjectTime, 10)
+	utils.SetDefaultNum(&c.MaxEjectTime, 300)
+	if len(c.ProbeQName) == 0 {
+		c.ProbeQName = "."
+	}
+	if !strings.HasSuffix(c.ProbeQName, ".") {
+		c.ProbeQName += "."
+	}
+}
+
+// upstreamHealth is the health state of an upstream.
+type upstreamHealth struct {
+	m            sync.Mutex
+	fails        int // consecutive failures
+	ejections    int // consecutive ejections
+	ejectedUntil time.Time
+	probation    bool // re-admitted after an ejection, one failure ejects it again
+	lastErr      error
+}
+
+func (h *upstreamHealth) healthy(now time.Time) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return !now.Before(h.ejectedUntil)
+}
+
+// healthChecker tracks the health of the upstreams of a fastForward.
+type healthChecker struct {
+	cfg    *HealthCheckConfig
+	logger *zap.Logger
+
+	upstreams []*healthUpstream // same order as fastForward.upstreamWrappers
+
+	ejectionTotal *prometheus.CounterVec
+	healthyDesc   *prometheus.Desc
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func newHealthChecker(cfg *HealthCheckConfig, logger *zap.Logger, reg prometheus.Registerer) *healthChecker {
+	cfg.init()
+	hc := &healthChecker{
+		cfg:    cfg,
+		logger: logger,
+		ejectionTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_ejection_total",
+			Help: "The total number of ejections of the upstream",
+		}, []string{"upstream"}),
+		healthyDesc: prometheus.NewDesc(
+			"upstream_healthy",
+			"Whether the upstream is healthy (1) or ejected (0)",
+			[]string{"upstream"}, nil,
+		),
+		closeNotify: make(chan struct{}),
+	}
+	reg.MustRegister(hc.ejectionTotal, hc)
+	return hc
+}
+
+// wrap returns a bundled_upstream.Upstream that reports the results of u to hc.
+func (hc *healthChecker) wrap(u bundled_upstream.Upstream) *healthUpstream {
+	hu := &healthUpstream{Upstream: u, hc: hc, h: new(upstreamHealth)}
+	hc.upstreams = append(hc.upstreams, hu)
+	return hu
+}
+
+// candidates returns the healthy upstreams in us. If all upstreams are
+// ejected, it returns us.
+func (hc *healthChecker) candidates(us []*forwardUpstream) []*forwardUpstream {
+	now := time.Now()
+	var healthy []*forwardUpstream
+	for _, u := range us {
+		if u.health.healthy(now) {
+			if healthy == nil {
+				healthy = make([]*forwardUpstream, 0, len(us))
+			}
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return us
+	}
+	return healthy
+}
+
+func (hc *healthChecker) report(hu *healthUpstream, latency time.Duration, err error) {
+	if err == nil && hc.cfg.MaxLatency > 0 && latency > time.Duration(hc.cfg.MaxLatency)*time.Millisecond {
+		err = fmt.Errorf("slow response, latency %s", latency)
+	}
+
+	h := hu.h
+	now := time.Now()
+	h.m.Lock()
+	if err == nil {
+		h.fails = 0
+		if now.Before(h.ejectedUntil) {
+			// It answered a probe (or a query when all upstreams are
+			// ejected), re-admit it early. It is in probation, so the
+			// backoff is kept until it is proven healthy.
+			h.ejectedUntil = now
+			h.probation = true
+			h.m.Unlock()
+			hc.logger.Info("upstream re-admitted", zap.String("addr", hu.Address()))
+			return
+		}
+		h.ejections = 0
+		h.probation = false
+		h.m.Unlock()
+		return
+	}
+	h.lastErr = err
+	h.fails++
+	if now.Before(h.ejectedUntil) || (h.fails < hc.cfg.MaxFails && !h.probation) {
+		h.m.Unlock()
+		return
+	}
+	h.ejections++
+	ejectTime := time.Duration(hc.cfg.EjectTime) * time.Second << min(h.ejections-1, 20)
+	ejectTime = min(ejectTime, time.Duration(hc.cfg.MaxEjectTime)*time.Second)
+	h.ejectedUntil = now.Add(ejectTime)
+	h.fails = 0
+	h.probation = true
+	h.m.Unlock()
+
+	hc.ejectionTotal.WithLabelValues(hu.Address()).Inc()
+	hc.logger.Warn("upstream ejected", zap.String("addr", hu.Address()), zap.Duration("eject_time", ejectTime), zap.Error(err))
+}
+
+// probeLoop actively probes the upstreams. Healthy upstreams are ejected
+// by failed probes, and ejected upstreams are re-admitted by a successful
+// probe before their eject time ends.
+func (hc *healthChecker) probeLoop() {
+	ticker := time.NewTicker(time.Duration(hc.cfg.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, hu := range hc.upstreams {
+				go hc.probe(hu)
+			}
+		case <-hc.closeNotify:
+			return
+		}
+	}
+}
+
+func (hc *healthChecker) probe(hu *healthUpstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	q := dns.NewMsg(hc.cfg.ProbeQName, dns.TypeNS)
+	_, _ = hu.Exchange(ctx, q)
+}
+
+func (hc *healthChecker) close() {
+	hc.closeOnce.Do(func() { close(hc.closeNotify) })
+}
+
+// Describe implements prometheus.Collector.
+func (hc *healthChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hc.healthyDesc
+}
+
+// Collect implements prometheus.Collector.
+func (hc *healthChecker) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, hu := range hc.upstreams {
+		v := 0.0
+		if hu.h.healthy(now) {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(hc.healthyDesc, prometheus.GaugeValue, v, hu.Address())
+	}
+}
+
+// serveHealth writes the health states of the upstreams, one per line:
+// "addr healthy|ejected consecutive_fails ejected_until last_error".
+func (hc *healthChecker) serveHealth(w http.ResponseWriter) {
+	now := time.Now()
+	sb := new(strings.Builder)
+	for _, hu := range hc.upstreams {
+		h := hu.h
+		h.m.Lock()
+		state := "healthy"
+		if now.Before(h.ejectedUntil) {
+			state = "ejected"
+		}
+		ejectedUntil := "-"
+		if !h.ejectedUntil.IsZero() {
+			ejectedUntil = h.ejectedUntil.Format(time.RFC3339)
+		}
+		lastErr := "-"
+		if h.lastErr != nil {
+			lastErr = h.lastErr.Error()
+		}
+		fmt.Fprintf(sb, "%s %s %d %s %s\n", hu.Address(), state, h.fails, ejectedUntil, lastErr)
+		h.m.Unlock()
+	}
+	w.Write([]byte(sb.String()))
+}
+
+// healthUpstream reports the results of exchanges to a healthChecker.
+type healthUpstream struct {
+	bundled_upstream.Upstream
+	hc *healthChecker
+	h  *upstreamHealth
+}
+
+func (u *healthUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	r, err := u.Upstream.Exchange(ctx, q)
+	if errors.Is(err, context.Canceled) {
+		// Canceled because another upstream won or the query was canceled.
+		return r, err
+	}
+	u.hc.report(u, time.Since(start), err)
+	return r, err
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+)
+
+type fakeUpstream struct {
+	addr string
+	err  error
+}
+
+func (u *fakeUpstream) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	return new(dns.Msg), nil
+}
+
+func (u *fakeUpstream) Address() string   { return u.addr }
+func (u *fakeUpstream) IPAddress() string { return "" }
+func (u *fakeUpstream) Trusted() bool     { return true }
+
+func Test_healthChecker(t *testing.T) {
+	hc := newHealthChecker(&HealthCheckConfig{MaxFails: 2, EjectTime: 1, MaxEjectTime: 3}, zap.NewNop(), prometheus.NewRegistry())
+	bad := &fakeUpstream{addr: "bad", err: errors.New("dial failed")}
+	good := &fakeUpstream{addr: "good"}
+	var us []*forwardUpstream
+	for _, u := range []bundled_upstream.Upstream{bad, good} {
+		hu := hc.wrap(u)
+		us = append(us, &forwardUpstream{Upstream: hu, health: hu.h})
+	}
+
+	exchange := func(u bundled_upstream.Upstream) {
+		_, _ = u.Exchange(context.Background(), new(dns.Msg))
+	}
+
+	exchange(us[0])
+	if got := hc.candidates(us); len(got) != 2 {
+		t.Fatalf("ejected after one failure, candidates: %d", len(got))
+	}
+	exchange(us[0])
+	if got := hc.candidates(us); len(got) != 1 || got[0] != us[1] {
+		t.Fatalf("bad upstream was not ejected")
+	}
+
+	// Canceled exchanges are not failures.
+	bad.err = context.Canceled
+	exchange(us[0])
+	exchange(us[0])
+	if got := hc.candidates(us); len(got) != 1 {
+		t.Fatalf("canceled exchanges changed the health state")
+	}
+
+	// If all upstreams are ejected, all of them are candidates.
+	good.err = errors.New("timeout")
+	exchange(us[1])
+	exchange(us[1])
+	if got := hc.candidates(us); len(got) != 2 {
+		t.Fatalf("want all upstreams as candidates, got %d", len(got))
+	}
+
+	// Re-admission with exponential backoff.
+	h := us[0].health
+	h.m.Lock()
+	h.ejectedUntil = time.Now() // eject time passed
+	h.m.Unlock()
+	bad.err = errors.New("dial failed")
+	exchange(us[0]) // one failure in probation ejects it again
+	h.m.Lock()
+	ejections, ejectTime := h.ejections, time.Until(h.ejectedUntil)
+	h.m.Unlock()
+	if ejections != 2 || ejectTime <= time.Second || ejectTime > time.Second*2 {
+		t.Fatalf("unexpected backoff, ejections: %d, eject time: %s", ejections, ejectTime)
+	}
+
+	// A successful probe re-admits an ejected upstream early, in probation.
+	h.m.Lock()
+	h.ejectedUntil = time.Now().Add(time.Hour)
+	h.m.Unlock()
+	bad.err = nil
+	hc.probe(hc.upstreams[0])
+	if got := hc.candidates(us); len(got) != 2 {
+		t.Fatalf("probed upstream was not re-admitted")
+	}
+	h.m.Lock()
+	if !h.probation || h.ejections != 2 {
+		t.Fatalf("re-admitted upstream should be in probation with its backoff")
+	}
+	h.m.Unlock()
+
+	// A success resets the backoff.
+	h.m.Lock()
+	h.ejectedUntil = time.Now()
+	h.m.Unlock()
+	bad.err = nil
+	exchange(us[0])
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.ejections != 0 || h.probation {
+		t.Fatalf("backoff was not reset")
+	}
+}
+
+func Test_newFastForward_duplicateAddr(t *testing.T) {
+	bp := coremain.NewBP("test", PluginType, nil, nil)
+	args := &Args{
+		Upstream:    []*UpstreamConfig{{Addr: "udp://127.0.0.1"}, {Addr: "udp://127.0.0.1"}},
+		HealthCheck: &HealthCheckConfig{},
+	}
+	if _, err := newFastForward(bp, args); err == nil {
+		t.Fatal("duplicate upstream addrs should be rejected if health_check is enabled")
+	}
+}
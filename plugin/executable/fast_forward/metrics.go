@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+)
+
+// Error classes of the upstream_error_total metric.
+const (
+	errClassTimeout = "timeout"
+	errClassNetwork = "network"
+	errClassOther   = "other"
+)
+
+type upstreamMetrics struct {
+	queryTotal *prometheus.CounterVec
+	errTotal   *prometheus.CounterVec
+	winTotal   *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+}
+
+func newUpstreamMetrics(reg prometheus.Registerer) *upstreamMetrics {
+	m := &upstreamMetrics{
+		queryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_query_total",
+			Help: "The total number of queries sent to the upstream",
+		}, []string{"upstream"}),
+		errTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_error_total",
+			Help: "The total number of failed queries of the upstream by error class",
+		}, []string{"upstream", "class"}),
+		winTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_win_total",
+			Help: "The total number of responses of the upstream that were accepted",
+		}, []string{"upstream"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_latency_millisecond",
+			Help:    "The response latency of the upstream in millisecond",
+			Buckets: []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
+		}, []string{"upstream"}),
+	}
+	reg.MustRegister(m.queryTotal, m.errTotal, m.winTotal, m.latency)
+	return m
+}
+
+// metricsUpstream records the metrics of a bundled_upstream.Upstream.
+type metricsUpstream struct {
+	bundled_upstream.Upstream
+	m *upstreamMetrics
+}
+
+func (u *metricsUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	addr := u.Address()
+	u.m.queryTotal.WithLabelValues(addr).Inc()
+	start := time.Now()
+	r, err := u.Upstream.Exchange(ctx, q)
+	switch {
+	case err == nil:
+		u.m.latency.WithLabelValues(addr).Observe(float64(time.Since(start).Milliseconds()))
+	case errors.Is(err, context.Canceled):
+		// Canceled because another upstream won or the query was canceled.
+	default:
+		u.m.errTotal.WithLabelValues(addr, errClass(err)).Inc()
+	}
+	return r, err
+}
+
+func errClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errClassTimeout
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return errClassTimeout
+		}
+		return errClassNetwork
+	default:
+		return errClassOther
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/pmkol/mosdns-x/pkg/bundled_upstream"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const (
+	strategyParallel       = "parallel"
+	strategyRoundRobin     = "round_robin"
+	strategyWeightedRandom = "weighted_random"
+	strategyLowestLatency  = "lowest_latency"
+	strategyFastestN       = "fastest_n"
+)
+
+const (
+	// latencyEWMAWeight is the weight of a new sample in the latency ewma.
+	latencyEWMAWeight = 0.2
+	// failureLatency is the latency sample of a failed exchange.
+	failureLatency = time.Second * 3
+
+	defaultExploreRate = 0.05
+	defaultFastestN    = 2
+)
+
+// latencyStat is the latency history of an upstream.
+type latencyStat struct {
+	ewma atomic.Int64 // in ns, 0 means no sample
+}
+
+func (s *latencyStat) observe(d time.Duration) {
+	for {
+		old := s.ewma.Load()
+		n := int64(d)
+		if old != 0 {
+			n = old + int64(float64(n-old)*latencyEWMAWeight)
+		}
+		n = max(n, 1)
+		if s.ewma.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+// value returns the latency ewma. It returns 0 if there is no sample yet.
+func (s *latencyStat) value() time.Duration {
+	return time.Duration(s.ewma.Load())
+}
+
+// latencyUpstream records the latency of an upstream to a latencyStat.
+type latencyUpstream struct {
+	bundled_upstream.Upstream
+	s *latencyStat
+}
+
+func (u *latencyUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	r, err := u.Upstream.Exchange(ctx, q)
+	switch {
+	case err == nil:
+		u.s.observe(time.Since(start))
+	case errors.Is(err, context.Canceled):
+		// Canceled because another upstream won or the query was canceled.
+	default:
+		u.s.observe(failureLatency)
+	}
+	return r, err
+}
+
+// selector selects the upstreams that a query will be sent to.
+// us is never empty.
+type selector interface {
+	selectUpstreams(us []*forwardUpstream) []*forwardUpstream
+}
+
+func newSelector(args *Args) (selector, error) {
+	switch args.Strategy {
+	case "", strategyParallel:
+		return parallelSelector{}, nil
+	case strategyRoundRobin:
+		return new(roundRobinSelector), nil
+	case strategyWeightedRandom:
+		return weightedRandomSelector{}, nil
+	case strategyLowestLatency:
+		r := args.ExploreRate
+		if r < 0 || r > 1 {
+			return nil, fmt.Errorf("invalid explore_rate %f, should be 0~1", r)
+		}
+		utils.SetDefaultNum(&r, defaultExploreRate)
+		return lowestLatencySelector{exploreRate: r}, nil
+	case strategyFastestN:
+		n := args.Concurrent
+		if n < 0 {
+			return nil, fmt.Errorf("invalid concurrent %d", n)
+		}
+		utils.SetDefaultNum(&n, defaultFastestN)
+		return fastestNSelector{n: n}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %s", args.Strategy)
+	}
+}
+
+// parallelSelector sends queries to all upstreams.
+type parallelSelector struct{}
+
+func (parallelSelector) selectUpstreams(us []*forwardUpstream) []*forwardUpstream {
+	return us
+}
+
+// latencyWeights returns the weights of us scaled by their latency ewma.
+// An upstream that is n times slower than the fastest one gets 1/n of its
+// weight. Upstreams without a latency history are treated as the fastest.
+func latencyWeights(us []*forwardUpstream, weight func(u *forwardUpstream) float64) []float64 {
+	var best time.Duration
+	for _, u := range us {
+		if l := u.latency.value(); l > 0 && (best == 0 || l < best) {
+			best = l
+		}
+	}
+	ws := make([]float64, len(us))
+	for i, u := range us {
+		ws[i] = weight(u)
+		if l := u.latency.value(); l > 0 {
+			ws[i] *= float64(best) / float64(l)
+		}
+	}
+	return ws
+}
+
+// roundRobinSelector sends each query to the next upstream. It is a smooth
+// weighted round robin, the weights are from latencyWeights.
+// When the set of upstreams changes (e.g. an upstream is ejected), the
+// credits of the upstreams that are not in the set are dropped, so they
+// start over when they come back.
+type roundRobinSelector struct {
+	m       sync.Mutex
+	us      []*forwardUpstream // the upstreams in current
+	current map[*forwardUpstream]float64
+}
+
+func (s *roundRobinSelector) selectUpstreams(us []*forwardUpstream) []*forwardUpstream {
+	ws := latencyWeights(us, func(*forwardUpstream) float64 { return 1 })
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.current == nil || !slices.Equal(s.us, us) {
+		current := make(map[*forwardUpstream]float64, len(us))
+		for _, u := range us {
+			current[u] = s.current[u]
+		}
+		s.us = slices.Clone(us)
+		s.current = current
+	}
+	total := 0.0
+	best := 0
+	for i, u := range us {
+		s.current[u] += ws[i]
+		total += ws[i]
+		if s.current[u] > s.current[us[best]] {
+			best = i
+		}
+	}
+	s.current[us[best]] -= total
+	return us[best : best+1]
+}
+
+// weightedRandomSelector sends each query to a random upstream. The
+// chance of an upstream is proportional to its weight from latencyWeights.
+type weightedRandomSelector struct{}
+
+func (weightedRandomSelector) selectUpstreams(us []*forwardUpstream) []*forwardUpstream {
+	ws := latencyWeights(us, func(u *forwardUpstream) float64 { return float64(u.weight) })
+	sum := 0.0
+	last := -1 // the last upstream that has a weight
+	for i, w := range ws {
+		sum += w
+		if w > 0 {
+			last = i
+		}
+	}
+	if last < 0 {
+		i := rand.IntN(len(us))
+		return us[i : i+1]
+	}
+	n := rand.Float64() * sum
+	for i, w := range ws {
+		n -= w
+		if n < 0 {
+			return us[i : i+1]
+		}
+	}
+	return us[last : last+1]
+}
+
+// lowestLatencySelector sends each query to the upstream that has the
+// lowest latency ewma. A fraction (exploreRate) of queries are sent to
+// a random upstream instead to refresh the latency history of others.
+// Upstreams without a latency history are preferred.
+type lowestLatencySelector struct {
+	exploreRate float64
+}
+
+func (s lowestLatencySelector) selectUpstreams(us []*forwardUpstream) []*forwardUpstream {
+	if len(us) > 1 && rand.Float64() < s.exploreRate {
+		i := rand.IntN(len(us))
+		return us[i : i+1]
+	}
+	best := 0
+	for i, u := range us {
+		if u.latency.value() < us[best].latency.value() {
+			best = i
+		}
+	}
+	return us[best : best+1]
+}
+
+// fastestNSelector sends each query to the n upstreams that have the
+// lowest latency ewma in parallel.
+type fastestNSelector struct {
+	n int
+}
+
+func (s fastestNSelector) selectUpstreams(us []*forwardUpstream) []*forwardUpstream {
+	if len(us) <= s.n {
+		return us
+	}
+	sorted := slices.Clone(us)
+	slices.SortStableFunc(sorted, func(a, b *forwardUpstream) int {
+		return cmp.Compare(a.latency.value(), b.latency.value())
+	})
+	return sorted[:s.n]
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+func newTestUpstreams(latencies ...time.Duration) []*forwardUpstream {
+	us := make([]*forwardUpstream, 0, len(latencies))
+	for _, l := range latencies {
+		u := &forwardUpstream{weight: 1, latency: new(latencyStat)}
+		if l > 0 {
+			u.latency.observe(l)
+		}
+		us = append(us, u)
+	}
+	return us
+}
+
+func Test_latencyStat(t *testing.T) {
+	s := new(latencyStat)
+	s.observe(time.Millisecond * 100)
+	if got := s.value(); got != time.Millisecond*100 {
+		t.Fatalf("want first sample, got %s", got)
+	}
+	s.observe(time.Millisecond * 200)
+	if got := s.value(); got != time.Millisecond*120 {
+		t.Fatalf("want ewma 120ms, got %s", got)
+	}
+}
+
+func Test_selectors(t *testing.T) {
+	us := newTestUpstreams(time.Millisecond*30, time.Millisecond*10, time.Millisecond*20)
+
+	rr := new(roundRobinSelector)
+	same := newTestUpstreams(time.Millisecond*10, time.Millisecond*10, 0)
+	for i := 0; i < 6; i++ {
+		got := rr.selectUpstreams(same)
+		if len(got) != 1 || got[0] != same[i%3] {
+			t.Fatalf("round_robin #%d: unexpected upstream", i)
+		}
+	}
+	// Turns are proportional to 1/latency: 30ms, 10ms, 20ms -> 2:6:3.
+	turns := make(map[*forwardUpstream]int)
+	for i := 0; i < 110; i++ {
+		turns[rr.selectUpstreams(us)[0]]++
+	}
+	if turns[us[0]] != 20 || turns[us[1]] != 60 || turns[us[2]] != 30 {
+		t.Fatalf("round_robin: unexpected turns %d, %d, %d", turns[us[0]], turns[us[1]], turns[us[2]])
+	}
+
+	// An ejected upstream does not keep its credit.
+	rr = new(roundRobinSelector)
+	rr.selectUpstreams(same)
+	for i := 0; i < 3; i++ {
+		rr.selectUpstreams(same[1:]) // same[0] was ejected
+	}
+	if _, ok := rr.current[same[0]]; ok {
+		t.Fatal("round_robin: kept the credit of an ejected upstream")
+	}
+	turns = make(map[*forwardUpstream]int)
+	for i := 0; i < 6; i++ {
+		turns[rr.selectUpstreams(same)[0]]++
+	}
+	for i, u := range same {
+		if turns[u] != 2 {
+			t.Fatalf("round_robin: upstream #%d got %d turns after the set changed", i, turns[u])
+		}
+	}
+
+	if got := (lowestLatencySelector{}).selectUpstreams(us); len(got) != 1 || got[0] != us[1] {
+		t.Fatal("lowest_latency: want the fastest upstream")
+	}
+	// Upstreams without history are tried first.
+	fresh := append(newTestUpstreams(0), us...)
+	if got := (lowestLatencySelector{}).selectUpstreams(fresh); got[0] != fresh[0] {
+		t.Fatal("lowest_latency: want the upstream without history")
+	}
+
+	got := fastestNSelector{n: 2}.selectUpstreams(us)
+	if len(got) != 2 || got[0] != us[1] || got[1] != us[2] {
+		t.Fatal("fastest_n: want the two fastest upstreams")
+	}
+
+	// Weights are scaled by the latency: 1*10/30, 1*10/10, 4*10/20 -> 1:3:6.
+	us[0].weight, us[1].weight, us[2].weight = 1, 1, 4
+	picks := make(map[*forwardUpstream]int)
+	for i := 0; i < 10000; i++ {
+		picks[(weightedRandomSelector{}).selectUpstreams(us)[0]]++
+	}
+	if p := picks[us[2]]; p < 5500 || p > 6500 {
+		t.Fatalf("weighted_random: unexpected picks %d of the heaviest upstream", p)
+	}
+	if p := picks[us[0]]; p < 700 || p > 1300 {
+		t.Fatalf("weighted_random: unexpected picks %d of the slowest upstream", p)
+	}
+
+	us[0].weight, us[1].weight, us[2].weight = 0, 1, 0
+	for i := 0; i < 10; i++ {
+		if got := (weightedRandomSelector{}).selectUpstreams(us); got[0] != us[1] {
+			t.Fatal("weighted_random: selected an upstream that has no weight")
+		}
+	}
+}
+
+// rcodeUpstream replies queries with rcode.
+type rcodeUpstream struct {
+	addr    string
+	rcode   uint16
+	trusted bool
+}
+
+func (u *rcodeUpstream) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	dnsutil.SetReply(r, q)
+	r.Rcode = u.rcode
+	return r, nil
+}
+
+func (u *rcodeUpstream) Address() string   { return u.addr }
+func (u *rcodeUpstream) IPAddress() string { return "" }
+func (u *rcodeUpstream) Trusted() bool     { return u.trusted }
+
+func Test_fastForward_exec_roundRobinNXDomain(t *testing.T) {
+	f := &fastForward{
+		BP:       coremain.NewBP("test", PluginType, nil, nil),
+		metrics:  newUpstreamMetrics(prometheus.NewRegistry()),
+		selector: new(roundRobinSelector),
+		timeout:  defaultTimeout,
+	}
+	f.addUpstream(&rcodeUpstream{addr: "1", rcode: dns.RcodeSuccess, trusted: true}, 0)
+	f.addUpstream(&rcodeUpstream{addr: "2", rcode: dns.RcodeNameError}, 0) // untrusted
+
+	for i := 0; i < 2; i++ {
+		qCtx := query_context.NewContext(dns.NewMsg("example.com.", dns.TypeA), nil)
+		if err := f.exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if r == nil {
+			t.Fatalf("query #%d: no response", i)
+		}
+		if want := []uint16{dns.RcodeSuccess, dns.RcodeNameError}[i]; r.Rcode != want {
+			t.Fatalf("query #%d: want rcode %d, got %d", i, want, r.Rcode)
+		}
+	}
+}
+
+// errUpstream fails all queries.
+type errUpstream struct {
+	addr  string
+	calls int
+}
+
+func (u *errUpstream) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) {
+	u.calls++
+	return nil, errors.New("upstream failed")
+}
+
+func (u *errUpstream) Address() string   { return u.addr }
+func (u *errUpstream) IPAddress() string { return "" }
+func (u *errUpstream) Trusted() bool     { return false }
+
+func Test_fastForward_exec_fallback(t *testing.T) {
+	for _, s := range []string{strategyRoundRobin, strategyLowestLatency, strategyWeightedRandom} {
+		t.Run(s, func(t *testing.T) {
+			sel, err := newSelector(&Args{Strategy: s, ExploreRate: 1e-9})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &fastForward{
+				BP:       coremain.NewBP("test", PluginType, nil, nil),
+				metrics:  newUpstreamMetrics(prometheus.NewRegistry()),
+				selector: sel,
+				timeout:  defaultTimeout,
+			}
+			bad := &errUpstream{addr: "1"}
+			f.addUpstream(bad, 0) // the first pick of all strategies
+			f.addUpstream(&errUpstream{addr: "2"}, 0)
+			f.addUpstream(&rcodeUpstream{addr: "3", rcode: dns.RcodeSuccess}, 0)
+			f.upstreams[1].weight, f.upstreams[2].weight = 0, 0
+
+			qCtx := query_context.NewContext(dns.NewMsg("example.com.", dns.TypeA), nil)
+			if err := f.exec(context.Background(), qCtx); err != nil {
+				t.Fatal(err)
+			}
+			if qCtx.R() == nil || qCtx.From() != "test@3" {
+				t.Fatalf("want the response of the last upstream, got it from %q", qCtx.From())
+			}
+			if bad.calls != 1 {
+				t.Fatalf("the first pick was queried %d times", bad.calls)
+			}
+		})
+	}
+
+	// All upstreams failed.
+	f := &fastForward{
+		BP:       coremain.NewBP("test", PluginType, nil, nil),
+		metrics:  newUpstreamMetrics(prometheus.NewRegistry()),
+		selector: new(roundRobinSelector),
+		timeout:  defaultTimeout,
+	}
+	f.addUpstream(&errUpstream{addr: "1"}, 0)
+	f.addUpstream(&errUpstream{addr: "2"}, 0)
+	qCtx := query_context.NewContext(dns.NewMsg("example.com.", dns.TypeA), nil)
+	if err := f.exec(context.Background(), qCtx); err == nil {
+		t.Fatal("want an error if all upstreams failed")
+	}
+}
@@ -21,13 +21,19 @@ package metrics_collector
 
 import (
 	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"sync"
 	"time"
 
+	"codeberg.org/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/pmkol/mosdns-x/coremain"
 	"github.com/pmkol/mosdns-x/pkg/executable_seq"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
 )
 
 const PluginType = "metrics_collector"
@@ -36,7 +42,17 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 }
 
-type Args struct{}
+type Args struct {
+	// ClientIP enables the client_query_total metric that is labelled by
+	// client. To limit the cardinality, client addresses are truncated to
+	// prefixes, and prefixes that exceed ClientMaxSeries are counted as "other".
+	ClientIP        bool `yaml:"client_ip"`
+	ClientIPv4Mask  int  `yaml:"client_ipv4_mask"`  // Default is 24.
+	ClientIPv6Mask  int  `yaml:"client_ipv6_mask"`  // Default is 48.
+	ClientMaxSeries int  `yaml:"client_max_series"` // Default is 1024.
+}
+
+const otherLabel = "other"
 
 var _ coremain.ExecutablePlugin = (*Collector)(nil)
 
@@ -47,11 +63,28 @@ type Collector struct {
 	errTotal        prometheus.Counter
 	thread          prometheus.Gauge
 	responseLatency prometheus.Histogram
+	responseTotal   *prometheus.CounterVec // qtype, rcode
+
+	args        *Args
+	clientTotal *prometheus.CounterVec // client, nil if disabled
+	clientM     sync.Mutex
+	clients     map[netip.Prefix]struct{}
 }
 
-func NewCollector(bp *coremain.BP, args *Args) *Collector {
+func NewCollector(bp *coremain.BP, args *Args) (*Collector, error) {
+	if m := args.ClientIPv4Mask; m < 0 || m > 32 {
+		return nil, fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
+	}
+	if m := args.ClientIPv6Mask; m < 0 || m > 128 {
+		return nil, fmt.Errorf("invalid ipv6 mask %d, should be 0~128", m)
+	}
+	utils.SetDefaultNum(&args.ClientIPv4Mask, 24)
+	utils.SetDefaultNum(&args.ClientIPv6Mask, 48)
+	utils.SetDefaultNum(&args.ClientMaxSeries, 1024)
+
 	c := &Collector{
-		BP: bp,
+		BP:   bp,
+		args: args,
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "query_total",
 			Help: "The total number of queries pass through this collector",
@@ -69,9 +102,21 @@ func NewCollector(bp *coremain.BP, args *Args) *Collector {
 			Help:    "The response latency in millisecond",
 			Buckets: []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
 		}),
+		responseTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "response_total",
+			Help: "The total number of responses by qtype and rcode",
+		}, []string{"qtype", "rcode"}),
+	}
+	bp.GetMetricsReg().MustRegister(c.queryTotal, c.errTotal, c.thread, c.responseLatency, c.responseTotal)
+	if args.ClientIP {
+		c.clients = make(map[netip.Prefix]struct{})
+		c.clientTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "client_query_total",
+			Help: "The total number of queries by client prefix",
+		}, []string{"client"})
+		bp.GetMetricsReg().MustRegister(c.clientTotal)
 	}
-	bp.GetMetricsReg().MustRegister(c.queryTotal, c.errTotal, c.thread, c.responseLatency)
-	return c
+	return c, nil
 }
 
 func (c *Collector) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecChainNode) error {
@@ -79,17 +124,57 @@ func (c *Collector) Exec(ctx context.Context, qCtx *query_context.Context, next
 	defer c.thread.Dec()
 
 	c.queryTotal.Inc()
+	if c.clientTotal != nil {
+		c.clientTotal.WithLabelValues(c.clientLabel(qCtx.ReqMeta().GetClientAddr())).Inc()
+	}
 	start := time.Now()
 	err := executable_seq.ExecChain(ctx, qCtx, next)
 	if err != nil {
 		c.errTotal.Inc()
 	}
-	if qCtx.R() != nil {
+	if r := qCtx.R(); r != nil {
 		c.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
+		c.responseTotal.WithLabelValues(qtypeLabel(qCtx.Q()), strconv.Itoa(int(r.Rcode))).Inc()
 	}
 	return err
 }
 
+// clientLabel returns the prefix of addr, or "other" if there are
+// too many prefixes.
+func (c *Collector) clientLabel(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return otherLabel
+	}
+	addr = addr.Unmap()
+	bits := c.args.ClientIPv6Mask
+	if addr.Is4() {
+		bits = c.args.ClientIPv4Mask
+	}
+	p, _ := addr.Prefix(bits)
+
+	c.clientM.Lock()
+	defer c.clientM.Unlock()
+	if _, ok := c.clients[p]; !ok {
+		if len(c.clients) >= c.args.ClientMaxSeries {
+			return otherLabel
+		}
+		c.clients[p] = struct{}{}
+	}
+	return p.String()
+}
+
+// qtypeLabel returns the name of the qtype. Unknown types are "other"
+// to limit the cardinality.
+func qtypeLabel(q *dns.Msg) string {
+	if len(q.Question) == 0 {
+		return otherLabel
+	}
+	if s, ok := dns.TypeToString[dns.RRToType(q.Question[0])]; ok {
+		return s
+	}
+	return otherLabel
+}
+
 func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
-	return NewCollector(bp, args.(*Args)), nil
+	return NewCollector(bp, args.(*Args))
 }
@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package metrics_collector
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCollector_clientLabel(t *testing.T) {
+	c := &Collector{
+		args:    &Args{ClientIPv4Mask: 24, ClientIPv6Mask: 48, ClientMaxSeries: 2},
+		clients: make(map[netip.Prefix]struct{}),
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.1", "192.168.1.0/24"},
+		{"::ffff:192.168.1.2", "192.168.1.0/24"},
+		{"2001:db8:1:2::1", "2001:db8:1::/48"},
+		{"10.0.0.1", "other"}, // exceeds ClientMaxSeries
+		{"192.168.1.3", "192.168.1.0/24"},
+	}
+	for _, tt := range tests {
+		if got := c.clientLabel(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("clientLabel(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -56,6 +56,9 @@ func (t *optm) Exec(ctx context.Context, qCtx *query_context.Context, next execu
 
 	// Block query that is unusual.
 	if isUnusualQuery(q) {
+		if addr := qCtx.ReqMeta().GetClientAddr(); addr.IsValid() {
+			t.M().GetIPObserver().Observe(addr)
+		}
 		r := new(dns.Msg)
 		dnsutil.SetReply(r, q)
 		r.Rcode = dns.RcodeRefused
@@ -0,0 +1,274 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/utils"
+)
+
+const PluginType = "query_log"
+
+const (
+	defaultQueueSize = 4096
+	flushInterval    = time.Second
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*queryLog)(nil)
+
+type Args struct {
+	Sinks []*SinkConfig `yaml:"sinks"`
+
+	// SampleRate is the fraction of queries that will be logged.
+	// Default (0) and 1 mean all queries.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// IPv4Mask and IPv6Mask anonymise the client address by truncating
+	// it to the prefix. Zero means the full address is logged.
+	IPv4Mask int `yaml:"ipv4_mask"`
+	IPv6Mask int `yaml:"ipv6_mask"`
+
+	// QueueSize is the number of records that can wait to be written.
+	// Records are dropped if the queue is full. Default is 4096.
+	QueueSize int `yaml:"queue_size"`
+}
+
+// Record is a query log record.
+type Record struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	ServerName string    `json:"server_name,omitempty"`
+	QName      string    `json:"qname"`
+	QType      uint16    `json:"qtype"`
+	QClass     uint16    `json:"qclass"`
+	Rcode      int       `json:"rcode"` // -1 if there is no response.
+	Answers    []string  `json:"answers,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	CacheHit   bool      `json:"cache_hit"`
+	LatencyMs  float64   `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type queryLog struct {
+	*coremain.BP
+	args *Args
+
+	sinks []sink
+	queue chan *Record
+
+	closeNotify chan struct{}
+	workerDone  chan struct{}
+
+	droppedTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args any) (coremain.Plugin, error) {
+	return newQueryLog(bp, args.(*Args))
+}
+
+func newQueryLog(bp *coremain.BP, args *Args) (*queryLog, error) {
+	if len(args.Sinks) == 0 {
+		return nil, errors.New("no sink is configured")
+	}
+	if r := args.SampleRate; r < 0 || r > 1 {
+		return nil, fmt.Errorf("invalid sample_rate %v, should be 0~1", r)
+	}
+	if m := args.IPv4Mask; m < 0 || m > 32 {
+		return nil, fmt.Errorf("invalid ipv4 mask %d, should be 0~32", m)
+	}
+	if m := args.IPv6Mask; m < 0 || m > 128 {
+		return nil, fmt.Errorf("invalid ipv6 mask %d, should be 0~128", m)
+	}
+	utils.SetDefaultNum(&args.QueueSize, defaultQueueSize)
+
+	p := &queryLog{
+		BP:          bp,
+		args:        args,
+		queue:       make(chan *Record, args.QueueSize),
+		closeNotify: make(chan struct{}),
+		workerDone:  make(chan struct{}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of records that were dropped because the queue was full",
+		}),
+	}
+	for i, sc := range args.Sinks {
+		s, err := newSink(sc)
+		if err != nil {
+			p.closeSinks()
+			return nil, fmt.Errorf("failed to init sink #%d, %w", i, err)
+		}
+		p.sinks = append(p.sinks, s)
+	}
+	bp.GetMetricsReg().MustRegister(p.droppedTotal)
+	go p.worker()
+	return p, nil
+}
+
+// Exec logs the query after the rest of the chain was executed.
+func (p *queryLog) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecChainNode) error {
+	err := executable_seq.ExecChain(ctx, qCtx, next)
+	if r := p.args.SampleRate; r > 0 && r < 1 && rand.Float64() >= r {
+		return err
+	}
+
+	rec := p.newRecord(qCtx, err)
+	if rec == nil {
+		return err
+	}
+	select {
+	case p.queue <- rec:
+	default:
+		p.droppedTotal.Inc()
+	}
+	return err
+}
+
+// newRecord builds a Record from qCtx. It returns nil if the query
+// does not have exactly one question.
+func (p *queryLog) newRecord(qCtx *query_context.Context, err error) *Record {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	meta := qCtx.ReqMeta()
+
+	rec := &Record{
+		Time:       qCtx.StartTime(),
+		Protocol:   meta.GetProtocol(),
+		ServerName: meta.GetServerName(),
+		QName:      question.Header().Name,
+		QType:      dns.RRToType(question),
+		QClass:     question.Header().Class,
+		Rcode:      -1,
+		Upstream:   qCtx.From(),
+		CacheHit:   qCtx.From() == "cache", // set by the cache plugin
+		LatencyMs:  float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+	}
+	if addr := meta.GetClientAddr(); addr.IsValid() {
+		rec.Client = p.anonymise(addr)
+	}
+	if r := qCtx.R(); r != nil {
+		rec.Rcode = int(r.Rcode)
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				rec.Answers = append(rec.Answers, rr.A.Addr.String())
+			case *dns.AAAA:
+				rec.Answers = append(rec.Answers, rr.AAAA.Addr.String())
+			}
+		}
+	}
+	if err == nil {
+		err = qCtx.Status()
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+// anonymise truncates addr to the configured prefix.
+func (p *queryLog) anonymise(addr netip.Addr) string {
+	addr = addr.Unmap()
+	bits := p.args.IPv6Mask
+	if addr.Is4() {
+		bits = p.args.IPv4Mask
+	}
+	if bits == 0 {
+		return addr.String()
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+func (p *queryLog) worker() {
+	defer close(p.workerDone)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec := <-p.queue:
+			p.write(rec)
+		case <-ticker.C:
+			p.flush()
+		case <-p.closeNotify:
+			for {
+				select {
+				case rec := <-p.queue:
+					p.write(rec)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *queryLog) write(rec *Record) {
+	for i, s := range p.sinks {
+		if err := s.Write(rec); err != nil {
+			p.L().Warn("failed to write query log", zap.Int("sink", i), zap.Error(err))
+		}
+	}
+}
+
+func (p *queryLog) flush() {
+	for i, s := range p.sinks {
+		if f, ok := s.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				p.L().Warn("failed to flush query log", zap.Int("sink", i), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (p *queryLog) closeSinks() {
+	for _, s := range p.sinks {
+		_ = s.Close()
+	}
+}
+
+// Close flushes the queued records and closes the sinks.
+func (p *queryLog) Close() error {
+	close(p.closeNotify)
+	<-p.workerDone
+	p.closeSinks()
+	return nil
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+)
+
+// testNext sets a response from upstream after delay.
+type testNext struct {
+	from  string
+	rcode uint16
+	delay time.Duration
+	err   error
+}
+
+func (n *testNext) Exec(_ context.Context, qCtx *query_context.Context, _ executable_seq.ExecChainNode) error {
+	time.Sleep(n.delay)
+	if n.err != nil {
+		return n.err
+	}
+	r := new(dns.Msg)
+	dnsutil.SetReply(r, qCtx.Q())
+	r.Rcode = n.rcode
+	if n.rcode == dns.RcodeSuccess {
+		hdr := dns.Header{Name: "example.com.", Class: dns.ClassINET, TTL: 60}
+		r.Answer = []dns.RR{
+			&dns.CNAME{Hdr: hdr, CNAME: rdata.CNAME{Target: "a.example.com."}},
+			&dns.A{Hdr: hdr, A: rdata.A{Addr: netip.MustParseAddr("1.2.3.4")}},
+			&dns.AAAA{Hdr: hdr, AAAA: rdata.AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+		}
+	}
+	qCtx.SetResponse(r)
+	qCtx.SetFrom(n.from)
+	return nil
+}
+
+func newTestQueryLog(args *Args) *queryLog {
+	return &queryLog{
+		args:         args,
+		queue:        make(chan *Record, 1024),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped_total"}),
+	}
+}
+
+func newTestQCtx() *query_context.Context {
+	meta := query_context.NewRequestMeta(netip.MustParseAddr("192.168.1.100"))
+	meta.SetProtocol("udp")
+	meta.SetServerName("dns.example")
+	return query_context.NewContext(dns.NewMsg("example.com.", dns.TypeA), meta)
+}
+
+func Test_queryLog_Exec_record(t *testing.T) {
+	errNext := errors.New("upstream error")
+	tests := []struct {
+		name         string
+		next         *testNext
+		wantRcode    int
+		wantAnswers  []string
+		wantUpstream string
+		wantCacheHit bool
+		wantErr      string
+	}{
+		{"upstream", &testNext{from: "upstream1", delay: 10 * time.Millisecond}, dns.RcodeSuccess, []string{"1.2.3.4", "2001:db8::1"}, "upstream1", false, ""},
+		{"cache hit", &testNext{from: "cache", delay: 10 * time.Millisecond}, dns.RcodeSuccess, []string{"1.2.3.4", "2001:db8::1"}, "cache", true, ""},
+		{"nxdomain", &testNext{from: "upstream1", rcode: dns.RcodeNameError, delay: 10 * time.Millisecond}, dns.RcodeNameError, nil, "upstream1", false, ""},
+		{"error", &testNext{delay: 10 * time.Millisecond, err: errNext}, -1, nil, "", false, errNext.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestQueryLog(&Args{IPv4Mask: 24})
+			qCtx := newTestQCtx()
+			if err := p.Exec(context.Background(), qCtx, executable_seq.WrapExecutable(tt.next)); !errors.Is(err, tt.next.err) {
+				t.Fatalf("Exec() returned %v, want %v", err, tt.next.err)
+			}
+			if len(p.queue) != 1 {
+				t.Fatalf("want 1 record, got %d", len(p.queue))
+			}
+			rec := <-p.queue
+
+			if rec.Client != "192.168.1.0/24" || rec.Protocol != "udp" || rec.ServerName != "dns.example" {
+				t.Errorf("unexpected client fields %q %q %q", rec.Client, rec.Protocol, rec.ServerName)
+			}
+			if rec.QName != "example.com." || rec.QType != dns.TypeA || rec.QClass != dns.ClassINET {
+				t.Errorf("unexpected question %s %d %d", rec.QName, rec.QType, rec.QClass)
+			}
+			if rec.Rcode != tt.wantRcode {
+				t.Errorf("want rcode %d, got %d", tt.wantRcode, rec.Rcode)
+			}
+			if !reflect.DeepEqual(rec.Answers, tt.wantAnswers) {
+				t.Errorf("want answers %v, got %v", tt.wantAnswers, rec.Answers)
+			}
+			if rec.Upstream != tt.wantUpstream || rec.CacheHit != tt.wantCacheHit {
+				t.Errorf("want upstream %q cache_hit %v, got %q %v", tt.wantUpstream, tt.wantCacheHit, rec.Upstream, rec.CacheHit)
+			}
+			if rec.Error != tt.wantErr {
+				t.Errorf("want error %q, got %q", tt.wantErr, rec.Error)
+			}
+			if rec.LatencyMs < 10 {
+				t.Errorf("latency %vms is shorter than the upstream delay", rec.LatencyMs)
+			}
+			if !rec.Time.Equal(qCtx.StartTime()) {
+				t.Errorf("record time %v is not the query start time", rec.Time)
+			}
+		})
+	}
+}
+
+func Test_queryLog_Exec_sampleRate(t *testing.T) {
+	const queries = 1000
+	tests := []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, queries, queries},
+		{1, queries, queries},
+		{0.1, 50, 150},
+		{0.5, 400, 600},
+	}
+	for _, tt := range tests {
+		p := newTestQueryLog(&Args{SampleRate: tt.rate})
+		next := executable_seq.WrapExecutable(&testNext{from: "upstream1"})
+		for i := 0; i < queries; i++ {
+			if err := p.Exec(context.Background(), newTestQCtx(), next); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := len(p.queue); n < tt.min || n > tt.max {
+			t.Errorf("sample rate %v: want %d~%d records, got %d", tt.rate, tt.min, tt.max, n)
+		}
+	}
+}
+
+func Test_queryLog_anonymise(t *testing.T) {
+	p := &queryLog{args: &Args{IPv4Mask: 24, IPv6Mask: 48}}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.100", "192.168.1.0/24"},
+		{"::ffff:192.168.1.100", "192.168.1.0/24"},
+		{"2001:db8:1:2::1", "2001:db8:1::/48"},
+	}
+	for _, tt := range tests {
+		if got := p.anonymise(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("anonymise(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+
+	p = &queryLog{args: &Args{}}
+	if got := p.anonymise(netip.MustParseAddr("192.168.1.100")); got != "192.168.1.100" {
+		t.Errorf("anonymise() without mask = %s", got)
+	}
+}
+
+func Test_syslogSink(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "log.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	s, err := newSyslogSink("unixgram", addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rec := &Record{Time: time.Now(), QName: "example.com.", QType: 1, QClass: 1, Rcode: 0}
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 4096)
+	n, err := l.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(b[:n])
+	if !strings.HasPrefix(msg, "<134>1 ") {
+		t.Fatalf("unexpected syslog header %q", msg)
+	}
+	body := msg[strings.Index(msg, "{"):]
+	var got Record
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.QName != rec.QName {
+		t.Fatalf("unexpected record %+v", got)
+	}
+}
+
+func Test_boltSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query_log.db")
+	s, err := newBoltSink(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, qName := range []string{"old.example.", "a.example.", "b.example."} {
+		rec := &Record{Time: now.Add(time.Duration(i) * time.Millisecond), QName: qName}
+		if i == 0 {
+			rec.Time = now.Add(-2 * time.Hour)
+		}
+		if err := s.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil { // Close flushes the pending records.
+		t.Fatal(err)
+	}
+
+	db, err := bbolt.Open(path, 0o644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var got []string
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			got = append(got, rec.QName)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The old record is deleted, the others are sorted by time.
+	if want := []string{"a.example.", "b.example."}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want records %v, got %v", want, got)
+	}
+}
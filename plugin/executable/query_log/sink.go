@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/pmkol/mosdns-x/pkg/rotate"
+)
+
+const (
+	sinkTypeFile   = "file"
+	sinkTypeBolt   = "bolt"
+	sinkTypeSyslog = "syslog"
+)
+
+type SinkConfig struct {
+	// Type is the type of the sink. Can be "file", "bolt" or "syslog".
+	Type string `yaml:"type"`
+
+	// Path is the file of the file and bolt sinks.
+	// The file sink writes records as json lines.
+	Path           string `yaml:"path"`
+	MaxSize        int    `yaml:"max_size"`        // in MB, rotates the file if it is larger than max_size. Default is 0 (no limit).
+	RotateInterval int    `yaml:"rotate_interval"` // in seconds, rotates the file periodically. Default is 0 (disabled).
+	MaxBackups     int    `yaml:"max_backups"`     // Default is 0 (keep all rotated files).
+	Compress       bool   `yaml:"compress"`        // compresses the rotated files with gzip.
+
+	// Options for the bolt sink. Records are stored in a bolt database
+	// as json, keyed by their time. See boltSink.
+	MaxAge int `yaml:"max_age"` // in seconds, deletes the older records. Default is 0 (keep all records).
+
+	// Options for the syslog sink. Records are sent as RFC 5424 messages
+	// with the json record as the message body.
+	Network string `yaml:"network"` // "unixgram", "unix", "udp" or "tcp". Default is "unixgram".
+	Addr    string `yaml:"addr"`    // Default is "/dev/log".
+	AppName string `yaml:"app_name"`
+}
+
+// sink writes Records. It is not required to be safe for concurrent use.
+type sink interface {
+	Write(rec *Record) error
+	Close() error
+}
+
+// flusher is a sink that buffers Records. Flush is called periodically.
+type flusher interface {
+	Flush() error
+}
+
+func newSink(c *SinkConfig) (sink, error) {
+	switch c.Type {
+	case sinkTypeFile:
+		if len(c.Path) == 0 {
+			return nil, fmt.Errorf("missing path")
+		}
+		w, err := rotate.NewWriter(rotate.Opts{
+			Path:       c.Path,
+			MaxSize:    int64(c.MaxSize) << 20,
+			Interval:   time.Duration(c.RotateInterval) * time.Second,
+			MaxBackups: c.MaxBackups,
+			Compress:   c.Compress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newJSONSink(w), nil
+	case sinkTypeBolt:
+		if len(c.Path) == 0 {
+			return nil, fmt.Errorf("missing path")
+		}
+		if c.MaxAge < 0 {
+			return nil, fmt.Errorf("invalid max_age %d", c.MaxAge)
+		}
+		return newBoltSink(c.Path, time.Duration(c.MaxAge)*time.Second)
+	case sinkTypeSyslog:
+		return newSyslogSink(c.Network, c.Addr, c.AppName)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", c.Type)
+	}
+}
+
+// jsonSink writes Records as json lines to w.
+type jsonSink struct {
+	w   io.WriteCloser
+	buf bytes.Buffer
+}
+
+func newJSONSink(w io.WriteCloser) *jsonSink {
+	return &jsonSink{w: w}
+}
+
+func (s *jsonSink) Write(rec *Record) error {
+	s.buf.Reset()
+	if err := json.NewEncoder(&s.buf).Encode(rec); err != nil { // Encode appends a newline.
+		return err
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	return err
+}
+
+func (s *jsonSink) Close() error {
+	return s.w.Close()
+}
+
+const (
+	boltBatchSize       = 256
+	boltCleanupInterval = time.Minute
+)
+
+// boltBucket is the bucket of the records in the bolt database.
+var boltBucket = []byte("query_log")
+
+// boltSink stores Records in a bolt database. The key of a record is its
+// time in unix nanoseconds followed by a sequence number, both are
+// big-endian uint64, so records are sorted by time. The value is the json
+// record. Records are written in batches.
+type boltSink struct {
+	db     *bbolt.DB
+	maxAge time.Duration
+
+	pending     [][]byte // json records
+	pendingTime []time.Time
+	lastCleanup time.Time
+}
+
+func newBoltSink(path string, maxAge time.Duration) (*boltSink, error) {
+	db, err := bbolt.Open(path, 0o644, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltSink{db: db, maxAge: maxAge}, nil
+}
+
+func (s *boltSink) Write(rec *Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, b)
+	s.pendingTime = append(s.pendingTime, rec.Time)
+	if len(s.pending) >= boltBatchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush writes the pending records, and deletes the expired records
+// at most once per boltCleanupInterval.
+func (s *boltSink) Flush() error {
+	now := time.Now()
+	cleanup := s.maxAge > 0 && now.Sub(s.lastCleanup) >= boltCleanupInterval
+	if len(s.pending) == 0 && !cleanup {
+		return nil
+	}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for i, v := range s.pending {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(boltKey(s.pendingTime[i], seq), v); err != nil {
+				return err
+			}
+		}
+		if cleanup {
+			return deleteBefore(b, now.Add(-s.maxAge))
+		}
+		return nil
+	})
+	// Drop the records on errors, so a broken database doesn't
+	// consume the memory.
+	s.pending = s.pending[:0]
+	s.pendingTime = s.pendingTime[:0]
+	if cleanup && err == nil {
+		s.lastCleanup = now
+	}
+	return err
+}
+
+func boltKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// deleteBefore deletes the records in b that are older than t.
+func deleteBefore(b *bbolt.Bucket, t time.Time) error {
+	end := boltKey(t, 0)
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltSink) Close() error {
+	err := s.Flush()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+const syslogPriority = 16<<3 | 6 // facility local0, severity info
+
+// syslogSink sends Records to a syslog socket.
+type syslogSink struct {
+	network, addr string
+	appName       string
+	hostname      string
+
+	c   net.Conn // nil if not connected
+	buf bytes.Buffer
+}
+
+func newSyslogSink(network, addr, appName string) (*syslogSink, error) {
+	if len(network) == 0 {
+		network = "unixgram"
+	}
+	if len(addr) == 0 {
+		addr = "/dev/log"
+	}
+	if len(appName) == 0 {
+		appName = "mosdns"
+	}
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = "-"
+	}
+	s := &syslogSink{network: network, addr: addr, appName: appName, hostname: hostname}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() error {
+	c, err := net.DialTimeout(s.network, s.addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	s.c = c
+	return nil
+}
+
+func (s *syslogSink) Write(rec *Record) error {
+	s.buf.Reset()
+	fmt.Fprintf(&s.buf, "<%d>1 %s %s %s - - - ", syslogPriority, rec.Time.UTC().Format(time.RFC3339Nano), s.hostname, s.appName)
+	if err := json.NewEncoder(&s.buf).Encode(rec); err != nil {
+		return err
+	}
+	b := s.buf.Bytes()
+	if s.network == "unixgram" || s.network == "udp" {
+		b = b[:len(b)-1] // datagrams don't need the newline delimiter
+	}
+
+	// Reconnect once if the connection was broken.
+	var err error
+	for range 2 {
+		if s.c == nil {
+			if err = s.connect(); err != nil {
+				return err
+			}
+		}
+		if _, err = s.c.Write(b); err == nil {
+			return nil
+		}
+		s.c.Close()
+		s.c = nil
+	}
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
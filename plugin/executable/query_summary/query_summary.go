@@ -110,6 +110,12 @@ func (l *logger) Exec(ctx context.Context, qCtx *C.Context, next executable_seq.
 		case C.ProtocolHTTPS, C.ProtocolH2, C.ProtocolH3, C.ProtocolQUIC, C.ProtocolTLS:
 			inboundInfo = append(inboundInfo, zap.String("server_name", qCtx.ReqMeta().GetServerName()))
 		}
+		if id := qCtx.ReqMeta().GetClientID(); len(id) > 0 {
+			inboundInfo = append(inboundInfo, zap.String("client_id", id))
+		}
+		if cert := qCtx.ReqMeta().GetClientCert(); cert != nil {
+			inboundInfo = append(inboundInfo, zap.String("client_cert", cert.Subject.String()))
+		}
 	}
 	inboundInfo = append(inboundInfo,
 		zap.String("qname", question.Header().Name),
@@ -130,6 +136,9 @@ func (l *logger) Exec(ctx context.Context, qCtx *C.Context, next executable_seq.
 		}
 		inboundInfo = append(inboundInfo, zap.String("source", source))
 	}
+	if rules := qCtx.MatchedRules(); len(rules) > 0 {
+		inboundInfo = append(inboundInfo, zap.Strings("matched_rules", rules))
+	}
 	if err != nil {
 		inboundInfo = append(inboundInfo, zap.Error(err))
 	}
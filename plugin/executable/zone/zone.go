@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pmkol/mosdns-x/coremain"
+	"github.com/pmkol/mosdns-x/pkg/executable_seq"
+	"github.com/pmkol/mosdns-x/pkg/query_context"
+	"github.com/pmkol/mosdns-x/pkg/zone_file"
+)
+
+const PluginType = "zone"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ coremain.ExecutablePlugin = (*zonePlugin)(nil)
+
+type Args struct {
+	// Zones are zone files. Use "provider:tag" to load a zone
+	// from a data provider, otherwise it is a file path.
+	// The origin of each zone is the owner of its SOA record.
+	Zones []string `yaml:"zones"`
+}
+
+type zonePlugin struct {
+	*coremain.BP
+	zones  []*dynamicZone
+	closer []func()
+}
+
+// dynamicZone is a zone that can be updated by a data provider.
+type dynamicZone struct {
+	z atomic.Pointer[zone_file.Zone]
+}
+
+func (d *dynamicZone) Update(b []byte) error {
+	z, err := zone_file.ParseZone(bytes.NewReader(b), "")
+	if err != nil {
+		return err
+	}
+	d.z.Store(z)
+	return nil
+}
+
+func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
+	return newZonePlugin(bp, args.(*Args))
+}
+
+func newZonePlugin(bp *coremain.BP, args *Args) (*zonePlugin, error) {
+	p := &zonePlugin{BP: bp}
+	for _, s := range args.Zones {
+		dz := new(dynamicZone)
+		if providerTag, ok := strings.CutPrefix(s, "provider:"); ok {
+			provider := bp.M().GetDataManager().GetDataProvider(providerTag)
+			if provider == nil {
+				p.Close()
+				return nil, fmt.Errorf("cannot find provider %s", providerTag)
+			}
+			if err := provider.LoadAndAddListener(dz); err != nil {
+				p.Close()
+				return nil, fmt.Errorf("failed to load zone from provider %s, %w", providerTag, err)
+			}
+			p.closer = append(p.closer, func() {
+				provider.DeleteListener(dz)
+			})
+		} else {
+			b, err := os.ReadFile(s)
+			if err != nil {
+				p.Close()
+				return nil, err
+			}
+			if err := dz.Update(b); err != nil {
+				p.Close()
+				return nil, fmt.Errorf("failed to load zone file %s, %w", s, err)
+			}
+		}
+		p.zones = append(p.zones, dz)
+	}
+	return p, nil
+}
+
+// Exec answers the query if its question is in one of the zones.
+// Otherwise, it calls next.
+func (p *zonePlugin) Exec(ctx context.Context, qCtx *query_context.Context, next executable_seq.ExecChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) == 1 {
+		if z := p.findZone(q.Question[0].Header().Name); z != nil {
+			if r := z.Reply(q); r != nil {
+				qCtx.SetResponse(r)
+				return nil
+			}
+		}
+	}
+	return executable_seq.ExecChain(ctx, qCtx, next)
+}
+
+// findZone returns the most specific zone that contains name.
+func (p *zonePlugin) findZone(name string) *zone_file.Zone {
+	var best *zone_file.Zone
+	for _, dz := range p.zones {
+		z := dz.z.Load()
+		if z.Contains(name) && (best == nil || len(z.Origin()) > len(best.Origin())) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (p *zonePlugin) Close() error {
+	for _, f := range p.closer {
+		f()
+	}
+	return nil
+}
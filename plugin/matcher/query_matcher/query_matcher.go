@@ -22,6 +22,7 @@ package querymatcher
 import (
 	"context"
 	"io"
+	"net/http"
 
 	"codeberg.org/miekg/dns"
 	"go.uber.org/zap"
@@ -32,6 +33,7 @@ import (
 	"github.com/pmkol/mosdns-x/pkg/matcher/elem"
 	"github.com/pmkol/mosdns-x/pkg/matcher/msg_matcher"
 	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
 
@@ -64,11 +66,18 @@ func init() {
 var _ coremain.MatcherPlugin = (*queryMatcher)(nil)
 
 type Args struct {
-	ClientIP []string `yaml:"client_ip"`
-	ECS      []string `yaml:"ecs"`
-	Domain   []string `yaml:"domain"`
-	QType    []uint16 `yaml:"qtype"`
-	QClass   []uint16 `yaml:"qclass"`
+	ClientIP   []string `yaml:"client_ip"`
+	ClientID   []string `yaml:"client_id"`   // authenticated by doh servers
+	ClientCert []string `yaml:"client_cert"` // identities of verified tls client certificates
+	ServerName []string `yaml:"server_name"` // tls server names (SNI), same format as Domain
+	ECS        []string `yaml:"ecs"`
+	Domain     []string `yaml:"domain"`
+	QType      []uint16 `yaml:"qtype"`
+	QClass     []uint16 `yaml:"qclass"`
+
+	// RuleStats enables per-rule hit statistics of the ip and domain
+	// matchers. See ServeHTTP.
+	RuleStats bool `yaml:"rule_stats"`
 	// TODO: Add PTR matcher.
 }
 
@@ -78,10 +87,32 @@ type queryMatcher struct {
 
 	matcherGroup []executable_seq.Matcher
 	closer       []io.Closer
+	ruleStats    *rule_stats.Registry // nil if rule_stats is disabled
 }
 
 func (m *queryMatcher) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, err error) {
-	return executable_seq.LogicalAndMatcherGroup(ctx, qCtx, m.matcherGroup)
+	if m.ruleStats == nil {
+		return executable_seq.LogicalAndMatcherGroup(ctx, qCtx, m.matcherGroup)
+	}
+	// Rules are recorded only if all matchers matched.
+	rc := new(msg_matcher.RuleCollector)
+	matched, err = executable_seq.LogicalAndMatcherGroup(msg_matcher.WithRuleCollector(ctx, rc), qCtx, m.matcherGroup)
+	if matched && err == nil {
+		rc.Record(qCtx)
+	}
+	return matched, err
+}
+
+// ServeHTTP serves the rule hit statistics if rule_stats is enabled.
+//
+//	GET top?n=: the n most hit rules.
+//	GET never_hit?n=: n rules that were never hit.
+func (m *queryMatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.ruleStats == nil {
+		http.Error(w, "rule_stats is disabled", http.StatusNotFound)
+		return
+	}
+	m.ruleStats.ServeHTTP(w, req)
 }
 
 func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
@@ -92,8 +123,11 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 	m = new(queryMatcher)
 	m.BP = bp
 	m.args = args
+	if args.RuleStats {
+		m.ruleStats = rule_stats.NewRegistry()
+	}
 	if len(args.ClientIP) > 0 {
-		l, err := netlist.BatchLoadProvider(args.ClientIP, bp.M().GetDataManager())
+		l, err := netlist.BatchLoadProvider(args.ClientIP, bp.M().GetDataManager(), m.ruleStats.Named("client_ip"))
 		if err != nil {
 			return nil, err
 		}
@@ -101,8 +135,27 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		m.closer = append(m.closer, l)
 		bp.L().Info("client ip matcher loaded", zap.Int("length", l.Len()))
 	}
+	if len(args.ClientID) > 0 {
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientIDMatcher(args.ClientID))
+	}
+	if len(args.ClientCert) > 0 {
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewClientCertMatcher(args.ClientCert))
+	}
+	if len(args.ServerName) > 0 {
+		mg, err := domain.BatchLoadDomainProvider(
+			args.ServerName,
+			bp.M().GetDataManager(),
+			m.ruleStats.Named("server_name"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewServerNameMatcher(mg))
+		m.closer = append(m.closer, mg)
+		bp.L().Info("server name matcher loaded", zap.Int("length", mg.Len()))
+	}
 	if len(args.ECS) > 0 {
-		l, err := netlist.BatchLoadProvider(args.ECS, bp.M().GetDataManager())
+		l, err := netlist.BatchLoadProvider(args.ECS, bp.M().GetDataManager(), m.ruleStats.Named("ecs"))
 		if err != nil {
 			return nil, err
 		}
@@ -114,6 +167,7 @@ func newQueryMatcher(bp *coremain.BP, args *Args) (m *queryMatcher, err error) {
 		mg, err := domain.BatchLoadDomainProvider(
 			args.Domain,
 			bp.M().GetDataManager(),
+			m.ruleStats.Named("domain"),
 		)
 		if err != nil {
 			return nil, err
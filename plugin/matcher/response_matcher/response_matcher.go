@@ -22,6 +22,7 @@ package responsematcher
 import (
 	"context"
 	"io"
+	"net/http"
 	"slices"
 
 	"codeberg.org/miekg/dns"
@@ -33,6 +34,7 @@ import (
 	"github.com/pmkol/mosdns-x/pkg/matcher/elem"
 	"github.com/pmkol/mosdns-x/pkg/matcher/msg_matcher"
 	"github.com/pmkol/mosdns-x/pkg/matcher/netlist"
+	"github.com/pmkol/mosdns-x/pkg/matcher/rule_stats"
 	"github.com/pmkol/mosdns-x/pkg/query_context"
 )
 
@@ -58,6 +60,10 @@ type Args struct {
 	RCode []uint16 `yaml:"rcode"`
 	IP    []string `yaml:"ip"`
 	CNAME []string `yaml:"cname"`
+
+	// RuleStats enables per-rule hit statistics of the ip and cname
+	// matchers. See ServeHTTP.
+	RuleStats bool `yaml:"rule_stats"`
 }
 
 type responseMatcher struct {
@@ -66,10 +72,20 @@ type responseMatcher struct {
 
 	matcherGroup []executable_seq.Matcher
 	closer       []io.Closer
+	ruleStats    *rule_stats.Registry // nil if rule_stats is disabled
 }
 
 func (m *responseMatcher) Match(ctx context.Context, qCtx *query_context.Context) (matched bool, err error) {
-	return executable_seq.LogicalAndMatcherGroup(ctx, qCtx, m.matcherGroup)
+	if m.ruleStats == nil {
+		return executable_seq.LogicalAndMatcherGroup(ctx, qCtx, m.matcherGroup)
+	}
+	// Rules are recorded only if all matchers matched.
+	rc := new(msg_matcher.RuleCollector)
+	matched, err = executable_seq.LogicalAndMatcherGroup(msg_matcher.WithRuleCollector(ctx, rc), qCtx, m.matcherGroup)
+	if matched && err == nil {
+		rc.Record(qCtx)
+	}
+	return matched, err
 }
 
 func (m *responseMatcher) Close() error {
@@ -79,6 +95,18 @@ func (m *responseMatcher) Close() error {
 	return nil
 }
 
+// ServeHTTP serves the rule hit statistics if rule_stats is enabled.
+//
+//	GET top?n=: the n most hit rules.
+//	GET never_hit?n=: n rules that were never hit.
+func (m *responseMatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.ruleStats == nil {
+		http.Error(w, "rule_stats is disabled", http.StatusNotFound)
+		return
+	}
+	m.ruleStats.ServeHTTP(w, req)
+}
+
 func Init(bp *coremain.BP, args any) (p coremain.Plugin, err error) {
 	return newResponseMatcher(bp, args.(*Args))
 }
@@ -87,6 +115,9 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 	m = new(responseMatcher)
 	m.BP = bp
 	m.args = args
+	if args.RuleStats {
+		m.ruleStats = rule_stats.NewRegistry()
+	}
 
 	if len(args.RCode) > 0 {
 		m.matcherGroup = append(m.matcherGroup, msg_matcher.NewRCodeMatcher(elem.NewIntMatcher(args.RCode)))
@@ -96,6 +127,7 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 		mg, err := domain.BatchLoadDomainProvider(
 			args.CNAME,
 			bp.M().GetDataManager(),
+			m.ruleStats.Named("cname"),
 		)
 		if err != nil {
 			return nil, err
@@ -106,7 +138,7 @@ func newResponseMatcher(bp *coremain.BP, args *Args) (m *responseMatcher, err er
 	}
 
 	if len(args.IP) > 0 {
-		l, err := netlist.BatchLoadProvider(args.IP, bp.M().GetDataManager())
+		l, err := netlist.BatchLoadProvider(args.IP, bp.M().GetDataManager(), m.ruleStats.Named("ip"))
 		if err != nil {
 			return nil, err
 		}